@@ -1,14 +1,18 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"math"
+	"io"
+	"log"
 	"net/http"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -17,6 +21,8 @@ import (
 type Item struct {
 	Description string `json:"shortDescription"`
 	Price       string `json:"price"`
+	// Category is optional and may be filled in by receipt hooks.
+	Category string `json:"category,omitempty"`
 }
 
 // Receipt holds the details of a purchase receipt.
@@ -26,22 +32,296 @@ type Receipt struct {
 	TimeOfPurchase string `json:"purchaseTime"`
 	TotalAmount    string `json:"total"`
 	PurchasedItems []Item `json:"items"`
+	Timezone       string `json:"timezone,omitempty"`
+	OrderNumber    string `json:"orderNumber,omitempty"`
+	// Location is where the store is, when the client knows it.
+	Location *GeoPoint `json:"location,omitempty"`
+	// CustomFields holds values for the fields the tenant has defined in
+	// CUSTOM_FIELDS_FILE.
+	CustomFields map[string]interface{} `json:"customFields,omitempty"`
 }
 
-// ReceiptResponse represents the response containing the receipt ID.
+// ReceiptResponse represents the response containing the receipt ID. Points
+// and Breakdown are only populated when the client asks for them.
+// DuplicateOf is set when the receipt was accepted but flagged as a
+// duplicate, and Status is then held: its points await review.
 type ReceiptResponse struct {
-	ReceiptID string `json:"id"`
+	ReceiptID   string       `json:"id"`
+	Points      *int         `json:"points,omitempty"`
+	Breakdown   []RuleResult `json:"breakdown,omitempty"`
+	DuplicateOf string       `json:"duplicateOf,omitempty"`
+	Status      string       `json:"status,omitempty"`
+	// Warnings list the corrections made to a receipt accepted in lenient
+	// validation mode.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// DuplicateResponse is returned with 409 Conflict for rejected duplicates.
+type DuplicateResponse struct {
+	Error      string `json:"error"`
+	ExistingID string `json:"existingId"`
 }
 
 // PointsResponse holds the calculated points for a receipt.
 type PointsResponse struct {
 	EarnedPoints int `json:"points"`
+	// RulesVersion is the rule set the points were awarded under.
+	RulesVersion string `json:"rulesVersion,omitempty"`
+	// Status is credited, held (awaiting review) or denied.
+	Status string `json:"status"`
 }
 
-var (
-	receiptStorage = make(map[string]Receipt)
-	storageMutex   = &sync.Mutex{}
-)
+// StoredReceiptResponse is a stored receipt as returned by GET /receipts/{id}.
+type StoredReceiptResponse struct {
+	ReceiptID   string    `json:"id"`
+	Receipt     Receipt   `json:"receipt"`
+	Points      int       `json:"points"`
+	SubmittedAt time.Time `json:"submittedAt"`
+	UserID      string    `json:"userId,omitempty"`
+	Favorite    bool      `json:"favorite"`
+	DuplicateOf string    `json:"duplicateOf,omitempty"`
+	// Status is credited, held (awaiting review) or denied.
+	Status string `json:"status"`
+	// Verification is empty for retailers without an order API.
+	Verification  string     `json:"verification,omitempty"`
+	RefundedItems []int      `json:"refundedItems,omitempty"`
+	FinalizedAt   *time.Time `json:"finalizedAt,omitempty"`
+	AmendedAt     *time.Time `json:"amendedAt,omitempty"`
+	Images        []string   `json:"images,omitempty"`
+	RulesVersion  string     `json:"rulesVersion,omitempty"`
+	Source        string     `json:"source,omitempty"`
+	Client        string     `json:"client,omitempty"`
+}
+
+// ReceiptPage is one page of GET /receipts. Total counts every matching
+// receipt, not just those on the page.
+type ReceiptPage struct {
+	Receipts []StoredReceiptResponse `json:"receipts"`
+	Total    int                     `json:"total"`
+	Limit    int                     `json:"limit"`
+	Offset   int                     `json:"offset"`
+}
+
+// StoredReceipt is a receipt together with the metadata recorded when it
+// was submitted.
+type StoredReceipt struct {
+	Receipt     Receipt
+	SubmittedAt time.Time
+	Images      []string
+	Tenant      string
+	UserID      string
+	Favorite    bool
+	ContentHash string
+	// Source is the channel the receipt arrived through and Client the
+	// client that submitted it. Both are empty for receipts stored before
+	// sources were recorded.
+	Source string
+	Client string
+	// Verification is the outcome of checking the receipt against the
+	// retailer's order API.
+	Verification       string
+	VerificationDetail string
+	// Points were awarded at submission; ItemPoints attributes them to the
+	// receipt's items, by index.
+	Points     int
+	ItemPoints []int
+	// RefundedItems are the indexes of returned items, whose attributed
+	// points (RefundedPoints in total) have been deducted.
+	RefundedItems  []int
+	RefundedPoints int
+	// Rounding records the fractional points rounded when the receipt was
+	// scored, for the rounding audit.
+	Rounding *PointsRounding
+	// Amendments record each time the receipt's contents were replaced.
+	Amendments []ReceiptAmendment
+	// Ledger records the adjustments to the receipt's points since it was
+	// scored, oldest first. It is stored with the receipt, in the same
+	// update as the change it records.
+	Ledger []LedgerEntry
+	// FinalizedAt is set once the receipt can no longer be amended; its
+	// points are then fixed and may be cached indefinitely.
+	FinalizedAt *time.Time
+	// ExpiryNotifiedAt is set once the user has been told the receipt's
+	// points are about to expire.
+	ExpiryNotifiedAt *time.Time
+	// ExpiredAt is set once the expiry process has written the receipt's
+	// points (ExpiredPoints of them) off the user's balance.
+	ExpiredAt     *time.Time
+	ExpiredPoints int
+	// DuplicateOf is the ID of an earlier receipt this one was flagged as
+	// duplicating.
+	DuplicateOf string
+	// Hold is held while a flagged receipt's points await review, then
+	// released or denied, with the reviewer's reason and the time of the
+	// decision.
+	Hold          string
+	HoldReason    string
+	HoldDecidedAt *time.Time
+	// MessageID is the broker message the receipt was submitted from.
+	MessageID string
+	// RulesVersion is the version of the rule set the receipt is scored
+	// under, that in effect when it was submitted.
+	RulesVersion string
+	// Experiment is the rules experiment bucket the receipt was assigned
+	// to, with its points under the control and the variant rules.
+	Experiment *ExperimentAssignment
+}
+
+// errInvalidReceipt is returned for receipts missing required fields.
+var errInvalidReceipt = errors.New("invalid receipt format")
+
+// errInvalidPurchaseTime is returned for unparseable dates, times or zones.
+var errInvalidPurchaseTime = errors.New("invalid purchase date, time or timezone")
+
+// validateReceipt checks that a receipt is complete and its purchase time
+// can be interpreted.
+func validateReceipt(receipt Receipt) error {
+	if receipt.StoreName == "" || receipt.DateOfPurchase == "" || receipt.TimeOfPurchase == "" || receipt.TotalAmount == "" || len(receipt.PurchasedItems) == 0 {
+		return errInvalidReceipt
+	}
+	if receipt.Location != nil && !receipt.Location.Valid() {
+		return errInvalidReceipt
+	}
+	if _, err := localPurchaseTime(receipt); err != nil {
+		return errInvalidPurchaseTime
+	}
+	return nil
+}
+
+// Submission identifies who submitted a receipt.
+type Submission struct {
+	Tenant string
+	Client string
+	UserID string
+	// Source is the channel the receipt arrived through.
+	Source string
+	// Bulk marks submissions from batch imports, which yield to
+	// interactive submissions when the processing queue is enabled.
+	Bulk bool
+	// MessageID makes a submission relayed from a message queue
+	// idempotent: redeliveries return the receipt the first delivery made.
+	MessageID string
+}
+
+// submissionFromRequest identifies the tenant, client and user behind a
+// request. ok is false when the tenant or user header is malformed.
+func submissionFromRequest(r *http.Request) (Submission, bool) {
+	tenant, tenantOK := tenantFromRequest(r)
+	userID, userOK := userFromRequest(r)
+	return Submission{Tenant: tenant, Client: clientFromRequest(r), UserID: userID, Source: sourceAPI}, tenantOK && userOK
+}
+
+// submitReceipt validates, deduplicates and stores a receipt, through the
+// processing queue when it is enabled. Rejected duplicates are reported as
+// *DuplicateError.
+func submitReceipt(ctx context.Context, sub Submission, receipt Receipt) (string, StoredReceipt, error) {
+	var receiptID string
+	var stored StoredReceipt
+	var err error
+	if sub.MessageID != "" {
+		receiptID, stored, err = messages.submit(ctx, sub, receipt)
+	} else {
+		receiptID, stored, err = enqueueSubmission(ctx, sub, receipt)
+	}
+	sourceStats.record(sub, submissionOutcome(err), clockFrom(ctx).Now())
+	return receiptID, stored, err
+}
+
+// enqueueSubmission hands a submission to the processing queue when it is
+// enabled, and processes it directly otherwise.
+func enqueueSubmission(ctx context.Context, sub Submission, receipt Receipt) (string, StoredReceipt, error) {
+	if submissions != nil {
+		return submissions.submit(ctx, sub, receipt)
+	}
+	return processSubmission(ctx, sub, receipt)
+}
+
+// processSubmission does the work of submitReceipt.
+func processSubmission(ctx context.Context, sub Submission, receipt Receipt) (string, StoredReceipt, error) {
+	if err := validateReceipt(receipt); err != nil {
+		return "", StoredReceipt{}, err
+	}
+	if err := checkCustomFields(sub.Tenant, receipt.CustomFields); err != nil {
+		return "", StoredReceipt{}, err
+	}
+	receipt, err := runHooks(ctx, receipt)
+	if err != nil {
+		return "", StoredReceipt{}, err
+	}
+	tenant := sub.Tenant
+
+	receiptID := uuid.New().String()
+	stored := StoredReceipt{
+		Receipt:     receipt,
+		SubmittedAt: clockFrom(ctx).Now(),
+		Tenant:      tenant,
+		UserID:      sub.UserID,
+		ContentHash: contentHash(receipt),
+		MessageID:   sub.MessageID,
+		Source:      sub.Source,
+		Client:      sub.Client,
+	}
+	stored.Verification, stored.VerificationDetail = verifyReceipt(ctx, receipt)
+	assignExperiment(receiptID, &stored)
+	detail := awardSubmissionPoints(&stored)
+	scoreExperiment(&stored)
+
+	policy := duplicatePolicy
+	if policy.Mode != duplicateModeOff {
+		existing, err := duplicates.checkAndAdd(ctx, policy, receiptID, tenant, stored.ContentHash, receipt, stored.SubmittedAt)
+		if existing != "" {
+			duplicateStats.record(sub.Client, policy.Action, stored.SubmittedAt)
+		}
+		if err != nil {
+			return "", StoredReceipt{}, err
+		}
+		if policy.Action == duplicateFlag && existing != "" {
+			stored.DuplicateOf = existing
+			stored.Hold = holdHeld
+		}
+	}
+
+	if err := receiptStore.Put(ctx, receiptID, stored); err != nil {
+		duplicates.remove(receiptID, tenant, stored.ContentHash, receipt)
+		return "", StoredReceipt{}, err
+	}
+	duplicates.stored(receiptID, tenant, stored.ContentHash)
+	queueDetail(receiptID, detail)
+	aggregates.record(stored, netPoints(stored), 1)
+	leaderboard.record(stored, 1)
+	search.add(receiptID, stored)
+	compareShadow(receiptID, stored)
+	publishEvent(tenant, eventReceiptProcessed, ReceiptEvent{
+		ReceiptID: receiptID,
+		Retailer:  receipt.StoreName,
+		Total:     receipt.TotalAmount,
+		Points:    stored.Points,
+		UserID:    stored.UserID,
+	})
+	return receiptID, stored, nil
+}
+
+// writeSubmitError maps a submitReceipt error to an HTTP response.
+func writeSubmitError(w http.ResponseWriter, r *http.Request, err error) {
+	var duplicate *DuplicateError
+	var rejection *HookRejection
+	var invalid *validationError
+	switch {
+	case errors.As(err, &duplicate):
+		writeJSONStatus(w, r, http.StatusConflict, DuplicateResponse{Error: "Duplicate receipt", ExistingID: duplicate.ExistingID})
+	case err == errInvalidReceipt:
+		http.Error(w, "Invalid receipt format. Please verify input.", http.StatusBadRequest)
+	case err == errInvalidPurchaseTime:
+		http.Error(w, "Invalid purchase date, time or timezone", http.StatusBadRequest)
+	case errors.As(err, &invalid):
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+	case errors.As(err, &rejection):
+		http.Error(w, "Receipt "+rejection.Error(), http.StatusUnprocessableEntity)
+	case writeContextError(w, err):
+	default:
+		http.Error(w, "Failed to store receipt", http.StatusInternalServerError)
+	}
+}
 
 // processReceipt handles the processing and storage of receipts.
 func processReceipt(w http.ResponseWriter, r *http.Request) {
@@ -50,26 +330,54 @@ func processReceipt(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var receipt Receipt
-	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
-		http.Error(w, "Invalid receipt format. Please verify input.", http.StatusBadRequest)
+	sub, ok := submissionFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid tenant or user ID", http.StatusBadRequest)
+		return
+	}
+	if sub.MessageID, ok = messageFromRequest(r); !ok {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+	if sub.Source, ok = sourceFromRequest(r, sub.MessageID); !ok {
+		http.Error(w, "X-Receipt-Source must be api, ocr or email", http.StatusBadRequest)
 		return
 	}
 
-	// Validate receipt fields
-	if receipt.StoreName == "" || receipt.DateOfPurchase == "" || receipt.TimeOfPurchase == "" || receipt.TotalAmount == "" || len(receipt.PurchasedItems) == 0 {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
 		http.Error(w, "Invalid receipt format. Please verify input.", http.StatusBadRequest)
 		return
 	}
+	receipt, warnings, err := decodeReceipt(body, validationMode(sub.Tenant))
+	if err != nil {
+		sourceStats.record(sub, rejectedSubmission, clockFrom(r.Context()).Now())
+		writeDecodeError(w, err)
+		return
+	}
 
-	receiptID := uuid.New().String()
-	storageMutex.Lock()
-	receiptStorage[receiptID] = receipt
-	storageMutex.Unlock()
+	receiptID, stored, err := submitReceipt(r.Context(), sub, receipt)
+	if err != nil {
+		writeSubmitError(w, r, err)
+		return
+	}
 
-	json.NewEncoder(w).Encode(ReceiptResponse{ReceiptID: receiptID})
+	response := ReceiptResponse{ReceiptID: receiptID, DuplicateOf: stored.DuplicateOf, Warnings: warnings}
+	if onHold(stored) {
+		response.Status = statusHeld
+	}
+	if r.URL.Query().Get("includePoints") == "true" {
+		breakdown := storedBreakdown(stored)
+		points := sumBreakdown(breakdown)
+		response.Points = &points
+		response.Breakdown = breakdown
+	}
+	writeJSON(w, r, response)
 }
 
+// receiptIDFormat is the form of receipt IDs getPoints accepts.
+var receiptIDFormat = regexp.MustCompile(`^\S+$`)
+
 // getPoints retrieves the calculated points for a given receipt ID.
 func getPoints(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -77,73 +385,192 @@ func getPoints(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	receiptID := strings.TrimPrefix(r.URL.Path, "/receipts/")
-	receiptID = strings.TrimSuffix(receiptID, "/points")
+	receiptID := receiptIDFromPath(r)
 
 	// Validate receipt ID format
-	if !regexp.MustCompile(`^\S+$`).MatchString(receiptID) {
+	if !receiptIDFormat.MatchString(receiptID) {
 		http.Error(w, "Invalid receipt ID format", http.StatusBadRequest)
 		return
 	}
 
-	storageMutex.Lock()
-	receipt, exists := receiptStorage[receiptID]
-	storageMutex.Unlock()
-	if !exists {
-		http.Error(w, "Receipt not found", http.StatusNotFound)
+	stored, err := ownedReceipt(r, receiptID)
+	if err != nil {
+		writeReceiptError(w, err)
 		return
 	}
 
-	points := computePoints(receipt)
-	json.NewEncoder(w).Encode(PointsResponse{EarnedPoints: points})
+	response := PointsResponse{EarnedPoints: netPoints(stored), RulesVersion: stored.RulesVersion, Status: receiptStatus(stored)}
+	setCacheHeaders(w, stored)
+	writeEncodedJSON(w, r, pointsBodies, response, func() interface{} { return response })
 }
 
-// computePoints calculates the points earned based on the receipt details.
-func computePoints(receipt Receipt) int {
-	points := 0
+// getReceipt returns a stored receipt as submitted, with its current points
+// and submission time.
+func getReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	for _, char := range receipt.StoreName {
-		if isAlphanumeric(char) {
-			points++
-		}
+	receiptID := receiptIDFromPath(r)
+	stored, err := ownedReceipt(r, receiptID)
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+
+	// Favorites and images change even after a receipt is finalized, so
+	// caches always revalidate the receipt itself.
+	w.Header().Set("Cache-Control", revalidateCacheControl)
+	if stored.FinalizedAt == nil {
+		writeJSON(w, r, storedReceiptResponse(receiptID, stored))
+		return
 	}
+	key := finalizedReceiptKey{id: receiptID, favorite: stored.Favorite, images: len(stored.Images), status: receiptStatus(stored)}
+	writeEncodedJSON(w, r, finalizedReceiptBodies, key, func() interface{} { return storedReceiptResponse(receiptID, stored) })
+}
 
-	if strings.HasSuffix(receipt.TotalAmount, ".00") {
-		points += 50
+// storedReceiptResponse describes a stored receipt for API responses.
+func storedReceiptResponse(receiptID string, stored StoredReceipt) StoredReceiptResponse {
+	return StoredReceiptResponse{
+		ReceiptID:     receiptID,
+		Receipt:       stored.Receipt,
+		Points:        netPoints(stored),
+		SubmittedAt:   stored.SubmittedAt,
+		UserID:        stored.UserID,
+		Favorite:      stored.Favorite,
+		DuplicateOf:   stored.DuplicateOf,
+		Status:        receiptStatus(stored),
+		Verification:  stored.Verification,
+		RefundedItems: stored.RefundedItems,
+		FinalizedAt:   stored.FinalizedAt,
+		AmendedAt:     lastAmendedAt(stored),
+		Images:        stored.Images,
+		RulesVersion:  stored.RulesVersion,
+		Source:        stored.Source,
+		Client:        stored.Client,
 	}
+}
 
-	totalValue, _ := strconv.ParseFloat(receipt.TotalAmount, 64)
-	if math.Mod(totalValue, 0.25) == 0 {
-		points += 25
+// listReceipts pages through the receipts visible to the caller: those of
+// the request's tenant that belong to the requesting user or to no one.
+// Receipts are listed newest first.
+func listReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	points += (len(receipt.PurchasedItems) / 2) * 5
+	sub, ok := submissionFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid tenant or user ID", http.StatusBadRequest)
+		return
+	}
+	limit, offset, ok := pageFromRequest(r)
+	if !ok {
+		http.Error(w, "limit must be 1-500 and offset non-negative", http.StatusBadRequest)
+		return
+	}
 
-	for _, item := range receipt.PurchasedItems {
-		if len(strings.TrimSpace(item.Description))%3 == 0 {
-			price, _ := strconv.ParseFloat(item.Price, 64)
-			points += int(math.Ceil(price * 0.2))
+	type match struct {
+		id     string
+		stored StoredReceipt
+	}
+	var matches []match
+	err := receiptStore.Range(r.Context(), func(id string, stored StoredReceipt) bool {
+		if stored.Tenant == sub.Tenant && (stored.UserID == "" || stored.UserID == sub.UserID) && matchesSource(r, stored) {
+			matches = append(matches, match{id: id, stored: stored})
 		}
+		return true
+	})
+	if err != nil {
+		if !writeContextError(w, err) {
+			http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		}
+		return
 	}
+	sort.Slice(matches, func(i, j int) bool {
+		a, b := matches[i].stored.SubmittedAt, matches[j].stored.SubmittedAt
+		if !a.Equal(b) {
+			return a.After(b)
+		}
+		return matches[i].id < matches[j].id
+	})
 
-	dateParts := strings.Split(receipt.DateOfPurchase, "-")
-	day, _ := strconv.Atoi(dateParts[2])
-	if day%2 != 0 {
-		points += 6
+	page := ReceiptPage{Receipts: []StoredReceiptResponse{}, Total: len(matches), Limit: limit, Offset: offset}
+	for i := offset; i < len(matches) && i < offset+limit; i++ {
+		page.Receipts = append(page.Receipts, storedReceiptResponse(matches[i].id, matches[i].stored))
 	}
+	writeJSON(w, r, page)
+}
 
-	timeParts := strings.Split(receipt.TimeOfPurchase, ":")
-	hour, _ := strconv.Atoi(timeParts[0])
-	if hour >= 14 && hour < 16 {
-		points += 10
+// pageFromRequest reads the limit (default 50, at most 500) and offset
+// query parameters.
+func pageFromRequest(r *http.Request) (limit, offset int, ok bool) {
+	limit = 50
+	query := r.URL.Query()
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > 500 {
+			return 0, 0, false
+		}
+		limit = n
+	}
+	if value := query.Get("offset"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return 0, 0, false
+		}
+		offset = n
 	}
+	return limit, offset, true
+}
+
+// receiptPath splits a /receipts/{id}/... path into its segments.
+func receiptPath(r *http.Request) []string {
+	return strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/receipts/"), "/"), "/")
+}
 
-	return points
+// receiptIDFromPath extracts the receipt ID from a /receipts/{id}/... path.
+func receiptIDFromPath(r *http.Request) string {
+	return receiptPath(r)[0]
 }
 
-// isAlphanumeric checks if a character is alphanumeric.
-func isAlphanumeric(char rune) bool {
-	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')
+// receiptRoutes dispatches /receipts/{id}/... requests to their handlers.
+func receiptRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := receiptPath(r)
+	switch {
+	case len(parts) == 1 && parts[0] == "":
+		listReceipts(w, r)
+	case len(parts) == 1 && r.Method == http.MethodPut:
+		amendReceipt(w, r)
+	case len(parts) == 1:
+		getReceipt(w, r)
+	case len(parts) == 2 && parts[1] == "points":
+		getPoints(w, r)
+	case len(parts) == 3 && parts[1] == "points" && parts[2] == "breakdown":
+		getPointsBreakdown(w, r)
+	case len(parts) == 3 && parts[1] == "items" && parts[2] == "points":
+		getItemPoints(w, r)
+	case len(parts) == 2 && parts[1] == "finalize":
+		requireAdmin(finalizeReceipt)(w, r)
+	case len(parts) == 2 && parts[1] == "refund":
+		requireAdmin(refundReceipt)(w, r)
+	case len(parts) == 2 && parts[1] == "images":
+		uploadReceiptImage(w, r)
+	case len(parts) == 2 && parts[1] == "favorite":
+		favoriteHandler(w, r)
+	case len(parts) == 2 && parts[1] == "duplicate":
+		resubmitReceipt(w, r)
+	case len(parts) == 2 && parts[1] == "verify":
+		requireAdmin(reverifyReceipt)(w, r)
+	case len(parts) == 2 && parts[1] == "release":
+		requireAdmin(releaseReceipt)(w, r)
+	case len(parts) == 2 && parts[1] == "deny":
+		requireAdmin(denyReceipt)(w, r)
+	default:
+		http.NotFound(w, r)
+	}
 }
 
 // rootHandler displays a welcome message for the root URL.
@@ -154,9 +581,228 @@ func rootHandler(w http.ResponseWriter, r *http.Request) {
 
 // main initializes the server and registers the endpoints.
 func main() {
+	selfTest := flag.Bool("selftest", false, "check scoring and storage with the configured components, then exit")
+	flag.Parse()
+
+	if err := loadLogConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadClockConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTimezoneConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadScoringPlugins(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadRulesConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadStoreConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTimeoutConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAmountConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadValidationConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadCustomFieldConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadDeadlineConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTransliteratorConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadParseTemplates(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadBlobConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadCampaigns(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadWebhooks(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTenantRules(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAccountConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadSLOConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadJobSLAConfig(); err != nil {
+		log.Fatal(err)
+	}
+	loadFaultConfig()
+	if err := loadOCRConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadVerifierConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadHookConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAnalyticsPrivacyConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadAnonymizationConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadTenantAdminConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadIdempotencyConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadPointsDetailConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadProcessingConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadShutdownConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadIngestConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadSFTPConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadSettlementConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadExpiryConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadPartnerConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadDeadLetters(); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadDuplicateConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkPinnedRuleSets(); err != nil {
+		log.Fatal(err)
+	}
+	if err := rebuildDuplicateIndex(); err != nil {
+		log.Fatal(err)
+	}
+	if err := rebuildMessageIndex(); err != nil {
+		log.Fatal(err)
+	}
+	if err := rebuildAggregates(); err != nil {
+		log.Fatal(err)
+	}
+	if err := rebuildLeaderboard(); err != nil {
+		log.Fatal(err)
+	}
+	if err := rebuildSearchIndex(); err != nil {
+		log.Fatal(err)
+	}
+	if *selfTest {
+		if err := runSelfTest(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Self-test passed")
+		return
+	}
+	if ingestConfig != nil {
+		go watchIngestDir(ingestConfig)
+	}
+	if sftpConfig != nil {
+		go watchSFTP(sftpConfig)
+	}
+	if settlementInterval > 0 {
+		go scheduleSettlements(settlementInterval)
+	}
+	if expiryEnabled() {
+		go watchExpiry()
+	}
+	go watchUploads()
+
 	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/receipts/process", processReceipt)
-	http.HandleFunc("/receipts/", getPoints)
+	http.HandleFunc("/receipts", listReceipts)
+	http.HandleFunc("/receipts/process", idempotent(processReceipt))
+	http.HandleFunc("/receipts/process/batch", processReceiptBatch)
+	http.HandleFunc("/receipts/process/stream", processReceiptStream)
+	http.HandleFunc("/receipts/points/preview", previewPoints)
+	http.HandleFunc("/receipts/parse", parseReceipt)
+	http.HandleFunc("/receipts/import", importReceipts)
+	http.HandleFunc("/receipts/search", searchReceipts)
+	http.HandleFunc("/receipts/", receiptRoutes)
+	http.HandleFunc("/users/", userRoutes)
+	http.HandleFunc("/leaderboard", getLeaderboard)
+	http.HandleFunc("/partner/receipts", partnerSubmitReceipt)
+	http.HandleFunc("/webhooks", requireTenantAdmin(webhooksHandler))
+	http.HandleFunc("/webhooks/", requireTenantAdmin(webhookRoutes))
+	http.HandleFunc("/blobs/", blobHandler)
+	http.HandleFunc("/uploads", createUpload)
+	http.HandleFunc("/uploads/", getUpload)
+	http.HandleFunc("/readyz", readinessHandler)
+	http.HandleFunc("/admin/dashboard", requireAdmin(getDashboard))
+	http.HandleFunc("/admin/latency", requireAdmin(getLatency))
+	http.HandleFunc("/admin/jobs/sla", requireAdmin(getJobSLA))
+	http.HandleFunc("/admin/clients", requireAdmin(getClientUsages))
+	http.HandleFunc("/admin/clients/", requireAdmin(getClientUsage))
+	http.HandleFunc("/admin/aggregates", requireAdmin(getAggregates))
+	http.HandleFunc("/admin/duplicates", requireAdmin(getDuplicateReport))
+	http.HandleFunc("/admin/sources", requireAdmin(getSourceReport))
+	http.HandleFunc("/admin/caches", requireAdmin(listCaches))
+	http.HandleFunc("/admin/caches/", requireAdmin(cacheRoutes))
+	http.HandleFunc("/stats", requireAdmin(getStats))
+	http.HandleFunc("/retailers/", requireAdmin(retailerRoutes))
+	http.HandleFunc("/admin/holds", requireAdmin(listHeldReceipts))
+	http.HandleFunc("/admin/rounding", requireAdmin(getRoundingReport))
+	http.HandleFunc("/admin/receipts/sample", requireAdmin(sampleReceipts))
+	http.HandleFunc("/admin/deadletters", requireAdmin(deadLettersHandler))
+	http.HandleFunc("/admin/deadletters/", requireAdmin(deadLetterRoutes))
+	http.HandleFunc("/admin/users", requireAdmin(usersHandler))
+	http.HandleFunc("/admin/users/", requireAdmin(userAccountRoutes))
+	http.HandleFunc("/admin/impersonations", requireAdmin(impersonationsHandler))
+	http.HandleFunc("/admin/impersonations/", requireAdmin(revokeImpersonation))
+	http.HandleFunc("/admin/audit", requireAdmin(getAuditLog))
+	http.HandleFunc("/admin/hooks", requireAdmin(getHookStats))
+	http.HandleFunc("/admin/plugins", requireAdmin(getPluginStats))
+	http.HandleFunc("/admin/throttle", requireAdmin(getThrottle))
+	http.HandleFunc("/admin/snapshot", requireAdmin(snapshotHandler))
+	http.HandleFunc("/admin/validation", requireAdmin(validationHandler))
+	http.HandleFunc("/admin/validation/", requireAdmin(tenantValidationHandler))
+	http.HandleFunc("/admin/settlements", requireAdmin(settlementsHandler))
+	http.HandleFunc("/admin/settlements/", requireAdmin(getSettlementFile))
+	http.HandleFunc("/admin/faults", requireAdmin(faultsHandler))
+	http.HandleFunc("/admin/rules", requireAdmin(rulesHandler))
+	http.HandleFunc("/admin/rules/validate", requireAdmin(validateRules))
+	http.HandleFunc("/admin/rules/reload", requireAdmin(reloadRulesHandler))
+	http.HandleFunc("/admin/recompute", requireAdmin(recomputePoints))
+	http.HandleFunc("/admin/rules/proposals", requireAdmin(listRulesProposals))
+	http.HandleFunc("/admin/rules/proposals/", requireAdmin(rulesProposalRoutes))
+	http.HandleFunc("/tenant/rules", requireTenantAdmin(getTenantRules))
+	http.HandleFunc("/tenant/rules/proposals", requireTenantAdmin(tenantProposalsHandler))
+	http.HandleFunc("/tenant/rules/proposals/", requireTenantAdmin(tenantProposalHandler))
+	http.HandleFunc("/admin/rules/shadow", requireAdmin(shadowRulesHandler))
+	http.HandleFunc("/admin/rules/shadow/report", requireAdmin(getShadowReport))
+	http.HandleFunc("/admin/rules/shadow/promote", requireAdmin(promoteShadowRules))
+	http.HandleFunc("/admin/experiments", requireAdmin(experimentsHandler))
+	http.HandleFunc("/admin/experiments/", requireAdmin(experimentRoutes))
+	http.HandleFunc("/admin/campaigns", requireAdmin(campaignsHandler))
+	http.HandleFunc("/admin/campaigns/", requireAdmin(campaignRoutes))
 	fmt.Println("Server is running on http://localhost:8080")
-	http.ListenAndServe(":8080", nil)
+	if err := serve(":8080", instrument(withTimeout(authenticateUsers(impersonate(injectFaults(http.DefaultServeMux)))))); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// userTokenHeader carries a user account's token. Requests bearing one act
+// as the account's user and tenant, whatever X-User-ID and X-Tenant-ID say.
+const userTokenHeader = "X-User-Token"
+
+// accountsKey is the blob key user accounts are saved under.
+const accountsKey = "users/accounts.json"
+
+// UserAccount is a registered user who owns the receipts submitted with
+// their token.
+type UserAccount struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant"`
+	Name      string    `json:"name,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Token is only returned when the account is created or its token is
+	// rotated.
+	Token string `json:"token,omitempty"`
+}
+
+// savedAccount is an account as stored, with its token hashed.
+type savedAccount struct {
+	UserAccount
+	TokenHash string `json:"tokenHash"`
+}
+
+var (
+	accountsMutex sync.RWMutex
+	// accounts holds accounts by tenant and user ID.
+	accounts = make(map[string]savedAccount)
+	// accountTokens maps token hashes to accounts' keys.
+	accountTokens = make(map[string]string)
+	// userAuthRequired rejects X-User-ID headers not backed by a user
+	// token, so that users cannot claim each other's receipts.
+	userAuthRequired bool
+)
+
+// accountKey identifies an account within its tenant.
+func accountKey(tenant, userID string) string {
+	return tenant + "/" + userID
+}
+
+// loadAccountConfig reads USER_AUTH and restores the accounts saved in the
+// blob store. It runs after the blob store is configured.
+func loadAccountConfig() error {
+	switch mode := os.Getenv("USER_AUTH"); mode {
+	case "", "optional":
+	case "required":
+		userAuthRequired = true
+	default:
+		return fmt.Errorf("USER_AUTH: unknown mode %q", mode)
+	}
+
+	data, err := blobStore.Get(accountsKey)
+	if errors.Is(err, errBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("user accounts: %w", err)
+	}
+	var saved []savedAccount
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("user accounts: %w", err)
+	}
+	for _, account := range saved {
+		key := accountKey(account.Tenant, account.ID)
+		accounts[key] = account
+		accountTokens[account.TokenHash] = key
+	}
+	return nil
+}
+
+// saveAccounts writes every account to the blob store. The caller holds
+// accountsMutex.
+func saveAccounts() error {
+	saved := make([]savedAccount, 0, len(accounts))
+	for _, account := range accounts {
+		saved = append(saved, account)
+	}
+	sort.Slice(saved, func(i, j int) bool {
+		return accountKey(saved[i].Tenant, saved[i].ID) < accountKey(saved[j].Tenant, saved[j].ID)
+	})
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return blobStore.Put(accountsKey, data)
+}
+
+// newUserToken returns a random token and its hash.
+func newUserToken() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(secret)
+	return token, hashKey(token), nil
+}
+
+// authenticateUsers resolves user tokens to their accounts' user and tenant
+// headers. With USER_AUTH=required, X-User-ID is only accepted from a token
+// or an impersonation token. Admin endpoints are left alone.
+func authenticateUsers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(userTokenHeader)
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/admin/") || r.Header.Get(impersonationHeader) != "":
+			next.ServeHTTP(w, r)
+			return
+		case token == "" && userAuthRequired && r.Header.Get(userHeader) != "":
+			http.Error(w, "X-User-ID requires a user token", http.StatusUnauthorized)
+			return
+		case token == "":
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		accountsMutex.RLock()
+		account, ok := accounts[accountTokens[hashKey(token)]]
+		accountsMutex.RUnlock()
+		if !ok {
+			http.Error(w, "Invalid user token", http.StatusUnauthorized)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Header.Set(userHeader, account.ID)
+		r.Header.Set(tenantHeader, account.Tenant)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorizeUser checks that a request may read the data of the user with
+// the given ID, and returns the tenant whose user it is: the tenant of the
+// request's user token, or its X-Tenant-ID. Requests acting as a user are
+// limited to that user's data, and with USER_AUTH=required anonymous
+// requests are refused. It reports false, having written the error,
+// otherwise.
+func authorizeUser(w http.ResponseWriter, r *http.Request, userID string) (string, bool) {
+	tenant, ok := tenantFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return "", false
+	}
+	acting, _ := userFromRequest(r)
+	switch {
+	case acting == "" && userAuthRequired:
+		http.Error(w, "A user token is required", http.StatusUnauthorized)
+		return "", false
+	case acting != "" && acting != userID:
+		http.Error(w, "Cannot access another user's data", http.StatusForbidden)
+		return "", false
+	}
+	return tenant, true
+}
+
+// usersHandler lists user accounts (GET, optionally ?tenant=) or registers
+// one (POST), returning its token.
+func usersHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		tenant := r.URL.Query().Get("tenant")
+		accountsMutex.RLock()
+		list := make([]UserAccount, 0, len(accounts))
+		for _, account := range accounts {
+			if tenant == "" || account.Tenant == tenant {
+				list = append(list, account.UserAccount)
+			}
+		}
+		accountsMutex.RUnlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+		writeJSON(w, r, list)
+	case http.MethodPost:
+		var account UserAccount
+		if err := json.NewDecoder(r.Body).Decode(&account); err != nil {
+			http.Error(w, "Invalid user account", http.StatusBadRequest)
+			return
+		}
+		if account.Tenant == "" {
+			account.Tenant = defaultTenant
+		}
+		if !tenantPattern.MatchString(account.ID) || !tenantPattern.MatchString(account.Tenant) {
+			http.Error(w, "Invalid user or tenant ID", http.StatusBadRequest)
+			return
+		}
+		token, hash, err := newUserToken()
+		if err != nil {
+			http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+			return
+		}
+		account.CreatedAt = clockFrom(r.Context()).Now()
+		account.Token = ""
+
+		key := accountKey(account.Tenant, account.ID)
+		accountsMutex.Lock()
+		defer accountsMutex.Unlock()
+		if _, ok := accounts[key]; ok {
+			http.Error(w, "User account already exists", http.StatusConflict)
+			return
+		}
+		accounts[key] = savedAccount{UserAccount: account, TokenHash: hash}
+		accountTokens[hash] = key
+		if err := saveAccounts(); err != nil {
+			delete(accounts, key)
+			delete(accountTokens, hash)
+			log.Printf("user accounts: saving: %v", err)
+			http.Error(w, "Failed to save user account", http.StatusInternalServerError)
+			return
+		}
+		account.Token = token
+		writeJSONStatus(w, r, http.StatusCreated, account)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// userAccountRoutes returns (GET) or deletes (DELETE) the account
+// /admin/users/{id} of the tenant given by ?tenant= (default "default"), or
+// rotates its token (POST /admin/users/{id}/token). Deleting an account
+// revokes its token; the user's receipts are kept.
+func userAccountRoutes(w http.ResponseWriter, r *http.Request) {
+	userID, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/users/"), "/"), "/")
+	tenant := r.URL.Query().Get("tenant")
+	if tenant == "" {
+		tenant = defaultTenant
+	}
+	switch {
+	case action != "" && action != "token":
+		http.NotFound(w, r)
+		return
+	case action == "" && r.Method != http.MethodGet && r.Method != http.MethodDelete,
+		action == "token" && r.Method != http.MethodPost:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	key := accountKey(tenant, userID)
+	accountsMutex.Lock()
+	defer accountsMutex.Unlock()
+	account, ok := accounts[key]
+	if !ok {
+		http.Error(w, "User account not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case r.Method == http.MethodGet:
+		writeJSON(w, r, account.UserAccount)
+	case r.Method == http.MethodDelete:
+		delete(accounts, key)
+		delete(accountTokens, account.TokenHash)
+		if err := saveAccounts(); err != nil {
+			log.Printf("user accounts: saving: %v", err)
+			http.Error(w, "Failed to save user accounts", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		token, hash, err := newUserToken()
+		if err != nil {
+			http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+			return
+		}
+		delete(accountTokens, account.TokenHash)
+		account.TokenHash = hash
+		accounts[key] = account
+		accountTokens[hash] = key
+		if err := saveAccounts(); err != nil {
+			log.Printf("user accounts: saving: %v", err)
+			http.Error(w, "Failed to save user accounts", http.StatusInternalServerError)
+			return
+		}
+		response := account.UserAccount
+		response.Token = token
+		writeJSON(w, r, response)
+	}
+}
+
+// listUserReceipts pages through a tenant user's receipts, newest first.
+func listUserReceipts(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID := userPath(r)[0]
+	limit, offset, ok := pageFromRequest(r)
+	if !ok {
+		http.Error(w, "limit must be 1-500 and offset non-negative", http.StatusBadRequest)
+		return
+	}
+
+	type userReceipt struct {
+		id     string
+		stored StoredReceipt
+	}
+	var owned []userReceipt
+	err := receiptStore.Range(r.Context(), func(id string, stored StoredReceipt) bool {
+		if stored.UserID == userID && stored.Tenant == tenant && matchesSource(r, stored) {
+			owned = append(owned, userReceipt{id, stored})
+		}
+		return true
+	})
+	if writeContextError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(owned, func(i, j int) bool {
+		if !owned[i].stored.SubmittedAt.Equal(owned[j].stored.SubmittedAt) {
+			return owned[i].stored.SubmittedAt.After(owned[j].stored.SubmittedAt)
+		}
+		return owned[i].id < owned[j].id
+	})
+
+	page := ReceiptPage{Receipts: []StoredReceiptResponse{}, Total: len(owned), Limit: limit, Offset: offset}
+	for i := offset; i < len(owned) && i < offset+limit; i++ {
+		page.Receipts = append(page.Receipts, storedReceiptResponse(owned[i].id, owned[i].stored))
+	}
+	writeJSON(w, r, page)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// adminToken guards the /admin endpoints. When empty the admin API is disabled.
+var adminToken = os.Getenv("ADMIN_TOKEN")
+
+// requireAdmin rejects requests that do not carry the admin bearer token.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if adminToken == "" {
+			http.Error(w, "Admin API disabled", http.StatusForbidden)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// RetailerCount is the number of stored receipts for one retailer.
+type RetailerCount struct {
+	Retailer string `json:"retailer"`
+	Receipts int    `json:"receipts"`
+}
+
+// ErrorRates summarizes failed requests across all endpoints.
+type ErrorRates struct {
+	Requests     int64                    `json:"requests"`
+	ClientErrors int64                    `json:"clientErrors"`
+	ServerErrors int64                    `json:"serverErrors"`
+	ErrorRate    float64                  `json:"errorRate"`
+	Endpoints    map[string]EndpointStats `json:"endpoints"`
+}
+
+// DashboardResponse is the consolidated payload for the ops dashboard.
+type DashboardResponse struct {
+	StoreSize          int             `json:"storeSize"`
+	UptimeSeconds      int64           `json:"uptimeSeconds"`
+	RequestsLastMinute int64           `json:"requestsLastMinute"`
+	RequestsPerSecond  float64         `json:"requestsPerSecond"`
+	Errors             ErrorRates      `json:"errors"`
+	Duplicates         DuplicateCounts `json:"duplicates"`
+	QueueDepths        map[string]int  `json:"queueDepths"`
+	ActiveCampaigns    []string        `json:"activeCampaigns"`
+	TopRetailers       []RetailerCount `json:"topRetailers"`
+
+	// PointsDetailDropped counts submissions whose points detail was not
+	// stored because the async writer's queue was full.
+	PointsDetailDropped int64 `json:"pointsDetailDropped"`
+}
+
+// topRetailerCount is how many retailers the dashboard lists.
+const topRetailerCount = 10
+
+// getDashboard returns store, traffic and queue figures in one payload.
+func getDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	response := DashboardResponse{
+		UptimeSeconds:   int64(now.Sub(serverStarted).Seconds()),
+		QueueDepths:     make(map[string]int),
+		ActiveCampaigns: []string{},
+	}
+
+	response.StoreSize = aggregates.Total().Receipts
+	response.Duplicates = duplicateStats.Total()
+	response.PointsDetailDropped = atomic.LoadInt64(&detailsDropped)
+	response.TopRetailers = topRetailers(topRetailerCount)
+
+	response.RequestsLastMinute = requestsInWindow(now)
+	response.RequestsPerSecond = float64(response.RequestsLastMinute) / throughputWindow
+
+	metricsMutex.Lock()
+	response.Errors.Endpoints = make(map[string]EndpointStats, len(endpointStats))
+	for route, stats := range endpointStats {
+		response.Errors.Endpoints[route] = *stats
+		response.Errors.Requests += stats.Requests
+		response.Errors.ClientErrors += stats.ClientErrors
+		response.Errors.ServerErrors += stats.ServerErrors
+	}
+	depths := make(map[string]func() int, len(queueDepths))
+	for name, depth := range queueDepths {
+		depths[name] = depth
+	}
+	metricsMutex.Unlock()
+
+	if response.Errors.Requests > 0 {
+		response.Errors.ErrorRate = float64(response.Errors.ClientErrors+response.Errors.ServerErrors) / float64(response.Errors.Requests)
+	}
+	for name, depth := range depths {
+		response.QueueDepths[name] = depth()
+	}
+
+	writeJSON(w, r, response)
+}
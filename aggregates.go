@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+)
+
+// AggregateCounters accumulates figures for a group of receipts.
+type AggregateCounters struct {
+	Receipts   int   `json:"receipts"`
+	Items      int   `json:"items"`
+	Points     int   `json:"points"`
+	SpendCents int64 `json:"spendCents"`
+}
+
+// add folds one receipt into the counters; sign is +1 to add, -1 to remove.
+func (c *AggregateCounters) add(receipt Receipt, points, sign int) {
+	cents, _ := scoring.ParseCents(receipt.TotalAmount)
+	c.Receipts += sign
+	c.Items += sign * len(receipt.PurchasedItems)
+	c.Points += sign * points
+	c.SpendCents += int64(sign) * cents
+}
+
+// aggregateGroup is the counters for one group of receipts, with the users
+// who contributed them so that small cohorts can be recognized.
+type aggregateGroup struct {
+	AggregateCounters
+	users     map[string]int
+	anonymous int
+}
+
+// add folds one receipt into the group; sign is +1 to add, -1 to remove.
+func (g *aggregateGroup) add(stored StoredReceipt, points, sign int) {
+	g.AggregateCounters.add(stored.Receipt, points, sign)
+	if stored.UserID == "" {
+		g.anonymous += sign
+		return
+	}
+	if g.users == nil {
+		g.users = make(map[string]int)
+	}
+	g.users[stored.UserID] += sign
+	if g.users[stored.UserID] <= 0 {
+		delete(g.users, stored.UserID)
+	}
+}
+
+// contributors counts the distinct users behind the group's receipts.
+// Receipts without a user each count as a contributor of their own.
+func (g *aggregateGroup) contributors() int {
+	return len(g.users) + g.anonymous
+}
+
+// aggregateView holds the counters of one set of receipts: in total, per
+// retailer, per purchase day, per retailer and purchase day and per
+// submission source, along with how many receipts earned each number of
+// points.
+type aggregateView struct {
+	total        aggregateGroup
+	retailers    map[string]*aggregateGroup
+	days         map[string]*aggregateGroup
+	retailerDays map[string]map[string]*aggregateGroup
+	sources      map[string]*aggregateGroup
+	histogram    map[int]int
+}
+
+func newAggregateView() *aggregateView {
+	return &aggregateView{
+		retailers:    make(map[string]*aggregateGroup),
+		days:         make(map[string]*aggregateGroup),
+		retailerDays: make(map[string]map[string]*aggregateGroup),
+		sources:      make(map[string]*aggregateGroup),
+		histogram:    make(map[int]int),
+	}
+}
+
+func (v *aggregateView) record(stored StoredReceipt, points, sign int) {
+	v.total.add(stored, points, sign)
+	group(v.retailers, stored.Receipt.StoreName).add(stored, points, sign)
+	group(v.days, stored.Receipt.DateOfPurchase).add(stored, points, sign)
+	days, ok := v.retailerDays[stored.Receipt.StoreName]
+	if !ok {
+		days = make(map[string]*aggregateGroup)
+		v.retailerDays[stored.Receipt.StoreName] = days
+	}
+	group(days, stored.Receipt.DateOfPurchase).add(stored, points, sign)
+	if stored.Source != "" {
+		group(v.sources, stored.Source).add(stored, points, sign)
+	}
+	if v.histogram[points] += sign; v.histogram[points] == 0 {
+		delete(v.histogram, points)
+	}
+}
+
+// aggregateIndex keeps per-retailer and per-day counters, overall and per
+// tenant, up to date on every write so analytics never need to scan the
+// store.
+type aggregateIndex struct {
+	mu      sync.RWMutex
+	all     *aggregateView
+	tenants map[string]*aggregateView
+}
+
+var aggregates = newAggregateIndex()
+
+func newAggregateIndex() *aggregateIndex {
+	return &aggregateIndex{all: newAggregateView(), tenants: make(map[string]*aggregateView)}
+}
+
+// record adds (sign=+1) or removes (sign=-1) a stored receipt and the points
+// it earned, net of refunds.
+func (a *aggregateIndex) record(stored StoredReceipt, points, sign int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.all.record(stored, points, sign)
+	tenant, ok := a.tenants[stored.Tenant]
+	if !ok {
+		tenant = newAggregateView()
+		a.tenants[stored.Tenant] = tenant
+	}
+	tenant.record(stored, points, sign)
+}
+
+// group returns the group for key, creating it if needed.
+func group(m map[string]*aggregateGroup, key string) *aggregateGroup {
+	g, ok := m[key]
+	if !ok {
+		g = &aggregateGroup{}
+		m[key] = g
+	}
+	return g
+}
+
+// Total returns the counters across every receipt.
+func (a *aggregateIndex) Total() AggregateCounters {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.all.total.AggregateCounters
+}
+
+// Retailer returns the counters for one retailer.
+func (a *aggregateIndex) Retailer(name string) AggregateCounters {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if g, ok := a.all.retailers[name]; ok {
+		return g.AggregateCounters
+	}
+	return AggregateCounters{}
+}
+
+// RetailerCounters returns a copy of every retailer's counters.
+func (a *aggregateIndex) RetailerCounters() map[string]AggregateCounters {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return copyCounters(a.all.retailers)
+}
+
+// DayCounters returns a copy of every purchase day's counters.
+func (a *aggregateIndex) DayCounters() map[string]AggregateCounters {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return copyCounters(a.all.days)
+}
+
+func copyCounters(m map[string]*aggregateGroup) map[string]AggregateCounters {
+	copied := make(map[string]AggregateCounters, len(m))
+	for key, g := range m {
+		if g.Receipts != 0 {
+			copied[key] = g.AggregateCounters
+		}
+	}
+	return copied
+}
+
+// rebuildAggregates recomputes the aggregates from the store.
+func rebuildAggregates() error {
+	rebuilt := newAggregateIndex()
+	err := receiptStore.Range(context.Background(), func(id string, stored StoredReceipt) bool {
+		rebuilt.record(stored, netPoints(stored), 1)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	aggregates = rebuilt
+	return nil
+}
+
+// AggregatesResponse lists the pre-computed analytics counters. Groups too
+// small to publish under the privacy policy are left out and counted in
+// Suppressed; TotalSuppressed is set when that applies to the total.
+type AggregatesResponse struct {
+	Tenant          string                       `json:"tenant,omitempty"`
+	Total           AggregateCounters            `json:"total"`
+	TotalSuppressed bool                         `json:"totalSuppressed,omitempty"`
+	Retailers       map[string]AggregateCounters `json:"retailers"`
+	Days            map[string]AggregateCounters `json:"days"`
+	Sources         map[string]AggregateCounters `json:"sources"`
+	Suppressed      int                          `json:"suppressed,omitempty"`
+}
+
+// Published returns the counters of a tenant's receipts, or of every
+// receipt for the empty tenant, under the tenant's privacy policy.
+func (a *aggregateIndex) Published(tenant string) AggregatesResponse {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	view := a.all
+	if tenant != "" {
+		if view = a.tenants[tenant]; view == nil {
+			view = newAggregateView()
+		}
+	}
+	policy := privacyFor(tenant)
+	response := AggregatesResponse{
+		Tenant:    tenant,
+		Retailers: make(map[string]AggregateCounters),
+		Days:      make(map[string]AggregateCounters),
+		Sources:   make(map[string]AggregateCounters),
+	}
+	var published bool
+	response.Total, published = policy.protect(tenant+"\x00total", view.total)
+	response.TotalSuppressed = !published
+	publish := func(kind string, groups map[string]*aggregateGroup, into map[string]AggregateCounters) {
+		for key, g := range groups {
+			if g.Receipts == 0 {
+				continue
+			}
+			if counters, ok := policy.protect(tenant+"\x00"+kind+"\x00"+key, *g); ok {
+				into[key] = counters
+			} else {
+				response.Suppressed++
+			}
+		}
+	}
+	publish("retailer", view.retailers, response.Retailers)
+	publish("day", view.days, response.Days)
+	publish("source", view.sources, response.Sources)
+	return response
+}
+
+// getAggregates returns the incremental per-retailer, per-day and per-source
+// counters, across all tenants or for the tenant named by the tenant
+// parameter.
+func getAggregates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, r, aggregates.Published(tenant))
+}
+
+// topRetailers returns up to n retailers ordered by receipt count, under the
+// default analytics privacy policy.
+func topRetailers(n int) []RetailerCount {
+	counters := aggregates.Published("").Retailers
+	top := make([]RetailerCount, 0, len(counters))
+	for retailer, c := range counters {
+		top = append(top, RetailerCount{Retailer: retailer, Receipts: c.Receipts})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Receipts != top[j].Receipts {
+			return top[i].Receipts > top[j].Receipts
+		}
+		return top[i].Retailer < top[j].Retailer
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
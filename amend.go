@@ -0,0 +1,182 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// errReceiptRefunded is returned when amending a receipt with refunded
+// items, whose refunds are tied to the original item list.
+var errReceiptRefunded = &httpError{status: http.StatusConflict, message: "Receipt has refunded items"}
+
+// errNotAmender is returned when a request may read a receipt but not amend
+// it.
+var errNotAmender = &httpError{status: http.StatusForbidden, message: "Only the receipt's owner or a tenant admin may amend it"}
+
+// ReceiptAmendment records one replacement of a receipt's contents.
+type ReceiptAmendment struct {
+	AmendedAt      time.Time
+	PreviousPoints int
+	Points         int
+}
+
+// AmendResponse is the amended receipt, with the points it had before.
+type AmendResponse struct {
+	StoredReceiptResponse
+	PreviousPoints int `json:"previousPoints"`
+	// Warnings list the corrections made in lenient validation mode.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// amendableReceipt loads a receipt the request may amend: one of its own
+// user's receipts, or any receipt of the tenant whose admin token it bears.
+func amendableReceipt(r *http.Request, receiptID string) (StoredReceipt, error) {
+	stored, err := receiptStore.Get(r.Context(), receiptID)
+	if err != nil {
+		return stored, err
+	}
+	if tenant, ok := tenantAdminFromRequest(r); ok {
+		if tenant != stored.Tenant {
+			return stored, errReceiptNotFound
+		}
+		return stored, nil
+	}
+	if err := checkReceiptAccess(r, stored); err != nil {
+		return stored, err
+	}
+	if stored.UserID == "" {
+		return stored, errNotAmender
+	}
+	return stored, nil
+}
+
+// amendReceipt replaces a receipt's contents, for correcting OCR or data
+// entry mistakes. The new contents are validated as a new submission would
+// be and checked for duplicates under the duplicate policy, the receipt is
+// re-verified and rescored, and the amendment is recorded on the receipt
+// and, when the points changed, in the ledger.
+func amendReceipt(w http.ResponseWriter, r *http.Request) {
+	receiptID := receiptIDFromPath(r)
+	original, err := amendableReceipt(r, receiptID)
+	if err == nil && original.FinalizedAt != nil {
+		err = errReceiptFinalized
+	}
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid receipt format. Please verify input.", http.StatusBadRequest)
+		return
+	}
+	receipt, warnings, err := decodeReceipt(body, validationMode(original.Tenant))
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if err := validateReceipt(receipt); err != nil {
+		writeSubmitError(w, r, err)
+		return
+	}
+	if err := checkCustomFields(original.Tenant, receipt.CustomFields); err != nil {
+		writeSubmitError(w, r, err)
+		return
+	}
+	if receipt, err = runHooks(r.Context(), receipt); err != nil {
+		writeSubmitError(w, r, err)
+		return
+	}
+	// The retailer API is called before taking the store's lock.
+	verification, detail := verifyReceipt(r.Context(), receipt)
+
+	// The receipt is taken out of the duplicate index so that it cannot
+	// match itself, and put back as it was if the amendment fails.
+	hash := contentHash(receipt)
+	policy := duplicatePolicy
+	now := clockFrom(r.Context()).Now()
+	duplicates.remove(receiptID, original.Tenant, original.ContentHash, original.Receipt)
+	restore := func() {
+		duplicates.remove(receiptID, original.Tenant, hash, receipt)
+		duplicates.mu.Lock()
+		duplicates.add(policy, receiptID, original.Tenant, original.ContentHash, original.Receipt, original.SubmittedAt)
+		duplicates.mu.Unlock()
+	}
+	var duplicateOf string
+	if policy.Mode != duplicateModeOff && hash != original.ContentHash {
+		duplicateOf, err = duplicates.checkAndAdd(r.Context(), policy, receiptID, original.Tenant, hash, receipt, now)
+		if duplicateOf != "" {
+			duplicateStats.record(clientFromRequest(r), policy.Action, now)
+		}
+		if err != nil {
+			restore()
+			writeSubmitError(w, r, err)
+			return
+		}
+	} else {
+		duplicates.mu.Lock()
+		duplicates.add(policy, receiptID, original.Tenant, hash, receipt, original.SubmittedAt)
+		duplicates.mu.Unlock()
+	}
+
+	var previous, amended StoredReceipt
+	var entry LedgerEntry
+	err = receiptStore.Update(r.Context(), receiptID, func(stored *StoredReceipt) error {
+		if stored.FinalizedAt != nil {
+			return errReceiptFinalized
+		}
+		if len(stored.RefundedItems) > 0 {
+			return errReceiptRefunded
+		}
+		previous = *stored
+		stored.Receipt = receipt
+		stored.ContentHash = hash
+		stored.Verification, stored.VerificationDetail = verification, detail
+		if duplicateOf != "" && policy.Action == duplicateFlag {
+			stored.DuplicateOf = duplicateOf
+			if stored.Hold != holdDenied {
+				stored.Hold, stored.HoldReason, stored.HoldDecidedAt = holdHeld, "", nil
+			}
+		}
+		awardPoints(stored)
+		stored.Amendments = append(stored.Amendments, ReceiptAmendment{AmendedAt: now, PreviousPoints: previous.Points, Points: stored.Points})
+		entry = LedgerEntry{
+			ID:        uuid.New().String(),
+			Tenant:    stored.Tenant,
+			UserID:    stored.UserID,
+			ReceiptID: receiptID,
+			Points:    stored.Points - previous.Points,
+			Reason:    "receipt amended",
+			CreatedAt: now,
+		}
+		if entry.Points != 0 {
+			stored.Ledger = append(stored.Ledger, entry)
+		}
+		amended = *stored
+		return nil
+	})
+	if err != nil {
+		restore()
+		writeReceiptError(w, err)
+		return
+	}
+
+	duplicates.stored(receiptID, amended.Tenant, hash)
+	recordPointsChange(receiptID, previous, amended, pointsAmended)
+	search.add(receiptID, amended)
+
+	response := AmendResponse{StoredReceiptResponse: storedReceiptResponse(receiptID, amended), PreviousPoints: netPoints(previous), Warnings: warnings}
+	writeJSON(w, r, response)
+}
+
+// lastAmendedAt returns when a receipt was last amended, or nil.
+func lastAmendedAt(stored StoredReceipt) *time.Time {
+	if len(stored.Amendments) == 0 {
+		return nil
+	}
+	return &stored.Amendments[len(stored.Amendments)-1].AmendedAt
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+)
+
+// Amount parsing modes.
+const (
+	// amountsStrict accepts totals and prices only as JSON strings, kept
+	// exactly as sent.
+	amountsStrict = "strict"
+	// amountsLenient also accepts JSON numbers and normalizes every amount
+	// to two decimal places.
+	amountsLenient = "lenient"
+)
+
+// amountParsing is the active amount parsing mode.
+var amountParsing = amountsStrict
+
+// errNumericAmount is returned for numeric amounts in strict mode.
+var errNumericAmount = errors.New("amounts must be JSON strings")
+
+// loadAmountConfig reads AMOUNT_PARSING from the environment.
+func loadAmountConfig() error {
+	switch mode := os.Getenv("AMOUNT_PARSING"); mode {
+	case "":
+	case amountsStrict, amountsLenient:
+		amountParsing = mode
+	default:
+		return fmt.Errorf("AMOUNT_PARSING: unknown mode %q", mode)
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes an item, accepting a numeric price in lenient mode.
+func (i *Item) UnmarshalJSON(data []byte) error {
+	type plain Item
+	var raw struct {
+		plain
+		Price json.RawMessage `json:"price"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	price, err := decodeAmount(raw.Price)
+	if err != nil {
+		return fmt.Errorf("price: %w", err)
+	}
+	*i = Item(raw.plain)
+	i.Price = price
+	return nil
+}
+
+// UnmarshalJSON decodes a receipt, accepting a numeric total in lenient mode.
+func (r *Receipt) UnmarshalJSON(data []byte) error {
+	type plain Receipt
+	var raw struct {
+		plain
+		TotalAmount json.RawMessage `json:"total"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	total, err := decodeAmount(raw.TotalAmount)
+	if err != nil {
+		return fmt.Errorf("total: %w", err)
+	}
+	*r = Receipt(raw.plain)
+	r.TotalAmount = total
+	return nil
+}
+
+// decodeAmount turns a JSON string or number into the string form used
+// throughout the service. In lenient mode amounts are normalized through
+// their value in cents, so 6.5, "6.5" and "6.50" all become "6.50".
+// Strings that are not valid amounts are kept as sent and rejected or
+// scored as before.
+func decodeAmount(raw json.RawMessage) (string, error) {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return "", nil
+	}
+	if raw[0] == '"' {
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return "", err
+		}
+		if amountParsing == amountsLenient {
+			if cents, err := scoring.ParseCents(text); err == nil {
+				return formatCents(cents), nil
+			}
+		}
+		return text, nil
+	}
+
+	if amountParsing != amountsLenient {
+		return "", errNumericAmount
+	}
+	var number json.Number
+	if err := json.Unmarshal(raw, &number); err != nil {
+		return "", err
+	}
+	if bytes.ContainsAny(raw, "eE") {
+		return "", fmt.Errorf("amount %s must be written without an exponent", raw)
+	}
+	cents, err := scoring.ParseCents(number.String())
+	if err != nil {
+		return "", fmt.Errorf("amount %s has more than two decimal places", raw)
+	}
+	return formatCents(cents), nil
+}
+
+// formatCents renders cents as a decimal amount with two places.
+func formatCents(cents int64) string {
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
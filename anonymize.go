@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"math"
+	"os"
+)
+
+// AnonymizedReceipt is a stored receipt as shared with partners for
+// analytics. Receipt and user IDs are replaced by keyed hashes, so receipts
+// and users can still be told apart and grouped but not identified; times
+// are truncated to the day, the store location is coarsened to about a
+// kilometer, and order numbers, custom fields, images and API clients are
+// left out.
+type AnonymizedReceipt struct {
+	ID             string    `json:"id"`
+	Tenant         string    `json:"tenant,omitempty"`
+	UserID         string    `json:"userId,omitempty"`
+	Retailer       string    `json:"retailer"`
+	PurchaseDate   string    `json:"purchaseDate"`
+	SubmittedDate  string    `json:"submittedDate"`
+	Total          string    `json:"total"`
+	Items          []Item    `json:"items"`
+	Location       *GeoPoint `json:"location,omitempty"`
+	Points         int       `json:"points"`
+	RefundedPoints int       `json:"refundedPoints,omitempty"`
+	Verification   string    `json:"verification,omitempty"`
+	DuplicateOf    string    `json:"duplicateOf,omitempty"`
+	RulesVersion   string    `json:"rulesVersion,omitempty"`
+	Source         string    `json:"source,omitempty"`
+}
+
+// anonymizationKey keys the hashes replacing IDs, so that the same IDs get
+// the same pseudonyms in every export. When unset, each export uses a
+// random key and its pseudonyms cannot be linked to another's.
+var anonymizationKey []byte
+
+// loadAnonymizationConfig reads ANONYMIZATION_KEY.
+func loadAnonymizationConfig() error {
+	key := os.Getenv("ANONYMIZATION_KEY")
+	if key == "" {
+		return nil
+	}
+	if len(key) < 16 {
+		return errors.New("ANONYMIZATION_KEY: must be at least 16 characters")
+	}
+	anonymizationKey = []byte(key)
+	return nil
+}
+
+// anonymizer replaces identifying fields for one export.
+type anonymizer struct {
+	key []byte
+}
+
+// newAnonymizer returns an anonymizer keyed by ANONYMIZATION_KEY, or by a
+// fresh random key.
+func newAnonymizer() (anonymizer, error) {
+	if anonymizationKey != nil {
+		return anonymizer{key: anonymizationKey}, nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return anonymizer{}, err
+	}
+	return anonymizer{key: key}, nil
+}
+
+// pseudonym hashes an identifier within a namespace, so that equal IDs of
+// different kinds, or of users of different tenants, do not collide.
+func (a anonymizer) pseudonym(namespace, id string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(namespace))
+	mac.Write([]byte{0})
+	mac.Write([]byte(id))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// anonymize converts a stored receipt for sharing.
+func (a anonymizer) anonymize(id string, stored StoredReceipt) AnonymizedReceipt {
+	anonymized := AnonymizedReceipt{
+		ID:             a.pseudonym("receipt", id),
+		Tenant:         stored.Tenant,
+		Retailer:       stored.Receipt.StoreName,
+		PurchaseDate:   stored.Receipt.DateOfPurchase,
+		SubmittedDate:  stored.SubmittedAt.UTC().Format("2006-01-02"),
+		Total:          stored.Receipt.TotalAmount,
+		Items:          stored.Receipt.PurchasedItems,
+		Points:         stored.Points,
+		RefundedPoints: stored.RefundedPoints,
+		Verification:   stored.Verification,
+		RulesVersion:   stored.RulesVersion,
+		Source:         stored.Source,
+	}
+	if stored.UserID != "" {
+		anonymized.UserID = a.pseudonym("user:"+stored.Tenant, stored.UserID)
+	}
+	if stored.DuplicateOf != "" {
+		anonymized.DuplicateOf = a.pseudonym("receipt", stored.DuplicateOf)
+	}
+	if location := stored.Receipt.Location; location != nil {
+		coarsen := func(degrees float64) float64 { return math.Round(degrees*100) / 100 }
+		anonymized.Location = &GeoPoint{Latitude: coarsen(location.Latitude), Longitude: coarsen(location.Longitude)}
+	}
+	return anonymized
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// UserTransaction is one change to a user's points balance: points earned
+// by a receipt, a ledger adjustment to them (an amendment, refund or
+// recompute) or their expiry. Balance is the user's balance after it.
+type UserTransaction struct {
+	Type      string    `json:"type"`
+	ReceiptID string    `json:"receiptId"`
+	Points    int       `json:"points"`
+	Reason    string    `json:"reason,omitempty"`
+	At        time.Time `json:"at"`
+	Balance   int       `json:"balance"`
+}
+
+// Transaction types.
+const (
+	transactionReceipt    = "receipt"
+	transactionAdjustment = "adjustment"
+	transactionExpiry     = "expiry"
+)
+
+// UserBalance is a user's running points balance across their receipts.
+// Receipts held for review are left out until they are released; see
+// PointsProjection for their pending points.
+type UserBalance struct {
+	UserID         string     `json:"userId"`
+	Balance        int        `json:"balance"`
+	Receipts       int        `json:"receipts"`
+	EarnedPoints   int        `json:"earnedPoints"`
+	AdjustedPoints int        `json:"adjustedPoints"`
+	ExpiredPoints  int        `json:"expiredPoints"`
+	UpdatedAt      *time.Time `json:"updatedAt,omitempty"`
+}
+
+// UserTransactionPage is a page of a user's transactions, newest first.
+type UserTransactionPage struct {
+	UserID       string            `json:"userId"`
+	Balance      int               `json:"balance"`
+	Transactions []UserTransaction `json:"transactions"`
+	Total        int               `json:"total"`
+	Limit        int               `json:"limit"`
+	Offset       int               `json:"offset"`
+}
+
+// userTransactions reconstructs a user's transactions up to now, oldest
+// first, with running balances. A receipt's transaction carries the points
+// it earned when submitted: its current net points less the ledger entries
+// recorded on it since.
+func userTransactions(ctx context.Context, tenant, userID string) ([]UserTransaction, error) {
+	now := clockFrom(ctx).Now()
+	var transactions []UserTransaction
+	err := receiptStore.Range(ctx, func(id string, stored StoredReceipt) bool {
+		if stored.UserID != userID || stored.Tenant != tenant || onHold(stored) || stored.Hold == holdDenied || stored.SubmittedAt.After(now) {
+			return true
+		}
+		// Released receipts are credited when released.
+		creditedAt := stored.SubmittedAt
+		if stored.Hold == holdReleased && stored.HoldDecidedAt != nil {
+			if stored.HoldDecidedAt.After(now) {
+				return true
+			}
+			creditedAt = *stored.HoldDecidedAt
+		}
+		earned := netPoints(stored)
+		for _, entry := range stored.Ledger {
+			// Expiry is recorded on the receipt and listed below.
+			if entry.Reason == expiryLedgerReason {
+				continue
+			}
+			earned -= entry.Points
+			if !entry.CreatedAt.After(now) {
+				transactions = append(transactions, UserTransaction{Type: transactionAdjustment, ReceiptID: id, Points: entry.Points, Reason: entry.Reason, At: entry.CreatedAt})
+			}
+		}
+		transactions = append(transactions, UserTransaction{Type: transactionReceipt, ReceiptID: id, Points: earned, Reason: stored.Receipt.StoreName, At: creditedAt})
+		if expiresAt, expires := pointsExpireAt(stored); expires && !expiresAt.After(now) {
+			transactions = append(transactions, UserTransaction{Type: transactionExpiry, ReceiptID: id, Points: -expiringPoints(stored), Reason: expiryLedgerReason, At: expiresAt})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Receipts come before their adjustments and expiry even when recorded
+	// in the same instant.
+	order := map[string]int{transactionReceipt: 0, transactionAdjustment: 1, transactionExpiry: 2}
+	sort.SliceStable(transactions, func(i, j int) bool {
+		a, b := transactions[i], transactions[j]
+		switch {
+		case !a.At.Equal(b.At):
+			return a.At.Before(b.At)
+		case a.ReceiptID != b.ReceiptID:
+			return a.ReceiptID < b.ReceiptID
+		}
+		return order[a.Type] < order[b.Type]
+	})
+	balance := 0
+	for i := range transactions {
+		balance += transactions[i].Points
+		transactions[i].Balance = balance
+	}
+	return transactions, nil
+}
+
+// userBalanceFrom sums a user's transactions.
+func userBalanceFrom(userID string, transactions []UserTransaction) UserBalance {
+	balance := UserBalance{UserID: userID}
+	for _, transaction := range transactions {
+		switch transaction.Type {
+		case transactionReceipt:
+			balance.Receipts++
+			balance.EarnedPoints += transaction.Points
+		case transactionAdjustment:
+			balance.AdjustedPoints += transaction.Points
+		case transactionExpiry:
+			balance.ExpiredPoints -= transaction.Points
+		}
+	}
+	if n := len(transactions); n > 0 {
+		balance.Balance = transactions[n-1].Balance
+		updatedAt := transactions[n-1].At
+		balance.UpdatedAt = &updatedAt
+	}
+	return balance
+}
+
+// getUserBalance returns a user's points balance, now or as of the time
+// given by asOf.
+func getUserBalance(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r, ok := asOf(w, r)
+	if !ok {
+		return
+	}
+	userID := userPath(r)[0]
+	if !tenantPattern.MatchString(userID) {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	transactions, err := userTransactions(r.Context(), tenant, userID)
+	if err != nil {
+		if !writeContextError(w, err) {
+			http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, r, userBalanceFrom(userID, transactions))
+}
+
+// getUserTransactions lists a page of a user's transactions, newest first,
+// now or as of the time given by asOf.
+func getUserTransactions(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r, ok := asOf(w, r)
+	if !ok {
+		return
+	}
+	userID := userPath(r)[0]
+	if !tenantPattern.MatchString(userID) {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	limit, offset, ok := pageFromRequest(r)
+	if !ok {
+		http.Error(w, "limit must be 1-500 and offset non-negative", http.StatusBadRequest)
+		return
+	}
+	transactions, err := userTransactions(r.Context(), tenant, userID)
+	if err != nil {
+		if !writeContextError(w, err) {
+			http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	page := UserTransactionPage{UserID: userID, Transactions: []UserTransaction{}, Total: len(transactions), Limit: limit, Offset: offset}
+	if n := len(transactions); n > 0 {
+		page.Balance = transactions[n-1].Balance
+	}
+	for i := len(transactions) - 1 - offset; i >= 0 && len(page.Transactions) < limit; i-- {
+		page.Transactions = append(page.Transactions, transactions[i])
+	}
+	writeJSON(w, r, page)
+}
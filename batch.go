@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// maxBatchReceipts bounds the receipts in one batch submission.
+const maxBatchReceipts = 1000
+
+// BatchResult reports the outcome of one receipt in a batch, by its index
+// in the request.
+type BatchResult struct {
+	Index       int      `json:"index"`
+	ReceiptID   string   `json:"id,omitempty"`
+	DuplicateOf string   `json:"duplicateOf,omitempty"`
+	Warnings    []string `json:"warnings,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// BatchResponse lists every receipt's outcome, in request order.
+type BatchResponse struct {
+	Accepted int           `json:"accepted"`
+	Failed   int           `json:"failed"`
+	Results  []BatchResult `json:"results"`
+}
+
+// processReceiptBatch submits an array of receipts in one request. Each is
+// decoded, validated and stored independently, so one bad receipt does not
+// fail the rest; the response reports every receipt's ID or error.
+func processReceiptBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub, ok := submissionFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid tenant or user ID", http.StatusBadRequest)
+		return
+	}
+	var bodies []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&bodies); err != nil {
+		http.Error(w, "Request body must be a JSON array of receipts", http.StatusBadRequest)
+		return
+	}
+	if len(bodies) == 0 || len(bodies) > maxBatchReceipts {
+		http.Error(w, fmt.Sprintf("A batch must contain 1-%d receipts", maxBatchReceipts), http.StatusBadRequest)
+		return
+	}
+
+	sub.Bulk, sub.Source = true, sourceBatch
+	mode := validationMode(sub.Tenant)
+	response := BatchResponse{Results: make([]BatchResult, 0, len(bodies))}
+	for i, body := range bodies {
+		result := submitBatchEntry(r.Context(), sub, mode, i, body)
+		if result.Error != "" {
+			response.Failed++
+		} else {
+			response.Accepted++
+		}
+		response.Results = append(response.Results, result)
+	}
+	writeJSON(w, r, response)
+}
+
+// submitBatchEntry decodes and submits one receipt of a bulk submission.
+// Once ctx is done, the remaining receipts are reported as failed rather than
+// losing the results of those stored.
+func submitBatchEntry(ctx context.Context, sub Submission, mode string, index int, body []byte) BatchResult {
+	result := BatchResult{Index: index}
+	err := ctx.Err()
+	var receipt Receipt
+	var warnings []string
+	if err == nil {
+		if receipt, warnings, err = decodeReceipt(body, mode); err != nil {
+			sourceStats.record(sub, rejectedSubmission, clockFrom(ctx).Now())
+		}
+	}
+	if err == nil {
+		err = paceBulkImport(ctx)
+	}
+	if err == nil {
+		var stored StoredReceipt
+		result.ReceiptID, stored, err = submitReceipt(ctx, sub, receipt)
+		result.DuplicateOf = stored.DuplicateOf
+		result.Warnings = warnings
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
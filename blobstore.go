@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errBlobNotFound is returned when a blob key has no stored content.
+var errBlobNotFound = errors.New("blob not found")
+
+// BlobStore persists opaque binary objects such as receipt images.
+type BlobStore interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Exists(key string) bool
+	// Delete removes a blob; deleting a missing blob is not an error.
+	Delete(key string) error
+}
+
+// memoryBlobStore keeps blobs in process memory.
+type memoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+func newMemoryBlobStore() *memoryBlobStore {
+	return &memoryBlobStore{blobs: make(map[string][]byte)}
+}
+
+func (s *memoryBlobStore) Put(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[key] = data
+	return nil
+}
+
+func (s *memoryBlobStore) Get(key string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data, ok := s.blobs[key]
+	if !ok {
+		return nil, errBlobNotFound
+	}
+	return data, nil
+}
+
+func (s *memoryBlobStore) Exists(key string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.blobs[key]
+	return ok
+}
+
+func (s *memoryBlobStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blobs, key)
+	return nil
+}
+
+// fileBlobStore keeps blobs as files beneath a root directory.
+type fileBlobStore struct {
+	root string
+}
+
+func (s *fileBlobStore) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *fileBlobStore) Put(key string, data []byte) error {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *fileBlobStore) Get(key string) ([]byte, error) {
+	data, err := os.ReadFile(s.path(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errBlobNotFound
+	}
+	return data, err
+}
+
+func (s *fileBlobStore) Exists(key string) bool {
+	_, err := os.Stat(s.path(key))
+	return err == nil
+}
+
+func (s *fileBlobStore) Delete(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+var (
+	blobStore      BlobStore = newMemoryBlobStore()
+	blobSigningKey []byte
+	// blobURLTTL is how long signed retrieval URLs remain valid.
+	blobURLTTL = 15 * time.Minute
+)
+
+// loadBlobConfig selects the blob backend from BLOB_DIR and the URL signing
+// key from BLOB_SIGNING_KEY. Without a configured key a random one is used,
+// so signed URLs do not survive a restart.
+func loadBlobConfig() error {
+	if dir := os.Getenv("BLOB_DIR"); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("BLOB_DIR: %w", err)
+		}
+		blobStore = &fileBlobStore{root: dir}
+	}
+
+	if key := os.Getenv("BLOB_SIGNING_KEY"); key != "" {
+		blobSigningKey = []byte(key)
+	} else {
+		blobSigningKey = make([]byte, 32)
+		if _, err := rand.Read(blobSigningKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// blobSignature computes the HMAC authorizing method on key until expires.
+func blobSignature(method, key string, expires int64) string {
+	mac := hmac.New(sha256.New, blobSigningKey)
+	fmt.Fprintf(mac, "%s\n%s\n%d", method, key, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signedBlobURL returns a time-limited retrieval URL for key.
+func signedBlobURL(key string) string {
+	return signBlobURL(http.MethodGet, key, time.Now().Add(blobURLTTL))
+}
+
+// signBlobURL returns a URL authorizing method on key until expires.
+func signBlobURL(method, key string, expires time.Time) string {
+	return fmt.Sprintf("/blobs/%s?expires=%d&sig=%s", key, expires.Unix(), blobSignature(method, key, expires.Unix()))
+}
+
+// verifyBlobRequest checks the request's signature and returns the blob key.
+func verifyBlobRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := strings.TrimPrefix(r.URL.Path, "/blobs/")
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil || strings.Contains(key, "..") {
+		http.Error(w, "Invalid blob URL", http.StatusBadRequest)
+		return "", false
+	}
+	signature := r.URL.Query().Get("sig")
+	if time.Now().Unix() > expires || !hmac.Equal([]byte(signature), []byte(blobSignature(r.Method, key, expires))) {
+		http.Error(w, "Blob URL expired or invalid", http.StatusForbidden)
+		return "", false
+	}
+	return key, true
+}
+
+// blobHandler serves signed blob downloads (GET) and uploads (PUT).
+func blobHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		getBlob(w, r)
+	case http.MethodPut:
+		putBlob(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getBlob serves a blob when the request carries a valid, unexpired signature.
+func getBlob(w http.ResponseWriter, r *http.Request) {
+	key, ok := verifyBlobRequest(w, r)
+	if !ok {
+		return
+	}
+
+	data, err := blobStore.Get(key)
+	if err == errBlobNotFound {
+		http.Error(w, "Blob not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read blob", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(data))
+	w.Write(data)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// bloomMagic identifies a persisted Bloom filter file.
+const bloomMagic = "RPBF"
+
+// bloomFilter is a probabilistic set: MayContain never returns false for an
+// added key, and returns true for absent keys at roughly the configured
+// false-positive rate.
+type bloomFilter struct {
+	mu    sync.RWMutex
+	bits  []uint64
+	m     uint64
+	k     uint32
+	count uint64
+	dirty bool
+}
+
+// newBloomFilter sizes a filter for n keys at false-positive rate p.
+func newBloomFilter(n uint64, p float64) *bloomFilter {
+	if n == 0 {
+		n = 1
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) / 64 * 64
+	k := uint32(math.Max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomFilter{bits: make([]uint64, m/64), m: m, k: k}
+}
+
+// positions returns the k bit positions for key using double hashing.
+func (b *bloomFilter) positions(key string) []uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	h1 := h.Sum64()
+	h.Write([]byte{0xff})
+	h2 := h.Sum64() | 1
+
+	positions := make([]uint64, b.k)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % b.m
+	}
+	return positions
+}
+
+// Add inserts key into the filter.
+func (b *bloomFilter) Add(key string) {
+	positions := b.positions(key)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, pos := range positions {
+		b.bits[pos/64] |= 1 << (pos % 64)
+	}
+	b.count++
+	b.dirty = true
+}
+
+// MayContain reports whether key may have been added.
+func (b *bloomFilter) MayContain(key string) bool {
+	positions := b.positions(key)
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, pos := range positions {
+		if b.bits[pos/64]&(1<<(pos%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Count returns how many keys have been added.
+func (b *bloomFilter) Count() uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.count
+}
+
+// Save writes the filter to path atomically.
+func (b *bloomFilter) Save(path string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(bloomMagic)
+	binary.Write(w, binary.LittleEndian, b.m)
+	binary.Write(w, binary.LittleEndian, b.k)
+	binary.Write(w, binary.LittleEndian, b.count)
+	binary.Write(w, binary.LittleEndian, b.bits)
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	b.dirty = false
+	return nil
+}
+
+// loadBloomFilter reads a filter written by Save.
+func loadBloomFilter(path string) (*bloomFilter, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(bloomMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != bloomMagic {
+		return nil, errors.New("not a bloom filter file")
+	}
+	b := &bloomFilter{}
+	if err := binary.Read(r, binary.LittleEndian, &b.m); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &b.k); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &b.count); err != nil {
+		return nil, err
+	}
+	if b.m == 0 || b.m%64 != 0 || b.k == 0 {
+		return nil, errors.New("corrupt bloom filter file")
+	}
+	b.bits = make([]uint64, b.m/64)
+	if err := binary.Read(r, binary.LittleEndian, b.bits); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// persistBloomFilter saves the filter to path whenever it has changed,
+// checking every interval.
+func persistBloomFilter(b *bloomFilter, path string, interval time.Duration) {
+	for range time.Tick(interval) {
+		b.mu.RLock()
+		dirty := b.dirty
+		b.mu.RUnlock()
+		if !dirty {
+			continue
+		}
+		if err := b.Save(path); err != nil {
+			log.Printf("bloom filter: save failed: %v", err)
+		}
+	}
+}
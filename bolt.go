@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltRangePage is how many receipts Range reads per transaction. Receipts
+// are handed to the callback outside the transaction, so it may write.
+const boltRangePage = 500
+
+var (
+	boltReceipts = []byte("receipts")
+	// boltHashes maps tenant and content hash to the earliest receipt ID.
+	boltHashes = []byte("hashes")
+)
+
+func init() {
+	storeDrivers["bolt"] = openBoltDSN
+}
+
+// boltStore keeps receipts as JSON in a bbolt file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+// openBoltDSN opens a bbolt backend from a DSN such as
+// "bolt:///var/lib/receipts.db" or "bolt://receipts.db".
+func openBoltDSN(dsn *url.URL) (ReceiptStore, error) {
+	path := dsn.Host + dsn.Path
+	if path == "" {
+		return nil, errors.New("bolt: missing database path")
+	}
+	return openBoltStore(path)
+}
+
+// openBoltStore opens or creates the database file at path. The file is
+// locked, so only one process can use it at a time.
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("bolt: %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltReceipts, boltHashes} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("bolt: %s: %w", path, err)
+	}
+	return &boltStore{db: db}, nil
+}
+
+// boltHashKey is a receipt's key in the hashes bucket.
+func boltHashKey(stored StoredReceipt) []byte {
+	return []byte(stored.Tenant + "\x00" + stored.ContentHash)
+}
+
+// put writes a receipt and keeps the hash index pointing at the earliest
+// receipt with each content hash, as memoryStore does.
+func (s *boltStore) put(tx *bolt.Tx, id string, stored StoredReceipt) error {
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	receipts, hashes := tx.Bucket(boltReceipts), tx.Bucket(boltHashes)
+	var old StoredReceipt
+	moved := false
+	if previous := receipts.Get([]byte(id)); previous != nil {
+		err := json.Unmarshal(previous, &old)
+		moved = err == nil && !bytes.Equal(boltHashKey(old), boltHashKey(stored)) && bytes.Equal(hashes.Get(boltHashKey(old)), []byte(id))
+	}
+	if err := receipts.Put([]byte(id), data); err != nil {
+		return err
+	}
+	if moved {
+		// Hand the old content hash to the earliest other receipt with it.
+		next, err := s.earliestWithHash(tx, boltHashKey(old))
+		if err != nil {
+			return err
+		}
+		if next == "" {
+			err = hashes.Delete(boltHashKey(old))
+		} else {
+			err = hashes.Put(boltHashKey(old), []byte(next))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if hashes.Get(boltHashKey(stored)) == nil {
+		return hashes.Put(boltHashKey(stored), []byte(id))
+	}
+	return nil
+}
+
+// earliestWithHash returns the earliest submitted receipt with a tenant and
+// content hash, scanning every receipt since the bucket is keyed by ID.
+func (s *boltStore) earliestWithHash(tx *bolt.Tx, key []byte) (string, error) {
+	var earliest string
+	var earliestAt time.Time
+	err := tx.Bucket(boltReceipts).ForEach(func(k, v []byte) error {
+		var stored StoredReceipt
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return err
+		}
+		if bytes.Equal(boltHashKey(stored), key) && (earliest == "" || stored.SubmittedAt.Before(earliestAt)) {
+			earliest, earliestAt = string(k), stored.SubmittedAt
+		}
+		return nil
+	})
+	return earliest, err
+}
+
+func (s *boltStore) Put(ctx context.Context, id string, stored StoredReceipt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return s.put(tx, id, stored)
+	})
+}
+
+func (s *boltStore) Get(ctx context.Context, id string) (StoredReceipt, error) {
+	var stored StoredReceipt
+	if err := ctx.Err(); err != nil {
+		return stored, err
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltReceipts).Get([]byte(id))
+		if data == nil {
+			return errReceiptNotFound
+		}
+		return json.Unmarshal(data, &stored)
+	})
+	return stored, err
+}
+
+func (s *boltStore) Update(ctx context.Context, id string, fn func(*StoredReceipt) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		data := tx.Bucket(boltReceipts).Get([]byte(id))
+		if data == nil {
+			return errReceiptNotFound
+		}
+		var stored StoredReceipt
+		if err := json.Unmarshal(data, &stored); err != nil {
+			return err
+		}
+		if err := fn(&stored); err != nil {
+			return err
+		}
+		return s.put(tx, id, stored)
+	})
+}
+
+// boltEntry is a receipt read by Range.
+type boltEntry struct {
+	id   string
+	data []byte
+}
+
+func (s *boltStore) Range(ctx context.Context, fn func(id string, stored StoredReceipt) bool) error {
+	var after []byte
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var page []boltEntry
+		err := s.db.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(boltReceipts).Cursor()
+			k, v := c.First()
+			if after != nil {
+				if k, v = c.Seek(after); k != nil && bytes.Equal(k, after) {
+					k, v = c.Next()
+				}
+			}
+			for ; k != nil && len(page) < boltRangePage; k, v = c.Next() {
+				// Keys and values are only valid during the transaction.
+				page = append(page, boltEntry{id: string(k), data: append([]byte(nil), v...)})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, entry := range page {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			var stored StoredReceipt
+			if err := json.Unmarshal(entry.data, &stored); err != nil {
+				return fmt.Errorf("receipt %s: %w", entry.id, err)
+			}
+			if !fn(entry.id, stored) {
+				return nil
+			}
+		}
+		if len(page) < boltRangePage {
+			return nil
+		}
+		after = []byte(page[len(page)-1].id)
+	}
+}
+
+func (s *boltStore) Len(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	var n int
+	err := s.db.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(boltReceipts).Stats().KeyN
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltStore) FindByContentHash(ctx context.Context, tenant, hash string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	var id string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		id = string(tx.Bucket(boltHashes).Get([]byte(tenant + "\x00" + hash)))
+		return nil
+	})
+	return id, err
+}
+
+// Close closes the database, releasing its file lock.
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+)
+
+// ExplainedRule is one line of a points breakdown: a rule that fired, the
+// points it contributed and what it awards for.
+type ExplainedRule struct {
+	Rule        string `json:"rule"`
+	Points      int    `json:"points"`
+	Description string `json:"description"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+// PointsBreakdownResponse itemizes a receipt's points under the rules version
+// it is pinned to. The rules' points always add up to Points.
+type PointsBreakdownResponse struct {
+	ReceiptID    string          `json:"id"`
+	Points       int             `json:"points"`
+	RulesVersion string          `json:"rulesVersion,omitempty"`
+	Rules        []ExplainedRule `json:"rules"`
+}
+
+// describe explains what a rule awards under the configuration.
+func (c RulesConfig) describe(rule string) string {
+	switch rule {
+	case "retailerName":
+		return c.engine().DescribeRetailerScoring()
+	case "roundDollarTotal":
+		return fmt.Sprintf("%d points when the total has no cents", c.RoundDollarPoints)
+	case "quarterMultipleTotal":
+		return fmt.Sprintf("%d points when the total is a multiple of 0.25", c.QuarterMultiplePoints)
+	case "totalBracket":
+		return "bonus points for the highest total bracket reached"
+	case "geoFence":
+		return "bonus points for purchases at stores inside a geo-fence"
+	case "itemPairs":
+		return fmt.Sprintf("%d points for every two items", c.ItemPairPoints)
+	case "itemDescriptionLength":
+		return fmt.Sprintf("%g times the price, rounded %s, for each item whose trimmed description length is a multiple of %d", c.DescriptionPriceMultiplier, c.engine().Rounding(), c.DescriptionLengthMultiple)
+	case "oddPurchaseDay":
+		return fmt.Sprintf("%d points when the purchase day is odd", c.OddDayPoints)
+	case "afternoonPurchase":
+		return fmt.Sprintf("%d points for purchases from %d:00 to %d:00", c.AfternoonPoints, c.AfternoonStartHour, c.AfternoonEndHour)
+	case "pointsCap":
+		return fmt.Sprintf("receipts earn at most %d points", c.MaxPoints)
+	case "submissionDeadline":
+		return fmt.Sprintf("receipts submitted more than %d days after purchase earn nothing", c.SubmissionDeadlineDays)
+	case "retailerVerification":
+		return "receipts the retailer has not verified earn nothing"
+	case "review":
+		return "receipts denied on review earn nothing"
+	case "finalized":
+		return "points were fixed when the receipt was finalized"
+	case "pinned":
+		return "points were fixed by the rules in effect when the receipt was submitted"
+	case "refunds":
+		return "points attributed to returned items are deducted"
+	}
+	if name := strings.TrimPrefix(rule, expressionRulePrefix); name != rule {
+		for _, e := range c.ExpressionRules {
+			if e.Name == name && e.Description != "" {
+				return e.Description
+			} else if e.Name == name {
+				return fmt.Sprintf("%d points when %s", e.Points, e.When)
+			}
+		}
+	}
+	if name := strings.TrimPrefix(rule, pluginRulePrefix); name != rule {
+		return fmt.Sprintf("points awarded by the %s scoring plugin", name)
+	}
+	if name := strings.TrimPrefix(rule, campaignRulePrefix); name != rule {
+		return describeCampaign(name)
+	}
+	if name := strings.TrimPrefix(rule, scoring.MultiplierRulePrefix); name != rule {
+		for _, m := range c.Multipliers {
+			if m.Name == name {
+				return fmt.Sprintf("%g times the points of the rules before it", m.Factor)
+			}
+		}
+	}
+	return ""
+}
+
+// explain describes each line of a breakdown.
+func (c RulesConfig) explain(breakdown []RuleResult) []ExplainedRule {
+	explained := make([]ExplainedRule, len(breakdown))
+	for i, result := range breakdown {
+		explained[i] = ExplainedRule{Rule: result.Rule, Points: result.Points, Description: c.describe(result.Rule), Reason: result.Reason}
+	}
+	return explained
+}
+
+// getPointsBreakdown explains a receipt's points rule by rule. Finalized
+// receipts keep the points they had when finalized, and refunds are
+// deducted, each as a line of its own.
+func getPointsBreakdown(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	receiptID := receiptIDFromPath(r)
+	stored, err := ownedReceipt(r, receiptID)
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+
+	rules, pinned := storedRules(stored)
+	breakdown := rules.storedBreakdown(stored)
+	if total := sumBreakdown(breakdown); total != stored.Points {
+		// Only receipts whose rule set has been lost, or that were scored
+		// before rule sets were versioned, score differently now.
+		reason := "the rules have changed since"
+		if stored.RulesVersion != "" && !pinned {
+			reason = "rules version " + stored.RulesVersion + " is no longer available"
+		}
+		rule := "pinned"
+		if stored.FinalizedAt != nil {
+			rule = "finalized"
+		}
+		breakdown = append(breakdown, RuleResult{Rule: rule, Points: stored.Points - total, Reason: reason})
+	}
+	if stored.RefundedPoints != 0 {
+		breakdown = append(breakdown, RuleResult{Rule: "refunds", Points: -stored.RefundedPoints, Reason: "items " + strings.Trim(fmt.Sprint(stored.RefundedItems), "[]") + " returned"})
+	}
+
+	response := PointsBreakdownResponse{ReceiptID: receiptID, Points: netPoints(stored), RulesVersion: stored.RulesVersion, Rules: rules.explain(breakdown)}
+	setCacheHeaders(w, stored)
+	writeJSON(w, r, response)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// cacheKeyPrefix namespaces cached receipts in Redis.
+const cacheKeyPrefix = "receipt:"
+
+// cachedStore serves receipt lookups from Redis, falling back to the
+// backend on a miss. Writes go to the backend and then drop the cached
+// copy, so other instances sharing the cache see them on their next read.
+// Redis failures are logged and the backend is used directly.
+type cachedStore struct {
+	ReceiptStore
+	client *redis.Client
+	ttl    time.Duration
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+// readCache is the Redis cache in front of the storage backend, or nil when
+// REDIS_URL is unset.
+var readCache *cachedStore
+
+// loadCacheConfig reads REDIS_URL ("redis://host:6379/0") and
+// REDIS_CACHE_TTL_SECONDS (default 300) and, when set, puts a Redis cache
+// in front of the storage backend.
+func loadCacheConfig() error {
+	value := os.Getenv("REDIS_URL")
+	if value == "" {
+		return nil
+	}
+	options, err := redis.ParseURL(value)
+	if err != nil {
+		return fmt.Errorf("REDIS_URL: %w", err)
+	}
+	ttl := 5 * time.Minute
+	if value := os.Getenv("REDIS_CACHE_TTL_SECONDS"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("REDIS_CACHE_TTL_SECONDS: invalid value %q", value)
+		}
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		log.Printf("cache: redis unavailable, reading from storage until it recovers: %v", err)
+	}
+	readCache = &cachedStore{ReceiptStore: receiptStore, client: client, ttl: ttl}
+	receiptStore = readCache
+	return nil
+}
+
+func (s *cachedStore) Get(ctx context.Context, id string) (StoredReceipt, error) {
+	var stored StoredReceipt
+	data, err := s.client.Get(ctx, cacheKeyPrefix+id).Bytes()
+	if err == nil {
+		if err := json.Unmarshal(data, &stored); err == nil {
+			s.hits.Add(1)
+			return stored, nil
+		}
+	} else if !errors.Is(err, redis.Nil) && ctx.Err() == nil {
+		log.Printf("cache: get %s: %v", id, err)
+	}
+
+	s.misses.Add(1)
+	stored, err = s.ReceiptStore.Get(ctx, id)
+	if err != nil {
+		return stored, err
+	}
+	if data, err := json.Marshal(stored); err == nil {
+		if err := s.client.Set(ctx, cacheKeyPrefix+id, data, s.ttl).Err(); err != nil && ctx.Err() == nil {
+			log.Printf("cache: set %s: %v", id, err)
+		}
+	}
+	return stored, nil
+}
+
+func (s *cachedStore) Put(ctx context.Context, id string, stored StoredReceipt) error {
+	if err := s.ReceiptStore.Put(ctx, id, stored); err != nil {
+		return err
+	}
+	s.invalidate(id)
+	return nil
+}
+
+func (s *cachedStore) Update(ctx context.Context, id string, fn func(*StoredReceipt) error) error {
+	if err := s.ReceiptStore.Update(ctx, id, fn); err != nil {
+		return err
+	}
+	s.invalidate(id)
+	return nil
+}
+
+// Close closes the backend and the Redis client.
+func (s *cachedStore) Close() error {
+	return errors.Join(s.ReceiptStore.Close(), s.client.Close())
+}
+
+// invalidate drops a receipt's cached copy. It runs even if the request has
+// been canceled, since the backend has already been written.
+func (s *cachedStore) invalidate(id string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.client.Del(ctx, cacheKeyPrefix+id).Err(); err != nil {
+		log.Printf("cache: invalidate %s: %v", id, err)
+	}
+}
+
+// invalidateAll drops every cached receipt, for all instances sharing the
+// cache, and returns how many it dropped.
+func (s *cachedStore) invalidateAll(ctx context.Context) (int, error) {
+	dropped := 0
+	iter := s.client.Scan(ctx, 0, cacheKeyPrefix+"*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		if keys = append(keys, iter.Val()); len(keys) == 1000 {
+			n, err := s.client.Del(ctx, keys...).Result()
+			if err != nil {
+				return dropped, err
+			}
+			dropped += int(n)
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return dropped, err
+	}
+	if len(keys) > 0 {
+		n, err := s.client.Del(ctx, keys...).Result()
+		dropped += int(n)
+		return dropped, err
+	}
+	return dropped, nil
+}
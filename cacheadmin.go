@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Cache names used by the cache admin endpoints.
+const (
+	cachePoints      = "points"
+	cacheReceipts    = "receipts"
+	cacheRead        = "read"
+	cacheIdempotency = "idempotency"
+)
+
+// CacheStats reports a cache's size and how often it was hit since startup.
+// Entries is omitted for the Redis read cache, which is shared with other
+// instances; InFlight counts idempotency keys whose first request is still
+// running.
+type CacheStats struct {
+	Name     string  `json:"name"`
+	Entries  *int    `json:"entries,omitempty"`
+	InFlight int     `json:"inFlight,omitempty"`
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRate  float64 `json:"hitRate"`
+}
+
+// newCacheStats fills in a cache's hit rate.
+func newCacheStats(name string, entries *int, hits, misses int64) CacheStats {
+	stats := CacheStats{Name: name, Entries: entries, Hits: hits, Misses: misses}
+	if lookups := hits + misses; lookups > 0 {
+		stats.HitRate = math.Round(float64(hits)/float64(lookups)*1000) / 1000
+	}
+	return stats
+}
+
+// CacheInvalidation reports how many entries an invalidation dropped.
+type CacheInvalidation struct {
+	Name    string `json:"name"`
+	Dropped int    `json:"dropped"`
+}
+
+// cacheStats lists every cache of this instance.
+func cacheStats() []CacheStats {
+	stats := []CacheStats{
+		pointsBodies.stats(cachePoints),
+		finalizedReceiptBodies.stats(cacheReceipts),
+	}
+	if readCache != nil {
+		stats = append(stats, newCacheStats(cacheRead, nil, readCache.hits.Load(), readCache.misses.Load()))
+	}
+	return append(stats, idempotency.stats(cacheIdempotency))
+}
+
+// listCaches returns the statistics of every cache.
+func listCaches(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, cacheStats())
+}
+
+// cacheRoutes returns (GET) or invalidates (DELETE) the cache
+// /admin/caches/{name}. ?id= limits invalidating the receipts and read
+// caches to one receipt, and ?key= (with ?tenant=) the idempotency cache to
+// one key; the points cache can only be cleared as a whole.
+func cacheRoutes(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/caches/"), "/")
+	if name != cachePoints && name != cacheReceipts && name != cacheIdempotency && (name != cacheRead || readCache == nil) {
+		http.Error(w, "Cache not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		for _, stats := range cacheStats() {
+			if stats.Name == name {
+				writeJSON(w, r, stats)
+				return
+			}
+		}
+	case http.MethodDelete:
+		invalidateCache(w, r, name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// invalidateCache drops the entries of the named cache that the request
+// selects.
+func invalidateCache(w http.ResponseWriter, r *http.Request, name string) {
+	query := r.URL.Query()
+	id := query.Get("id")
+	result := CacheInvalidation{Name: name}
+	switch name {
+	case cachePoints:
+		if id != "" {
+			http.Error(w, "The points cache is keyed by value and can only be cleared as a whole", http.StatusBadRequest)
+			return
+		}
+		result.Dropped = pointsBodies.invalidate(nil)
+	case cacheReceipts:
+		var match func(finalizedReceiptKey) bool
+		if id != "" {
+			match = func(key finalizedReceiptKey) bool { return key.id == id }
+		}
+		result.Dropped = finalizedReceiptBodies.invalidate(match)
+	case cacheRead:
+		var dropped int
+		var err error
+		if id != "" {
+			var n int64
+			n, err = readCache.client.Del(r.Context(), cacheKeyPrefix+id).Result()
+			dropped = int(n)
+		} else {
+			dropped, err = readCache.invalidateAll(r.Context())
+		}
+		if err != nil {
+			if !writeContextError(w, err) {
+				http.Error(w, "Failed to clear the read cache: "+err.Error(), http.StatusBadGateway)
+			}
+			return
+		}
+		result.Dropped = dropped
+	case cacheIdempotency:
+		key := query.Get("key")
+		if key != "" {
+			tenant := query.Get("tenant")
+			if tenant == "" {
+				tenant = defaultTenant
+			}
+			key = tenant + "\x00" + key
+		}
+		result.Dropped = idempotency.invalidate(key)
+	}
+	writeJSON(w, r, result)
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+)
+
+// Campaign is a time-bounded promotion, such as double points on weekends
+// in March or 100 bonus points for one retailer's receipts. It applies to
+// every receipt submitted from StartsAt until EndsAt that matches its
+// optional retailer and purchase days, on top of the receipt's rules:
+// BonusPoints are added with the base rules and Multiplier scales the
+// points of the rules before it, after the configured multipliers and
+// before the cap.
+type Campaign struct {
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	StartsAt    time.Time `json:"startsAt"`
+	EndsAt      time.Time `json:"endsAt"`
+	Retailer    string    `json:"retailer,omitempty"`
+	// Days limits the campaign to purchases on these days of the week, in
+	// the zone the purchase was recorded in, e.g. ["saturday", "sunday"].
+	Days        []string  `json:"days,omitempty"`
+	BonusPoints int       `json:"bonusPoints,omitempty"`
+	Multiplier  float64   `json:"multiplier,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// CampaignResponse is a campaign with its status: scheduled, active or
+// ended.
+type CampaignResponse struct {
+	Campaign
+	Status string `json:"status"`
+}
+
+// campaignRulePrefix prefixes campaigns' rule names.
+const campaignRulePrefix = "campaign:"
+
+// campaignsKey is the blob key campaigns are saved under, so that receipts
+// are rescored with the same campaigns after a restart.
+const campaignsKey = "campaigns.json"
+
+// campaignName is the form of campaign names.
+var campaignName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// weekdays maps day names to days of the week.
+var weekdays = map[string]time.Weekday{
+	"sunday": time.Sunday, "monday": time.Monday, "tuesday": time.Tuesday, "wednesday": time.Wednesday,
+	"thursday": time.Thursday, "friday": time.Friday, "saturday": time.Saturday,
+}
+
+var (
+	campaignsMutex sync.RWMutex
+	// campaigns holds every campaign, scheduled, active or ended, by name.
+	// Ended campaigns are kept, since receipts submitted while they ran are
+	// rescored with them.
+	campaigns = make(map[string]Campaign)
+)
+
+// loadCampaigns restores the campaigns saved in the blob store. It runs
+// after the blob store is configured.
+func loadCampaigns() error {
+	data, err := blobStore.Get(campaignsKey)
+	if errors.Is(err, errBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("campaigns: %w", err)
+	}
+	var saved []Campaign
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("campaigns: %w", err)
+	}
+	for _, campaign := range saved {
+		campaigns[campaign.Name] = campaign
+	}
+	return nil
+}
+
+// saveCampaigns writes every campaign to the blob store. The caller holds
+// campaignsMutex.
+func saveCampaigns() error {
+	saved := make([]Campaign, 0, len(campaigns))
+	for _, campaign := range campaigns {
+		saved = append(saved, campaign)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Name < saved[j].Name })
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return blobStore.Put(campaignsKey, data)
+}
+
+// validate reports every problem with a new campaign.
+func (c Campaign) validate(now time.Time) []string {
+	var problems []string
+	if !campaignName.MatchString(c.Name) {
+		problems = append(problems, "name must be 1-64 letters, digits, '-' or '_'")
+	}
+	if c.StartsAt.Before(now) {
+		problems = append(problems, "startsAt must not be in the past")
+	}
+	if !c.EndsAt.After(c.StartsAt) {
+		problems = append(problems, "endsAt must be after startsAt")
+	}
+	for _, day := range c.Days {
+		if _, ok := weekdays[strings.ToLower(day)]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown day %q", day))
+		}
+	}
+	switch {
+	case c.BonusPoints < 0:
+		problems = append(problems, "bonusPoints must not be negative")
+	case c.Multiplier < 0 || math.IsNaN(c.Multiplier) || math.IsInf(c.Multiplier, 0):
+		problems = append(problems, "multiplier must be a positive number")
+	case (c.BonusPoints == 0) == (c.Multiplier == 0):
+		problems = append(problems, "exactly one of bonusPoints and multiplier is required")
+	}
+	return problems
+}
+
+// status describes where now falls in the campaign's window.
+func (c Campaign) status(now time.Time) string {
+	switch {
+	case now.Before(c.StartsAt):
+		return "scheduled"
+	case now.Before(c.EndsAt):
+		return "active"
+	}
+	return "ended"
+}
+
+// applies reports whether the campaign covers a receipt submitted at
+// submittedAt.
+func (c Campaign) applies(receipt Receipt, submittedAt time.Time) bool {
+	if c.status(submittedAt) != "active" {
+		return false
+	}
+	if c.Retailer != "" && !strings.EqualFold(c.Retailer, receipt.StoreName) {
+		return false
+	}
+	if len(c.Days) == 0 {
+		return true
+	}
+	purchasedAt, err := localPurchaseTime(receipt)
+	if err != nil {
+		return false
+	}
+	for _, day := range c.Days {
+		if weekdays[strings.ToLower(day)] == purchasedAt.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// campaignRules returns scoring rules for the campaigns covering a receipt
+// submitted at submittedAt, in order of their start.
+func campaignRules(receipt Receipt, submittedAt time.Time) []scoring.Rule {
+	campaignsMutex.RLock()
+	var covering []Campaign
+	for _, campaign := range campaigns {
+		if campaign.applies(receipt, submittedAt) {
+			covering = append(covering, campaign)
+		}
+	}
+	campaignsMutex.RUnlock()
+	sort.Slice(covering, func(i, j int) bool {
+		if !covering[i].StartsAt.Equal(covering[j].StartsAt) {
+			return covering[i].StartsAt.Before(covering[j].StartsAt)
+		}
+		return covering[i].Name < covering[j].Name
+	})
+
+	rules := make([]scoring.Rule, 0, len(covering))
+	for _, campaign := range covering {
+		campaign := campaign
+		if campaign.Multiplier != 0 {
+			rules = append(rules, scoring.Rule{
+				Name:  campaignRulePrefix + campaign.Name,
+				Phase: scoring.Multiplier,
+				Score: func(total int) (int, string) {
+					return int(math.Round(float64(total) * (campaign.Multiplier - 1))), ""
+				},
+			})
+			continue
+		}
+		rules = append(rules, scoring.Rule{
+			Name:  campaignRulePrefix + campaign.Name,
+			Phase: scoring.Base,
+			Score: func(int) (int, string) {
+				return campaign.BonusPoints, ""
+			},
+		})
+	}
+	return rules
+}
+
+// describeCampaign explains a campaign's line in points breakdowns.
+func describeCampaign(name string) string {
+	campaignsMutex.RLock()
+	campaign, ok := campaigns[name]
+	campaignsMutex.RUnlock()
+	switch {
+	case !ok:
+		return ""
+	case campaign.Description != "":
+		return campaign.Description
+	case campaign.Multiplier != 0:
+		return fmt.Sprintf("%g times the points of the rules before it during the %s campaign", campaign.Multiplier, name)
+	}
+	return fmt.Sprintf("%d bonus points during the %s campaign", campaign.BonusPoints, name)
+}
+
+// campaignsHandler lists campaigns (GET) or creates one (POST). A campaign
+// without a start time starts immediately.
+func campaignsHandler(w http.ResponseWriter, r *http.Request) {
+	now := clockFrom(r.Context()).Now()
+	switch r.Method {
+	case http.MethodGet:
+		campaignsMutex.RLock()
+		list := make([]CampaignResponse, 0, len(campaigns))
+		for _, campaign := range campaigns {
+			list = append(list, CampaignResponse{Campaign: campaign, Status: campaign.status(now)})
+		}
+		campaignsMutex.RUnlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].StartsAt.Before(list[j].StartsAt) })
+		writeJSON(w, r, list)
+	case http.MethodPost:
+		var campaign Campaign
+		if err := json.NewDecoder(r.Body).Decode(&campaign); err != nil {
+			http.Error(w, "Invalid campaign", http.StatusBadRequest)
+			return
+		}
+		if campaign.StartsAt.IsZero() {
+			campaign.StartsAt = now
+		}
+		campaign.CreatedAt = now
+		if problems := campaign.validate(now); len(problems) > 0 {
+			http.Error(w, "Invalid campaign: "+strings.Join(problems, "; "), http.StatusBadRequest)
+			return
+		}
+
+		campaignsMutex.Lock()
+		defer campaignsMutex.Unlock()
+		if _, ok := campaigns[campaign.Name]; ok {
+			http.Error(w, "A campaign with this name already exists", http.StatusConflict)
+			return
+		}
+		campaigns[campaign.Name] = campaign
+		if err := saveCampaigns(); err != nil {
+			delete(campaigns, campaign.Name)
+			log.Printf("campaigns: saving: %v", err)
+			http.Error(w, "Failed to save campaign", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("campaign %s scheduled from %s to %s", campaign.Name, campaign.StartsAt.Format(time.RFC3339), campaign.EndsAt.Format(time.RFC3339))
+		writeJSONStatus(w, r, http.StatusCreated, CampaignResponse{Campaign: campaign, Status: campaign.status(now)})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// campaignRoutes returns (GET) or withdraws (DELETE) a campaign. A
+// scheduled campaign is removed; an active one ends now, so that the
+// receipts it already covered keep its points when rescored.
+func campaignRoutes(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/campaigns/"), "/")
+	now := clockFrom(r.Context()).Now()
+
+	campaignsMutex.Lock()
+	defer campaignsMutex.Unlock()
+	campaign, ok := campaigns[name]
+	if !ok {
+		http.Error(w, "Campaign not found", http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		previous := campaign
+		switch campaign.status(now) {
+		case "ended":
+			http.Error(w, "Campaign has already ended", http.StatusConflict)
+			return
+		case "scheduled":
+			delete(campaigns, name)
+		default:
+			campaign.EndsAt = now
+			campaigns[name] = campaign
+		}
+		if err := saveCampaigns(); err != nil {
+			campaigns[name] = previous
+			log.Printf("campaigns: saving: %v", err)
+			http.Error(w, "Failed to save campaigns", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("campaign %s withdrawn", name)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, CampaignResponse{Campaign: campaign, Status: campaign.status(now)})
+}
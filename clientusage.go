@@ -0,0 +1,176 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTrackedClients bounds the clients whose usage is kept. When a new
+// client arrives at the limit, the one seen least recently is dropped.
+const maxTrackedClients = 1000
+
+// usageMinutes is how many one-minute request buckets are kept per client.
+const usageMinutes = 60
+
+// clientUsage accumulates one client's traffic since it was first seen.
+type clientUsage struct {
+	firstSeen time.Time
+	lastSeen  time.Time
+	totals    EndpointStats
+	endpoints map[string]*EndpointStats
+	latency   latencyRing
+	minutes   [usageMinutes]UsageMinute
+}
+
+// UsageMinute counts a client's requests in one minute.
+type UsageMinute struct {
+	Minute   time.Time `json:"minute"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`
+}
+
+// ClientUsage reports one client's traffic. Errors count client and server
+// errors alike; ErrorRate is their share of all requests.
+type ClientUsage struct {
+	Client    string    `json:"client"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	EndpointStats
+	ErrorRate float64                  `json:"errorRate"`
+	Latency   LatencySummary           `json:"latency"`
+	Endpoints map[string]EndpointStats `json:"endpoints,omitempty"`
+	LastHour  []UsageMinute            `json:"lastHour,omitempty"`
+}
+
+var (
+	clientUsageMutex sync.Mutex
+	clientUsages     = make(map[string]*clientUsage)
+)
+
+// recordClientUsage adds one completed request to its client's usage.
+func recordClientUsage(client, route string, status int, duration time.Duration, at time.Time) {
+	clientUsageMutex.Lock()
+	defer clientUsageMutex.Unlock()
+
+	usage, ok := clientUsages[client]
+	if !ok {
+		if len(clientUsages) >= maxTrackedClients {
+			evictIdleClient()
+		}
+		usage = &clientUsage{firstSeen: at, endpoints: make(map[string]*EndpointStats)}
+		clientUsages[client] = usage
+	}
+	usage.lastSeen = at
+	usage.totals.countStatus(status)
+	stats, ok := usage.endpoints[route]
+	if !ok {
+		stats = &EndpointStats{}
+		usage.endpoints[route] = stats
+	}
+	stats.countStatus(status)
+
+	usage.latency.add(latencySample{at: at, duration: duration})
+
+	minute := at.UTC().Truncate(time.Minute)
+	bucket := &usage.minutes[minute.Unix()/60%usageMinutes]
+	if !bucket.Minute.Equal(minute) {
+		*bucket = UsageMinute{Minute: minute}
+	}
+	bucket.Requests++
+	if status >= 400 {
+		bucket.Errors++
+	}
+}
+
+// evictIdleClient drops the client seen least recently. The caller holds
+// clientUsageMutex.
+func evictIdleClient() {
+	idle := ""
+	var idleSince time.Time
+	for client, usage := range clientUsages {
+		if idle == "" || usage.lastSeen.Before(idleSince) {
+			idle, idleSince = client, usage.lastSeen
+		}
+	}
+	delete(clientUsages, idle)
+}
+
+// report summarizes the usage, with per-endpoint counts and the last hour's
+// minutes when detailed.
+func (usage *clientUsage) report(client string, detailed bool, now time.Time) ClientUsage {
+	report := ClientUsage{
+		Client:        client,
+		FirstSeen:     usage.firstSeen,
+		LastSeen:      usage.lastSeen,
+		EndpointStats: usage.totals,
+		Latency:       usage.latency.summarize(now),
+	}
+	if usage.totals.Requests > 0 {
+		report.ErrorRate = float64(usage.totals.ClientErrors+usage.totals.ServerErrors) / float64(usage.totals.Requests)
+	}
+	if !detailed {
+		return report
+	}
+	report.Endpoints = make(map[string]EndpointStats, len(usage.endpoints))
+	for route, stats := range usage.endpoints {
+		report.Endpoints[route] = *stats
+	}
+	since := now.UTC().Truncate(time.Minute).Add(-(usageMinutes - 1) * time.Minute)
+	for _, bucket := range usage.minutes {
+		if !bucket.Minute.Before(since) {
+			report.LastHour = append(report.LastHour, bucket)
+		}
+	}
+	sort.Slice(report.LastHour, func(i, j int) bool { return report.LastHour[i].Minute.Before(report.LastHour[j].Minute) })
+	return report
+}
+
+// getClientUsages lists every tracked client's usage, busiest first.
+func getClientUsages(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	now := time.Now()
+	clientUsageMutex.Lock()
+	reports := make([]ClientUsage, 0, len(clientUsages))
+	for client, usage := range clientUsages {
+		reports = append(reports, usage.report(client, false, now))
+	}
+	clientUsageMutex.Unlock()
+	sort.Slice(reports, func(i, j int) bool {
+		if reports[i].Requests != reports[j].Requests {
+			return reports[i].Requests > reports[j].Requests
+		}
+		return reports[i].Client < reports[j].Client
+	})
+	writeJSON(w, r, reports)
+}
+
+// getClientUsage reports one client's usage: totals, error rate and latency
+// percentiles, counts per endpoint and requests per minute over the last
+// hour.
+func getClientUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	client := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/clients/"), "/usage")
+	clientUsageMutex.Lock()
+	usage, ok := clientUsages[client]
+	var report ClientUsage
+	if ok {
+		report = usage.report(client, true, time.Now())
+	}
+	clientUsageMutex.Unlock()
+	if !ok || !strings.HasSuffix(r.URL.Path, "/usage") {
+		http.Error(w, "No usage recorded for client", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, r, report)
+}
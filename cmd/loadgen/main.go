@@ -0,0 +1,205 @@
+// Command loadgen submits randomized receipts to a running receipt processor
+// at a fixed rate and reports latency and error statistics.
+//
+//	go run ./cmd/loadgen -target http://localhost:8080 -rate 200 -duration 1m
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type item struct {
+	Description string `json:"shortDescription"`
+	Price       string `json:"price"`
+}
+
+type receipt struct {
+	StoreName      string `json:"retailer"`
+	DateOfPurchase string `json:"purchaseDate"`
+	TimeOfPurchase string `json:"purchaseTime"`
+	TotalAmount    string `json:"total"`
+	PurchasedItems []item `json:"items"`
+}
+
+var retailers = []string{"Target", "Walgreens", "M&M Corner Market", "Costco", "Whole Foods", "Trader Joe's", "CVS", "Kroger"}
+
+var products = []string{
+	"Mountain Dew 12PK", "Emils Cheese Pizza", "Knorr Creamy Chicken", "Doritos Nacho Cheese",
+	"Klarbrunn 12-PK 12 FL OZ", "Gatorade", "Pepsi - 12-oz", "Dasani", "Organic Bananas",
+	"Whole Milk 1 Gal", "Sourdough Bread", "Greek Yogurt", "Paper Towels 6PK", "Coffee Beans 1LB",
+}
+
+// randomReceipt builds a plausible receipt whose total matches its items.
+func randomReceipt(rng *rand.Rand) receipt {
+	r := receipt{
+		StoreName:      retailers[rng.Intn(len(retailers))],
+		DateOfPurchase: time.Now().AddDate(0, 0, -rng.Intn(30)).Format("2006-01-02"),
+		TimeOfPurchase: fmt.Sprintf("%02d:%02d", rng.Intn(24), rng.Intn(60)),
+	}
+	cents := 0
+	for i := 0; i < 1+rng.Intn(8); i++ {
+		price := 50 + rng.Intn(2500)
+		if rng.Intn(4) == 0 {
+			price -= price % 25
+		}
+		cents += price
+		r.PurchasedItems = append(r.PurchasedItems, item{
+			Description: products[rng.Intn(len(products))],
+			Price:       fmt.Sprintf("%d.%02d", price/100, price%100),
+		})
+	}
+	r.TotalAmount = fmt.Sprintf("%d.%02d", cents/100, cents%100)
+	return r
+}
+
+// stats collects per-operation latencies and failures.
+type stats struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	statuses  map[int]int
+}
+
+func (s *stats) record(op string, latency time.Duration, status int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latencies[op] = append(s.latencies[op], latency)
+	if err != nil {
+		s.errors[op]++
+		return
+	}
+	s.statuses[status]++
+	if status >= 400 {
+		s.errors[op]++
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func (s *stats) report(elapsed time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fmt.Printf("elapsed %s\n", elapsed.Round(time.Millisecond))
+	for _, op := range []string{"process", "points"} {
+		latencies := s.latencies[op]
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		fmt.Printf("%-8s requests=%d errors=%d rate=%.1f/s p50=%s p95=%s p99=%s max=%s\n",
+			op, len(latencies), s.errors[op], float64(len(latencies))/elapsed.Seconds(),
+			percentile(latencies, 0.50), percentile(latencies, 0.95), percentile(latencies, 0.99),
+			percentile(latencies, 1))
+	}
+	codes := make([]int, 0, len(s.statuses))
+	for code := range s.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Printf("status %d: %d\n", code, s.statuses[code])
+	}
+}
+
+// submit posts one receipt and, on success, fetches its points.
+func submit(client *http.Client, target string, r receipt, s *stats) {
+	body, _ := json.Marshal(r)
+	started := time.Now()
+	resp, err := client.Post(target+"/receipts/process", "application/json", bytes.NewReader(body))
+	if err != nil {
+		s.record("process", time.Since(started), 0, err)
+		return
+	}
+	var created struct {
+		ID string `json:"id"`
+	}
+	decodeErr := json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	s.record("process", time.Since(started), resp.StatusCode, nil)
+	if resp.StatusCode != http.StatusOK || decodeErr != nil {
+		return
+	}
+
+	started = time.Now()
+	resp, err = client.Get(target + "/receipts/" + created.ID + "/points")
+	if err != nil {
+		s.record("points", time.Since(started), 0, err)
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	s.record("points", time.Since(started), resp.StatusCode, nil)
+}
+
+func main() {
+	target := flag.String("target", "http://localhost:8080", "base URL of the receipt processor")
+	rate := flag.Float64("rate", 50, "receipts submitted per second")
+	duration := flag.Duration("duration", 30*time.Second, "how long to generate load")
+	concurrency := flag.Int("concurrency", 64, "maximum in-flight submissions")
+	seed := flag.Int64("seed", time.Now().UnixNano(), "random seed for receipt generation")
+	timeout := flag.Duration("timeout", 10*time.Second, "per-request timeout")
+	flag.Parse()
+
+	if *rate <= 0 || *concurrency <= 0 {
+		fmt.Fprintln(os.Stderr, "rate and concurrency must be positive")
+		os.Exit(2)
+	}
+
+	client := &http.Client{Timeout: *timeout}
+	rng := rand.New(rand.NewSource(*seed))
+	s := &stats{latencies: make(map[string][]time.Duration), errors: make(map[string]int), statuses: make(map[int]int)}
+	slots := make(chan struct{}, *concurrency)
+	var wg sync.WaitGroup
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+	deadline := time.After(*duration)
+	started := time.Now()
+	dropped := 0
+
+loop:
+	for {
+		select {
+		case <-deadline:
+			break loop
+		case <-ticker.C:
+			select {
+			case slots <- struct{}{}:
+			default:
+				dropped++
+				continue
+			}
+			r := randomReceipt(rng)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+				submit(client, *target, r, s)
+			}()
+		}
+	}
+	wg.Wait()
+
+	s.report(time.Since(started))
+	if dropped > 0 {
+		fmt.Printf("skipped %d ticks with all %d workers busy\n", dropped, *concurrency)
+	}
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxImportBytes bounds the export file accepted by one import.
+const maxImportBytes = 32 << 20
+
+// ImportResult reports the outcome of one receipt found in an export, by its
+// position in the file. Source names it: an email's subject or a pass's
+// file name. Entries that are not receipts, such as other mail in a
+// Takeout archive or a boarding pass, are reported as skipped.
+type ImportResult struct {
+	BatchResult
+	Source  string `json:"source,omitempty"`
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// ImportResponse lists every entry's outcome, in file order.
+type ImportResponse struct {
+	Accepted int            `json:"accepted"`
+	Failed   int            `json:"failed"`
+	Skipped  int            `json:"skipped"`
+	Results  []ImportResult `json:"results"`
+}
+
+// importEntry is one receipt read from an export, or the reason an entry
+// could not be read as one.
+type importEntry struct {
+	source   string
+	receipt  Receipt
+	warnings []string
+	skipped  string
+	// channel is the entry's submission source, email or wallet.
+	channel string
+}
+
+// importReceipts backfills receipts from consumer export formats: a Gmail
+// mbox archive of order confirmations, as exported by Google Takeout, or
+// Apple Wallet passes, either one .pkpass or a zip of them. The format is
+// recognized from the body. Entries are submitted like a batch, each
+// independently.
+func importReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub, ok := submissionFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid tenant or user ID", http.StatusBadRequest)
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		http.Error(w, "Export must be at most 32 MiB", http.StatusRequestEntityTooLarge)
+		return
+	}
+	entries, err := readExport(data)
+	if err != nil {
+		http.Error(w, "Unreadable export: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(entries) == 0 {
+		http.Error(w, "Export contains no messages or passes", http.StatusBadRequest)
+		return
+	}
+
+	sub.Bulk = true
+	mode := validationMode(sub.Tenant)
+	response := ImportResponse{Results: make([]ImportResult, 0, len(entries))}
+	for i, entry := range entries {
+		result := ImportResult{BatchResult: BatchResult{Index: i}, Source: entry.source}
+		if entry.skipped != "" {
+			result.Skipped = entry.skipped
+			response.Skipped++
+			response.Results = append(response.Results, result)
+			continue
+		}
+		body, _ := json.Marshal(entry.receipt)
+		sub.Source = entry.channel
+		result.BatchResult = submitBatchEntry(r.Context(), sub, mode, i, body)
+		result.Warnings = append(entry.warnings, result.Warnings...)
+		if result.Error != "" {
+			response.Failed++
+		} else {
+			response.Accepted++
+		}
+		response.Results = append(response.Results, result)
+	}
+	writeJSON(w, r, response)
+}
+
+// readExport recognizes an export's format and reads its entries.
+func readExport(data []byte) ([]importEntry, error) {
+	if bytes.HasPrefix(data, []byte("PK\x03\x04")) {
+		return readZipExport(data)
+	}
+	return readMbox(data)
+}
+
+// readZipExport reads a zip that is either a single Wallet pass or an
+// archive holding passes and mbox files, such as a Takeout download.
+func readZipExport(data []byte) ([]importEntry, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	if file := zipFile(archive, "pass.json"); file != nil {
+		entry, err := readPass(file)
+		if err != nil {
+			return nil, err
+		}
+		return []importEntry{entry}, nil
+	}
+
+	var entries []importEntry
+	for _, file := range archive.File {
+		name := path.Base(file.Name)
+		switch strings.ToLower(path.Ext(name)) {
+		case ".pkpass":
+			entry, err := readNestedPass(file)
+			if err != nil {
+				entry = importEntry{skipped: "unreadable pass: " + err.Error()}
+			}
+			entry.source = name
+			entries = append(entries, entry)
+		case ".mbox":
+			contents, err := readZipFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file.Name, err)
+			}
+			messages, err := readMbox(contents)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", file.Name, err)
+			}
+			entries = append(entries, messages...)
+		}
+	}
+	return entries, nil
+}
+
+// zipFile returns the named file at the root of an archive, or nil.
+func zipFile(archive *zip.Reader, name string) *zip.File {
+	for _, file := range archive.File {
+		if file.Name == name {
+			return file
+		}
+	}
+	return nil
+}
+
+// readZipFile reads a file from an archive, bounded like the export itself.
+func readZipFile(file *zip.File) ([]byte, error) {
+	if file.UncompressedSize64 > maxImportBytes {
+		return nil, errors.New("file exceeds 32 MiB")
+	}
+	reader, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(io.LimitReader(reader, maxImportBytes))
+}
+
+// readNestedPass reads a .pkpass stored inside another archive.
+func readNestedPass(file *zip.File) (importEntry, error) {
+	data, err := readZipFile(file)
+	if err != nil {
+		return importEntry{}, err
+	}
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return importEntry{}, err
+	}
+	pass := zipFile(archive, "pass.json")
+	if pass == nil {
+		return importEntry{}, errors.New("pass.json is missing")
+	}
+	return readPass(pass)
+}
+
+// walletPass is the part of a Wallet pass.json a receipt is read from.
+// Passes carry their fields under one of several styles.
+type walletPass struct {
+	OrganizationName string            `json:"organizationName"`
+	Description      string            `json:"description"`
+	SerialNumber     string            `json:"serialNumber"`
+	RelevantDate     string            `json:"relevantDate"`
+	StoreCard        *walletPassFields `json:"storeCard"`
+	Generic          *walletPassFields `json:"generic"`
+	Coupon           *walletPassFields `json:"coupon"`
+	EventTicket      *walletPassFields `json:"eventTicket"`
+	BoardingPass     *walletPassFields `json:"boardingPass"`
+}
+
+// walletPassFields are the field groups of a pass style.
+type walletPassFields struct {
+	HeaderFields    []walletPassField `json:"headerFields"`
+	PrimaryFields   []walletPassField `json:"primaryFields"`
+	SecondaryFields []walletPassField `json:"secondaryFields"`
+	AuxiliaryFields []walletPassField `json:"auxiliaryFields"`
+	BackFields      []walletPassField `json:"backFields"`
+}
+
+// walletPassField is one labelled value on a pass. Amounts carry a
+// currency code; dates a date style.
+type walletPassField struct {
+	Key          string      `json:"key"`
+	Label        string      `json:"label"`
+	Value        interface{} `json:"value"`
+	CurrencyCode string      `json:"currencyCode"`
+	DateStyle    string      `json:"dateStyle"`
+}
+
+// fields returns every field of the pass, whatever its style.
+func (p walletPass) fields() []walletPassField {
+	var fields []walletPassField
+	for _, style := range []*walletPassFields{p.StoreCard, p.Generic, p.Coupon, p.EventTicket, p.BoardingPass} {
+		if style == nil {
+			continue
+		}
+		for _, group := range [][]walletPassField{style.HeaderFields, style.PrimaryFields, style.SecondaryFields, style.AuxiliaryFields, style.BackFields} {
+			fields = append(fields, group...)
+		}
+	}
+	return fields
+}
+
+// walletDateLayouts are the W3C date forms passes use.
+var walletDateLayouts = []string{time.RFC3339, "2006-01-02T15:04Z07:00"}
+
+// totalLabel recognizes the field holding a purchase's total.
+var totalLabel = regexp.MustCompile(`(?i)\b(total|amount)\b`)
+
+// amountPattern finds a decimal amount in a formatted value such as "$12.50".
+var amountPattern = regexp.MustCompile(`\d+(?:\.\d+)?`)
+
+// passAmount reads a field's value as an amount in dollars.
+func passAmount(field walletPassField) (string, bool) {
+	var amount float64
+	switch value := field.Value.(type) {
+	case float64:
+		amount = value
+	case string:
+		match := amountPattern.FindString(strings.ReplaceAll(value, ",", ""))
+		if match == "" {
+			return "", false
+		}
+		amount, _ = strconv.ParseFloat(match, 64)
+	default:
+		return "", false
+	}
+	return strconv.FormatFloat(amount, 'f', 2, 64), true
+}
+
+// readPass maps a Wallet pass onto a receipt. The organization is the
+// retailer and the relevant date the purchase time. Among the amount fields
+// one labelled as the total is the total and the rest are items; a pass
+// with no amounts, such as a boarding pass, is not a receipt.
+func readPass(file *zip.File) (importEntry, error) {
+	data, err := readZipFile(file)
+	if err != nil {
+		return importEntry{}, err
+	}
+	var pass walletPass
+	if err := json.Unmarshal(data, &pass); err != nil {
+		return importEntry{}, fmt.Errorf("pass.json: %w", err)
+	}
+
+	entry := importEntry{source: "pass.json", channel: sourceWallet}
+	receipt := &entry.receipt
+	receipt.StoreName = pass.OrganizationName
+	receipt.OrderNumber = pass.SerialNumber
+
+	dates := []string{pass.RelevantDate}
+	var amounts []walletPassField
+	for _, field := range pass.fields() {
+		if field.DateStyle != "" {
+			if value, ok := field.Value.(string); ok {
+				dates = append(dates, value)
+			}
+		}
+		if _, ok := passAmount(field); ok && (field.CurrencyCode != "" || totalLabel.MatchString(field.Key+" "+field.Label)) {
+			amounts = append(amounts, field)
+		}
+	}
+	for _, value := range dates {
+		if at, ok := parseWalletDate(value); ok {
+			receipt.DateOfPurchase = at.Format("2006-01-02")
+			receipt.TimeOfPurchase = at.Format("15:04")
+			break
+		}
+	}
+	if len(amounts) == 0 {
+		entry.skipped = "pass has no amounts"
+		return entry, nil
+	}
+
+	total := -1
+	for i, field := range amounts {
+		if totalLabel.MatchString(field.Key + " " + field.Label) {
+			total = i
+			break
+		}
+	}
+	if total < 0 && len(amounts) == 1 {
+		total = 0
+	}
+	for i, field := range amounts {
+		amount, _ := passAmount(field)
+		if i == total {
+			receipt.TotalAmount = amount
+			continue
+		}
+		description := field.Label
+		if description == "" {
+			description = field.Key
+		}
+		receipt.PurchasedItems = append(receipt.PurchasedItems, Item{Description: description, Price: amount})
+	}
+	if receipt.TotalAmount == "" {
+		entry.warnings = append(entry.warnings, "no total on pass; using the sum of its amounts")
+		receipt.TotalAmount = sumItems(receipt.PurchasedItems)
+	}
+	if len(receipt.PurchasedItems) == 0 {
+		entry.warnings = append(entry.warnings, "pass is not itemized; recorded as a single item")
+		receipt.PurchasedItems = []Item{{Description: pass.Description, Price: receipt.TotalAmount}}
+	}
+	if receipt.DateOfPurchase == "" {
+		entry.warnings = append(entry.warnings, "purchase date not found")
+	}
+	return entry, nil
+}
+
+// parseWalletDate parses a pass date.
+func parseWalletDate(value string) (time.Time, bool) {
+	for _, layout := range walletDateLayouts {
+		if at, err := time.Parse(layout, value); err == nil {
+			return at, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// sumItems adds up item prices.
+func sumItems(items []Item) string {
+	var cents int64
+	for _, item := range items {
+		price, _ := strconv.ParseFloat(item.Price, 64)
+		cents += int64(price*100 + 0.5)
+	}
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+// readMbox splits an mbox archive into its messages and reads each as an
+// order confirmation. Lines quoted as ">From " by mboxrd writers are
+// unquoted. Data that does not start with a "From " line is read as a
+// single message.
+func readMbox(data []byte) ([]importEntry, error) {
+	var messages [][]byte
+	var current []byte
+	started := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), maxImportBytes)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if bytes.HasPrefix(line, []byte("From ")) {
+			if started {
+				messages = append(messages, current)
+			}
+			current, started = nil, true
+			continue
+		}
+		if !started {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			started = true
+		}
+		if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) && bytes.HasPrefix(unquoted, []byte("From ")) {
+			line = line[1:]
+		}
+		current = append(current, line...)
+		current = append(current, '\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if started {
+		messages = append(messages, current)
+	}
+
+	entries := make([]importEntry, 0, len(messages))
+	for _, message := range messages {
+		entries = append(entries, readOrderEmail(message))
+	}
+	return entries, nil
+}
+
+// orderSubject recognizes the subjects of order confirmation emails.
+var orderSubject = regexp.MustCompile(`(?i)\b(order|receipt|purchase|invoice)\b`)
+
+// orderNumberPattern finds an order number in a subject or body.
+var orderNumberPattern = regexp.MustCompile(`(?i)\border\s*(?:#|no\.?|number)\s*:?\s*([A-Z0-9][A-Z0-9-]{3,})`)
+
+// emailTotalPattern finds total lines anywhere in an email, not only at the
+// start of a line as on printed receipts.
+var emailTotalPattern = regexp.MustCompile(`(?i)\btotal\b[^\d\n]*(\d+\.\d{2})`)
+
+// readOrderEmail maps an order confirmation email onto a receipt. The
+// sender's name is the retailer; items and total are parsed from the body
+// like raw receipt text, and the purchase time defaults to when the email
+// was sent. Mail that is not an order confirmation is skipped.
+func readOrderEmail(data []byte) importEntry {
+	message, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return importEntry{skipped: "unreadable message: " + err.Error()}
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(message.Header.Get("Subject"))
+	if err != nil {
+		subject = message.Header.Get("Subject")
+	}
+	entry := importEntry{source: subject, channel: sourceEmail}
+	if !orderSubject.MatchString(subject) {
+		entry.skipped = "not an order confirmation"
+		return entry
+	}
+
+	text, err := messageText(message.Header, message.Body)
+	if err != nil {
+		entry.skipped = "unreadable message: " + err.Error()
+		return entry
+	}
+	parsed := parseReceiptText(senderName(message.Header.Get("From")), text)
+	if parsed.Receipt.TotalAmount == "" {
+		// Confirmations often label the total "Order Total" or "Grand
+		// Total", after a subtotal; the last one is the amount charged.
+		if matches := emailTotalPattern.FindAllStringSubmatch(text, -1); matches != nil {
+			parsed.Receipt.TotalAmount = matches[len(matches)-1][1]
+		}
+	}
+	if parsed.Receipt.TotalAmount == "" {
+		entry.skipped = "no order total found"
+		return entry
+	}
+	receipt := parsed.Receipt
+	var warnings []string
+	for _, warning := range parsed.Warnings {
+		switch warning {
+		case "purchase date not found", "purchase time not found", "no items found", "total not found":
+			// Filled in below.
+		default:
+			warnings = append(warnings, warning)
+		}
+	}
+	if sent, err := message.Header.Date(); err == nil {
+		if receipt.DateOfPurchase == "" {
+			receipt.DateOfPurchase = sent.Format("2006-01-02")
+		}
+		if receipt.TimeOfPurchase == "" {
+			receipt.TimeOfPurchase = sent.Format("15:04")
+		}
+	}
+	if receipt.DateOfPurchase == "" {
+		warnings = append(warnings, "purchase date not found")
+	}
+	if len(receipt.PurchasedItems) == 0 {
+		warnings = append(warnings, "order is not itemized; recorded as a single item")
+		receipt.PurchasedItems = []Item{{Description: subject, Price: receipt.TotalAmount}}
+	}
+	if m := orderNumberPattern.FindStringSubmatch(subject + "\n" + text); m != nil {
+		receipt.OrderNumber = m[1]
+	}
+	entry.receipt = receipt
+	entry.warnings = warnings
+	return entry
+}
+
+// senderName is the display name of an email's sender, or its domain when
+// it has none.
+func senderName(from string) string {
+	address, err := mail.ParseAddress(from)
+	if err != nil {
+		return strings.TrimSpace(from)
+	}
+	if address.Name != "" {
+		return address.Name
+	}
+	_, domain, _ := strings.Cut(address.Address, "@")
+	return domain
+}
+
+// headerGetter is satisfied by message and multipart part headers.
+type headerGetter interface {
+	Get(key string) string
+}
+
+// messageText returns the plain text of a message body, preferring a
+// text/plain part and otherwise stripping the markup of an HTML one.
+func messageText(header headerGetter, body io.Reader) (string, error) {
+	body = decodeTransfer(header.Get("Content-Transfer-Encoding"), body)
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		reader := multipart.NewReader(body, params["boundary"])
+		var htmlText string
+		for {
+			part, err := reader.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			text, err := messageText(part.Header, part)
+			if err != nil {
+				return "", err
+			}
+			partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+			switch {
+			case partType == "text/plain" || strings.HasPrefix(partType, "multipart/") && text != "":
+				return text, nil
+			case partType == "text/html" && htmlText == "":
+				htmlText = text
+			}
+		}
+		return htmlText, nil
+	}
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+	switch mediaType {
+	case "text/plain":
+		return string(data), nil
+	case "text/html":
+		return htmlToText(string(data)), nil
+	}
+	return "", nil
+}
+
+// decodeTransfer undoes a part's content transfer encoding.
+func decodeTransfer(encoding string, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, body)
+	}
+	return body
+}
+
+var (
+	// htmlBreaks are the tags that end a line of text.
+	htmlBreaks = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/li|/h[1-6])\b[^>]*>`)
+	// htmlCells are table cell ends, which separate a row's values.
+	htmlCells = regexp.MustCompile(`(?i)</t[dh]>`)
+	// htmlTags matches any tag, including style and script contents.
+	htmlTags = regexp.MustCompile(`(?is)<(style|script)\b.*?</(style|script)>|<[^>]*>`)
+	// htmlSpaces collapses runs of horizontal space.
+	htmlSpaces = regexp.MustCompile(`[ \t\x{a0}]+`)
+)
+
+// htmlToText reduces an HTML email to lines of text, one per paragraph or
+// table row, so that the receipt text parser can read it.
+func htmlToText(markup string) string {
+	markup = htmlBreaks.ReplaceAllString(markup, "\n")
+	markup = htmlCells.ReplaceAllString(markup, " ")
+	markup = htmlTags.ReplaceAllString(markup, "")
+	text := html.UnescapeString(markup)
+	lines := strings.Split(text, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if line = strings.TrimSpace(htmlSpaces.ReplaceAllString(line, " ")); line != "" {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
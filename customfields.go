@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Custom field types.
+const (
+	customString  = "string"
+	customNumber  = "number"
+	customBoolean = "boolean"
+	// customDate is a YYYY-MM-DD string.
+	customDate = "date"
+)
+
+// customFieldName is the format of custom field names.
+var customFieldName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,63}$`)
+
+// CustomField is a tenant-defined receipt field, submitted in the receipt's
+// customFields object.
+type CustomField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+}
+
+// customFields holds each tenant's field definitions by name. It is only
+// written at startup.
+var customFields = make(map[string]map[string]CustomField)
+
+// loadCustomFieldConfig reads tenants' custom fields from the JSON object in
+// the file named by CUSTOM_FIELDS_FILE, e.g.
+// {"acme": [{"name": "storeNumber", "type": "string", "required": true}]}.
+func loadCustomFieldConfig() error {
+	path := os.Getenv("CUSTOM_FIELDS_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("CUSTOM_FIELDS_FILE: %w", err)
+	}
+	var config map[string][]CustomField
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("CUSTOM_FIELDS_FILE: %w", err)
+	}
+	for tenant, fields := range config {
+		if !tenantPattern.MatchString(tenant) {
+			return fmt.Errorf("CUSTOM_FIELDS_FILE: invalid tenant %q", tenant)
+		}
+		byName := make(map[string]CustomField, len(fields))
+		for _, field := range fields {
+			if !customFieldName.MatchString(field.Name) {
+				return fmt.Errorf("CUSTOM_FIELDS_FILE: %s: invalid field name %q", tenant, field.Name)
+			}
+			if _, ok := byName[field.Name]; ok {
+				return fmt.Errorf("CUSTOM_FIELDS_FILE: %s: field %q defined twice", tenant, field.Name)
+			}
+			switch field.Type {
+			case customString, customNumber, customBoolean, customDate:
+			default:
+				return fmt.Errorf("CUSTOM_FIELDS_FILE: %s: field %q has unknown type %q", tenant, field.Name, field.Type)
+			}
+			byName[field.Name] = field
+		}
+		customFields[tenant] = byName
+	}
+	return nil
+}
+
+// tenantCustomFields returns a tenant's custom field definitions, sorted by
+// name.
+func tenantCustomFields(tenant string) []CustomField {
+	fields := make([]CustomField, 0, len(customFields[tenant]))
+	for _, field := range customFields[tenant] {
+		fields = append(fields, field)
+	}
+	sort.Slice(fields, func(i, j int) bool { return fields[i].Name < fields[j].Name })
+	return fields
+}
+
+// checkCustomFields validates a receipt's custom fields against its
+// tenant's definitions, reporting every undefined, missing or mistyped field.
+func checkCustomFields(tenant string, values map[string]interface{}) error {
+	defined := customFields[tenant]
+	var problems []string
+	for _, name := range sortedFields(values) {
+		if _, ok := defined[name]; !ok {
+			problems = append(problems, fmt.Sprintf("unknown custom field %q", name))
+		}
+	}
+	for _, field := range tenantCustomFields(tenant) {
+		value, ok := values[field.Name]
+		if !ok || value == nil {
+			if field.Required {
+				problems = append(problems, fmt.Sprintf("custom field %q is required", field.Name))
+			}
+			continue
+		}
+		if !customValueValid(field.Type, value) {
+			problems = append(problems, fmt.Sprintf("custom field %q must be a %s", field.Name, field.Type))
+		}
+	}
+	if len(problems) > 0 {
+		return &validationError{problems: problems}
+	}
+	return nil
+}
+
+// customValueValid reports whether a decoded JSON value has the given type.
+func customValueValid(fieldType string, value interface{}) bool {
+	switch fieldType {
+	case customString:
+		_, ok := value.(string)
+		return ok
+	case customNumber:
+		_, ok := value.(float64)
+		return ok
+	case customBoolean:
+		_, ok := value.(bool)
+		return ok
+	case customDate:
+		s, ok := value.(string)
+		if !ok {
+			return false
+		}
+		_, err := time.Parse("2006-01-02", s)
+		return err == nil
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DeadLetter is an event whose delivery exhausted its retries.
+type DeadLetter struct {
+	ID         string    `json:"id"`
+	WebhookID  string    `json:"webhookId"`
+	URL        string    `json:"url"`
+	Event      Event     `json:"event"`
+	Attempts   int       `json:"attempts"`
+	LastStatus int       `json:"lastStatus"`
+	LastError  string    `json:"lastError"`
+	FailedAt   time.Time `json:"failedAt"`
+}
+
+var (
+	deadLetterMutex sync.Mutex
+	deadLetters     = make(map[string]DeadLetter)
+	// deadLetterPath, when set, persists dead letters across restarts.
+	deadLetterPath string
+)
+
+func init() {
+	registerQueue("deadLetters", func() int {
+		deadLetterMutex.Lock()
+		defer deadLetterMutex.Unlock()
+		return len(deadLetters)
+	})
+}
+
+// loadDeadLetters reads DEAD_LETTER_FILE and loads any dead letters saved
+// there by a previous run.
+func loadDeadLetters() error {
+	deadLetterPath = os.Getenv("DEAD_LETTER_FILE")
+	if deadLetterPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(deadLetterPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var letters []DeadLetter
+	if err := json.Unmarshal(data, &letters); err != nil {
+		return err
+	}
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	for _, letter := range letters {
+		deadLetters[letter.ID] = letter
+	}
+	return nil
+}
+
+// saveDeadLetters writes every dead letter to deadLetterPath, replacing the
+// file atomically. Callers hold deadLetterMutex.
+func saveDeadLetters() {
+	if deadLetterPath == "" {
+		return
+	}
+	data, err := json.Marshal(sortedDeadLetters())
+	if err == nil {
+		tmp := deadLetterPath + ".tmp"
+		if err = os.WriteFile(tmp, data, 0o600); err == nil {
+			err = os.Rename(tmp, deadLetterPath)
+		}
+	}
+	if err != nil {
+		log.Printf("dead letters: save failed: %v", err)
+	}
+}
+
+// sortedDeadLetters returns the dead letters, oldest first. Callers hold
+// deadLetterMutex.
+func sortedDeadLetters() []DeadLetter {
+	letters := make([]DeadLetter, 0, len(deadLetters))
+	for _, letter := range deadLetters {
+		letters = append(letters, letter)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].FailedAt.Before(letters[j].FailedAt) })
+	return letters
+}
+
+// addDeadLetter records a delivery that exhausted its retries.
+func addDeadLetter(hook *Webhook, event Event, delivery *WebhookDelivery) {
+	webhookMutex.Lock()
+	letter := DeadLetter{
+		ID:         delivery.ID,
+		WebhookID:  hook.ID,
+		URL:        hook.URL,
+		Event:      event,
+		Attempts:   delivery.Attempts,
+		LastStatus: delivery.Status,
+		LastError:  delivery.Error,
+		FailedAt:   delivery.UpdatedAt,
+	}
+	webhookMutex.Unlock()
+
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	deadLetters[letter.ID] = letter
+	saveDeadLetters()
+}
+
+// deadLettersHandler lists dead letters, oldest first. ?webhook= filters
+// them to one webhook.
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	webhookID := r.URL.Query().Get("webhook")
+	deadLetterMutex.Lock()
+	letters := sortedDeadLetters()
+	deadLetterMutex.Unlock()
+	filtered := letters[:0]
+	for _, letter := range letters {
+		if webhookID == "" || letter.WebhookID == webhookID {
+			filtered = append(filtered, letter)
+		}
+	}
+	writeJSON(w, r, filtered)
+}
+
+// deadLetterRoutes handles /admin/deadletters/{id}: GET inspects an entry,
+// DELETE discards it and POST .../redrive queues it for delivery again.
+func deadLetterRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/deadletters/"), "/"), "/")
+	id := parts[0]
+	deadLetterMutex.Lock()
+	letter, ok := deadLetters[id]
+	deadLetterMutex.Unlock()
+	if !ok {
+		http.Error(w, "Dead letter not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		writeJSON(w, r, letter)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		removeDeadLetter(id)
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 2 && parts[1] == "redrive" && r.Method == http.MethodPost:
+		redriveDeadLetter(w, r, letter)
+	case len(parts) <= 2:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// removeDeadLetter discards a dead letter.
+func removeDeadLetter(id string) {
+	deadLetterMutex.Lock()
+	defer deadLetterMutex.Unlock()
+	delete(deadLetters, id)
+	saveDeadLetters()
+}
+
+// redriveDeadLetter removes a dead letter and delivers its event again with
+// the usual retries. If delivery fails again it returns to the queue.
+func redriveDeadLetter(w http.ResponseWriter, r *http.Request, letter DeadLetter) {
+	webhookMutex.Lock()
+	hook, ok := webhooks[letter.WebhookID]
+	webhookMutex.Unlock()
+	if !ok {
+		http.Error(w, "Webhook no longer exists; discard the dead letter instead", http.StatusConflict)
+		return
+	}
+
+	removeDeadLetter(letter.ID)
+	deliverInBackground(hook, letter.Event)
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Duplicate detection modes.
+const (
+	duplicateModeOff   = "off"
+	duplicateModeExact = "exact"
+	duplicateModeFuzzy = "fuzzy"
+)
+
+// Actions taken when a duplicate is detected.
+const (
+	duplicateReject = "reject"
+	duplicateFlag   = "flag"
+	duplicateAllow  = "allow"
+)
+
+// DuplicatePolicy configures duplicate detection.
+type DuplicatePolicy struct {
+	// Mode is off, exact (identical contents) or fuzzy (same retailer,
+	// purchase date and total submitted within the window).
+	Mode string
+	// Action is reject, flag or allow.
+	Action string
+	// Window bounds fuzzy matching by submission time.
+	Window time.Duration
+	// TenantWindows overrides Window for individual tenants.
+	TenantWindows map[string]time.Duration
+}
+
+// DuplicateError reports a submission rejected as a duplicate.
+type DuplicateError struct {
+	ExistingID string
+}
+
+func (e *DuplicateError) Error() string {
+	return "duplicate of receipt " + e.ExistingID
+}
+
+var duplicatePolicy = DuplicatePolicy{
+	Mode:          duplicateModeOff,
+	Action:        duplicateReject,
+	Window:        24 * time.Hour,
+	TenantWindows: make(map[string]time.Duration),
+}
+
+// loadDuplicateConfig reads DUPLICATE_MODE, DUPLICATE_ACTION,
+// DUPLICATE_WINDOW_HOURS and DUPLICATE_TENANT_WINDOWS ("tenant=hours,...").
+func loadDuplicateConfig() error {
+	if mode := os.Getenv("DUPLICATE_MODE"); mode != "" {
+		if mode != duplicateModeOff && mode != duplicateModeExact && mode != duplicateModeFuzzy {
+			return fmt.Errorf("DUPLICATE_MODE: unknown mode %q", mode)
+		}
+		duplicatePolicy.Mode = mode
+	}
+	if action := os.Getenv("DUPLICATE_ACTION"); action != "" {
+		if action != duplicateReject && action != duplicateFlag && action != duplicateAllow {
+			return fmt.Errorf("DUPLICATE_ACTION: unknown action %q", action)
+		}
+		duplicatePolicy.Action = action
+	}
+	if value := os.Getenv("DUPLICATE_WINDOW_HOURS"); value != "" {
+		hours, err := strconv.Atoi(value)
+		if err != nil || hours <= 0 {
+			return fmt.Errorf("DUPLICATE_WINDOW_HOURS: invalid value %q", value)
+		}
+		duplicatePolicy.Window = time.Duration(hours) * time.Hour
+	}
+	if value := os.Getenv("BLOOM_EXPECTED_ITEMS"); value != "" {
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || n == 0 {
+			return fmt.Errorf("BLOOM_EXPECTED_ITEMS: invalid value %q", value)
+		}
+		bloomExpectedItems = n
+		duplicates.bloom = newBloomFilter(bloomExpectedItems, bloomFalsePositiveRate)
+	}
+	bloomFilterPath = os.Getenv("BLOOM_FILTER_PATH")
+	for _, pair := range strings.Split(os.Getenv("DUPLICATE_TENANT_WINDOWS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		tenant, value, ok := strings.Cut(pair, "=")
+		hours, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || hours <= 0 {
+			return fmt.Errorf("DUPLICATE_TENANT_WINDOWS: malformed entry %q", pair)
+		}
+		duplicatePolicy.TenantWindows[strings.TrimSpace(tenant)] = time.Duration(hours) * time.Hour
+	}
+	return nil
+}
+
+// windowFor returns the fuzzy matching window for a tenant.
+func (p DuplicatePolicy) windowFor(tenant string) time.Duration {
+	if window, ok := p.TenantWindows[tenant]; ok {
+		return window
+	}
+	return p.Window
+}
+
+// contentHash returns a canonical hash of a receipt's contents, ignoring
+// surrounding whitespace and letter case in free-text fields.
+func contentHash(receipt Receipt) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n%s\n", canonicalText(receipt.StoreName), receipt.DateOfPurchase, receipt.TimeOfPurchase, receipt.TotalAmount)
+	for _, item := range receipt.PurchasedItems {
+		fmt.Fprintf(h, "%s\t%s\n", canonicalText(item.Description), item.Price)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// canonicalText lowercases text and collapses runs of whitespace.
+func canonicalText(text string) string {
+	return strings.ToLower(strings.Join(strings.Fields(text), " "))
+}
+
+// fuzzyKey groups receipts considered duplicates under fuzzy matching.
+func fuzzyKey(tenant string, receipt Receipt) string {
+	return tenant + "\x00" + canonicalText(receipt.StoreName) + "\x00" + receipt.DateOfPurchase + "\x00" + receipt.TotalAmount
+}
+
+// fuzzyEntry is one previously submitted receipt under a fuzzy key.
+type fuzzyEntry struct {
+	id          string
+	submittedAt time.Time
+}
+
+// duplicateIndex answers duplicate lookups. Exact matches are screened by a
+// Bloom filter so the common non-duplicate case never touches storage; only
+// possible matches are confirmed with a store lookup.
+type duplicateIndex struct {
+	mu    sync.Mutex
+	bloom *bloomFilter
+	// pending holds receipts accepted but not yet stored, so concurrent
+	// identical submissions are caught before the store can see them.
+	pending map[string]string
+	fuzzy   map[string][]fuzzyEntry
+	// sweptAt is when every fuzzy key was last pruned.
+	sweptAt time.Time
+	// generation counts the receipts added, so that a store lookup made
+	// without holding mu can tell whether it may have missed one.
+	generation uint64
+}
+
+var duplicates = &duplicateIndex{
+	bloom:   newBloomFilter(bloomExpectedItems, bloomFalsePositiveRate),
+	pending: make(map[string]string),
+	fuzzy:   make(map[string][]fuzzyEntry),
+}
+
+var (
+	// bloomExpectedItems and bloomFalsePositiveRate size the Bloom filter.
+	bloomExpectedItems     uint64 = 1000000
+	bloomFalsePositiveRate        = 0.01
+	// bloomFilterPath, when set, persists the Bloom filter across restarts.
+	bloomFilterPath string
+)
+
+const (
+	// fuzzySweepInterval is how often every fuzzy key is pruned, so that
+	// keys no later receipt shares are dropped too.
+	fuzzySweepInterval = time.Hour
+	// maxUnlockedLookups bounds how often checkAndAdd confirms an exact
+	// match with the store without holding the index's lock, retrying
+	// while other receipts are added, before it looks up under the lock.
+	maxUnlockedLookups = 3
+)
+
+// exactKey identifies a receipt's contents within a tenant.
+func exactKey(tenant, hash string) string {
+	return tenant + "\x00" + hash
+}
+
+// find returns the ID of an earlier receipt that the policy considers a
+// duplicate of receipt, or "" when there is none, and whether a possible
+// exact match must still be confirmed with the store. Callers hold d.mu.
+func (d *duplicateIndex) find(policy DuplicatePolicy, tenant, hash string, receipt Receipt, now time.Time) (string, bool) {
+	switch policy.Mode {
+	case duplicateModeExact:
+		key := exactKey(tenant, hash)
+		if id, ok := d.pending[key]; ok {
+			return id, false
+		}
+		return "", d.bloom.MayContain(key)
+	case duplicateModeFuzzy:
+		d.sweepFuzzy(policy, now)
+		key := fuzzyKey(tenant, receipt)
+		d.pruneFuzzy(key, policy.windowFor(tenant), now)
+		if entries := d.fuzzy[key]; len(entries) > 0 {
+			return entries[0].id, false
+		}
+	}
+	return "", false
+}
+
+// add records a receipt. Fuzzy entries are only kept under fuzzy matching.
+// Callers hold d.mu.
+func (d *duplicateIndex) add(policy DuplicatePolicy, id, tenant, hash string, receipt Receipt, submittedAt time.Time) {
+	d.generation++
+	d.bloom.Add(exactKey(tenant, hash))
+	if policy.Mode != duplicateModeFuzzy {
+		return
+	}
+	key := fuzzyKey(tenant, receipt)
+	d.pruneFuzzy(key, policy.windowFor(tenant), submittedAt)
+	d.fuzzy[key] = append(d.fuzzy[key], fuzzyEntry{id: id, submittedAt: submittedAt})
+}
+
+// pruneFuzzy drops the entries under a fuzzy key submitted more than window
+// before now, which no later receipt can match. Callers hold d.mu.
+func (d *duplicateIndex) pruneFuzzy(key string, window time.Duration, now time.Time) {
+	entries := d.fuzzy[key][:0]
+	for _, entry := range d.fuzzy[key] {
+		if now.Sub(entry.submittedAt) <= window {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		delete(d.fuzzy, key)
+	} else {
+		d.fuzzy[key] = entries
+	}
+}
+
+// sweepFuzzy prunes every fuzzy key under its tenant's window, at most once
+// per fuzzySweepInterval. Callers hold d.mu.
+func (d *duplicateIndex) sweepFuzzy(policy DuplicatePolicy, now time.Time) {
+	if now.Sub(d.sweptAt) < fuzzySweepInterval {
+		return
+	}
+	d.sweptAt = now
+	for key := range d.fuzzy {
+		tenant, _, _ := strings.Cut(key, "\x00")
+		d.pruneFuzzy(key, policy.windowFor(tenant), now)
+	}
+}
+
+// stored marks a pending receipt as written to the store.
+func (d *duplicateIndex) stored(id, tenant, hash string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pending[exactKey(tenant, hash)] == id {
+		delete(d.pending, exactKey(tenant, hash))
+	}
+}
+
+// remove forgets a receipt, e.g. when storing it failed. The Bloom filter
+// cannot forget keys; the stale bit only costs an extra store lookup.
+func (d *duplicateIndex) remove(id, tenant, hash string, receipt Receipt) {
+	d.stored(id, tenant, hash)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	key := fuzzyKey(tenant, receipt)
+	entries := d.fuzzy[key][:0]
+	for _, entry := range d.fuzzy[key] {
+		if entry.id != id {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		delete(d.fuzzy, key)
+	} else {
+		d.fuzzy[key] = entries
+	}
+}
+
+// checkAndAdd looks for a duplicate of the new receipt and, unless the
+// policy rejects it, records the receipt under id in the same step so that
+// concurrent identical submissions cannot both pass. Possible exact matches
+// are confirmed with the store without holding d.mu, and looked for again
+// if another receipt was added meanwhile. Callers must follow up with
+// stored or remove once the store write completes.
+func (d *duplicateIndex) checkAndAdd(ctx context.Context, policy DuplicatePolicy, id, tenant, hash string, receipt Receipt, now time.Time) (string, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	existing, confirm := d.find(policy, tenant, hash, receipt, now)
+	for attempt := 1; confirm; attempt++ {
+		if attempt > maxUnlockedLookups {
+			var err error
+			if existing, err = receiptStore.FindByContentHash(ctx, tenant, hash); err != nil {
+				return "", err
+			}
+			break
+		}
+		generation := d.generation
+		d.mu.Unlock()
+		found, err := receiptStore.FindByContentHash(ctx, tenant, hash)
+		d.mu.Lock()
+		if err != nil {
+			return "", err
+		}
+		if found != "" || d.generation == generation {
+			existing = found
+			break
+		}
+		existing, confirm = d.find(policy, tenant, hash, receipt, now)
+	}
+	if existing != "" && policy.Action == duplicateReject {
+		return existing, &DuplicateError{ExistingID: existing}
+	}
+	d.add(policy, id, tenant, hash, receipt, now)
+	if _, ok := d.pending[exactKey(tenant, hash)]; !ok {
+		d.pending[exactKey(tenant, hash)] = id
+	}
+	return existing, nil
+}
+
+// rebuildDuplicateIndex loads stored receipts into the duplicate index. A
+// persisted Bloom filter whose count matches the store is reused; otherwise
+// the filter is rebuilt from scratch.
+func rebuildDuplicateIndex() error {
+	duplicates.mu.Lock()
+	defer duplicates.mu.Unlock()
+
+	size, err := receiptStore.Len(context.Background())
+	if err != nil {
+		return err
+	}
+	reuseBloom := false
+	if bloomFilterPath != "" {
+		if loaded, err := loadBloomFilter(bloomFilterPath); err == nil && loaded.Count() == uint64(size) {
+			duplicates.bloom = loaded
+			reuseBloom = true
+		} else if err != nil && !os.IsNotExist(err) {
+			log.Printf("bloom filter: ignoring %s: %v", bloomFilterPath, err)
+		}
+		go persistBloomFilter(duplicates.bloom, bloomFilterPath, 30*time.Second)
+	}
+	if reuseBloom && duplicatePolicy.Mode != duplicateModeFuzzy {
+		return nil
+	}
+
+	return receiptStore.Range(context.Background(), func(id string, stored StoredReceipt) bool {
+		if reuseBloom {
+			key := fuzzyKey(stored.Tenant, stored.Receipt)
+			duplicates.fuzzy[key] = append(duplicates.fuzzy[key], fuzzyEntry{id: id, submittedAt: stored.SubmittedAt})
+		} else {
+			duplicates.add(duplicatePolicy, id, stored.Tenant, stored.ContentHash, stored.Receipt, stored.SubmittedAt)
+		}
+		return true
+	})
+}
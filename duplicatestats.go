@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// duplicateStatsRetention is how many days of per-client counts are kept.
+const duplicateStatsRetention = 90
+
+// DuplicateCounts tallies detected duplicates by the action taken.
+type DuplicateCounts struct {
+	Rejected int `json:"rejected"`
+	Flagged  int `json:"flagged"`
+	Allowed  int `json:"allowed"`
+	Total    int `json:"total"`
+}
+
+func (c *DuplicateCounts) add(action string) {
+	switch action {
+	case duplicateReject:
+		c.Rejected++
+	case duplicateFlag:
+		c.Flagged++
+	case duplicateAllow:
+		c.Allowed++
+	}
+	c.Total++
+}
+
+// duplicateCounter counts duplicate submissions per day and client.
+type duplicateCounter struct {
+	mu    sync.Mutex
+	total DuplicateCounts
+	days  map[string]map[string]*DuplicateCounts
+}
+
+var duplicateStats = &duplicateCounter{days: make(map[string]map[string]*DuplicateCounts)}
+
+// record counts one duplicate from client handled with action.
+func (c *duplicateCounter) record(client, action string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	day := at.UTC().Format("2006-01-02")
+	clients, ok := c.days[day]
+	if !ok {
+		clients = make(map[string]*DuplicateCounts)
+		c.days[day] = clients
+		c.prune(at)
+	}
+	counts, ok := clients[client]
+	if !ok {
+		counts = &DuplicateCounts{}
+		clients[client] = counts
+	}
+	counts.add(action)
+	c.total.add(action)
+}
+
+// prune drops days older than the retention period. Callers hold c.mu.
+func (c *duplicateCounter) prune(now time.Time) {
+	cutoff := now.UTC().AddDate(0, 0, -duplicateStatsRetention).Format("2006-01-02")
+	for day := range c.days {
+		if day < cutoff {
+			delete(c.days, day)
+		}
+	}
+}
+
+// Total returns the counts since startup.
+func (c *duplicateCounter) Total() DuplicateCounts {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
+
+// ClientDuplicates is one client's duplicate counts on one day.
+type ClientDuplicates struct {
+	Day    string `json:"day"`
+	Client string `json:"client"`
+	DuplicateCounts
+}
+
+// DuplicateReport lists duplicate submissions per client and day, worst first.
+type DuplicateReport struct {
+	Since   string             `json:"since"`
+	Total   DuplicateCounts    `json:"total"`
+	Clients []ClientDuplicates `json:"clients"`
+}
+
+// report returns counts for the last days days, optionally for one client.
+func (c *duplicateCounter) report(days int, client string, now time.Time) DuplicateReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	since := now.UTC().AddDate(0, 0, 1-days).Format("2006-01-02")
+	report := DuplicateReport{Since: since, Clients: []ClientDuplicates{}}
+	for day, clients := range c.days {
+		if day < since {
+			continue
+		}
+		for name, counts := range clients {
+			if client != "" && name != client {
+				continue
+			}
+			report.Clients = append(report.Clients, ClientDuplicates{Day: day, Client: name, DuplicateCounts: *counts})
+			report.Total.Rejected += counts.Rejected
+			report.Total.Flagged += counts.Flagged
+			report.Total.Allowed += counts.Allowed
+			report.Total.Total += counts.Total
+		}
+	}
+	sort.Slice(report.Clients, func(i, j int) bool {
+		a, b := report.Clients[i], report.Clients[j]
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		if a.Day != b.Day {
+			return a.Day > b.Day
+		}
+		return a.Client < b.Client
+	})
+	return report
+}
+
+// getDuplicateReport reports duplicate submissions per client and day. The
+// "days" query parameter (default 7) selects the period and "client"
+// narrows the report to one client.
+func getDuplicateReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := 7
+	if value := r.URL.Query().Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > duplicateStatsRetention {
+			http.Error(w, "Invalid days parameter", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	writeJSON(w, r, duplicateStats.report(days, r.URL.Query().Get("client"), time.Now()))
+}
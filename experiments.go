@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Experiment compares the point economics of rule sets on live traffic.
+// Each new receipt is assigned to a variant bucket, by user so that a user
+// stays in one bucket, and scored under both the control rules (its
+// tenant's current rules) and its variant's rules; both results are stored
+// with the receipt. Unless Award is set, receipts keep the control points
+// and the variants are only recorded; with Award, receipts earn their
+// variant's points and are pinned to its rules.
+type Experiment struct {
+	Name     string              `json:"name"`
+	Tenant   string              `json:"tenant,omitempty"`
+	Award    bool                `json:"award"`
+	Variants []ExperimentVariant `json:"variants"`
+	// StartedAt and StoppedAt are set by the server.
+	StartedAt time.Time  `json:"startedAt"`
+	StoppedAt *time.Time `json:"stoppedAt,omitempty"`
+}
+
+// ExperimentVariant is one bucket of an experiment. Weight is the
+// percentage of receipts assigned to it. A variant without rules is a
+// control bucket, scored under the tenant's current rules.
+type ExperimentVariant struct {
+	Name         string          `json:"name"`
+	Weight       int             `json:"weight"`
+	Rules        json.RawMessage `json:"rules,omitempty"`
+	RulesVersion string          `json:"rulesVersion,omitempty"`
+}
+
+// ExperimentAssignment records a receipt's experiment bucket and its points
+// under the control and the variant rules.
+type ExperimentAssignment struct {
+	Name          string `json:"name"`
+	Variant       string `json:"variant"`
+	ControlPoints int    `json:"controlPoints"`
+	VariantPoints int    `json:"variantPoints"`
+}
+
+// ExperimentVariantReport sums the points of one variant's receipts.
+// AwardedPoints are the points the receipts actually hold, net of refunds.
+type ExperimentVariantReport struct {
+	Variant       string  `json:"variant"`
+	Receipts      int     `json:"receipts"`
+	Users         int     `json:"users"`
+	ControlPoints int     `json:"controlPoints"`
+	VariantPoints int     `json:"variantPoints"`
+	Delta         int     `json:"delta"`
+	AveragePoints float64 `json:"averagePoints"`
+	AwardedPoints int     `json:"awardedPoints"`
+}
+
+// ExperimentResponse is an experiment with its results so far.
+type ExperimentResponse struct {
+	Experiment
+	Running bool                      `json:"running"`
+	Results []ExperimentVariantReport `json:"results"`
+}
+
+// experimentName is the form of experiment names.
+var experimentName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// runningExperiment is an experiment with its variants' rules decoded.
+type runningExperiment struct {
+	Experiment
+	rules []*RulesConfig
+}
+
+var (
+	experimentsMutex sync.RWMutex
+	// experiments holds every experiment started since startup, by name.
+	// Definitions are kept in memory; assignments are stored with the
+	// receipts.
+	experiments = make(map[string]*runningExperiment)
+)
+
+// newRunningExperiment validates an experiment definition and decodes its
+// variants' rules, which are registered and saved so that receipts pinned to
+// them can be rescored after a restart.
+func newRunningExperiment(experiment Experiment) (*runningExperiment, error) {
+	if !experimentName.MatchString(experiment.Name) {
+		return nil, fmt.Errorf("name must be 1-64 letters, digits, '-' or '_'")
+	}
+	if experiment.Tenant != "" && !tenantPattern.MatchString(experiment.Tenant) {
+		return nil, fmt.Errorf("invalid tenant")
+	}
+	if len(experiment.Variants) < 2 {
+		return nil, fmt.Errorf("an experiment needs at least two variants")
+	}
+
+	running := &runningExperiment{Experiment: experiment}
+	names := make(map[string]bool)
+	total := 0
+	for i := range running.Variants {
+		variant := &running.Variants[i]
+		switch {
+		case !experimentName.MatchString(variant.Name):
+			return nil, fmt.Errorf("variants[%d].name must be 1-64 letters, digits, '-' or '_'", i)
+		case names[variant.Name]:
+			return nil, fmt.Errorf("variants[%d].name %q is used twice", i, variant.Name)
+		case variant.Weight <= 0:
+			return nil, fmt.Errorf("variants[%d].weight must be positive", i)
+		}
+		names[variant.Name] = true
+		total += variant.Weight
+
+		variant.RulesVersion = ""
+		if len(variant.Rules) == 0 || string(variant.Rules) == "null" {
+			running.rules = append(running.rules, nil)
+			continue
+		}
+		rules := defaultRules()
+		if err := json.Unmarshal(variant.Rules, &rules); err != nil {
+			return nil, fmt.Errorf("variants[%d].rules: %v", i, err)
+		}
+		if problems := rules.Validate(); len(problems) > 0 {
+			return nil, fmt.Errorf("variants[%d].rules: %s", i, strings.Join(problems, "; "))
+		}
+		variant.RulesVersion = rulesVersion(rules)
+		running.rules = append(running.rules, &rules)
+	}
+	if total != 100 {
+		return nil, fmt.Errorf("variant weights must add up to 100, not %d", total)
+	}
+
+	for i, rules := range running.rules {
+		if rules != nil {
+			registerRuleSet(running.Variants[i].RulesVersion, *rules)
+			saveRuleSet(running.Variants[i].RulesVersion, *rules)
+		}
+	}
+	return running, nil
+}
+
+// bucket picks a receipt's variant: by user, or by receipt for anonymous
+// submissions.
+func (e *runningExperiment) bucket(receiptID string, stored StoredReceipt) int {
+	key := receiptID
+	if stored.UserID != "" {
+		key = "user:" + stored.UserID
+	}
+	h := fnv.New64a()
+	h.Write([]byte(e.Name + "/" + stored.Tenant + "/" + key))
+	slot := int(h.Sum64() % 100)
+	for i, variant := range e.Variants {
+		if slot < variant.Weight {
+			return i
+		}
+		slot -= variant.Weight
+	}
+	return len(e.Variants) - 1
+}
+
+// assignExperiment puts a new receipt in a bucket of the running experiment
+// covering its tenant, if any, and pins it to the variant's rules when the
+// experiment awards them. It is called before the receipt is scored.
+func assignExperiment(receiptID string, stored *StoredReceipt) {
+	experimentsMutex.RLock()
+	defer experimentsMutex.RUnlock()
+	for _, experiment := range experiments {
+		if experiment.StoppedAt != nil || (experiment.Tenant != "" && experiment.Tenant != stored.Tenant) {
+			continue
+		}
+		i := experiment.bucket(receiptID, *stored)
+		stored.Experiment = &ExperimentAssignment{Name: experiment.Name, Variant: experiment.Variants[i].Name}
+		if experiment.Award && experiment.rules[i] != nil {
+			stored.RulesVersion = experiment.Variants[i].RulesVersion
+		}
+		return
+	}
+}
+
+// scoreExperiment records a scored receipt's points under the control and
+// the variant rules of the experiment it was assigned to.
+func scoreExperiment(stored *StoredReceipt) {
+	if stored.Experiment == nil {
+		return
+	}
+	experimentsMutex.RLock()
+	experiment := experiments[stored.Experiment.Name]
+	experimentsMutex.RUnlock()
+	if experiment == nil {
+		return
+	}
+
+	control, _ := tenantRuleSet(stored.Tenant)
+	stored.Experiment.ControlPoints = sumBreakdown(control.storedBreakdown(*stored))
+	stored.Experiment.VariantPoints = stored.Experiment.ControlPoints
+	for i, variant := range experiment.Variants {
+		if variant.Name == stored.Experiment.Variant && experiment.rules[i] != nil {
+			stored.Experiment.VariantPoints = sumBreakdown(experiment.rules[i].storedBreakdown(*stored))
+		}
+	}
+}
+
+// experimentsHandler lists experiments (GET) or starts one (POST). Only one
+// experiment may run for a tenant at a time, and an experiment for all
+// tenants excludes any other.
+func experimentsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		experimentsMutex.RLock()
+		names := make([]string, 0, len(experiments))
+		for name := range experiments {
+			names = append(names, name)
+		}
+		list := make([]Experiment, 0, len(names))
+		sort.Strings(names)
+		for _, name := range names {
+			list = append(list, experiments[name].Experiment)
+		}
+		experimentsMutex.RUnlock()
+		writeJSON(w, r, list)
+	case http.MethodPost:
+		var experiment Experiment
+		if err := json.NewDecoder(r.Body).Decode(&experiment); err != nil {
+			http.Error(w, "Invalid experiment", http.StatusBadRequest)
+			return
+		}
+		running, err := newRunningExperiment(experiment)
+		if err != nil {
+			http.Error(w, "Invalid experiment: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		running.StartedAt = time.Now().UTC()
+		running.StoppedAt = nil
+
+		experimentsMutex.Lock()
+		defer experimentsMutex.Unlock()
+		if _, ok := experiments[running.Name]; ok {
+			http.Error(w, "An experiment with this name already exists", http.StatusConflict)
+			return
+		}
+		for _, other := range experiments {
+			if other.StoppedAt == nil && (other.Tenant == "" || running.Tenant == "" || other.Tenant == running.Tenant) {
+				http.Error(w, fmt.Sprintf("Experiment %s is already running", other.Name), http.StatusConflict)
+				return
+			}
+		}
+		experiments[running.Name] = running
+		log.Printf("experiment %s started", running.Name)
+		writeJSONStatus(w, r, http.StatusCreated, ExperimentResponse{Experiment: running.Experiment, Running: true, Results: []ExperimentVariantReport{}})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// experimentRoutes reports on an experiment (GET /admin/experiments/{name})
+// or stops it (POST /admin/experiments/{name}/stop). Receipts keep the
+// points and assignments they were given while it ran.
+func experimentRoutes(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/experiments/"), "/"), "/")
+	switch {
+	case action == "" && r.Method != http.MethodGet,
+		action != "" && r.Method != http.MethodPost:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	case action != "" && action != "stop":
+		http.NotFound(w, r)
+		return
+	}
+
+	experimentsMutex.Lock()
+	running, ok := experiments[name]
+	var experiment Experiment
+	if ok {
+		if action == "stop" && running.StoppedAt == nil {
+			now := time.Now().UTC()
+			running.StoppedAt = &now
+			log.Printf("experiment %s stopped", name)
+		}
+		experiment = running.Experiment
+	}
+	experimentsMutex.Unlock()
+	if !ok {
+		http.Error(w, "Experiment not found", http.StatusNotFound)
+		return
+	}
+
+	results, err := experimentResults(r, experiment)
+	if writeContextError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, ExperimentResponse{Experiment: experiment, Running: experiment.StoppedAt == nil, Results: results})
+}
+
+// experimentResults sums the stored assignments of an experiment's
+// receipts by variant, in the order the variants were declared.
+func experimentResults(r *http.Request, experiment Experiment) ([]ExperimentVariantReport, error) {
+	reports := make([]ExperimentVariantReport, len(experiment.Variants))
+	index := make(map[string]int, len(experiment.Variants))
+	users := make([]map[string]bool, len(experiment.Variants))
+	for i, variant := range experiment.Variants {
+		reports[i].Variant = variant.Name
+		index[variant.Name] = i
+		users[i] = make(map[string]bool)
+	}
+	err := receiptStore.Range(r.Context(), func(id string, stored StoredReceipt) bool {
+		assignment := stored.Experiment
+		if assignment == nil || assignment.Name != experiment.Name {
+			return true
+		}
+		i, ok := index[assignment.Variant]
+		if !ok {
+			return true
+		}
+		report := &reports[i]
+		report.Receipts++
+		report.ControlPoints += assignment.ControlPoints
+		report.VariantPoints += assignment.VariantPoints
+		report.AwardedPoints += stored.Points - stored.RefundedPoints
+		if stored.UserID != "" {
+			users[i][stored.Tenant+"/"+stored.UserID] = true
+		}
+		return true
+	})
+	for i := range reports {
+		report := &reports[i]
+		report.Users = len(users[i])
+		report.Delta = report.VariantPoints - report.ControlPoints
+		if report.Receipts > 0 {
+			report.AveragePoints = float64(report.VariantPoints) / float64(report.Receipts)
+		}
+	}
+	return reports, err
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// eventPointsExpiring notifies a tenant that a user's points will lapse.
+const eventPointsExpiring = "points.expiring"
+
+// expiryCheckInterval is how often receipts are scanned for points nearing
+// or past expiry.
+const expiryCheckInterval = time.Hour
+
+// expiryLedgerReason is the reason of the ledger entries that write expired
+// points off.
+const expiryLedgerReason = "points expired"
+
+// maxExpiringDays bounds the window of the expiring points endpoint.
+const maxExpiringDays = 3660
+
+var (
+	// pointsExpiry is how long after they are earned a receipt's points
+	// lapse; pointsExpiryMonths gives the same in calendar months. Zero in
+	// both means points never expire.
+	pointsExpiry       time.Duration
+	pointsExpiryMonths int
+	// expiryNotice is how far ahead of expiry users are notified.
+	expiryNotice = 14 * 24 * time.Hour
+)
+
+// ExpiringReceipt is one receipt whose points are about to lapse.
+type ExpiringReceipt struct {
+	ReceiptID string    `json:"id"`
+	Retailer  string    `json:"retailer"`
+	Points    int       `json:"points"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// ExpiringPoints lists a user's points due to lapse before Until, soonest
+// first.
+type ExpiringPoints struct {
+	UserID   string            `json:"userId"`
+	Points   int               `json:"points"`
+	Until    time.Time         `json:"until"`
+	Receipts []ExpiringReceipt `json:"receipts"`
+}
+
+// PointsExpiringEvent summarizes the points a user will lose and when.
+type PointsExpiringEvent struct {
+	UserID string `json:"userId"`
+	Points int    `json:"points"`
+	// ExpiresAt is when the first of the receipts lapses.
+	ExpiresAt time.Time         `json:"expiresAt"`
+	Receipts  []ExpiringReceipt `json:"receipts"`
+}
+
+// loadExpiryConfig reads POINTS_EXPIRY_DAYS or POINTS_EXPIRY_MONTHS, and
+// EXPIRY_NOTICE_DAYS (default 14).
+func loadExpiryConfig() error {
+	if value := os.Getenv("POINTS_EXPIRY_MONTHS"); value != "" {
+		if os.Getenv("POINTS_EXPIRY_DAYS") != "" {
+			return errors.New("POINTS_EXPIRY_DAYS and POINTS_EXPIRY_MONTHS are mutually exclusive")
+		}
+		months, err := strconv.Atoi(value)
+		if err != nil || months < 0 {
+			return fmt.Errorf("POINTS_EXPIRY_MONTHS: invalid value %q", value)
+		}
+		pointsExpiryMonths = months
+	}
+	for _, setting := range []struct {
+		name   string
+		target *time.Duration
+	}{
+		{"POINTS_EXPIRY_DAYS", &pointsExpiry},
+		{"EXPIRY_NOTICE_DAYS", &expiryNotice},
+	} {
+		value := os.Getenv(setting.name)
+		if value == "" {
+			continue
+		}
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 0 {
+			return fmt.Errorf("%s: invalid value %q", setting.name, value)
+		}
+		*setting.target = time.Duration(days) * 24 * time.Hour
+	}
+	return nil
+}
+
+// expiryEnabled reports whether points expire.
+func expiryEnabled() bool {
+	return pointsExpiry > 0 || pointsExpiryMonths > 0
+}
+
+// pointsExpireAt returns when a receipt's points lapse, if they do: when
+// they were written off, or the expiry period after they were earned.
+// Released receipts earn their points when released.
+func pointsExpireAt(stored StoredReceipt) (time.Time, bool) {
+	if stored.ExpiredAt != nil {
+		return *stored.ExpiredAt, true
+	}
+	if !expiryEnabled() {
+		return time.Time{}, false
+	}
+	earnedAt := stored.SubmittedAt
+	if stored.Hold == holdReleased && stored.HoldDecidedAt != nil {
+		earnedAt = *stored.HoldDecidedAt
+	}
+	if pointsExpiryMonths > 0 {
+		return earnedAt.AddDate(0, pointsExpiryMonths, 0), true
+	}
+	return earnedAt.Add(pointsExpiry), true
+}
+
+// expiringPoints returns the points a receipt loses on expiry: those written
+// off, once they have been, or else its net points.
+func expiringPoints(stored StoredReceipt) int {
+	if stored.ExpiredAt != nil {
+		return stored.ExpiredPoints
+	}
+	return netPoints(stored)
+}
+
+// watchExpiry notifies users of expiring points and writes off expired ones
+// until the process exits.
+func watchExpiry() {
+	for {
+		now := serverClock.Now()
+		if err := notifyExpiringPoints(context.Background(), now); err != nil {
+			log.Printf("expiry: %v", err)
+		}
+		if err := expirePoints(context.Background(), now); err != nil {
+			log.Printf("expiry: %v", err)
+		}
+		time.Sleep(expiryCheckInterval)
+	}
+}
+
+// expirePoints writes off the points of receipts past their expiry,
+// recording each with a ledger entry dated when the points lapsed. Held and
+// denied receipts have no points to expire.
+func expirePoints(ctx context.Context, now time.Time) error {
+	var expired []string
+	err := receiptStore.Range(ctx, func(id string, stored StoredReceipt) bool {
+		expiresAt, ok := pointsExpireAt(stored)
+		if ok && stored.ExpiredAt == nil && !onHold(stored) && stored.Hold != holdDenied &&
+			!expiresAt.After(now) && netPoints(stored) > 0 {
+			expired = append(expired, id)
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range expired {
+		err := receiptStore.Update(ctx, id, func(stored *StoredReceipt) error {
+			expiresAt, _ := pointsExpireAt(*stored)
+			if stored.ExpiredAt != nil {
+				return nil
+			}
+			stored.ExpiredAt, stored.ExpiredPoints = &expiresAt, netPoints(*stored)
+			stored.Ledger = append(stored.Ledger, LedgerEntry{
+				ID:        uuid.New().String(),
+				Tenant:    stored.Tenant,
+				UserID:    stored.UserID,
+				ReceiptID: id,
+				Points:    -stored.ExpiredPoints,
+				Reason:    expiryLedgerReason,
+				CreatedAt: expiresAt,
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notifyExpiringPoints publishes one points.expiring event per user with
+// points lapsing within the notice period and marks those receipts so each
+// is only announced once.
+func notifyExpiringPoints(ctx context.Context, now time.Time) error {
+	type userKey struct{ tenant, userID string }
+	pending := make(map[userKey]*PointsExpiringEvent)
+	err := receiptStore.Range(ctx, func(id string, stored StoredReceipt) bool {
+		expiresAt, ok := pointsExpireAt(stored)
+		if !ok || stored.UserID == "" || stored.ExpiryNotifiedAt != nil || onHold(stored) ||
+			!expiresAt.After(now) || expiresAt.After(now.Add(expiryNotice)) {
+			return true
+		}
+		points := netPoints(stored)
+		if points <= 0 {
+			return true
+		}
+		key := userKey{stored.Tenant, stored.UserID}
+		event := pending[key]
+		if event == nil {
+			event = &PointsExpiringEvent{UserID: stored.UserID, ExpiresAt: expiresAt}
+			pending[key] = event
+		}
+		event.Points += points
+		if expiresAt.Before(event.ExpiresAt) {
+			event.ExpiresAt = expiresAt
+		}
+		event.Receipts = append(event.Receipts, ExpiringReceipt{ReceiptID: id, Retailer: stored.Receipt.StoreName, Points: points, ExpiresAt: expiresAt})
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, event := range pending {
+		sort.Slice(event.Receipts, func(i, j int) bool { return event.Receipts[i].ExpiresAt.Before(event.Receipts[j].ExpiresAt) })
+		for _, receipt := range event.Receipts {
+			err := receiptStore.Update(ctx, receipt.ReceiptID, func(stored *StoredReceipt) error {
+				stored.ExpiryNotifiedAt = &now
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		publishEvent(key.tenant, eventPointsExpiring, *event)
+	}
+	return nil
+}
+
+// getExpiringPoints lists a user's points due to expire within ?days=
+// (default EXPIRY_NOTICE_DAYS), now or as of the time given by asOf.
+func getExpiringPoints(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	r, ok := asOf(w, r)
+	if !ok {
+		return
+	}
+	userID := userPath(r)[0]
+	if !tenantPattern.MatchString(userID) {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	window := expiryNotice
+	if value := r.URL.Query().Get("days"); value != "" {
+		days, err := strconv.Atoi(value)
+		if err != nil || days < 1 || days > maxExpiringDays {
+			http.Error(w, fmt.Sprintf("days must be 1-%d", maxExpiringDays), http.StatusBadRequest)
+			return
+		}
+		window = time.Duration(days) * 24 * time.Hour
+	}
+
+	now := clockFrom(r.Context()).Now()
+	expiring := ExpiringPoints{UserID: userID, Until: now.Add(window), Receipts: []ExpiringReceipt{}}
+	err := receiptStore.Range(r.Context(), func(id string, stored StoredReceipt) bool {
+		if stored.UserID != userID || stored.Tenant != tenant || onHold(stored) || stored.Hold == holdDenied || stored.SubmittedAt.After(now) {
+			return true
+		}
+		expiresAt, ok := pointsExpireAt(stored)
+		if !ok || !expiresAt.After(now) || expiresAt.After(expiring.Until) {
+			return true
+		}
+		points := netPoints(stored)
+		if points <= 0 {
+			return true
+		}
+		expiring.Points += points
+		expiring.Receipts = append(expiring.Receipts, ExpiringReceipt{ReceiptID: id, Retailer: stored.Receipt.StoreName, Points: points, ExpiresAt: expiresAt})
+		return true
+	})
+	if err != nil {
+		if !writeContextError(w, err) {
+			http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		}
+		return
+	}
+	sort.Slice(expiring.Receipts, func(i, j int) bool {
+		a, b := expiring.Receipts[i], expiring.Receipts[j]
+		if !a.ExpiresAt.Equal(b.ExpiresAt) {
+			return a.ExpiresAt.Before(b.ExpiresAt)
+		}
+		return a.ReceiptID < b.ReceiptID
+	})
+	writeJSON(w, r, expiring)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+	"github.com/google/cel-go/cel"
+)
+
+// ExpressionRule is a custom base rule declared as a CEL expression over the
+// receipt, e.g. `retailer.contains("Target") && total > 50.0`. Receipts for
+// which When evaluates to true earn Points.
+//
+// Expressions see these variables:
+//
+//	retailer      string
+//	total         double, in dollars
+//	purchaseDate  string, as submitted
+//	purchaseTime  string, as submitted
+//	purchasedAt   timestamp, in the zone the purchase was recorded in
+//	items         list of maps with description (string), price (double)
+//	              and category (string)
+//	itemCount     int
+//	customFields  map of the receipt's custom fields
+//
+// A receipt the expression cannot be evaluated on, say because it reads a
+// custom field the receipt lacks, earns nothing from the rule.
+type ExpressionRule = scoring.ExpressionRule
+
+// expressionRulePrefix prefixes expression rules' rule names.
+const expressionRulePrefix = "expression:"
+
+// maxExpressionCost bounds the work one evaluation may do, so that an
+// expression iterating over items cannot stall scoring.
+const maxExpressionCost = 100000
+
+// expressionEnv declares the variables expressions may use.
+var expressionEnv = sync.OnceValues(func() (*cel.Env, error) {
+	return cel.NewEnv(
+		cel.CrossTypeNumericComparisons(true),
+		cel.Variable("retailer", cel.StringType),
+		cel.Variable("total", cel.DoubleType),
+		cel.Variable("purchaseDate", cel.StringType),
+		cel.Variable("purchaseTime", cel.StringType),
+		cel.Variable("purchasedAt", cel.TimestampType),
+		cel.Variable("items", cel.ListType(cel.MapType(cel.StringType, cel.DynType))),
+		cel.Variable("itemCount", cel.IntType),
+		cel.Variable("customFields", cel.MapType(cel.StringType, cel.DynType)),
+	)
+})
+
+// compiledExpressions caches programs by expression, since rule sets are
+// copied freely and scored on every request.
+var compiledExpressions sync.Map
+
+// compileExpression type-checks a rule expression, which must be boolean,
+// and returns its program.
+func compileExpression(expression string) (cel.Program, error) {
+	if program, ok := compiledExpressions.Load(expression); ok {
+		return program.(cel.Program), nil
+	}
+	env, err := expressionEnv()
+	if err != nil {
+		return nil, err
+	}
+	ast, issues := env.Compile(expression)
+	if issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("expression must be boolean, not %s", ast.OutputType())
+	}
+	program, err := env.Program(ast, cel.CostLimit(maxExpressionCost))
+	if err != nil {
+		return nil, err
+	}
+	compiledExpressions.Store(expression, program)
+	return program, nil
+}
+
+// expressionVariables binds a receipt's fields to the expression variables.
+// purchasedAt is left unbound when the purchase time cannot be read, so
+// expressions using it fail on such receipts.
+func expressionVariables(receipt Receipt) map[string]interface{} {
+	total, _ := strconv.ParseFloat(receipt.TotalAmount, 64)
+	items := make([]interface{}, len(receipt.PurchasedItems))
+	for i, item := range receipt.PurchasedItems {
+		price, _ := strconv.ParseFloat(item.Price, 64)
+		items[i] = map[string]interface{}{"description": item.Description, "price": price, "category": item.Category}
+	}
+	customFields := receipt.CustomFields
+	if customFields == nil {
+		customFields = map[string]interface{}{}
+	}
+	variables := map[string]interface{}{
+		"retailer":     receipt.StoreName,
+		"total":        total,
+		"purchaseDate": receipt.DateOfPurchase,
+		"purchaseTime": receipt.TimeOfPurchase,
+		"items":        items,
+		"itemCount":    len(receipt.PurchasedItems),
+		"customFields": customFields,
+	}
+	if purchasedAt, err := localPurchaseTime(receipt); err == nil {
+		variables["purchasedAt"] = purchasedAt
+	}
+	return variables
+}
+
+// expressionRule turns a configured expression rule into a scoring rule for
+// a receipt. The expression has been compiled when the configuration was
+// validated.
+func expressionRule(e ExpressionRule, receipt Receipt) scoring.Rule {
+	return scoring.Rule{
+		Name:  expressionRulePrefix + e.Name,
+		Phase: scoring.Base,
+		Score: func(int) (int, string) {
+			program, err := compileExpression(e.When)
+			if err != nil {
+				return 0, ""
+			}
+			result, _, err := program.Eval(expressionVariables(receipt))
+			if err != nil || result.Value() != true {
+				return 0, ""
+			}
+			return e.Points, ""
+		},
+	}
+}
+
+// validateExpressionRules reports every problem with the configured
+// expression rules.
+func (c RulesConfig) validateExpressionRules() []string {
+	var problems []string
+	names := make(map[string]bool)
+	for i, e := range c.ExpressionRules {
+		switch {
+		case e.Name == "":
+			problems = append(problems, fmt.Sprintf("expressionRules[%d].name is required", i))
+		case names[e.Name]:
+			problems = append(problems, fmt.Sprintf("expressionRules[%d].name %q is used twice", i, e.Name))
+		}
+		names[e.Name] = true
+		if e.Points < 0 {
+			problems = append(problems, fmt.Sprintf("expressionRules[%d].points must not be negative", i))
+		}
+		if _, err := compileExpression(e.When); err != nil {
+			problems = append(problems, fmt.Sprintf("expressionRules[%d].when: %v", i, err))
+		}
+	}
+	return problems
+}
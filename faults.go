@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errInjectedFault is returned by storage operations failed on purpose.
+var errInjectedFault = errors.New("injected storage fault")
+
+// FaultConfig describes the faults injected while fault injection is enabled.
+// Rates are probabilities between 0 and 1.
+type FaultConfig struct {
+	LatencyMs          int     `json:"latencyMs"`
+	ErrorRate          float64 `json:"errorRate"`
+	StorageFailureRate float64 `json:"storageFailureRate"`
+}
+
+var (
+	// faultInjectionEnabled is set from FAULT_INJECTION at startup and can
+	// never be switched on through the API, keeping faults out of production.
+	faultInjectionEnabled bool
+	faultMutex            sync.Mutex
+	faults                FaultConfig
+)
+
+// loadFaultConfig enables the fault-injection layer when FAULT_INJECTION=true
+// and wraps the receipt store so storage failures can be simulated.
+func loadFaultConfig() {
+	faultInjectionEnabled = os.Getenv("FAULT_INJECTION") == "true"
+	if faultInjectionEnabled {
+		receiptStore = &faultyStore{next: receiptStore}
+	}
+}
+
+// currentFaults returns the active fault configuration.
+func currentFaults() FaultConfig {
+	faultMutex.Lock()
+	defer faultMutex.Unlock()
+	return faults
+}
+
+// injectFaults delays or fails requests according to the fault configuration.
+// Admin and readiness endpoints are never affected.
+func injectFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !faultInjectionEnabled || strings.HasPrefix(r.URL.Path, "/admin/") || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		config := currentFaults()
+		if config.LatencyMs > 0 {
+			select {
+			case <-time.After(time.Duration(config.LatencyMs) * time.Millisecond):
+			case <-r.Context().Done():
+				writeContextError(w, r.Context().Err())
+				return
+			}
+		}
+		if config.ErrorRate > 0 && rand.Float64() < config.ErrorRate {
+			http.Error(w, "Injected fault", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// faultyStore fails storage operations at the configured rate.
+type faultyStore struct {
+	next ReceiptStore
+}
+
+func (s *faultyStore) fail() bool {
+	rate := currentFaults().StorageFailureRate
+	return rate > 0 && rand.Float64() < rate
+}
+
+func (s *faultyStore) Put(ctx context.Context, id string, stored StoredReceipt) error {
+	if s.fail() {
+		return errInjectedFault
+	}
+	return s.next.Put(ctx, id, stored)
+}
+
+func (s *faultyStore) Get(ctx context.Context, id string) (StoredReceipt, error) {
+	if s.fail() {
+		return StoredReceipt{}, errInjectedFault
+	}
+	return s.next.Get(ctx, id)
+}
+
+func (s *faultyStore) Update(ctx context.Context, id string, fn func(*StoredReceipt) error) error {
+	if s.fail() {
+		return errInjectedFault
+	}
+	return s.next.Update(ctx, id, fn)
+}
+
+func (s *faultyStore) Range(ctx context.Context, fn func(id string, stored StoredReceipt) bool) error {
+	if s.fail() {
+		return errInjectedFault
+	}
+	return s.next.Range(ctx, fn)
+}
+
+func (s *faultyStore) Len(ctx context.Context) (int, error) {
+	if s.fail() {
+		return 0, errInjectedFault
+	}
+	return s.next.Len(ctx)
+}
+
+// faultsHandler reads (GET), replaces (PUT) or clears (DELETE) the fault
+// configuration.
+func faultsHandler(w http.ResponseWriter, r *http.Request) {
+	if !faultInjectionEnabled {
+		http.Error(w, "Fault injection disabled. Start the server with FAULT_INJECTION=true.", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var config FaultConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil ||
+			config.LatencyMs < 0 || config.ErrorRate < 0 || config.ErrorRate > 1 ||
+			config.StorageFailureRate < 0 || config.StorageFailureRate > 1 {
+			http.Error(w, "Invalid fault configuration", http.StatusBadRequest)
+			return
+		}
+		faultMutex.Lock()
+		faults = config
+		faultMutex.Unlock()
+	case http.MethodDelete:
+		faultMutex.Lock()
+		faults = FaultConfig{}
+		faultMutex.Unlock()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, currentFaults())
+}
+
+func (s *faultyStore) FindByContentHash(ctx context.Context, tenant, hash string) (string, error) {
+	if s.fail() {
+		return "", errInjectedFault
+	}
+	return s.next.FindByContentHash(ctx, tenant, hash)
+}
+
+func (s *faultyStore) Close() error {
+	return s.next.Close()
+}
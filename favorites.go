@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+// FavoriteResponse reports a receipt's favorite flag.
+type FavoriteResponse struct {
+	ReceiptID string `json:"id"`
+	Favorite  bool   `json:"favorite"`
+}
+
+// ResubmitRequest overrides the purchase date and time of a resubmitted
+// receipt. Both default to the current time in the rules zone.
+type ResubmitRequest struct {
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+}
+
+// errNotReceiptOwner is returned when a user acts on another user's receipt.
+var errNotReceiptOwner = &httpError{status: http.StatusForbidden, message: "Receipt belongs to another user"}
+
+// checkReceiptAccess checks that a request may use a stored receipt, as
+// listings do: receipts of other tenants are reported not found, and a
+// receipt with an owner may only be used by that user.
+func checkReceiptAccess(r *http.Request, stored StoredReceipt) error {
+	sub, ok := submissionFromRequest(r)
+	if !ok {
+		return &httpError{status: http.StatusBadRequest, message: "Invalid tenant or user ID"}
+	}
+	if stored.Tenant != sub.Tenant {
+		return errReceiptNotFound
+	}
+	if stored.UserID != "" && sub.UserID != stored.UserID {
+		return errNotReceiptOwner
+	}
+	return nil
+}
+
+// ownedReceipt loads a receipt the request may use.
+func ownedReceipt(r *http.Request, receiptID string) (StoredReceipt, error) {
+	stored, err := receiptStore.Get(r.Context(), receiptID)
+	if err != nil {
+		return stored, err
+	}
+	return stored, checkReceiptAccess(r, stored)
+}
+
+// favoriteHandler marks (PUT) or unmarks (DELETE) a receipt as a favorite.
+func favoriteHandler(w http.ResponseWriter, r *http.Request) {
+	var favorite bool
+	switch r.Method {
+	case http.MethodPut:
+		favorite = true
+	case http.MethodDelete:
+		favorite = false
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	receiptID := receiptIDFromPath(r)
+	if _, err := ownedReceipt(r, receiptID); err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+	err := receiptStore.Update(r.Context(), receiptID, func(stored *StoredReceipt) error {
+		stored.Favorite = favorite
+		return nil
+	})
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+	writeJSON(w, r, FavoriteResponse{ReceiptID: receiptID, Favorite: favorite})
+}
+
+// resubmitReceipt submits a copy of an earlier receipt with a new purchase
+// date and time, for quickly recording a repeat purchase.
+func resubmitReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub, ok := submissionFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid tenant or user ID", http.StatusBadRequest)
+		return
+	}
+	original, err := ownedReceipt(r, receiptIDFromPath(r))
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+
+	var request ResubmitRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		http.Error(w, "Invalid resubmit request", http.StatusBadRequest)
+		return
+	}
+	now := clockFrom(r.Context()).Now().In(rulesLocation)
+	if request.PurchaseDate == "" {
+		request.PurchaseDate = now.Format("2006-01-02")
+	}
+	if request.PurchaseTime == "" {
+		request.PurchaseTime = now.Format("15:04")
+	}
+
+	receipt := original.Receipt
+	receipt.PurchasedItems = append([]Item{}, original.Receipt.PurchasedItems...)
+	receipt.DateOfPurchase = request.PurchaseDate
+	receipt.TimeOfPurchase = request.PurchaseTime
+	if sub.UserID == "" {
+		sub.UserID = original.UserID
+	}
+	if r.Header.Get(tenantHeader) == "" {
+		sub.Tenant = original.Tenant
+	}
+
+	receiptID, stored, err := submitReceipt(r.Context(), sub, receipt)
+	if err != nil {
+		writeSubmitError(w, r, err)
+		return
+	}
+	writeJSONStatus(w, r, http.StatusCreated, ReceiptResponse{ReceiptID: receiptID, DuplicateOf: stored.DuplicateOf})
+}
+
+// FavoriteReceipt is a favorited receipt in a user's list.
+type FavoriteReceipt struct {
+	ReceiptID string  `json:"id"`
+	Receipt   Receipt `json:"receipt"`
+}
+
+// getFavorites lists a tenant user's favorite receipts.
+func getFavorites(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := userPath(r)[0]
+	favorites := []FavoriteReceipt{}
+	err := receiptStore.Range(r.Context(), func(id string, stored StoredReceipt) bool {
+		if stored.UserID == userID && stored.Tenant == tenant && stored.Favorite {
+			favorites = append(favorites, FavoriteReceipt{ReceiptID: id, Receipt: stored.Receipt})
+		}
+		return true
+	})
+	if err != nil {
+		if !writeContextError(w, err) {
+			http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, r, favorites)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Cache policies of responses about receipts, which are private to the
+// requesting user. Responses whose contents can no longer change may be
+// cached for a year without revalidating; the others must be revalidated.
+const (
+	immutableCacheControl  = "private, max-age=31536000, immutable"
+	revalidateCacheControl = "private, no-cache"
+)
+
+// errReceiptFinalized is returned when amending a finalized receipt.
+var errReceiptFinalized = &httpError{status: http.StatusConflict, message: "Receipt is finalized"}
+
+// FinalizeResponse reports a finalized receipt and its fixed points.
+type FinalizeResponse struct {
+	ReceiptID   string    `json:"id"`
+	Points      int       `json:"points"`
+	FinalizedAt time.Time `json:"finalizedAt"`
+}
+
+// netPoints returns the points a receipt currently counts for: the points it
+// was awarded under the rules it is pinned to, less any refunded points.
+func netPoints(stored StoredReceipt) int {
+	return stored.Points - stored.RefundedPoints
+}
+
+// recordPointsChange brings the aggregates and leaderboard up to date after
+// a stored receipt changed from previous to current, and publishes a
+// points.updated event for the given reason if its net points changed.
+// Every path that changes a stored receipt's points or hold state calls it.
+func recordPointsChange(receiptID string, previous, current StoredReceipt, reason string) {
+	aggregates.record(previous, netPoints(previous), -1)
+	aggregates.record(current, netPoints(current), 1)
+	leaderboard.update(previous, current)
+	publishPointsUpdated(receiptID, previous, current, reason)
+}
+
+// pointsFixed reports whether a receipt's points and status can no longer
+// change: it is finalized and its points are not held for review, since a
+// held receipt can still be released.
+func pointsFixed(stored StoredReceipt) bool {
+	return stored.FinalizedAt != nil && !onHold(stored)
+}
+
+// setCacheHeaders marks responses about a receipt's points as immutable once
+// they are fixed. Other responses may still change, so caches must
+// revalidate them.
+func setCacheHeaders(w http.ResponseWriter, stored StoredReceipt) {
+	if pointsFixed(stored) {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", revalidateCacheControl)
+	}
+}
+
+// finalizeReceipt fixes a receipt's points as they stand, without rescoring
+// it, and stops further amendments such as refunds or re-verification.
+// Finalizing an already finalized receipt is a no-op.
+func finalizeReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	receiptID := receiptIDFromPath(r)
+	var response FinalizeResponse
+	err := receiptStore.Update(r.Context(), receiptID, func(stored *StoredReceipt) error {
+		if stored.FinalizedAt == nil {
+			now := clockFrom(r.Context()).Now()
+			stored.FinalizedAt = &now
+		}
+		response = FinalizeResponse{ReceiptID: receiptID, Points: netPoints(*stored), FinalizedAt: *stored.FinalizedAt}
+		return nil
+	})
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+	writeJSON(w, r, response)
+}
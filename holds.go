@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Hold states of receipts flagged by duplicate detection. A flagged
+// receipt's points are held, not credited, until an admin reviews it and
+// releases them or denies them for good.
+const (
+	holdHeld     = "held"
+	holdReleased = "released"
+	holdDenied   = "denied"
+)
+
+// Receipt statuses shown to users.
+const (
+	statusCredited = "credited"
+	statusHeld     = "held"
+	statusDenied   = "denied"
+)
+
+// errReceiptNotHeld is returned when reviewing a receipt that is not held.
+var errReceiptNotHeld = &httpError{status: http.StatusConflict, message: "Receipt is not held for review"}
+
+// HoldDecision is the optional body of a release or deny request.
+type HoldDecision struct {
+	Reason string `json:"reason"`
+}
+
+// HoldResponse reports a review decision.
+type HoldResponse struct {
+	ReceiptID string    `json:"id"`
+	Status    string    `json:"status"`
+	Points    int       `json:"points"`
+	Reason    string    `json:"reason,omitempty"`
+	DecidedAt time.Time `json:"decidedAt"`
+}
+
+// HeldReceiptPage is one page of the review queue, oldest first.
+type HeldReceiptPage struct {
+	Receipts []StoredReceiptResponse `json:"receipts"`
+	Total    int                     `json:"total"`
+	Limit    int                     `json:"limit"`
+	Offset   int                     `json:"offset"`
+}
+
+// onHold reports whether a receipt's points are held for review. Receipts
+// flagged before holds were introduced have no hold state and count as
+// held.
+func onHold(stored StoredReceipt) bool {
+	return stored.Hold == holdHeld || (stored.Hold == "" && stored.DuplicateOf != "")
+}
+
+// receiptStatus is a receipt's status as shown to its user.
+func receiptStatus(stored StoredReceipt) string {
+	switch {
+	case onHold(stored):
+		return statusHeld
+	case stored.Hold == holdDenied:
+		return statusDenied
+	}
+	return statusCredited
+}
+
+// holdGate returns a zero-point breakdown for receipts whose points were
+// denied on review, or nil otherwise.
+func holdGate(stored StoredReceipt) []RuleResult {
+	if stored.Hold != holdDenied {
+		return nil
+	}
+	reason := "points were denied on review"
+	if stored.HoldReason != "" {
+		reason += ": " + stored.HoldReason
+	}
+	return []RuleResult{{Rule: "review", Reason: reason}}
+}
+
+// releaseReceipt credits a held receipt's points.
+func releaseReceipt(w http.ResponseWriter, r *http.Request) {
+	decideHold(w, r, holdReleased)
+}
+
+// denyReceipt permanently rejects a held receipt's points. Finalized
+// receipts keep their points and cannot be denied.
+func denyReceipt(w http.ResponseWriter, r *http.Request) {
+	decideHold(w, r, holdDenied)
+}
+
+// decideHold moves a held receipt to the decided state, rescoring denied
+// receipts to zero.
+func decideHold(w http.ResponseWriter, r *http.Request, decision string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request HoldDecision
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "Invalid review decision", http.StatusBadRequest)
+		return
+	}
+
+	receiptID := receiptIDFromPath(r)
+	var previous, decided StoredReceipt
+	err := receiptStore.Update(r.Context(), receiptID, func(stored *StoredReceipt) error {
+		if !onHold(*stored) {
+			return errReceiptNotHeld
+		}
+		if decision == holdDenied && stored.FinalizedAt != nil {
+			return errReceiptFinalized
+		}
+		previous = *stored
+		now := clockFrom(r.Context()).Now()
+		stored.Hold, stored.HoldReason, stored.HoldDecidedAt = decision, request.Reason, &now
+		if decision == holdDenied {
+			awardPoints(stored)
+		}
+		decided = *stored
+		return nil
+	})
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+
+	reason := pointsReleased
+	if decision == holdDenied {
+		reason = pointsDenied
+	}
+	recordPointsChange(receiptID, previous, decided, reason)
+	search.add(receiptID, decided)
+	writeJSON(w, r, HoldResponse{
+		ReceiptID: receiptID,
+		Status:    receiptStatus(decided),
+		Points:    netPoints(decided),
+		Reason:    decided.HoldReason,
+		DecidedAt: *decided.HoldDecidedAt,
+	})
+}
+
+// listHeldReceipts pages through the receipts awaiting review, oldest first.
+func listHeldReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit, offset, ok := pageFromRequest(r)
+	if !ok {
+		http.Error(w, "limit must be 1-500 and offset non-negative", http.StatusBadRequest)
+		return
+	}
+
+	type heldReceipt struct {
+		id     string
+		stored StoredReceipt
+	}
+	var held []heldReceipt
+	err := receiptStore.Range(r.Context(), func(id string, stored StoredReceipt) bool {
+		if onHold(stored) {
+			held = append(held, heldReceipt{id, stored})
+		}
+		return true
+	})
+	if writeContextError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(held, func(i, j int) bool {
+		if !held[i].stored.SubmittedAt.Equal(held[j].stored.SubmittedAt) {
+			return held[i].stored.SubmittedAt.Before(held[j].stored.SubmittedAt)
+		}
+		return held[i].id < held[j].id
+	})
+
+	page := HeldReceiptPage{Receipts: []StoredReceiptResponse{}, Total: len(held), Limit: limit, Offset: offset}
+	for i := offset; i < len(held) && i < offset+limit; i++ {
+		page.Receipts = append(page.Receipts, storedReceiptResponse(held[i].id, held[i].stored))
+	}
+	writeJSON(w, r, page)
+}
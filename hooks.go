@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReceiptHook transforms or enriches a receipt after validation and before
+// it is scored and stored.
+type ReceiptHook interface {
+	Name() string
+	Process(ctx context.Context, receipt Receipt) (Receipt, error)
+}
+
+// HookRejection is returned by hooks that refuse a receipt outright. Any
+// other hook error is treated as a failure of the hook: it is logged and
+// counted, and the receipt continues unchanged.
+type HookRejection struct {
+	Hook   string
+	Reason string
+}
+
+func (e *HookRejection) Error() string {
+	return fmt.Sprintf("rejected by hook %s: %s", e.Hook, e.Reason)
+}
+
+// hookTimeout bounds each script hook run.
+const hookTimeout = 5 * time.Second
+
+// builtinHooks are the compiled-in hooks, by name.
+var builtinHooks = map[string]func() (ReceiptHook, error){
+	"retailerCodes": newRetailerCodesHook,
+}
+
+// HookStats counts a hook's runs.
+type HookStats struct {
+	Name       string  `json:"name"`
+	Calls      int     `json:"calls"`
+	Failures   int     `json:"failures"`
+	Rejections int     `json:"rejections"`
+	TotalMs    float64 `json:"totalMs"`
+	AverageMs  float64 `json:"averageMs"`
+}
+
+var (
+	// receiptHooks run in order on every submitted receipt.
+	receiptHooks []ReceiptHook
+	hookMutex    sync.Mutex
+	hookStats    = make(map[string]*HookStats)
+)
+
+// loadHookConfig reads RECEIPT_HOOKS, a comma-separated list of built-in
+// hook names and "exec:<command>" script hooks, run in the order given.
+func loadHookConfig() error {
+	for _, spec := range strings.Split(os.Getenv("RECEIPT_HOOKS"), ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		var hook ReceiptHook
+		if strings.HasPrefix(spec, "exec:") {
+			args := strings.Fields(strings.TrimPrefix(spec, "exec:"))
+			if len(args) == 0 {
+				return fmt.Errorf("RECEIPT_HOOKS: empty command in %q", spec)
+			}
+			hook = scriptHook{args: args}
+		} else {
+			newHook, ok := builtinHooks[spec]
+			if !ok {
+				return fmt.Errorf("RECEIPT_HOOKS: unknown hook %q", spec)
+			}
+			var err error
+			if hook, err = newHook(); err != nil {
+				return fmt.Errorf("RECEIPT_HOOKS: %s: %w", spec, err)
+			}
+		}
+		receiptHooks = append(receiptHooks, hook)
+		hookStats[hook.Name()] = &HookStats{Name: hook.Name()}
+	}
+	return nil
+}
+
+// runHooks passes a validated receipt through every hook in turn. A hook
+// whose output no longer validates is treated as failed.
+func runHooks(ctx context.Context, receipt Receipt) (Receipt, error) {
+	for _, hook := range receiptHooks {
+		started := time.Now()
+		processed, err := hook.Process(ctx, receipt)
+		if err == nil {
+			err = validateReceipt(processed)
+		}
+
+		var rejection *HookRejection
+		rejected := errors.As(err, &rejection)
+		hookMutex.Lock()
+		stats := hookStats[hook.Name()]
+		stats.Calls++
+		stats.TotalMs += float64(time.Since(started).Microseconds()) / 1000
+		switch {
+		case rejected:
+			stats.Rejections++
+		case err != nil:
+			stats.Failures++
+		}
+		hookMutex.Unlock()
+
+		switch {
+		case rejected:
+			return receipt, rejection
+		case err != nil:
+			log.Printf("hook %s failed: %v", hook.Name(), err)
+		default:
+			receipt = processed
+		}
+	}
+	return receipt, nil
+}
+
+// scriptHook runs an external command that reads the receipt as JSON on
+// stdin and writes the processed receipt to stdout. Exiting with status 2
+// rejects the receipt, with stderr as the reason.
+type scriptHook struct {
+	args []string
+}
+
+// Name implements ReceiptHook.
+func (h scriptHook) Name() string {
+	return "exec:" + strings.Join(h.args, " ")
+}
+
+// Process implements ReceiptHook.
+func (h scriptHook) Process(ctx context.Context, receipt Receipt) (Receipt, error) {
+	input, err := json.Marshal(receipt)
+	if err != nil {
+		return receipt, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, h.args[0], h.args[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) && exit.ExitCode() == 2 {
+			return receipt, &HookRejection{Hook: h.Name(), Reason: strings.TrimSpace(stderr.String())}
+		}
+		return receipt, errors.New(strings.TrimSpace(err.Error() + ": " + stderr.String()))
+	}
+	var processed Receipt
+	if err := json.Unmarshal(stdout.Bytes(), &processed); err != nil {
+		return receipt, fmt.Errorf("invalid output: %w", err)
+	}
+	return processed, nil
+}
+
+// retailerCodesHook replaces retailer codes sent by POS systems with
+// retailer names, using RETAILER_CODES ("TGT=Target,WMT=Walmart").
+type retailerCodesHook struct {
+	names map[string]string
+}
+
+func newRetailerCodesHook() (ReceiptHook, error) {
+	hook := retailerCodesHook{names: make(map[string]string)}
+	for _, pair := range strings.Split(os.Getenv("RETAILER_CODES"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		code, name, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(code) == "" || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("RETAILER_CODES: malformed entry %q", pair)
+		}
+		hook.names[strings.TrimSpace(code)] = strings.TrimSpace(name)
+	}
+	return hook, nil
+}
+
+// Name implements ReceiptHook.
+func (h retailerCodesHook) Name() string {
+	return "retailerCodes"
+}
+
+// Process implements ReceiptHook.
+func (h retailerCodesHook) Process(ctx context.Context, receipt Receipt) (Receipt, error) {
+	if name, ok := h.names[strings.TrimSpace(receipt.StoreName)]; ok {
+		receipt.StoreName = name
+	}
+	return receipt, nil
+}
+
+// getHookStats reports per-hook call, failure and rejection counts and
+// latency, in pipeline order.
+func getHookStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hookMutex.Lock()
+	response := make([]HookStats, 0, len(receiptHooks))
+	for _, hook := range receiptHooks {
+		stats := *hookStats[hook.Name()]
+		if stats.Calls > 0 {
+			stats.AverageMs = stats.TotalMs / float64(stats.Calls)
+		}
+		response = append(response, stats)
+	}
+	hookMutex.Unlock()
+	writeJSON(w, r, response)
+}
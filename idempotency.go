@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// idempotencyHeader carries a client-chosen key identifying one logical
+// request, so that retries of it are answered without repeating it.
+const idempotencyHeader = "Idempotency-Key"
+
+// maxIdempotencyKeyLength bounds idempotency keys accepted from clients.
+const maxIdempotencyKeyLength = 256
+
+// idempotencyTTL is how long a key's response is replayed.
+var idempotencyTTL = 24 * time.Hour
+
+// idempotentResponse is the response recorded for one key. done is closed
+// once the first request has finished; until then, retries wait for it.
+type idempotentResponse struct {
+	requestHash [sha256.Size]byte
+	createdAt   time.Time
+	done        chan struct{}
+	status      int
+	header      http.Header
+	body        []byte
+	// stored is false when the response is not to be replayed.
+	stored bool
+}
+
+// idempotencyCache holds responses by tenant and key, oldest first in order
+// for expiry.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	entries map[string]*idempotentResponse
+	order   []string
+	// hits counts requests answered from, or waiting on, an earlier one.
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+var idempotency = &idempotencyCache{entries: make(map[string]*idempotentResponse)}
+
+// loadIdempotencyConfig reads IDEMPOTENCY_TTL_HOURS.
+func loadIdempotencyConfig() error {
+	if value := os.Getenv("IDEMPOTENCY_TTL_HOURS"); value != "" {
+		hours, err := strconv.Atoi(value)
+		if err != nil || hours <= 0 {
+			return fmt.Errorf("IDEMPOTENCY_TTL_HOURS: invalid value %q", value)
+		}
+		idempotencyTTL = time.Duration(hours) * time.Hour
+	}
+	return nil
+}
+
+// idempotencyRequestHash identifies what a request asks for, so that a key
+// reused for a different request can be refused.
+func idempotencyRequestHash(r *http.Request, body []byte) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", r.Method, r.URL.RawQuery, r.Header.Get(userHeader))
+	h.Write(body)
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// finished reports whether the first request with the key has finished.
+func (e *idempotentResponse) finished() bool {
+	select {
+	case <-e.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// claim returns the key's recorded response, or records a new one for the
+// caller to fill when first is true. Expired keys are dropped first.
+func (c *idempotencyCache) claim(key string, hash [sha256.Size]byte, now time.Time) (entry *idempotentResponse, first bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.order) > 0 {
+		if oldest, ok := c.entries[c.order[0]]; ok {
+			if now.Sub(oldest.createdAt) < idempotencyTTL || !oldest.finished() {
+				break
+			}
+			delete(c.entries, c.order[0])
+		}
+		c.order = c.order[1:]
+	}
+
+	if entry, ok := c.entries[key]; ok {
+		c.hits.Add(1)
+		return entry, false
+	}
+	c.misses.Add(1)
+	entry = &idempotentResponse{requestHash: hash, createdAt: now, done: make(chan struct{})}
+	c.entries[key] = entry
+	c.order = append(c.order, key)
+	return entry, true
+}
+
+// forget drops a key whose response is not to be replayed, so a retry is
+// processed afresh.
+func (c *idempotencyCache) forget(key string, entry *idempotentResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[key] == entry {
+		delete(c.entries, key)
+	}
+}
+
+// stats returns the number of keys held, of them those whose first request
+// is still running, and the hit counts.
+func (c *idempotencyCache) stats(name string) CacheStats {
+	c.mu.Lock()
+	entries, inFlight := len(c.entries), 0
+	for _, entry := range c.entries {
+		if !entry.finished() {
+			inFlight++
+		}
+	}
+	c.mu.Unlock()
+	stats := newCacheStats(name, &entries, c.hits.Load(), c.misses.Load())
+	stats.InFlight = inFlight
+	return stats
+}
+
+// invalidate drops the finished responses of every key, or of the one
+// tenant-scoped key given, so that their next requests are processed afresh, and returns how
+// many it dropped. Requests still running are left for their retries to
+// wait on.
+func (c *idempotencyCache) invalidate(key string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := 0
+	for k, entry := range c.entries {
+		if (key == "" || k == key) && entry.finished() {
+			delete(c.entries, k)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// idempotentRecorder passes a response through while keeping a copy.
+type idempotentRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *idempotentRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *idempotentRecorder) Write(p []byte) (int, error) {
+	r.body.Write(p)
+	return r.ResponseWriter.Write(p)
+}
+
+// idempotent makes a handler honor the Idempotency-Key header. The first
+// request with a key is handled normally; repeats within idempotencyTTL
+// replay its response, marked with Idempotent-Replayed, rather than being
+// handled again, and wait for it while it is still running. Keys are scoped
+// to the tenant, and reusing one for a different request fails with 422.
+// Server errors are not recorded, so those requests can be retried.
+func idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		tenant, ok := tenantFromRequest(r)
+		if !ok || len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Invalid tenant or idempotency key", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Invalid receipt format. Please verify input.", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		hash := idempotencyRequestHash(r, body)
+		scoped := tenant + "\x00" + key
+
+		for {
+			entry, first := idempotency.claim(scoped, hash, time.Now())
+			if first {
+				// Released even if the handler panics, so retries do not
+				// wait forever.
+				defer func() {
+					if !entry.stored {
+						idempotency.forget(scoped, entry)
+					}
+					close(entry.done)
+				}()
+				recorder := &idempotentRecorder{ResponseWriter: w, status: http.StatusOK}
+				next(recorder, r)
+				if recorder.status < 500 {
+					entry.status, entry.header, entry.body = recorder.status, w.Header().Clone(), recorder.body.Bytes()
+					entry.stored = true
+				}
+				return
+			}
+			if entry.requestHash != hash {
+				http.Error(w, "Idempotency key was used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+
+			select {
+			case <-entry.done:
+			case <-r.Context().Done():
+				writeContextError(w, r.Context().Err())
+				return
+			}
+			if !entry.stored {
+				// The first request failed; handle this one afresh.
+				continue
+			}
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+	}
+}
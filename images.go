@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"image"
+	"image/jpeg"
+	"io"
+	"net/http"
+
+	_ "image/gif"
+	_ "image/png"
+)
+
+// maxImageBytes caps the size of an uploaded receipt image.
+const maxImageBytes = 10 << 20
+
+// maxImagePixels caps the width times height of an uploaded image, checked
+// before decoding so that a small file claiming huge dimensions cannot make
+// the decoder allocate gigabytes.
+const maxImagePixels = 25_000_000
+
+var errImageTooLarge = errors.New("image dimensions too large")
+
+// thumbnailSize is the longest edge, in pixels, of generated thumbnails.
+const thumbnailSize = 200
+
+// ImageResponse describes a stored receipt image and where to fetch it.
+type ImageResponse struct {
+	Hash         string `json:"hash"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl"`
+}
+
+// imageKeys returns the blob keys of an image and its thumbnail.
+func imageKeys(hash string) (string, string) {
+	return "images/" + hash, "thumbnails/" + hash + ".jpg"
+}
+
+// storeImage decodes an uploaded image, writes it and a thumbnail to the blob
+// store and returns its content hash. Identical images are stored only once.
+func storeImage(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	imageKey, thumbKey := imageKeys(hash)
+	if blobStore.Exists(imageKey) && blobStore.Exists(thumbKey) {
+		return hash, nil
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	if int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return "", errImageTooLarge
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	var thumb bytes.Buffer
+	if err := jpeg.Encode(&thumb, thumbnail(img, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		return "", err
+	}
+	if err := blobStore.Put(imageKey, data); err != nil {
+		return "", err
+	}
+	if err := blobStore.Put(thumbKey, thumb.Bytes()); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+// thumbnail scales img with nearest-neighbour sampling so that its longest
+// edge is at most size pixels.
+func thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= size && height <= size {
+		return img
+	}
+	newWidth, newHeight := size, height*size/width
+	if height > width {
+		newWidth, newHeight = width*size/height, size
+	}
+	if newWidth < 1 {
+		newWidth = 1
+	}
+	if newHeight < 1 {
+		newHeight = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, newWidth, newHeight))
+	for y := 0; y < newHeight; y++ {
+		for x := 0; x < newWidth; x++ {
+			thumb.Set(x, y, img.At(bounds.Min.X+x*width/newWidth, bounds.Min.Y+y*height/newHeight))
+		}
+	}
+	return thumb
+}
+
+// imageResponse builds signed retrieval URLs for a stored image.
+func imageResponse(hash string) ImageResponse {
+	imageKey, thumbKey := imageKeys(hash)
+	return ImageResponse{Hash: hash, URL: signedBlobURL(imageKey), ThumbnailURL: signedBlobURL(thumbKey)}
+}
+
+// uploadReceiptImage attaches an image, sent as the raw request body, to an
+// existing receipt.
+func uploadReceiptImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	receiptID := receiptIDFromPath(r)
+	if _, err := ownedReceipt(r, receiptID); err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImageBytes))
+	if err != nil {
+		http.Error(w, "Image too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	hash, err := storeImage(data)
+	if err == errImageTooLarge {
+		http.Error(w, "Image dimensions too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid image. Supported formats are JPEG, PNG and GIF.", http.StatusBadRequest)
+		return
+	}
+
+	err = receiptStore.Update(r.Context(), receiptID, func(stored *StoredReceipt) error {
+		stored.Images = appendUnique(stored.Images, hash)
+		return nil
+	})
+	if err == errReceiptNotFound {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to store receipt", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSONStatus(w, r, http.StatusCreated, imageResponse(hash))
+}
+
+// appendUnique appends value to values unless it is already present.
+func appendUnique(values []string, value string) []string {
+	for _, v := range values {
+		if v == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
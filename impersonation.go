@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// impersonationHeader carries an impersonation token. Requests bearing one
+// act as the token's user.
+const impersonationHeader = "X-Impersonation-Token"
+
+// Impersonation scopes.
+const (
+	// scopeRead allows GET and HEAD requests only.
+	scopeRead = "read"
+	// scopeWrite additionally allows requests that change data.
+	scopeWrite = "write"
+)
+
+const (
+	// maxImpersonationTTL bounds how long an impersonation token may live.
+	maxImpersonationTTL = 8 * time.Hour
+	// defaultImpersonationTTL applies when no TTL is requested.
+	defaultImpersonationTTL = 30 * time.Minute
+	// maxAuditEntries bounds the in-memory audit log.
+	maxAuditEntries = 10000
+)
+
+// Impersonation is a time-limited grant to act as a user.
+type Impersonation struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId"`
+	Tenant    string    `json:"tenant"`
+	Scope     string    `json:"scope"`
+	Admin     string    `json:"admin"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Revoked   bool      `json:"revoked,omitempty"`
+	// Token is only returned when the impersonation is created.
+	Token string `json:"token,omitempty"`
+}
+
+// ImpersonationRequest asks for an impersonation token.
+type ImpersonationRequest struct {
+	UserID string `json:"userId"`
+	Tenant string `json:"tenant"`
+	Scope  string `json:"scope"`
+	// Admin names the person requesting the token, for the audit log.
+	Admin      string `json:"admin"`
+	Reason     string `json:"reason"`
+	TTLMinutes int    `json:"ttlMinutes"`
+}
+
+// AuditEntry records an action taken on a user's behalf.
+type AuditEntry struct {
+	Time            time.Time `json:"time"`
+	Action          string    `json:"action"`
+	ImpersonationID string    `json:"impersonationId"`
+	Admin           string    `json:"admin"`
+	UserID          string    `json:"userId"`
+	Method          string    `json:"method,omitempty"`
+	Path            string    `json:"path,omitempty"`
+	Status          int       `json:"status,omitempty"`
+}
+
+var (
+	impersonationMutex sync.Mutex
+	// impersonations are keyed by the SHA-256 of their token.
+	impersonations = make(map[string]*Impersonation)
+	auditLog       []AuditEntry
+)
+
+// expireImpersonations drops grants that have expired, revoked or not, so
+// that issued tokens do not accumulate. The caller holds impersonationMutex.
+func expireImpersonations(now time.Time) {
+	for key, grant := range impersonations {
+		if now.After(grant.ExpiresAt) {
+			delete(impersonations, key)
+		}
+	}
+}
+
+// recordAudit appends an entry to the audit log, dropping the oldest
+// entries beyond maxAuditEntries.
+func recordAudit(entry AuditEntry) {
+	impersonationMutex.Lock()
+	defer impersonationMutex.Unlock()
+	auditLog = append(auditLog, entry)
+	if len(auditLog) > maxAuditEntries {
+		auditLog = auditLog[len(auditLog)-maxAuditEntries:]
+	}
+}
+
+// impersonate lets requests carrying an impersonation token act as its user:
+// the token's user and tenant replace the request's identity headers, the
+// token's scope is enforced and the outcome, including refusals, is written
+// to the audit log.
+func impersonate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(impersonationHeader)
+		if token == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		impersonationMutex.Lock()
+		expireImpersonations(time.Now())
+		grant, ok := impersonations[hashKey(token)]
+		var current Impersonation
+		if ok {
+			current = *grant
+		}
+		impersonationMutex.Unlock()
+		if !ok || current.Revoked || time.Now().After(current.ExpiresAt) {
+			http.Error(w, "Invalid or expired impersonation token", http.StatusUnauthorized)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/admin/"):
+			http.Error(recorder, "Admin endpoints cannot be impersonated", http.StatusForbidden)
+		case current.Scope == scopeRead && r.Method != http.MethodGet && r.Method != http.MethodHead:
+			http.Error(recorder, "Impersonation token is read-only", http.StatusForbidden)
+		default:
+			r = r.Clone(r.Context())
+			r.Header.Set(userHeader, current.UserID)
+			r.Header.Set(tenantHeader, current.Tenant)
+			next.ServeHTTP(recorder, r)
+		}
+		recordAudit(AuditEntry{
+			Time:            time.Now(),
+			Action:          "request",
+			ImpersonationID: current.ID,
+			Admin:           current.Admin,
+			UserID:          current.UserID,
+			Method:          r.Method,
+			Path:            r.URL.Path,
+			Status:          recorder.status,
+		})
+	})
+}
+
+// impersonationsHandler lists (GET) or issues (POST) impersonation tokens.
+func impersonationsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		impersonationMutex.Lock()
+		expireImpersonations(time.Now())
+		list := make([]Impersonation, 0, len(impersonations))
+		for _, grant := range impersonations {
+			list = append(list, *grant)
+		}
+		impersonationMutex.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+		writeJSON(w, r, list)
+	case http.MethodPost:
+		createImpersonation(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createImpersonation issues a token to act as a user.
+func createImpersonation(w http.ResponseWriter, r *http.Request) {
+	var request ImpersonationRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid impersonation request", http.StatusBadRequest)
+		return
+	}
+	if request.Tenant == "" {
+		request.Tenant = defaultTenant
+	}
+	if request.Scope == "" {
+		request.Scope = scopeRead
+	}
+	ttl := time.Duration(request.TTLMinutes) * time.Minute
+	if request.TTLMinutes == 0 {
+		ttl = defaultImpersonationTTL
+	}
+	switch {
+	case !tenantPattern.MatchString(request.UserID) || !tenantPattern.MatchString(request.Tenant):
+		http.Error(w, "Invalid user or tenant ID", http.StatusBadRequest)
+		return
+	case request.Scope != scopeRead && request.Scope != scopeWrite:
+		http.Error(w, "Scope must be read or write", http.StatusBadRequest)
+		return
+	case strings.TrimSpace(request.Admin) == "" || strings.TrimSpace(request.Reason) == "":
+		http.Error(w, "Admin and reason are required", http.StatusBadRequest)
+		return
+	case ttl <= 0 || ttl > maxImpersonationTTL:
+		http.Error(w, "ttlMinutes must be between 1 and 480", http.StatusBadRequest)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	grant := &Impersonation{
+		ID:        uuid.New().String(),
+		UserID:    request.UserID,
+		Tenant:    request.Tenant,
+		Scope:     request.Scope,
+		Admin:     request.Admin,
+		Reason:    request.Reason,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	token := hex.EncodeToString(secret)
+	impersonationMutex.Lock()
+	expireImpersonations(now)
+	impersonations[hashKey(token)] = grant
+	response := *grant
+	impersonationMutex.Unlock()
+	recordAudit(AuditEntry{Time: now, Action: "issue", ImpersonationID: grant.ID, Admin: grant.Admin, UserID: grant.UserID})
+
+	response.Token = token
+	writeJSONStatus(w, r, http.StatusCreated, response)
+}
+
+// revokeImpersonation handles DELETE /admin/impersonations/{id}.
+func revokeImpersonation(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/impersonations/"), "/")
+	impersonationMutex.Lock()
+	expireImpersonations(time.Now())
+	var revoked *Impersonation
+	for _, grant := range impersonations {
+		if grant.ID == id {
+			grant.Revoked = true
+			revoked = grant
+		}
+	}
+	impersonationMutex.Unlock()
+	if revoked == nil {
+		http.Error(w, "Impersonation not found", http.StatusNotFound)
+		return
+	}
+	recordAudit(AuditEntry{Time: time.Now(), Action: "revoke", ImpersonationID: revoked.ID, Admin: revoked.Admin, UserID: revoked.UserID})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getAuditLog lists audit entries, newest first, optionally filtered by
+// ?user= and ?impersonation=.
+func getAuditLog(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := r.URL.Query().Get("user")
+	impersonationID := r.URL.Query().Get("impersonation")
+	impersonationMutex.Lock()
+	entries := []AuditEntry{}
+	for i := len(auditLog) - 1; i >= 0; i-- {
+		entry := auditLog[i]
+		if (userID == "" || entry.UserID == userID) && (impersonationID == "" || entry.ImpersonationID == impersonationID) {
+			entries = append(entries, entry)
+		}
+	}
+	impersonationMutex.Unlock()
+	writeJSON(w, r, entries)
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ingestClient identifies the ingester in duplicate reports.
+	ingestClient = "ingest"
+	// ingestSettle is how long a file must go unmodified before it is
+	// picked up, so files still being written are left alone.
+	ingestSettle = 2 * time.Second
+)
+
+// IngestConfig configures the watch directory ingester.
+type IngestConfig struct {
+	Dir      string
+	Interval time.Duration
+	Tenant   string
+}
+
+// IngestResult reports the outcome of one receipt from an ingested file.
+type IngestResult struct {
+	Line      int    `json:"line,omitempty"`
+	ReceiptID string `json:"id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// ingestConfig is nil unless INGEST_DIR is set.
+var ingestConfig *IngestConfig
+
+// loadIngestConfig reads INGEST_DIR, INGEST_INTERVAL_SECONDS (default 10)
+// and INGEST_TENANT.
+func loadIngestConfig() error {
+	dir := os.Getenv("INGEST_DIR")
+	if dir == "" {
+		return nil
+	}
+	config := &IngestConfig{Dir: dir, Interval: 10 * time.Second, Tenant: defaultTenant}
+	if value := os.Getenv("INGEST_INTERVAL_SECONDS"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("INGEST_INTERVAL_SECONDS: invalid value %q", value)
+		}
+		config.Interval = time.Duration(seconds) * time.Second
+	}
+	if tenant := os.Getenv("INGEST_TENANT"); tenant != "" {
+		if !tenantPattern.MatchString(tenant) {
+			return fmt.Errorf("INGEST_TENANT: invalid tenant %q", tenant)
+		}
+		config.Tenant = tenant
+	}
+	for _, sub := range []string{"done", "failed"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return fmt.Errorf("INGEST_DIR: %w", err)
+		}
+	}
+	ingestConfig = config
+	return nil
+}
+
+// watchIngestDir polls the ingest directory for new files until the
+// process exits.
+func watchIngestDir(config *IngestConfig) {
+	for {
+		scanIngestDir(config)
+		time.Sleep(config.Interval)
+	}
+}
+
+// scanIngestDir processes every settled .json and .csv file in the ingest
+// directory.
+func scanIngestDir(config *IngestConfig) {
+	entries, err := os.ReadDir(config.Dir)
+	if err != nil {
+		log.Printf("ingest: %v", err)
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isBatchFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < ingestSettle {
+			continue
+		}
+		ingestFile(config, entry.Name())
+	}
+}
+
+// ingestFile submits every receipt in a file, then moves it to done/ when
+// all were accepted or to failed/ otherwise. A <name>.result.json report
+// with the receipt IDs and errors is written alongside the moved file.
+func ingestFile(config *IngestConfig, name string) {
+	path := filepath.Join(config.Dir, name)
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("ingest: %s: %v", name, err)
+		return
+	}
+	results := ingestBatch(config.Tenant, name, f)
+	f.Close()
+
+	target := batchOutcome(results)
+	dest := filepath.Join(config.Dir, target, name)
+	if err := os.Rename(path, dest); err != nil {
+		log.Printf("ingest: %s: %v", name, err)
+		return
+	}
+	report, _ := json.MarshalIndent(results, "", "  ")
+	if err := os.WriteFile(dest+".result.json", report, 0o644); err != nil {
+		log.Printf("ingest: %s: %v", name, err)
+	}
+	log.Printf("ingest: %s: %d receipts, moved to %s", name, len(results), target)
+}
+
+// batchOutcome returns "done" when every receipt in a batch was accepted
+// and "failed" otherwise.
+func batchOutcome(results []IngestResult) string {
+	for _, result := range results {
+		if result.Error != "" {
+			return "failed"
+		}
+	}
+	return "done"
+}
+
+// isBatchFile reports whether a file name has a batch extension.
+func isBatchFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return !strings.HasPrefix(name, ".") && (ext == ".json" || ext == ".csv")
+}
+
+// ingestBatch parses a batch file, CSV or JSON according to its name, and
+// submits its receipts for the tenant. A file that cannot be parsed yields
+// a single result carrying the error.
+func ingestBatch(tenant, name string, r io.Reader) []IngestResult {
+	var receipts []ingestRecord
+	var err error
+	if strings.EqualFold(filepath.Ext(name), ".csv") {
+		receipts, err = parseReceiptCSV(r)
+	} else {
+		receipts, err = parseReceiptJSON(r)
+	}
+	if err != nil {
+		return []IngestResult{{Error: err.Error()}}
+	}
+
+	results := make([]IngestResult, 0, len(receipts))
+	for _, record := range receipts {
+		result := IngestResult{Line: record.line}
+		if record.userID != "" && !tenantPattern.MatchString(record.userID) {
+			result.Error = "invalid user ID"
+			results = append(results, result)
+			continue
+		}
+		if err := paceBulkImport(context.Background()); err != nil {
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
+		}
+		sub := Submission{Tenant: tenant, Client: ingestClient, UserID: record.userID, Source: sourceImport, Bulk: true}
+		id, _, err := submitReceipt(context.Background(), sub, record.receipt)
+		result.ReceiptID = id
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// ingestRecord is one receipt read from an ingest file.
+type ingestRecord struct {
+	line    int
+	userID  string
+	receipt Receipt
+}
+
+// parseReceiptJSON reads a single receipt or an array of receipts.
+func parseReceiptJSON(r io.Reader) ([]ingestRecord, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var receipts []Receipt
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(data, &receipts)
+	} else {
+		var receipt Receipt
+		err = json.Unmarshal(data, &receipt)
+		receipts = []Receipt{receipt}
+	}
+	if err != nil {
+		return nil, err
+	}
+	records := make([]ingestRecord, len(receipts))
+	for i, receipt := range receipts {
+		records[i] = ingestRecord{receipt: receipt}
+	}
+	return records, nil
+}
+
+// ingestCSVColumns are the required CSV columns. Rows with the same
+// "receipt" value are the items of one receipt; an optional "userId"
+// column credits it to a user.
+var ingestCSVColumns = []string{"receipt", "retailer", "purchaseDate", "purchaseTime", "total", "shortDescription", "price"}
+
+// parseReceiptCSV reads receipts from a CSV file with a header row.
+func parseReceiptCSV(r io.Reader) ([]ingestRecord, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range ingestCSVColumns {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	var records []ingestRecord
+	byKey := make(map[string]int)
+	for line := 2; ; line++ {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		key := field(row, "receipt")
+		i, ok := byKey[key]
+		if !ok {
+			i = len(records)
+			byKey[key] = i
+			records = append(records, ingestRecord{
+				line:   line,
+				userID: field(row, "userId"),
+				receipt: Receipt{
+					StoreName:      field(row, "retailer"),
+					DateOfPurchase: field(row, "purchaseDate"),
+					TimeOfPurchase: field(row, "purchaseTime"),
+					TotalAmount:    field(row, "total"),
+				},
+			})
+		}
+		records[i].receipt.PurchasedItems = append(records[i].receipt.PurchasedItems, Item{
+			Description: field(row, "shortDescription"),
+			Price:       field(row, "price"),
+		})
+	}
+	return records, nil
+}
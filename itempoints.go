@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+)
+
+// ItemPoints is one item's share of the points a receipt earned.
+type ItemPoints struct {
+	Index       int    `json:"index"`
+	Description string `json:"shortDescription"`
+	Price       string `json:"price"`
+	Points      int    `json:"points"`
+}
+
+// ItemPointsResponse lists the per-item attribution of a receipt's points.
+type ItemPointsResponse struct {
+	ReceiptID string       `json:"id"`
+	Points    int          `json:"points"`
+	Items     []ItemPoints `json:"items"`
+}
+
+// awardPoints scores a stored receipt under the rules it is pinned to,
+// pinning it to the active rules first if need be, and records the points,
+// their per-item attribution and how they were rounded on it.
+func awardPoints(stored *StoredReceipt) {
+	rules := pinnedRules(stored)
+	breakdown := rules.storedBreakdown(*stored)
+	stored.Points = sumBreakdown(breakdown)
+	stored.ItemPoints = rules.attributeItems(stored.Receipt, breakdown)
+	stored.Rounding = rules.descriptionRounding(stored.Receipt, breakdown)
+}
+
+// attributeItems splits the points in a breakdown across the receipt's items.
+// Description points go to the item that earned them and pair points to the
+// paired items; receipt-level points are shared in proportion to price. The
+// shares always add up to the breakdown's total, so a cap or a zeroed
+// receipt scales every item down together.
+func (c RulesConfig) attributeItems(receipt Receipt, breakdown []RuleResult) []int {
+	items := receipt.PurchasedItems
+	engine := c.engine()
+	direct := make([]int64, len(items))
+	prices := make([]int64, len(items))
+	receiptLevel := 0
+	for _, result := range breakdown {
+		switch result.Rule {
+		case "itemDescriptionLength":
+			for i, item := range items {
+				direct[i] += int64(engine.RoundDescriptionPoints(engine.ExactDescriptionPoints(scoringItem(item))))
+			}
+		case "itemPairs":
+			for i := 0; i+1 < len(items); i += 2 {
+				pair := apportion(int64(c.ItemPairPoints), []int64{1, 1})
+				direct[i] += pair[0]
+				direct[i+1] += pair[1]
+			}
+		case "pointsCap":
+		default:
+			receiptLevel += result.Points
+		}
+	}
+	for i, item := range items {
+		if cents, err := scoring.ParseCents(item.Price); err == nil && cents > 0 {
+			prices[i] = cents
+		}
+	}
+
+	weights := apportion(int64(receiptLevel), prices)
+	for i := range weights {
+		weights[i] += direct[i]
+	}
+	shares := apportion(int64(sumBreakdown(breakdown)), weights)
+	points := make([]int, len(shares))
+	for i, share := range shares {
+		points[i] = int(share)
+	}
+	return points
+}
+
+// apportion divides total into whole parts proportional to weights using
+// the largest remainder method. Without positive weights the total is split
+// evenly.
+func apportion(total int64, weights []int64) []int64 {
+	parts := make([]int64, len(weights))
+	if len(weights) == 0 {
+		return parts
+	}
+	var sum int64
+	for _, weight := range weights {
+		if weight > 0 {
+			sum += weight
+		}
+	}
+	if sum == 0 {
+		weights = make([]int64, len(parts))
+		for i := range weights {
+			weights[i] = 1
+		}
+		sum = int64(len(weights))
+	}
+
+	remainders := make([]int64, len(parts))
+	assigned := int64(0)
+	for i, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		parts[i] = total * weight / sum
+		remainders[i] = total * weight % sum
+		assigned += parts[i]
+	}
+	order := make([]int, len(parts))
+	for i := range order {
+		order[i] = i
+	}
+	// Hand the leftover out one point at a time, largest remainder first;
+	// for negative totals the most negative remainders give up a point.
+	left := total - assigned
+	step := int64(1)
+	if left < 0 {
+		step = -1
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]]*step > remainders[order[b]]*step
+	})
+	for i := 0; left != 0; i++ {
+		parts[order[i%len(order)]] += step
+		left -= step
+	}
+	return parts
+}
+
+// backfillItemPoints records the attribution of a receipt's points, from its
+// pinned rules, on a receipt stored without it, and returns the receipt.
+func backfillItemPoints(ctx context.Context, receiptID string) (StoredReceipt, error) {
+	var updated StoredReceipt
+	err := receiptStore.Update(ctx, receiptID, func(stored *StoredReceipt) error {
+		if stored.ItemPoints == nil {
+			rules := pinnedRules(stored)
+			breakdown := rules.storedBreakdown(*stored)
+			stored.ItemPoints = rules.attributeItems(stored.Receipt, breakdown)
+			stored.Rounding = rules.descriptionRounding(stored.Receipt, breakdown)
+		}
+		updated = *stored
+		return nil
+	})
+	return updated, err
+}
+
+// getItemPoints returns how a receipt's points were attributed to its items
+// when they were awarded.
+func getItemPoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	receiptID := receiptIDFromPath(r)
+	stored, err := ownedReceipt(r, receiptID)
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+	if stored.ItemPoints == nil {
+		// Receipts stored before attribution was recorded, or whose detail
+		// was dropped, are attributed once and stored.
+		if stored, err = backfillItemPoints(r.Context(), receiptID); err != nil {
+			writeReceiptError(w, err)
+			return
+		}
+	}
+
+	setCacheHeaders(w, stored)
+	response := ItemPointsResponse{ReceiptID: receiptID, Points: stored.Points, Items: make([]ItemPoints, len(stored.Receipt.PurchasedItems))}
+	for i, item := range stored.Receipt.PurchasedItems {
+		response.Items[i] = ItemPoints{Index: i, Description: item.Description, Price: item.Price}
+		if i < len(stored.ItemPoints) {
+			response.Items[i].Points = stored.ItemPoints[i]
+		}
+	}
+	writeJSON(w, r, response)
+}
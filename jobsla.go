@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Kinds of asynchronous job whose processing times are tracked.
+const (
+	jobUpload                = "uploads"
+	jobInteractiveSubmission = "submissions.interactive"
+	jobBulkSubmission        = "submissions.bulk"
+)
+
+// JobTiming records when an asynchronous job was queued, picked up and
+// finished. WithinSLA is set once it has finished.
+type JobTiming struct {
+	QueuedAt   time.Time  `json:"queuedAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	WithinSLA  *bool      `json:"withinSla,omitempty"`
+}
+
+// JobSLASummary reports how one kind of job meets the processing SLA. Jobs
+// and WithinSLA count every job finished since startup; the percentiles, in
+// milliseconds, cover the last five minutes, from queuing to finishing.
+type JobSLASummary struct {
+	Jobs       int64   `json:"jobs"`
+	WithinSLA  int64   `json:"withinSla"`
+	Compliance float64 `json:"compliance"`
+	Met        bool    `json:"met"`
+	Recent     int     `json:"recent"`
+	WaitP95    float64 `json:"waitP95Ms"`
+	P50        float64 `json:"p50Ms"`
+	P95        float64 `json:"p95Ms"`
+	P99        float64 `json:"p99Ms"`
+}
+
+// JobSLAResponse is the processing SLA and how each kind of job meets it.
+type JobSLAResponse struct {
+	SLASeconds    float64                  `json:"slaSeconds"`
+	TargetPercent float64                  `json:"targetPercent"`
+	Jobs          map[string]JobSLASummary `json:"jobs"`
+}
+
+// jobStats accumulates the finished jobs of one kind.
+type jobStats struct {
+	jobs      int64
+	withinSLA int64
+	wait      latencyRing
+	total     latencyRing
+}
+
+var (
+	// jobSLA is how soon after being queued a job should finish.
+	jobSLA = 30 * time.Second
+	// jobSLATarget is the percentage of jobs that should finish within
+	// jobSLA.
+	jobSLATarget = 95.0
+
+	jobStatsMutex  sync.Mutex
+	jobStatsByKind = make(map[string]*jobStats)
+)
+
+// loadJobSLAConfig reads JOB_SLA_SECONDS and JOB_SLA_TARGET_PERCENT.
+func loadJobSLAConfig() error {
+	if value := os.Getenv("JOB_SLA_SECONDS"); value != "" {
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(seconds > 0) {
+			return fmt.Errorf("JOB_SLA_SECONDS: invalid value %q", value)
+		}
+		jobSLA = time.Duration(seconds * float64(time.Second))
+	}
+	if value := os.Getenv("JOB_SLA_TARGET_PERCENT"); value != "" {
+		percent, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(percent > 0 && percent <= 100) {
+			return fmt.Errorf("JOB_SLA_TARGET_PERCENT: invalid value %q", value)
+		}
+		jobSLATarget = percent
+	}
+	return nil
+}
+
+// newJobTiming starts timing a job queued now.
+func newJobTiming(now time.Time) *JobTiming {
+	return &JobTiming{QueuedAt: now}
+}
+
+// start records that a worker picked the job up.
+func (t *JobTiming) start(now time.Time) {
+	t.StartedAt = &now
+}
+
+// finish records that the job finished and adds it to its kind's SLA
+// figures.
+func (t *JobTiming) finish(kind string, now time.Time) {
+	if t.StartedAt == nil {
+		t.start(now)
+	}
+	t.FinishedAt = &now
+	total := now.Sub(t.QueuedAt)
+	within := total <= jobSLA
+	t.WithinSLA = &within
+
+	jobStatsMutex.Lock()
+	defer jobStatsMutex.Unlock()
+	stats, ok := jobStatsByKind[kind]
+	if !ok {
+		stats = &jobStats{}
+		jobStatsByKind[kind] = stats
+	}
+	stats.jobs++
+	if within {
+		stats.withinSLA++
+	}
+	stats.wait.add(latencySample{at: now, duration: t.StartedAt.Sub(t.QueuedAt)})
+	stats.total.add(latencySample{at: now, duration: total})
+}
+
+// jobSLASummaries reports every kind of job that has finished since startup.
+func jobSLASummaries(now time.Time) map[string]JobSLASummary {
+	jobStatsMutex.Lock()
+	defer jobStatsMutex.Unlock()
+
+	summaries := make(map[string]JobSLASummary, len(jobStatsByKind))
+	for kind, stats := range jobStatsByKind {
+		total := stats.total.recent(now)
+		summary := JobSLASummary{
+			Jobs:       stats.jobs,
+			WithinSLA:  stats.withinSLA,
+			Compliance: float64(stats.withinSLA) / float64(stats.jobs),
+			Recent:     len(total),
+			WaitP95:    percentileMs(stats.wait.recent(now), 0.95),
+			P50:        percentileMs(total, 0.50),
+			P95:        percentileMs(total, 0.95),
+			P99:        percentileMs(total, 0.99),
+		}
+		summary.Met = summary.Compliance*100 >= jobSLATarget
+		summaries[kind] = summary
+	}
+	return summaries
+}
+
+// getJobSLA reports how asynchronous jobs meet the processing SLA.
+func getJobSLA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, JobSLAResponse{
+		SLASeconds:    jobSLA.Seconds(),
+		TargetPercent: jobSLATarget,
+		Jobs:          jobSLASummaries(time.Now()),
+	})
+}
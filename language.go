@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// Transliterator rewrites text in the given language into a Latin-script
+// form suitable for the keyword and length-based scoring rules.
+type Transliterator interface {
+	Transliterate(text, lang string) (string, error)
+}
+
+// descriptionTransliterator is the provider applied to item descriptions
+// before scoring. A nil provider leaves descriptions untouched.
+var descriptionTransliterator Transliterator
+
+// scriptLanguages maps a Unicode script to the language assumed for it.
+var scriptLanguages = []struct {
+	table *unicode.RangeTable
+	lang  string
+}{
+	{unicode.Cyrillic, "ru"},
+	{unicode.Greek, "el"},
+	{unicode.Hiragana, "ja"},
+	{unicode.Katakana, "ja"},
+	{unicode.Hangul, "ko"},
+	{unicode.Han, "zh"},
+	{unicode.Arabic, "ar"},
+	{unicode.Hebrew, "he"},
+	{unicode.Devanagari, "hi"},
+}
+
+// detectLanguage guesses the language of text from the script used by the
+// majority of its letters, defaulting to "en" for Latin text.
+func detectLanguage(text string) string {
+	counts := make(map[string]int)
+	latin := 0
+	for _, char := range text {
+		if !unicode.IsLetter(char) {
+			continue
+		}
+		if unicode.Is(unicode.Latin, char) {
+			latin++
+			continue
+		}
+		for _, s := range scriptLanguages {
+			if unicode.Is(s.table, char) {
+				counts[s.lang]++
+				break
+			}
+		}
+	}
+
+	best, bestCount := "en", latin
+	for lang, count := range counts {
+		if count > bestCount {
+			best, bestCount = lang, count
+		}
+	}
+	return best
+}
+
+// normalizeDescription runs an item description through the configured
+// transliterator when it is not already English.
+func normalizeDescription(description string) string {
+	if descriptionTransliterator == nil {
+		return description
+	}
+	lang := detectLanguage(description)
+	if lang == "en" {
+		return description
+	}
+	normalized, err := descriptionTransliterator.Transliterate(description, lang)
+	if err != nil {
+		return description
+	}
+	return normalized
+}
+
+// builtinTransliterator converts Cyrillic and Greek letters to Latin using a
+// fixed character table. Other scripts are returned unchanged.
+type builtinTransliterator struct{}
+
+var transliterationTable = map[rune]string{
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'д': "d", 'е': "e", 'ё': "e", 'ж': "zh",
+	'з': "z", 'и': "i", 'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o",
+	'п': "p", 'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+	'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu",
+	'я': "ya",
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th",
+	'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p",
+	'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps",
+	'ω': "o",
+}
+
+// Transliterate implements Transliterator.
+func (builtinTransliterator) Transliterate(text, lang string) (string, error) {
+	var b strings.Builder
+	for _, char := range text {
+		latin, ok := transliterationTable[unicode.ToLower(char)]
+		if !ok {
+			b.WriteRune(char)
+			continue
+		}
+		if unicode.IsUpper(char) && latin != "" {
+			latin = strings.ToUpper(latin[:1]) + latin[1:]
+		}
+		b.WriteString(latin)
+	}
+	return b.String(), nil
+}
+
+// loadTransliteratorConfig selects the description transliterator from the
+// TRANSLITERATOR environment variable ("builtin" or unset).
+func loadTransliteratorConfig() error {
+	switch mode := os.Getenv("TRANSLITERATOR"); mode {
+	case "":
+	case "builtin":
+		descriptionTransliterator = builtinTransliterator{}
+	default:
+		return fmt.Errorf("TRANSLITERATOR: unknown mode %q", mode)
+	}
+	return nil
+}
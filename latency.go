@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencySamples is how many recent samples are kept per endpoint.
+const latencySamples = 1024
+
+// latencyWindow is how far back percentiles look.
+const latencyWindow = 5 * time.Minute
+
+// latencySample is one observed request duration.
+type latencySample struct {
+	at       time.Time
+	duration time.Duration
+}
+
+// latencyRing holds the most recent samples for one endpoint.
+type latencyRing struct {
+	samples [latencySamples]latencySample
+	next    int
+	filled  bool
+}
+
+// LatencySummary reports rolling percentiles, in milliseconds, for one endpoint.
+type LatencySummary struct {
+	Count       int     `json:"count"`
+	P50         float64 `json:"p50Ms"`
+	P95         float64 `json:"p95Ms"`
+	P99         float64 `json:"p99Ms"`
+	SLOBreached bool    `json:"sloBreached"`
+}
+
+var (
+	latencyMutex sync.Mutex
+	latencies    = make(map[string]*latencyRing)
+
+	// sloP99 is the p99 latency objective applied to every endpoint. Zero
+	// disables SLO evaluation.
+	sloP99 time.Duration
+	// sloBreachPeriod is how long an SLO must stay breached before readiness fails.
+	sloBreachPeriod = 5 * time.Minute
+	// sloFailReadiness makes /readyz report unready during a sustained breach.
+	sloFailReadiness bool
+	// sloBreachedSince is when the current breach began; zero when healthy.
+	sloBreachedSince time.Time
+)
+
+// loadSLOConfig reads SLO_P99_MS, SLO_BREACH_SECONDS and SLO_FAIL_READINESS.
+func loadSLOConfig() error {
+	if value := os.Getenv("SLO_P99_MS"); value != "" {
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms <= 0 {
+			return fmt.Errorf("SLO_P99_MS: invalid value %q", value)
+		}
+		sloP99 = time.Duration(ms) * time.Millisecond
+	}
+	if value := os.Getenv("SLO_BREACH_SECONDS"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("SLO_BREACH_SECONDS: invalid value %q", value)
+		}
+		sloBreachPeriod = time.Duration(seconds) * time.Second
+	}
+	sloFailReadiness = os.Getenv("SLO_FAIL_READINESS") == "true"
+	return nil
+}
+
+// recordLatency adds a request duration to the endpoint's rolling samples.
+func recordLatency(route string, duration time.Duration, at time.Time) {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+
+	ring, ok := latencies[route]
+	if !ok {
+		ring = &latencyRing{}
+		latencies[route] = ring
+	}
+	ring.add(latencySample{at: at, duration: duration})
+}
+
+// add records a sample, replacing the oldest once the ring is full.
+func (ring *latencyRing) add(sample latencySample) {
+	ring.samples[ring.next] = sample
+	ring.next = (ring.next + 1) % latencySamples
+	if ring.next == 0 {
+		ring.filled = true
+	}
+}
+
+// recent returns the durations of the samples inside the window, sorted.
+func (ring *latencyRing) recent(now time.Time) []time.Duration {
+	count := ring.next
+	if ring.filled {
+		count = latencySamples
+	}
+	durations := make([]time.Duration, 0, count)
+	for _, sample := range ring.samples[:count] {
+		if now.Sub(sample.at) <= latencyWindow {
+			durations = append(durations, sample.duration)
+		}
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations
+}
+
+// summarize computes percentiles over the samples inside the window.
+func (ring *latencyRing) summarize(now time.Time) LatencySummary {
+	durations := ring.recent(now)
+	summary := LatencySummary{
+		Count: len(durations),
+		P50:   percentileMs(durations, 0.50),
+		P95:   percentileMs(durations, 0.95),
+		P99:   percentileMs(durations, 0.99),
+	}
+	summary.SLOBreached = sloP99 > 0 && summary.Count > 0 && summary.P99 > float64(sloP99)/float64(time.Millisecond)
+	return summary
+}
+
+// percentileMs returns the nearest-rank percentile of sorted durations in
+// milliseconds.
+func percentileMs(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return float64(sorted[rank]) / float64(time.Millisecond)
+}
+
+// latencySummaries returns the rolling percentiles of every endpoint.
+func latencySummaries(now time.Time) map[string]LatencySummary {
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+
+	summaries := make(map[string]LatencySummary, len(latencies))
+	for route, ring := range latencies {
+		summaries[route] = ring.summarize(now)
+	}
+	return summaries
+}
+
+// sloHealthy reports whether no endpoint has breached its SLO for longer
+// than sloBreachPeriod.
+func sloHealthy(now time.Time) bool {
+	breached := false
+	for _, summary := range latencySummaries(now) {
+		if summary.SLOBreached {
+			breached = true
+			break
+		}
+	}
+
+	latencyMutex.Lock()
+	defer latencyMutex.Unlock()
+	if !breached {
+		sloBreachedSince = time.Time{}
+		return true
+	}
+	if sloBreachedSince.IsZero() {
+		sloBreachedSince = now
+	}
+	return now.Sub(sloBreachedSince) < sloBreachPeriod
+}
+
+// getLatency reports rolling latency percentiles per endpoint.
+func getLatency(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, latencySummaries(time.Now()))
+}
+
+// readinessHandler reports whether the server should receive traffic.
+func readinessHandler(w http.ResponseWriter, r *http.Request) {
+	if sloFailReadiness && !sloHealthy(time.Now()) {
+		http.Error(w, "Latency SLO breached", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Leaderboard rankings.
+const (
+	leaderboardUsers     = "users"
+	leaderboardRetailers = "retailers"
+)
+
+// leaderboardWindows maps each leaderboard window to the number of days it
+// covers, up to and including today. Zero covers all time.
+var leaderboardWindows = map[string]int{
+	"day":   1,
+	"week":  7,
+	"month": 30,
+	"year":  365,
+	"all":   0,
+}
+
+// maxLeaderboardLimit bounds the entries a leaderboard returns.
+const maxLeaderboardLimit = 100
+
+// LeaderboardEntry is one ranked user or retailer. Entries with equal points
+// share a rank.
+type LeaderboardEntry struct {
+	Rank   int    `json:"rank"`
+	ID     string `json:"id"`
+	Points int    `json:"points"`
+}
+
+// Leaderboard ranks a tenant's users or retailers by the points credited in
+// a window of days, From to To in the rules time zone.
+type Leaderboard struct {
+	Tenant  string             `json:"tenant"`
+	By      string             `json:"by"`
+	Window  string             `json:"window"`
+	From    string             `json:"from,omitempty"`
+	To      string             `json:"to,omitempty"`
+	Entries []LeaderboardEntry `json:"entries"`
+}
+
+// leaderboardDay is the points credited to each user and retailer on one
+// day, or in total.
+type leaderboardDay struct {
+	users     map[string]int
+	retailers map[string]int
+}
+
+func newLeaderboardDay() *leaderboardDay {
+	return &leaderboardDay{users: make(map[string]int), retailers: make(map[string]int)}
+}
+
+// add credits points to a user and a retailer, dropping keys that fall back
+// to zero.
+func (d *leaderboardDay) add(userID, retailer string, points int) {
+	credit := func(m map[string]int, key string) {
+		if m[key] += points; m[key] == 0 {
+			delete(m, key)
+		}
+	}
+	if userID != "" {
+		credit(d.users, userID)
+	}
+	credit(d.retailers, retailer)
+}
+
+// leaderboardView holds one tenant's points by day and in total.
+type leaderboardView struct {
+	total *leaderboardDay
+	days  map[string]*leaderboardDay
+}
+
+// leaderboardIndex keeps per-day points by user and retailer for each
+// tenant, updated on every write so that leaderboards only sum the days in
+// their window instead of scanning the store.
+type leaderboardIndex struct {
+	mu      sync.RWMutex
+	tenants map[string]*leaderboardView
+}
+
+var leaderboard = newLeaderboardIndex()
+
+func newLeaderboardIndex() *leaderboardIndex {
+	return &leaderboardIndex{tenants: make(map[string]*leaderboardView)}
+}
+
+// creditedDay returns the day, in the rules time zone, a receipt's points
+// were credited: when it was submitted, or when it was released from review.
+func creditedDay(stored StoredReceipt) string {
+	creditedAt := stored.SubmittedAt
+	if stored.Hold == holdReleased && stored.HoldDecidedAt != nil {
+		creditedAt = *stored.HoldDecidedAt
+	}
+	return creditedAt.In(rulesLocation).Format("2006-01-02")
+}
+
+// record adds (sign=+1) or removes (sign=-1) a stored receipt's net points.
+// Held and denied receipts have no credited points.
+func (l *leaderboardIndex) record(stored StoredReceipt, sign int) {
+	if onHold(stored) || stored.Hold == holdDenied {
+		return
+	}
+	points := sign * netPoints(stored)
+	if points == 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	view, ok := l.tenants[stored.Tenant]
+	if !ok {
+		view = &leaderboardView{total: newLeaderboardDay(), days: make(map[string]*leaderboardDay)}
+		l.tenants[stored.Tenant] = view
+	}
+	day := creditedDay(stored)
+	if view.days[day] == nil {
+		view.days[day] = newLeaderboardDay()
+	}
+	view.days[day].add(stored.UserID, stored.Receipt.StoreName, points)
+	view.total.add(stored.UserID, stored.Receipt.StoreName, points)
+}
+
+// update replaces a receipt's points with those of its new version.
+func (l *leaderboardIndex) update(previous, current StoredReceipt) {
+	l.record(previous, -1)
+	l.record(current, 1)
+}
+
+// top returns up to limit of a tenant's users or retailers with the most
+// points over the given days ending today, or over all time when days is
+// zero.
+func (l *leaderboardIndex) top(tenant, by string, days int, today time.Time, limit int) []LeaderboardEntry {
+	l.mu.RLock()
+	totals := make(map[string]int)
+	if view, ok := l.tenants[tenant]; ok {
+		pick := func(day *leaderboardDay) map[string]int {
+			if by == leaderboardRetailers {
+				return day.retailers
+			}
+			return day.users
+		}
+		if days == 0 {
+			for key, points := range pick(view.total) {
+				totals[key] = points
+			}
+		}
+		for i := 0; i < days; i++ {
+			if day, ok := view.days[today.AddDate(0, 0, -i).Format("2006-01-02")]; ok {
+				for key, points := range pick(day) {
+					totals[key] += points
+				}
+			}
+		}
+	}
+	l.mu.RUnlock()
+
+	entries := make([]LeaderboardEntry, 0, len(totals))
+	for key, points := range totals {
+		if points > 0 {
+			entries = append(entries, LeaderboardEntry{ID: key, Points: points})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Points != entries[j].Points {
+			return entries[i].Points > entries[j].Points
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	for i := range entries {
+		entries[i].Rank = i + 1
+		if i > 0 && entries[i].Points == entries[i-1].Points {
+			entries[i].Rank = entries[i-1].Rank
+		}
+	}
+	return entries
+}
+
+// rebuildLeaderboard recomputes the leaderboard index from the store.
+func rebuildLeaderboard() error {
+	rebuilt := newLeaderboardIndex()
+	err := receiptStore.Range(context.Background(), func(id string, stored StoredReceipt) bool {
+		rebuilt.record(stored, 1)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	leaderboard = rebuilt
+	return nil
+}
+
+// getLeaderboard ranks the requesting tenant's users (?by=users, the
+// default) or retailers (?by=retailers) by points credited in the window
+// given by ?window= (day, week, the default, month, year or all), returning
+// the top ?limit= (default 10).
+func getLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant, ok := tenantFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	by := query.Get("by")
+	switch by {
+	case "":
+		by = leaderboardUsers
+	case leaderboardUsers, leaderboardRetailers:
+	default:
+		http.Error(w, "by must be users or retailers", http.StatusBadRequest)
+		return
+	}
+	window := query.Get("window")
+	if window == "" {
+		window = "week"
+	}
+	days, ok := leaderboardWindows[window]
+	if !ok {
+		http.Error(w, "window must be day, week, month, year or all", http.StatusBadRequest)
+		return
+	}
+	limit := 10
+	if value := query.Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxLeaderboardLimit {
+			http.Error(w, "limit must be 1-100", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	today := clockFrom(r.Context()).Now().In(rulesLocation)
+	board := Leaderboard{Tenant: tenant, By: by, Window: window}
+	if days > 0 {
+		board.From = today.AddDate(0, 0, 1-days).Format("2006-01-02")
+		board.To = today.Format("2006-01-02")
+	}
+	board.Entries = leaderboard.top(tenant, by, days, today, limit)
+	writeJSON(w, r, board)
+}
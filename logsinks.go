@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogEntry is one structured log record. Access log entries carry the
+// request fields; other entries only a message.
+type LogEntry struct {
+	Time       time.Time `json:"time"`
+	Level      string    `json:"level"`
+	Message    string    `json:"msg"`
+	Method     string    `json:"method,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	Route      string    `json:"route,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	DurationMs float64   `json:"durationMs,omitempty"`
+	Client     string    `json:"client,omitempty"`
+}
+
+// logSink receives every structured log entry, already encoded as a JSON
+// line.
+type logSink interface {
+	writeEntry(entry LogEntry, line []byte) error
+}
+
+var (
+	// logSinks is empty unless LOG_SINKS is set, in which case all log
+	// output is structured and sent to every sink.
+	logSinks []logSink
+	// accessLogSampleRate is the fraction of successful requests logged;
+	// server errors are always logged.
+	accessLogSampleRate = 1.0
+)
+
+// loadLogConfig reads LOG_SINKS, a comma-separated list of stdout (JSON
+// lines), file and syslog, and each sink's settings: LOG_FILE,
+// LOG_FILE_MAX_MB (default 100) and LOG_FILE_BACKUPS (default 5) for the
+// file; SYSLOG_ADDR ("udp://host:514" or "tcp://host:514", default the local
+// daemon) and SYSLOG_TAG for syslog. ACCESS_LOG_SAMPLE_RATE (0-1, default
+// 1) samples the access log.
+func loadLogConfig() error {
+	value := os.Getenv("LOG_SINKS")
+	if value == "" {
+		return nil
+	}
+	if rate := os.Getenv("ACCESS_LOG_SAMPLE_RATE"); rate != "" {
+		f, err := strconv.ParseFloat(rate, 64)
+		if err != nil || !(f >= 0 && f <= 1) {
+			return fmt.Errorf("ACCESS_LOG_SAMPLE_RATE: invalid value %q", rate)
+		}
+		accessLogSampleRate = f
+	}
+
+	var sinks []logSink
+	for _, name := range strings.Split(value, ",") {
+		switch strings.TrimSpace(name) {
+		case "stdout":
+			sinks = append(sinks, &writerSink{w: os.Stdout})
+		case "file":
+			sink, err := openRotatingFile()
+			if err != nil {
+				return err
+			}
+			sinks = append(sinks, sink)
+		case "syslog":
+			sink, err := openSyslog(os.Getenv("SYSLOG_ADDR"), os.Getenv("SYSLOG_TAG"))
+			if err != nil {
+				return fmt.Errorf("LOG_SINKS: syslog: %w", err)
+			}
+			sinks = append(sinks, sink)
+		default:
+			return fmt.Errorf("LOG_SINKS: unknown sink %q", name)
+		}
+	}
+	logSinks = sinks
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+	return nil
+}
+
+// emitLog sends an entry to every sink. A failing sink is reported on
+// stderr and does not stop the others.
+func emitLog(entry LogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+	for _, sink := range logSinks {
+		if err := sink.writeEntry(entry, line); err != nil {
+			fmt.Fprintf(os.Stderr, "log sink: %v\n", err)
+		}
+	}
+}
+
+// stdLogWriter turns the standard logger's output into structured entries.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(p []byte) (int, error) {
+	emitLog(LogEntry{Time: time.Now().UTC(), Level: "info", Message: strings.TrimRight(string(p), "\n")})
+	return len(p), nil
+}
+
+// logAccess records a completed request in the access log, sampling
+// requests that did not fail on the server.
+func logAccess(r *http.Request, route string, status int, duration time.Duration, finished time.Time) {
+	if len(logSinks) == 0 {
+		return
+	}
+	level := "info"
+	if status >= 500 {
+		level = "error"
+	} else if accessLogSampleRate < 1 && rand.Float64() >= accessLogSampleRate {
+		return
+	}
+	emitLog(LogEntry{
+		Time:       finished.UTC(),
+		Level:      level,
+		Message:    "request",
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Route:      route,
+		Status:     status,
+		DurationMs: float64(duration.Microseconds()) / 1000,
+		Client:     clientFromRequest(r),
+	})
+}
+
+// writerSink writes JSON lines to a stream.
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerSink) writeEntry(_ LogEntry, line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(line)
+	return err
+}
+
+// rotatingFile writes JSON lines to a file, renaming it to path.1 (and
+// older files to path.2 and so on, up to backups) when it reaches maxBytes.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	backups  int
+	file     *os.File
+	size     int64
+}
+
+// openRotatingFile opens the log file configured by LOG_FILE,
+// LOG_FILE_MAX_MB and LOG_FILE_BACKUPS.
+func openRotatingFile() (*rotatingFile, error) {
+	f := &rotatingFile{path: os.Getenv("LOG_FILE"), maxBytes: 100 << 20, backups: 5}
+	if f.path == "" {
+		return nil, fmt.Errorf("LOG_SINKS: the file sink requires LOG_FILE")
+	}
+	if value := os.Getenv("LOG_FILE_MAX_MB"); value != "" {
+		mb, err := strconv.Atoi(value)
+		if err != nil || mb <= 0 {
+			return nil, fmt.Errorf("LOG_FILE_MAX_MB: invalid value %q", value)
+		}
+		f.maxBytes = int64(mb) << 20
+	}
+	if value := os.Getenv("LOG_FILE_BACKUPS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("LOG_FILE_BACKUPS: invalid value %q", value)
+		}
+		f.backups = n
+	}
+	if err := f.open(); err != nil {
+		return nil, fmt.Errorf("LOG_FILE: %w", err)
+	}
+	return f, nil
+}
+
+// open opens the log file for appending.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// rotate shifts the backups along, dropping the oldest, and starts a new
+// file.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	if f.backups == 0 {
+		os.Remove(f.path)
+	} else {
+		for i := f.backups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return err
+		}
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) writeEntry(_ LogEntry, line []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && f.size+int64(len(line)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
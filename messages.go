@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// messageHeader carries the broker message ID of a submission relayed from
+// a message queue. Redeliveries of the same message are processed once.
+const messageHeader = "X-Message-ID"
+
+// maxMessageIDLength bounds message IDs accepted from clients.
+const maxMessageIDLength = 256
+
+// messageIndex maps each tenant's processed message IDs to the receipts
+// they created, so a redelivered message returns the original receipt
+// instead of crediting points again.
+type messageIndex struct {
+	mu        sync.Mutex
+	processed map[string]string
+	// pending holds messages being processed; redeliveries arriving
+	// meanwhile wait for the channel to close.
+	pending map[string]chan struct{}
+}
+
+var messages = &messageIndex{
+	processed: make(map[string]string),
+	pending:   make(map[string]chan struct{}),
+}
+
+// messageKey is a message's key in the index.
+func messageKey(tenant, messageID string) string {
+	return tenant + "\x00" + messageID
+}
+
+// messageFromRequest returns the request's message ID, if any. ok is false
+// when the ID is too long.
+func messageFromRequest(r *http.Request) (string, bool) {
+	id := r.Header.Get(messageHeader)
+	return id, len(id) <= maxMessageIDLength
+}
+
+// submit processes a submission carrying a message ID exactly once. A
+// message already processed returns the receipt it created; one still
+// being processed is waited for. Failed submissions are forgotten, so a
+// redelivery tries again.
+func (m *messageIndex) submit(ctx context.Context, sub Submission, receipt Receipt) (string, StoredReceipt, error) {
+	key := messageKey(sub.Tenant, sub.MessageID)
+	for {
+		m.mu.Lock()
+		if id, ok := m.processed[key]; ok {
+			m.mu.Unlock()
+			stored, err := receiptStore.Get(ctx, id)
+			return id, stored, err
+		}
+		wait, busy := m.pending[key]
+		if !busy {
+			done := make(chan struct{})
+			m.pending[key] = done
+			m.mu.Unlock()
+
+			id, stored, err := enqueueSubmission(ctx, sub, receipt)
+			m.mu.Lock()
+			if err == nil {
+				m.processed[key] = id
+			}
+			delete(m.pending, key)
+			m.mu.Unlock()
+			close(done)
+			return id, stored, err
+		}
+		m.mu.Unlock()
+
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return "", StoredReceipt{}, ctx.Err()
+		}
+	}
+}
+
+// rebuildMessageIndex loads the message IDs of stored receipts.
+func rebuildMessageIndex() error {
+	messages.mu.Lock()
+	defer messages.mu.Unlock()
+
+	return receiptStore.Range(context.Background(), func(id string, stored StoredReceipt) bool {
+		if stored.MessageID != "" {
+			messages.processed[messageKey(stored.Tenant, stored.MessageID)] = id
+		}
+		return true
+	})
+}
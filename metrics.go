@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EndpointStats counts requests and errors for one route.
+type EndpointStats struct {
+	Requests     int64 `json:"requests"`
+	ClientErrors int64 `json:"clientErrors"`
+	ServerErrors int64 `json:"serverErrors"`
+}
+
+// countStatus adds one request with the given status to stats.
+func (stats *EndpointStats) countStatus(status int) {
+	stats.Requests++
+	if status >= 500 {
+		stats.ServerErrors++
+	} else if status >= 400 {
+		stats.ClientErrors++
+	}
+}
+
+// throughputWindow is the number of one-second buckets kept for throughput.
+const throughputWindow = 60
+
+var (
+	metricsMutex   sync.Mutex
+	serverStarted  = time.Now()
+	endpointStats  = make(map[string]*EndpointStats)
+	requestBuckets [throughputWindow]struct {
+		second int64
+		count  int64
+	}
+
+	// queueDepths reports the current depth of each registered work queue.
+	queueDepths = make(map[string]func() int)
+)
+
+// registerQueue exposes a queue's depth on the admin dashboard.
+func registerQueue(name string, depth func() int) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	queueDepths[name] = depth
+}
+
+var idSegment = regexp.MustCompile(`^([0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{32,})$`)
+
+// staticReceiptRoutes are the fixed names registered directly under
+// /receipts/. Any other segment in that position is a receipt ID.
+var staticReceiptRoutes = map[string]bool{"process": true, "parse": true, "import": true, "search": true, "points": true}
+
+// routeLabel names the route a request hit, with IDs collapsed so that all
+// requests for the same endpoint share a label.
+func routeLabel(r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/blobs/") {
+		return r.Method + " /blobs/{key}"
+	}
+	segments := strings.Split(r.URL.Path, "/")
+	for i, segment := range segments {
+		if idSegment.MatchString(segment) || (i == 2 && segments[1] == "receipts" && segment != "" && !staticReceiptRoutes[segment]) {
+			segments[i] = "{id}"
+		}
+	}
+	return r.Method + " " + strings.Join(segments, "/")
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the underlying writer, so that handlers can control it
+// with http.ResponseController.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument records request counts, error counts, throughput and latency,
+// overall and per client, and writes the access log.
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		finished := time.Now()
+		route := routeLabel(r)
+		recordRequest(route, recorder.status, finished)
+		recordLatency(route, finished.Sub(started), finished)
+		recordClientUsage(clientFromRequest(r), route, recorder.status, finished.Sub(started), finished)
+		logAccess(r, route, recorder.status, finished.Sub(started), finished)
+	})
+}
+
+// recordRequest adds one completed request to the in-process metrics.
+func recordRequest(route string, status int, at time.Time) {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	stats, ok := endpointStats[route]
+	if !ok {
+		stats = &EndpointStats{}
+		endpointStats[route] = stats
+	}
+	stats.countStatus(status)
+
+	second := at.Unix()
+	bucket := &requestBuckets[second%throughputWindow]
+	if bucket.second != second {
+		bucket.second, bucket.count = second, 0
+	}
+	bucket.count++
+}
+
+// requestsInWindow returns the number of requests completed in the last
+// throughputWindow seconds.
+func requestsInWindow(now time.Time) int64 {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+
+	var total int64
+	for _, bucket := range requestBuckets {
+		if now.Unix()-bucket.second < throughputWindow {
+			total += bucket.count
+		}
+	}
+	return total
+}
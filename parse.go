@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ParseRequest is the body accepted by the raw text parsing endpoint.
+type ParseRequest struct {
+	Retailer string `json:"retailer"`
+	Text     string `json:"text"`
+}
+
+// ParseResponse holds the structured receipt extracted from raw text along
+// with any fields that could not be found.
+type ParseResponse struct {
+	Receipt  Receipt  `json:"receipt"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// parseTemplateConfig is the on-disk form of a retailer parsing template.
+// Each pattern's first capture group holds the value; the item pattern
+// captures the description and then the price.
+type parseTemplateConfig struct {
+	Date        string   `json:"date"`
+	DateLayouts []string `json:"dateLayouts"`
+	Time        string   `json:"time"`
+	TimeLayouts []string `json:"timeLayouts"`
+	Total       string   `json:"total"`
+	Item        string   `json:"item"`
+	Skip        string   `json:"skip"`
+}
+
+// parseTemplate is a compiled set of line rules for one retailer.
+type parseTemplate struct {
+	date        *regexp.Regexp
+	dateLayouts []string
+	time        *regexp.Regexp
+	timeLayouts []string
+	total       *regexp.Regexp
+	item        *regexp.Regexp
+	skip        *regexp.Regexp
+}
+
+var defaultParseTemplate = parseTemplateConfig{
+	Date:        `(\d{4}-\d{2}-\d{2}|\d{1,2}/\d{1,2}/\d{2,4})`,
+	DateLayouts: []string{"2006-01-02", "01/02/2006", "1/2/2006", "01/02/06", "1/2/06"},
+	Time:        `(\d{1,2}:\d{2}(?:\s*[AaPp][Mm])?)`,
+	TimeLayouts: []string{"15:04", "3:04PM", "3:04 PM", "3:04pm", "3:04 pm"},
+	Total:       `(?i)^\s*total\b\D*(\d+\.\d{2})`,
+	Item:        `^\s*(.*?[A-Za-z].*?)\s+\$?(\d+\.\d{2})\s*$`,
+	Skip:        `(?i)\b(sub\s*total|total|tax|change|cash|visa|mastercard|amex|debit|credit|balance)\b`,
+}
+
+var (
+	genericParseTemplate *parseTemplate
+	// retailerParseTemplates holds per-retailer templates keyed by retailer name.
+	retailerParseTemplates = make(map[string]*parseTemplate)
+)
+
+// compile builds a parseTemplate, filling unset fields from the default.
+func (c parseTemplateConfig) compile() (*parseTemplate, error) {
+	pick := func(value, fallback string) string {
+		if value == "" {
+			return fallback
+		}
+		return value
+	}
+	t := &parseTemplate{dateLayouts: c.DateLayouts, timeLayouts: c.TimeLayouts}
+	if len(t.dateLayouts) == 0 {
+		t.dateLayouts = defaultParseTemplate.DateLayouts
+	}
+	if len(t.timeLayouts) == 0 {
+		t.timeLayouts = defaultParseTemplate.TimeLayouts
+	}
+
+	// groups is how many capture groups the parser reads from a match: the
+	// date, time or total, and an item's description and price.
+	patterns := []struct {
+		name     string
+		target   **regexp.Regexp
+		value    string
+		fallback string
+		groups   int
+	}{
+		{"date", &t.date, c.Date, defaultParseTemplate.Date, 1},
+		{"time", &t.time, c.Time, defaultParseTemplate.Time, 1},
+		{"total", &t.total, c.Total, defaultParseTemplate.Total, 1},
+		{"item", &t.item, c.Item, defaultParseTemplate.Item, 2},
+		{"skip", &t.skip, c.Skip, defaultParseTemplate.Skip, 0},
+	}
+	for _, p := range patterns {
+		re, err := regexp.Compile(pick(p.value, p.fallback))
+		if err != nil {
+			return nil, err
+		}
+		if re.NumSubexp() < p.groups {
+			return nil, fmt.Errorf("%s pattern %q must have at least %d capture group(s)", p.name, re.String(), p.groups)
+		}
+		*p.target = re
+	}
+	return t, nil
+}
+
+// loadParseTemplates compiles the default template and any retailer
+// templates in the JSON file named by PARSE_TEMPLATES_FILE.
+func loadParseTemplates() error {
+	t, err := defaultParseTemplate.compile()
+	if err != nil {
+		return err
+	}
+	genericParseTemplate = t
+
+	path := os.Getenv("PARSE_TEMPLATES_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("PARSE_TEMPLATES_FILE: %w", err)
+	}
+	var configs map[string]parseTemplateConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("PARSE_TEMPLATES_FILE: %w", err)
+	}
+	for retailer, config := range configs {
+		t, err := config.compile()
+		if err != nil {
+			return fmt.Errorf("PARSE_TEMPLATES_FILE: template %q: %w", retailer, err)
+		}
+		retailerParseTemplates[retailer] = t
+	}
+	return nil
+}
+
+// parseReceiptText extracts a Receipt from raw text using the template for
+// the hinted retailer, or the generic template when none is configured.
+func parseReceiptText(retailer, text string) ParseResponse {
+	t, ok := retailerParseTemplates[retailer]
+	if !ok {
+		t = genericParseTemplate
+	}
+
+	response := ParseResponse{Receipt: Receipt{StoreName: retailer}}
+	receipt := &response.Receipt
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if receipt.DateOfPurchase == "" {
+			if m := t.date.FindStringSubmatch(line); m != nil {
+				receipt.DateOfPurchase = normalizeTimestamp(m[1], t.dateLayouts, "2006-01-02")
+			}
+		}
+		if receipt.TimeOfPurchase == "" {
+			if m := t.time.FindStringSubmatch(line); m != nil {
+				receipt.TimeOfPurchase = normalizeTimestamp(m[1], t.timeLayouts, "15:04")
+			}
+		}
+		if m := t.total.FindStringSubmatch(line); m != nil {
+			receipt.TotalAmount = m[1]
+			continue
+		}
+		if t.skip.MatchString(line) {
+			continue
+		}
+		if m := t.item.FindStringSubmatch(line); m != nil {
+			receipt.PurchasedItems = append(receipt.PurchasedItems, Item{
+				Description: strings.TrimSpace(m[1]),
+				Price:       m[2],
+			})
+		}
+	}
+
+	if receipt.StoreName == "" {
+		response.Warnings = append(response.Warnings, "retailer not provided")
+	}
+	if receipt.DateOfPurchase == "" {
+		response.Warnings = append(response.Warnings, "purchase date not found")
+	}
+	if receipt.TimeOfPurchase == "" {
+		response.Warnings = append(response.Warnings, "purchase time not found")
+	}
+	if receipt.TotalAmount == "" {
+		response.Warnings = append(response.Warnings, "total not found")
+	}
+	if len(receipt.PurchasedItems) == 0 {
+		response.Warnings = append(response.Warnings, "no items found")
+	}
+	return response
+}
+
+// normalizeTimestamp reformats value into the canonical layout, returning it
+// unchanged when none of the layouts match.
+func normalizeTimestamp(value string, layouts []string, canonical string) string {
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Format(canonical)
+		}
+	}
+	return value
+}
+
+// parseReceipt converts raw receipt text into a structured receipt for the
+// client to confirm. Nothing is stored.
+func parseReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request ParseRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || strings.TrimSpace(request.Text) == "" {
+		http.Error(w, "Invalid parse request. Please provide receipt text.", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, r, parseReceiptText(request.Retailer, request.Text))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Partner is a retailer integration allowed to submit receipts on behalf of
+// its customers.
+type Partner struct {
+	Retailer string `json:"retailer"`
+	Tenant   string `json:"tenant"`
+	Key      string `json:"key"`
+}
+
+// partnersByKeyHash maps the SHA-256 of each partner credential to its
+// partner, so raw credentials are not kept or compared directly.
+var partnersByKeyHash = make(map[string]Partner)
+
+// hashKey returns the hex SHA-256 of a credential.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadPartnerConfig reads partner credentials from the JSON array in the
+// file named by PARTNERS_FILE.
+func loadPartnerConfig() error {
+	path := os.Getenv("PARTNERS_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("PARTNERS_FILE: %w", err)
+	}
+	var partners []Partner
+	if err := json.Unmarshal(data, &partners); err != nil {
+		return fmt.Errorf("PARTNERS_FILE: %w", err)
+	}
+	for _, partner := range partners {
+		if partner.Retailer == "" || len(partner.Key) < 16 {
+			return fmt.Errorf("PARTNERS_FILE: partner %q needs a retailer and a key of at least 16 characters", partner.Retailer)
+		}
+		if partner.Tenant == "" {
+			partner.Tenant = defaultTenant
+		}
+		if !tenantPattern.MatchString(partner.Tenant) {
+			return fmt.Errorf("PARTNERS_FILE: invalid tenant %q", partner.Tenant)
+		}
+		keyHash := hashKey(partner.Key)
+		partner.Key = ""
+		partnersByKeyHash[keyHash] = partner
+	}
+	return nil
+}
+
+// partnerFromRequest authenticates the partner credential in the
+// Authorization header.
+func partnerFromRequest(r *http.Request) (Partner, bool) {
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if key == "" {
+		return Partner{}, false
+	}
+	partner, ok := partnersByKeyHash[hashKey(key)]
+	return partner, ok
+}
+
+// PartnerReceiptRequest is a receipt submitted by a retailer's POS for one of
+// its customers.
+type PartnerReceiptRequest struct {
+	CustomerID string  `json:"customerId"`
+	Receipt    Receipt `json:"receipt"`
+}
+
+// PartnerReceiptResponse confirms a partner submission and the points credited.
+type PartnerReceiptResponse struct {
+	ReceiptID  string `json:"id"`
+	CustomerID string `json:"customerId"`
+	Points     int    `json:"points"`
+}
+
+// partnerSubmitReceipt accepts a receipt from an authenticated retailer and
+// credits it to the identified customer. Retailers can only submit receipts
+// under their own name.
+func partnerSubmitReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	partner, ok := partnerFromRequest(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var request PartnerReceiptRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid receipt format. Please verify input.", http.StatusBadRequest)
+		return
+	}
+	if !tenantPattern.MatchString(request.CustomerID) {
+		http.Error(w, "Invalid or missing customerId", http.StatusBadRequest)
+		return
+	}
+	if request.Receipt.StoreName == "" {
+		request.Receipt.StoreName = partner.Retailer
+	}
+	if request.Receipt.StoreName != partner.Retailer {
+		http.Error(w, "Receipt retailer does not match partner credential", http.StatusForbidden)
+		return
+	}
+
+	messageID, ok := messageFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid message ID", http.StatusBadRequest)
+		return
+	}
+
+	sub := Submission{Tenant: partner.Tenant, Client: "partner:" + partner.Retailer, UserID: request.CustomerID, Source: sourcePartner, MessageID: messageID}
+	receiptID, stored, err := submitReceipt(r.Context(), sub, request.Receipt)
+	if err != nil {
+		writeSubmitError(w, r, err)
+		return
+	}
+	writeJSONStatus(w, r, http.StatusCreated, PartnerReceiptResponse{
+		ReceiptID:  receiptID,
+		CustomerID: request.CustomerID,
+		Points:     stored.Points,
+	})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// pluginRulePrefix prefixes scoring plugins' rule names.
+const pluginRulePrefix = "plugin:"
+
+// pluginTimeout bounds one plugin call, so that a looping script cannot
+// stall scoring.
+const pluginTimeout = 100 * time.Millisecond
+
+// pluginName is the form of plugin names, taken from their file names.
+var pluginName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// pluginLibs are the Lua libraries scripts may use. Those reaching the file
+// system, the OS or other scripts are left out.
+var pluginLibs = []struct {
+	name string
+	open lua.LGFunction
+}{
+	{lua.BaseLibName, lua.OpenBase},
+	{lua.TabLibName, lua.OpenTable},
+	{lua.StringLibName, lua.OpenString},
+	{lua.MathLibName, lua.OpenMath},
+}
+
+// unsafePluginGlobals are base library functions that load code from files
+// or strings.
+var unsafePluginGlobals = []string{"dofile", "loadfile", "load", "loadstring", "module", "require"}
+
+// scoringPlugin is a Lua script of custom scoring logic. The script defines
+// a global function score(receipt, total) returning the points the receipt
+// earns and, optionally, a reason.
+type scoringPlugin struct {
+	name string
+	// hash is the SHA-256 of the script, which rule set versions cover.
+	hash  string
+	proto *lua.FunctionProto
+	// states holds idle interpreters with the script loaded, since a Lua
+	// state serves one call at a time.
+	states sync.Pool
+}
+
+// PluginStats counts a scoring plugin's calls.
+type PluginStats struct {
+	Name      string  `json:"name"`
+	Calls     int     `json:"calls"`
+	Failures  int     `json:"failures"`
+	TotalMs   float64 `json:"totalMs"`
+	AverageMs float64 `json:"averageMs"`
+}
+
+var (
+	// scoringPlugins are the plugins loaded at startup, by name.
+	scoringPlugins = make(map[string]*scoringPlugin)
+	pluginMutex    sync.Mutex
+	pluginStats    = make(map[string]*PluginStats)
+)
+
+// loadScoringPlugins loads every .lua file in SCORING_PLUGINS_DIR as a
+// scoring plugin named after the file. Plugins only score receipts under
+// rule sets that list them, so they must be loaded before the rules.
+func loadScoringPlugins() error {
+	dir := os.Getenv("SCORING_PLUGINS_DIR")
+	if dir == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*.lua"))
+	if err != nil {
+		return fmt.Errorf("SCORING_PLUGINS_DIR: %w", err)
+	}
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".lua")
+		if !pluginName.MatchString(name) {
+			return fmt.Errorf("SCORING_PLUGINS_DIR: invalid plugin name %q", name)
+		}
+		plugin, err := loadScoringPlugin(name, path)
+		if err != nil {
+			return fmt.Errorf("SCORING_PLUGINS_DIR: %s: %w", filepath.Base(path), err)
+		}
+		scoringPlugins[name] = plugin
+		pluginStats[name] = &PluginStats{Name: name}
+		log.Printf("loaded scoring plugin %s", name)
+	}
+	return nil
+}
+
+// loadScoringPlugin compiles a script and checks that it defines score.
+func loadScoringPlugin(name, path string) (*scoringPlugin, error) {
+	script, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(bytes.NewReader(script), path)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, path)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(script)
+	plugin := &scoringPlugin{name: name, hash: hex.EncodeToString(sum[:]), proto: proto}
+	state, err := plugin.newState()
+	if err != nil {
+		return nil, err
+	}
+	plugin.states.Put(state)
+	return plugin, nil
+}
+
+// newState starts a sandboxed interpreter and runs the script in it.
+func (p *scoringPlugin) newState() (*lua.LState, error) {
+	state := lua.NewState(lua.Options{SkipOpenLibs: true, CallStackSize: 256, RegistryMaxSize: 1 << 20})
+	for _, lib := range pluginLibs {
+		state.Push(state.NewFunction(lib.open))
+		state.Push(lua.LString(lib.name))
+		state.Call(1, 0)
+	}
+	for _, name := range unsafePluginGlobals {
+		state.SetGlobal(name, lua.LNil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	state.SetContext(ctx)
+	defer state.RemoveContext()
+	state.Push(state.NewFunctionFromProto(p.proto))
+	if err := state.PCall(0, 0, nil); err != nil {
+		state.Close()
+		return nil, err
+	}
+	if _, ok := state.GetGlobal("score").(*lua.LFunction); !ok {
+		state.Close()
+		return nil, errors.New("script does not define a score function")
+	}
+	return state, nil
+}
+
+// score calls the script's score function on a receipt.
+func (p *scoringPlugin) score(receipt Receipt, total int) (int, string, error) {
+	state, _ := p.states.Get().(*lua.LState)
+	if state == nil {
+		var err error
+		if state, err = p.newState(); err != nil {
+			return 0, "", err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	state.SetContext(ctx)
+	err := state.CallByParam(lua.P{Fn: state.GetGlobal("score"), NRet: 2, Protect: true},
+		luaValue(state, receiptVariables(receipt)), lua.LNumber(total))
+	state.RemoveContext()
+	if err != nil {
+		// A state interrupted mid-call may be left inconsistent.
+		state.Close()
+		return 0, "", err
+	}
+	points, reason := state.Get(-2), state.Get(-1)
+	state.Pop(2)
+	p.states.Put(state)
+
+	number, ok := points.(lua.LNumber)
+	if !ok || float64(number) != math.Trunc(float64(number)) || math.Abs(float64(number)) > math.MaxInt32 {
+		return 0, "", fmt.Errorf("score returned %s, not a whole number", points.String())
+	}
+	text := ""
+	if reason != lua.LNil {
+		text = reason.String()
+	}
+	return int(number), text, nil
+}
+
+// receiptVariables is the receipt as scripts see it, with the same fields
+// as expression rules.
+func receiptVariables(receipt Receipt) map[string]interface{} {
+	variables := expressionVariables(receipt)
+	if purchasedAt, ok := variables["purchasedAt"].(time.Time); ok {
+		variables["purchasedAt"] = purchasedAt.Format(time.RFC3339)
+	}
+	return variables
+}
+
+// luaValue converts a Go value built from JSON or receipt fields to Lua.
+// Lists become sequences indexed from 1.
+func luaValue(state *lua.LState, value interface{}) lua.LValue {
+	switch v := value.(type) {
+	case nil:
+		return lua.LNil
+	case bool:
+		return lua.LBool(v)
+	case string:
+		return lua.LString(v)
+	case int:
+		return lua.LNumber(v)
+	case float64:
+		return lua.LNumber(v)
+	case []interface{}:
+		table := state.NewTable()
+		for _, element := range v {
+			table.Append(luaValue(state, element))
+		}
+		return table
+	case map[string]interface{}:
+		table := state.NewTable()
+		for key, element := range v {
+			table.RawSetString(key, luaValue(state, element))
+		}
+		return table
+	}
+	return lua.LString(fmt.Sprint(value))
+}
+
+// pluginRule turns a scoring plugin listed in a rule set into a scoring
+// rule for a receipt. A plugin that fails, or is no longer loaded, adds
+// nothing; failures are logged and counted.
+func pluginRule(name string, receipt Receipt) scoring.Rule {
+	return scoring.Rule{
+		Name:  pluginRulePrefix + name,
+		Phase: scoring.Base,
+		Score: func(total int) (int, string) {
+			plugin, ok := scoringPlugins[name]
+			if !ok {
+				return 0, ""
+			}
+			started := time.Now()
+			points, reason, err := plugin.score(receipt, total)
+
+			pluginMutex.Lock()
+			stats := pluginStats[name]
+			stats.Calls++
+			stats.TotalMs += float64(time.Since(started).Microseconds()) / 1000
+			if err != nil {
+				stats.Failures++
+			}
+			pluginMutex.Unlock()
+
+			if err != nil {
+				log.Printf("scoring plugin %s failed: %v", name, err)
+				return 0, ""
+			}
+			return points, reason
+		},
+	}
+}
+
+// validatePlugins reports plugins a rule set lists that are not loaded or
+// are listed twice.
+func (c RulesConfig) validatePlugins() []string {
+	var problems []string
+	listed := make(map[string]bool)
+	for i, name := range c.Plugins {
+		switch {
+		case scoringPlugins[name] == nil:
+			problems = append(problems, fmt.Sprintf("plugins[%d]: unknown scoring plugin %q", i, name))
+		case listed[name]:
+			problems = append(problems, fmt.Sprintf("plugins[%d]: %q is listed twice", i, name))
+		}
+		listed[name] = true
+	}
+	return problems
+}
+
+// getPluginStats lists the loaded scoring plugins and their call counts.
+func getPluginStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	names := make([]string, 0, len(scoringPlugins))
+	for name := range scoringPlugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pluginMutex.Lock()
+	response := make([]PluginStats, 0, len(names))
+	for _, name := range names {
+		stats := *pluginStats[name]
+		if stats.Calls > 0 {
+			stats.AverageMs = stats.TotalMs / float64(stats.Calls)
+		}
+		response = append(response, stats)
+	}
+	pluginMutex.Unlock()
+	writeJSON(w, r, response)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync/atomic"
+)
+
+// Ways of storing a submission's points detail: the attribution of points
+// to items and the rounding audit record.
+const (
+	// detailSync stores the detail with the receipt.
+	detailSync = "sync"
+	// detailAsync stores the receipt first and adds the detail in the
+	// background.
+	detailAsync = "async"
+	// detailOff never stores the detail.
+	detailOff = "off"
+)
+
+// detailJob is a stored receipt waiting for its points detail. The detail is
+// derived from the breakdown and rules the receipt was scored with, so it
+// adds up to the stored points even if the rules change in the meantime.
+type detailJob struct {
+	receiptID string
+	rules     RulesConfig
+	breakdown []RuleResult
+}
+
+var (
+	// pointsDetailMode is how submissions' points detail is stored. Without
+	// stored detail, item points are computed when requested and the
+	// rounding audit counts the receipt as unrecorded.
+	pointsDetailMode = detailSync
+	// detailJobs feeds the background writer in async mode.
+	detailJobs chan detailJob
+	// detailsDropped counts detail skipped because the queue was full.
+	detailsDropped int64
+)
+
+// loadPointsDetailConfig reads POINTS_DETAIL_STORAGE and, in async mode,
+// POINTS_DETAIL_QUEUE_SIZE (default 10000), and starts the writer.
+func loadPointsDetailConfig() error {
+	switch mode := os.Getenv("POINTS_DETAIL_STORAGE"); mode {
+	case "", detailSync:
+		return nil
+	case detailOff:
+		pointsDetailMode = mode
+		return nil
+	case detailAsync:
+		pointsDetailMode = mode
+	default:
+		return fmt.Errorf("POINTS_DETAIL_STORAGE: invalid value %q", mode)
+	}
+
+	size := 10000
+	if value := os.Getenv("POINTS_DETAIL_QUEUE_SIZE"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("POINTS_DETAIL_QUEUE_SIZE: invalid value %q", value)
+		}
+		size = n
+	}
+	detailJobs = make(chan detailJob, size)
+	registerQueue("pointsDetail", func() int { return len(detailJobs) })
+	go writePointsDetail()
+	return nil
+}
+
+// awardSubmissionPoints scores a new submission. Outside sync mode only the
+// points are set; what they were scored with is returned so that queueDetail
+// can record the detail once the receipt is stored.
+func awardSubmissionPoints(stored *StoredReceipt) detailJob {
+	if pointsDetailMode == detailSync {
+		awardPoints(stored)
+		return detailJob{}
+	}
+	rules := pinnedRules(stored)
+	breakdown := rules.storedBreakdown(*stored)
+	stored.Points = sumBreakdown(breakdown)
+	return detailJob{rules: rules, breakdown: breakdown}
+}
+
+// queueDetail hands a stored submission's detail to the background writer in
+// async mode. When the writer is behind and its queue is full, the detail is
+// dropped rather than slowing submissions down.
+func queueDetail(receiptID string, job detailJob) {
+	if pointsDetailMode != detailAsync {
+		return
+	}
+	job.receiptID = receiptID
+	select {
+	case detailJobs <- job:
+	default:
+		atomic.AddInt64(&detailsDropped, 1)
+	}
+}
+
+// writePointsDetail adds queued detail to stored receipts. Receipts that have
+// been rescored since, and so already carry detail, are left alone.
+func writePointsDetail() {
+	for job := range detailJobs {
+		err := receiptStore.Update(context.Background(), job.receiptID, func(stored *StoredReceipt) error {
+			if stored.ItemPoints != nil {
+				return nil
+			}
+			stored.ItemPoints = job.rules.attributeItems(stored.Receipt, job.breakdown)
+			stored.Rounding = job.rules.descriptionRounding(stored.Receipt, job.breakdown)
+			return nil
+		})
+		if err != nil && err != errReceiptNotFound {
+			log.Printf("points detail: receipt %s: %v", job.receiptID, err)
+		}
+	}
+}
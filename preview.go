@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// PointsPreviewResponse is the points a receipt would earn if submitted now,
+// or at the time given by asOf.
+type PointsPreviewResponse struct {
+	Points int             `json:"points"`
+	Rules  []ExplainedRule `json:"rules"`
+	// VerificationRequired is set when the retailer requires verification,
+	// so the points are only awarded once the order is verified.
+	VerificationRequired bool `json:"verificationRequired,omitempty"`
+	// Warnings list the corrections made in lenient validation mode.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// previewPoints scores a receipt without storing it, so point-of-sale
+// integrations can show shoppers their expected points before the
+// transaction completes. The receipt is validated and run through the hooks
+// as a submission would be, but is not verified with the retailer or
+// checked for duplicates, and nothing is recorded.
+func previewPoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r, ok := asOf(w, r)
+	if !ok {
+		return
+	}
+	sub, ok := submissionFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid tenant or user ID", http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid receipt format. Please verify input.", http.StatusBadRequest)
+		return
+	}
+	receipt, warnings, err := decodeReceipt(body, validationMode(sub.Tenant))
+	if err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if err := validateReceipt(receipt); err != nil {
+		writeSubmitError(w, r, err)
+		return
+	}
+	if err := checkCustomFields(sub.Tenant, receipt.CustomFields); err != nil {
+		writeSubmitError(w, r, err)
+		return
+	}
+	if receipt, err = runHooks(r.Context(), receipt); err != nil {
+		writeSubmitError(w, r, err)
+		return
+	}
+
+	rules, _ := tenantRuleSet(sub.Tenant)
+	breakdown := rules.breakdown(receipt, clockFrom(r.Context()).Now())
+	writeJSON(w, r, PointsPreviewResponse{
+		Points:               sumBreakdown(breakdown),
+		Rules:                rules.explain(breakdown),
+		VerificationRequired: verificationRequired[receipt.StoreName],
+		Warnings:             warnings,
+	})
+}
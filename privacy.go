@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math"
+	mathrand "math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// AnalyticsPrivacy protects individual users in aggregate analytics. Groups
+// with fewer than MinCohort contributing users are suppressed, and when
+// Epsilon is positive the remaining figures get Laplace noise, larger as
+// Epsilon gets smaller. The zero value publishes exact figures.
+type AnalyticsPrivacy struct {
+	MinCohort int
+	Epsilon   float64
+}
+
+var (
+	// analyticsPrivacy is the default privacy policy, also applied to the
+	// figures across all tenants.
+	analyticsPrivacy AnalyticsPrivacy
+	// tenantAnalyticsPrivacy overrides the default per tenant.
+	tenantAnalyticsPrivacy = make(map[string]AnalyticsPrivacy)
+	// noiseKey keys the noise, so it cannot be predicted from the figures.
+	noiseKey = make([]byte, 32)
+)
+
+// loadAnalyticsPrivacyConfig reads ANALYTICS_MIN_COHORT,
+// ANALYTICS_NOISE_EPSILON and their per-tenant overrides
+// TENANT_ANALYTICS_MIN_COHORT and TENANT_ANALYTICS_NOISE_EPSILON
+// ("acme=10,globex=5").
+func loadAnalyticsPrivacyConfig() error {
+	if _, err := rand.Read(noiseKey); err != nil {
+		return err
+	}
+	if value := os.Getenv("ANALYTICS_MIN_COHORT"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("ANALYTICS_MIN_COHORT: invalid value %q", value)
+		}
+		analyticsPrivacy.MinCohort = n
+	}
+	if value := os.Getenv("ANALYTICS_NOISE_EPSILON"); value != "" {
+		epsilon, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(epsilon >= 0) || math.IsInf(epsilon, 0) {
+			return fmt.Errorf("ANALYTICS_NOISE_EPSILON: invalid value %q", value)
+		}
+		analyticsPrivacy.Epsilon = epsilon
+	}
+
+	overrides := func(name string, apply func(policy *AnalyticsPrivacy, value string) bool) error {
+		for _, pair := range strings.Split(os.Getenv(name), ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			tenant, value, ok := strings.Cut(pair, "=")
+			tenant = strings.TrimSpace(tenant)
+			policy, found := tenantAnalyticsPrivacy[tenant]
+			if !found {
+				policy = analyticsPrivacy
+			}
+			if !ok || !apply(&policy, strings.TrimSpace(value)) {
+				return fmt.Errorf("%s: malformed entry %q", name, pair)
+			}
+			tenantAnalyticsPrivacy[tenant] = policy
+		}
+		return nil
+	}
+	if err := overrides("TENANT_ANALYTICS_MIN_COHORT", func(policy *AnalyticsPrivacy, value string) bool {
+		n, err := strconv.Atoi(value)
+		policy.MinCohort = n
+		return err == nil && n >= 0
+	}); err != nil {
+		return err
+	}
+	return overrides("TENANT_ANALYTICS_NOISE_EPSILON", func(policy *AnalyticsPrivacy, value string) bool {
+		epsilon, err := strconv.ParseFloat(value, 64)
+		policy.Epsilon = epsilon
+		return err == nil && epsilon >= 0 && !math.IsInf(epsilon, 0)
+	})
+}
+
+// privacyFor returns a tenant's analytics privacy policy; the empty tenant
+// stands for all tenants together.
+func privacyFor(tenant string) AnalyticsPrivacy {
+	if policy, ok := tenantAnalyticsPrivacy[tenant]; ok {
+		return policy
+	}
+	return analyticsPrivacy
+}
+
+// protect applies the policy to one group's counters, identified by key.
+// It reports false when the group is too small to publish.
+//
+// The receipt count gets noise of scale 1/Epsilon; the sums get noise of
+// the same scale times the group's average per receipt, so that one
+// receipt's contribution is hidden whatever the unit. The noise is derived
+// from the key and the exact figures, so repeating a query returns the same
+// figures rather than fresh noise that could be averaged away.
+func (p AnalyticsPrivacy) protect(key string, group aggregateGroup) (AggregateCounters, bool) {
+	if group.contributors() < p.MinCohort {
+		return AggregateCounters{}, false
+	}
+	counters := group.AggregateCounters
+	if p.Epsilon <= 0 || counters.Receipts <= 0 {
+		return counters, true
+	}
+
+	mac := hmac.New(sha256.New, noiseKey)
+	fmt.Fprintf(mac, "%s\x00%+v", key, counters)
+	rng := mathrand.New(mathrand.NewSource(int64(binary.LittleEndian.Uint64(mac.Sum(nil)))))
+	scale := 1 / p.Epsilon
+	receipts := float64(counters.Receipts)
+	noisy := func(value float64, perReceipt float64) float64 {
+		return math.Max(0, math.Round(value+laplace(rng, scale*perReceipt)))
+	}
+	return AggregateCounters{
+		Receipts:   int(noisy(receipts, 1)),
+		Items:      int(noisy(float64(counters.Items), float64(counters.Items)/receipts)),
+		Points:     int(noisy(float64(counters.Points), math.Abs(float64(counters.Points))/receipts)),
+		SpendCents: int64(noisy(float64(counters.SpendCents), math.Abs(float64(counters.SpendCents))/receipts)),
+	}, true
+}
+
+// laplace draws from the Laplace distribution centered on zero.
+func laplace(rng *mathrand.Rand, scale float64) float64 {
+	u := rng.Float64() - 0.5
+	for u == -0.5 {
+		u = rng.Float64() - 0.5
+	}
+	if u < 0 {
+		return scale * math.Log(1+2*u)
+	}
+	return -scale * math.Log(1-2*u)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// submissionJob is a submission waiting for a processing worker.
+type submissionJob struct {
+	ctx     context.Context
+	sub     Submission
+	receipt Receipt
+	timing  *JobTiming
+	done    chan submissionResult
+}
+
+// submissionResult is the outcome of a queued submission.
+type submissionResult struct {
+	id     string
+	stored StoredReceipt
+	err    error
+}
+
+// processingQueue holds submissions by priority class. Workers always take
+// interactive submissions first, so bulk imports only use capacity that
+// real-time users leave idle.
+type processingQueue struct {
+	interactive chan submissionJob
+	bulk        chan submissionJob
+}
+
+// submissions is nil unless PROCESSING_WORKERS is set, in which case every
+// submission goes through the queue.
+var submissions *processingQueue
+
+// loadProcessingConfig reads PROCESSING_WORKERS and PROCESSING_QUEUE_SIZE
+// (per priority class, default 1000) and starts the workers.
+func loadProcessingConfig() error {
+	value := os.Getenv("PROCESSING_WORKERS")
+	if value == "" {
+		return nil
+	}
+	workers, err := strconv.Atoi(value)
+	if err != nil || workers <= 0 {
+		return fmt.Errorf("PROCESSING_WORKERS: invalid value %q", value)
+	}
+	size := 1000
+	if value := os.Getenv("PROCESSING_QUEUE_SIZE"); value != "" {
+		if size, err = strconv.Atoi(value); err != nil || size <= 0 {
+			return fmt.Errorf("PROCESSING_QUEUE_SIZE: invalid value %q", value)
+		}
+	}
+
+	queue := &processingQueue{
+		interactive: make(chan submissionJob, size),
+		bulk:        make(chan submissionJob, size),
+	}
+	registerQueue("submissions.interactive", func() int { return len(queue.interactive) })
+	registerQueue("submissions.bulk", func() int { return len(queue.bulk) })
+	for i := 0; i < workers; i++ {
+		go queue.work()
+	}
+	submissions = queue
+	return nil
+}
+
+// submit queues a submission in its priority class and waits for a worker
+// to process it. A full queue makes the caller wait for room.
+func (q *processingQueue) submit(ctx context.Context, sub Submission, receipt Receipt) (string, StoredReceipt, error) {
+	job := submissionJob{ctx: ctx, sub: sub, receipt: receipt, timing: newJobTiming(time.Now()), done: make(chan submissionResult, 1)}
+	lane := q.interactive
+	if sub.Bulk {
+		lane = q.bulk
+	}
+	select {
+	case lane <- job:
+	case <-ctx.Done():
+		return "", StoredReceipt{}, ctx.Err()
+	}
+	select {
+	case result := <-job.done:
+		return result.id, result.stored, result.err
+	case <-ctx.Done():
+		return "", StoredReceipt{}, ctx.Err()
+	}
+}
+
+// work processes queued submissions until the process exits.
+func (q *processingQueue) work() {
+	for {
+		var job submissionJob
+		select {
+		case job = <-q.interactive:
+		default:
+			select {
+			case job = <-q.interactive:
+			case job = <-q.bulk:
+			}
+		}
+		// Skip submissions whose caller has already given up.
+		if err := job.ctx.Err(); err != nil {
+			job.done <- submissionResult{err: err}
+			continue
+		}
+		job.timing.start(time.Now())
+		id, stored, err := processSubmission(job.ctx, job.sub, job.receipt)
+		kind := jobInteractiveSubmission
+		if job.sub.Bulk {
+			kind = jobBulkSubmission
+		}
+		job.timing.finish(kind, time.Now())
+		job.done <- submissionResult{id: id, stored: stored, err: err}
+	}
+}
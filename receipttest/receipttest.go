@@ -0,0 +1,178 @@
+// Package receipttest provides an in-memory fake of the receipt processor
+// HTTP API so that downstream Go services can test their integration
+// without running the real server.
+//
+//	fake := receipttest.NewServer()
+//	defer fake.Close()
+//	client := myservice.NewClient(fake.URL)
+package receipttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Item is a single line item, encoded as in the real API.
+type Item struct {
+	Description string `json:"shortDescription"`
+	Price       string `json:"price"`
+}
+
+// Receipt is a submitted receipt, encoded as in the real API.
+type Receipt struct {
+	StoreName      string `json:"retailer"`
+	DateOfPurchase string `json:"purchaseDate"`
+	TimeOfPurchase string `json:"purchaseTime"`
+	TotalAmount    string `json:"total"`
+	PurchasedItems []Item `json:"items"`
+}
+
+// Server is a fake receipt processor serving POST /receipts/process and
+// GET /receipts/{id}/points from memory.
+type Server struct {
+	*httptest.Server
+
+	// PointsFunc computes the points returned for a receipt. It defaults to
+	// DefaultPoints and may be replaced before requests are made.
+	PointsFunc func(Receipt) int
+
+	mu       sync.Mutex
+	receipts map[string]Receipt
+	order    []string
+	failures []int
+	nextID   int
+}
+
+// NewServer starts a fake server. Callers must Close it when done.
+func NewServer() *Server {
+	s := &Server{PointsFunc: DefaultPoints, receipts: make(map[string]Receipt)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/receipts/process", s.process)
+	mux.HandleFunc("/receipts/", s.points)
+	s.Server = httptest.NewServer(s.injectFailures(mux))
+	return s
+}
+
+// Add stores a receipt directly, as if it had been submitted, and returns
+// its ID.
+func (s *Server) Add(receipt Receipt) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextID++
+	id := fmt.Sprintf("00000000-0000-0000-0000-%012d", s.nextID)
+	s.receipts[id] = receipt
+	s.order = append(s.order, id)
+	return id
+}
+
+// Receipts returns the stored receipts in submission order.
+func (s *Server) Receipts() []Receipt {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	receipts := make([]Receipt, len(s.order))
+	for i, id := range s.order {
+		receipts[i] = s.receipts[id]
+	}
+	return receipts
+}
+
+// FailNext makes the next request fail with the given status code. Calls
+// queue up, so FailNext(503) twice fails the next two requests.
+func (s *Server) FailNext(status int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, status)
+}
+
+func (s *Server) injectFailures(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		status := 0
+		if len(s.failures) > 0 {
+			status, s.failures = s.failures[0], s.failures[1:]
+		}
+		s.mu.Unlock()
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) process(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var receipt Receipt
+	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil ||
+		receipt.StoreName == "" || receipt.DateOfPurchase == "" || receipt.TimeOfPurchase == "" ||
+		receipt.TotalAmount == "" || len(receipt.PurchasedItems) == 0 {
+		http.Error(w, "Invalid receipt format. Please verify input.", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"id": s.Add(receipt)})
+}
+
+func (s *Server) points(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasSuffix(r.URL.Path, "/points") {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/receipts/"), "/points")
+	s.mu.Lock()
+	receipt, exists := s.receipts[id]
+	s.mu.Unlock()
+	if !exists {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"points": s.PointsFunc(receipt)})
+}
+
+// DefaultPoints scores a receipt with the server's default rules.
+func DefaultPoints(receipt Receipt) int {
+	points := 0
+	for _, char := range receipt.StoreName {
+		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') {
+			points++
+		}
+	}
+	if strings.HasSuffix(receipt.TotalAmount, ".00") {
+		points += 50
+	}
+	if total, err := strconv.ParseFloat(receipt.TotalAmount, 64); err == nil && math.Mod(total, 0.25) == 0 {
+		points += 25
+	}
+	points += (len(receipt.PurchasedItems) / 2) * 5
+	for _, item := range receipt.PurchasedItems {
+		if len(strings.TrimSpace(item.Description))%3 == 0 {
+			price, _ := strconv.ParseFloat(item.Price, 64)
+			points += int(math.Ceil(price * 0.2))
+		}
+	}
+	if parts := strings.Split(receipt.DateOfPurchase, "-"); len(parts) == 3 {
+		if day, err := strconv.Atoi(parts[2]); err == nil && day%2 != 0 {
+			points += 6
+		}
+	}
+	if parts := strings.Split(receipt.TimeOfPurchase, ":"); len(parts) == 2 {
+		if hour, err := strconv.Atoi(parts[0]); err == nil && hour >= 14 && hour < 16 {
+			points += 10
+		}
+	}
+	return points
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// RecomputeResponse reports a recompute run. Receipts that are finalized or
+// have refunded items keep their points and are counted as skipped. Rules
+// breaks the change down by scoring rule. Complete is false when the
+// request timed out before every receipt was visited; a second run leaves
+// the receipts already recomputed unchanged.
+type RecomputeResponse struct {
+	RulesVersion string `json:"rulesVersion,omitempty"`
+	DryRun       bool   `json:"dryRun"`
+	Scanned      int    `json:"scanned"`
+	Changed      int    `json:"changed"`
+	Skipped      int    `json:"skipped"`
+	Failed       int    `json:"failed"`
+	PointsBefore int    `json:"pointsBefore"`
+	PointsAfter  int    `json:"pointsAfter"`
+	Delta        int    `json:"delta"`
+	Complete     bool   `json:"complete"`
+	// Rules holds the rules whose points changed, by name.
+	Rules map[string]RecomputeRuleImpact `json:"rules"`
+}
+
+// RecomputeRuleImpact is how one rule's points changed in a recompute run:
+// the receipts it awarded a different number of points and the net change.
+type RecomputeRuleImpact struct {
+	Receipts int `json:"receipts"`
+	Delta    int `json:"delta"`
+}
+
+// recomputePoints rescores stored receipts after a rules change and re-pins
+// them to the rules they were rescored under: by default each tenant's
+// current rules, or the rule set named by the version query parameter. The
+// tenant parameter limits the run to one tenant, and dryRun=true reports
+// the changes without storing them. Points that change are recorded in the
+// ledger.
+func recomputePoints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var named RulesConfig
+	version := query.Get("version")
+	if version != "" {
+		var ok bool
+		if named, ok = ruleSetByVersion(version); !ok {
+			http.Error(w, "Rules version not found", http.StatusNotFound)
+			return
+		}
+	}
+	tenant := query.Get("tenant")
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+	dryRun, _ := strconv.ParseBool(query.Get("dryRun"))
+
+	// Receipts are updated after the scan, since stores may not allow
+	// updates from within Range.
+	var ids []string
+	err := receiptStore.Range(r.Context(), func(id string, stored StoredReceipt) bool {
+		if tenant == "" || stored.Tenant == tenant {
+			ids = append(ids, id)
+		}
+		return true
+	})
+	if writeContextError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		return
+	}
+
+	response := RecomputeResponse{RulesVersion: version, DryRun: dryRun, Complete: true, Rules: make(map[string]RecomputeRuleImpact)}
+	for _, id := range ids {
+		if r.Context().Err() != nil {
+			response.Complete = false
+			break
+		}
+		previous, recomputed, ruleDeltas, err := recomputeReceipt(r.Context(), id, named, version, dryRun)
+		switch {
+		case errors.Is(err, errReceiptNotFound):
+			// Deleted since the scan.
+			continue
+		case err == errReceiptFinalized || err == errReceiptRefunded:
+			response.Skipped++
+		case err != nil:
+			log.Printf("recompute: receipt %s: %v", id, err)
+			response.Failed++
+		}
+		response.Scanned++
+		if err != nil {
+			continue
+		}
+		response.PointsBefore += previous.Points
+		response.PointsAfter += recomputed.Points
+		if recomputed.Points != previous.Points {
+			response.Changed++
+		}
+		for rule, delta := range ruleDeltas {
+			impact := response.Rules[rule]
+			impact.Receipts++
+			impact.Delta += delta
+			response.Rules[rule] = impact
+		}
+	}
+	response.Delta = response.PointsAfter - response.PointsBefore
+	writeJSON(w, r, response)
+}
+
+// recomputeReceipt rescores one receipt under the named rule set, or its
+// tenant's current rules when version is empty, returning it before and
+// after and the change in each rule's points. Unless dryRun is set, the
+// result is stored and the indexes and ledger are updated.
+func recomputeReceipt(ctx context.Context, id string, named RulesConfig, version string, dryRun bool) (StoredReceipt, StoredReceipt, map[string]int, error) {
+	var previous, recomputed StoredReceipt
+	var rules RulesConfig
+	var ruleDeltas map[string]int
+	rescore := func(stored *StoredReceipt) error {
+		if stored.FinalizedAt != nil {
+			return errReceiptFinalized
+		}
+		if len(stored.RefundedItems) > 0 {
+			return errReceiptRefunded
+		}
+		previous = *stored
+		before := storedBreakdown(previous)
+		if total := sumBreakdown(before); total != previous.Points {
+			// The receipt's pinned rules are unavailable, as in its
+			// points breakdown.
+			before = append(before, RuleResult{Rule: "pinned", Points: previous.Points - total})
+		}
+		rules, stored.RulesVersion = named, version
+		if version == "" {
+			rules, stored.RulesVersion = tenantRuleSet(stored.Tenant)
+		}
+		awardPoints(stored)
+		if stored.Points != previous.Points {
+			stored.Ledger = append(stored.Ledger, LedgerEntry{
+				ID:        uuid.New().String(),
+				Tenant:    stored.Tenant,
+				UserID:    stored.UserID,
+				ReceiptID: id,
+				Points:    stored.Points - previous.Points,
+				Reason:    "points recomputed",
+				CreatedAt: serverClock.Now(),
+			})
+		}
+		recomputed = *stored
+
+		ruleDeltas = make(map[string]int)
+		for _, result := range before {
+			ruleDeltas[result.Rule] -= result.Points
+		}
+		for _, result := range rules.storedBreakdown(recomputed) {
+			ruleDeltas[result.Rule] += result.Points
+		}
+		for rule, delta := range ruleDeltas {
+			if delta == 0 {
+				delete(ruleDeltas, rule)
+			}
+		}
+		return nil
+	}
+
+	if dryRun {
+		stored, err := receiptStore.Get(ctx, id)
+		if err == nil {
+			err = rescore(&stored)
+		}
+		return previous, recomputed, ruleDeltas, err
+	}
+	if err := receiptStore.Update(ctx, id, rescore); err != nil {
+		return previous, recomputed, ruleDeltas, err
+	}
+
+	saveRuleSet(recomputed.RulesVersion, rules)
+	recordPointsChange(id, previous, recomputed, pointsRecomputed)
+	search.add(id, recomputed)
+	return previous, recomputed, ruleDeltas, nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RefundRequest lists the items, by index, being returned.
+type RefundRequest struct {
+	Items []int `json:"items"`
+}
+
+// RefundResponse reports the points deducted for a refund.
+type RefundResponse struct {
+	ReceiptID      string      `json:"id"`
+	DeductedPoints int         `json:"deductedPoints"`
+	Points         int         `json:"points"`
+	Entry          LedgerEntry `json:"ledgerEntry"`
+}
+
+// LedgerEntry records a change to a user's points balance outside of
+// normal receipt scoring.
+type LedgerEntry struct {
+	ID        string    `json:"id"`
+	Tenant    string    `json:"tenant,omitempty"`
+	UserID    string    `json:"userId,omitempty"`
+	ReceiptID string    `json:"receiptId"`
+	Points    int       `json:"points"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// userLedger returns a tenant user's ledger entries, oldest first, from the
+// receipts they were recorded on.
+func userLedger(ctx context.Context, tenant, userID string) ([]LedgerEntry, error) {
+	entries := []LedgerEntry{}
+	err := receiptStore.Range(ctx, func(id string, stored StoredReceipt) bool {
+		if stored.Tenant != tenant {
+			return true
+		}
+		for _, entry := range stored.Ledger {
+			if entry.UserID == userID {
+				entries = append(entries, entry)
+			}
+		}
+		return true
+	})
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].CreatedAt.Before(entries[j].CreatedAt) })
+	return entries, err
+}
+
+// refundReceipt deducts the points attributed to returned items and records
+// the deduction in the ledger. Each item can be refunded once.
+func refundReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request RefundRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Items) == 0 {
+		http.Error(w, "Invalid refund request", http.StatusBadRequest)
+		return
+	}
+
+	receiptID := receiptIDFromPath(r)
+	var response RefundResponse
+	var previous, refunded StoredReceipt
+	err := receiptStore.Update(r.Context(), receiptID, func(stored *StoredReceipt) error {
+		if stored.FinalizedAt != nil {
+			return errReceiptFinalized
+		}
+		previous = *stored
+		if stored.ItemPoints == nil {
+			awardPoints(stored)
+		}
+		deducted := 0
+		seen := make(map[int]bool)
+		for _, index := range request.Items {
+			switch {
+			case index < 0 || index >= len(stored.ItemPoints):
+				return &httpError{status: http.StatusBadRequest, message: fmt.Sprintf("Item %d does not exist", index)}
+			case seen[index] || containsInt(stored.RefundedItems, index):
+				return &httpError{status: http.StatusConflict, message: fmt.Sprintf("Item %d has already been refunded", index)}
+			}
+			seen[index] = true
+			deducted += stored.ItemPoints[index]
+		}
+		stored.RefundedItems = append(stored.RefundedItems, request.Items...)
+		stored.RefundedPoints += deducted
+
+		response = RefundResponse{
+			ReceiptID:      receiptID,
+			DeductedPoints: deducted,
+			Points:         stored.Points - stored.RefundedPoints,
+			Entry: LedgerEntry{
+				ID:        uuid.New().String(),
+				Tenant:    stored.Tenant,
+				UserID:    stored.UserID,
+				ReceiptID: receiptID,
+				Points:    -deducted,
+				Reason:    fmt.Sprintf("refund of items %v", request.Items),
+				CreatedAt: clockFrom(r.Context()).Now(),
+			},
+		}
+		stored.Ledger = append(stored.Ledger, response.Entry)
+		refunded = *stored
+		return nil
+	})
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+	recordPointsChange(receiptID, previous, refunded, pointsRefunded)
+	writeJSON(w, r, response)
+}
+
+// getLedger lists a user's ledger entries.
+func getLedger(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID := userPath(r)[0]
+	if !tenantPattern.MatchString(userID) {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	entries, err := userLedger(r.Context(), tenant, userID)
+	if err != nil {
+		if !writeContextError(w, err) {
+			http.Error(w, "Failed to read ledger", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, r, entries)
+}
+
+// containsInt reports whether values contains v.
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// writeJSON encodes v as the response body. When the request carries a
+// "fields" query parameter, only the listed fields are returned. Nested
+// fields are addressed with dots, and arrays are filtered element-wise, so
+// "total,receipts.id" on a list response keeps the count and each item's ID.
+func writeJSON(w http.ResponseWriter, r *http.Request, v interface{}) {
+	writeJSONStatus(w, r, http.StatusOK, v)
+}
+
+// writeJSONStatus is writeJSON with an explicit status code.
+func writeJSONStatus(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+
+	fields := r.URL.Query().Get("fields")
+	if fields == "" {
+		w.WriteHeader(status)
+		encoder.Encode(v)
+		return
+	}
+
+	raw, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	var generic interface{}
+	if err := json.Unmarshal(raw, &generic); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+
+	var paths [][]string
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			paths = append(paths, strings.Split(field, "."))
+		}
+	}
+	w.WriteHeader(status)
+	encoder.Encode(filterFields(generic, paths))
+}
+
+// filterFields keeps only the values reachable through paths.
+func filterFields(value interface{}, paths [][]string) interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		filtered := make([]interface{}, len(v))
+		for i, elem := range v {
+			filtered[i] = filterFields(elem, paths)
+		}
+		return filtered
+	case map[string]interface{}:
+		children := make(map[string][][]string)
+		whole := make(map[string]bool)
+		for _, path := range paths {
+			if len(path) == 1 {
+				whole[path[0]] = true
+			} else {
+				children[path[0]] = append(children[path[0]], path[1:])
+			}
+		}
+		filtered := make(map[string]interface{})
+		for key, elem := range v {
+			if whole[key] {
+				filtered[key] = elem
+			} else if sub, ok := children[key]; ok {
+				filtered[key] = filterFields(elem, sub)
+			}
+		}
+		return filtered
+	default:
+		return value
+	}
+}
+
+// httpError pairs an error with the HTTP response it should produce.
+type httpError struct {
+	status  int
+	message string
+}
+
+func (e *httpError) Error() string { return e.message }
+
+// writeReceiptError maps a receipt lookup error to an HTTP response.
+func writeReceiptError(w http.ResponseWriter, err error) {
+	if e, ok := err.(*httpError); ok {
+		http.Error(w, e.message, e.status)
+		return
+	}
+	if err == errReceiptNotFound {
+		http.Error(w, "Receipt not found", http.StatusNotFound)
+		return
+	}
+	if writeContextError(w, err) {
+		return
+	}
+	http.Error(w, "Failed to load receipt", http.StatusInternalServerError)
+}
+
+// writeContextError answers a request abandoned because its context ended,
+// reporting whether err was such an error.
+func writeContextError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "Request timed out", http.StatusGatewayTimeout)
+	case errors.Is(err, context.Canceled):
+		http.Error(w, "Request canceled", http.StatusServiceUnavailable)
+	default:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// maxEncodedResponses bounds each cache of encoded responses.
+const maxEncodedResponses = 10000
+
+// encodedCache holds response bodies encoded once and written as they are,
+// for hot GET endpoints whose responses never change for a given key. Keys
+// include everything the body is encoded from, so entries never go stale;
+// when the cache is full an arbitrary entry makes room.
+type encodedCache[K comparable] struct {
+	mu     sync.RWMutex
+	bodies map[K][]byte
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func newEncodedCache[K comparable]() *encodedCache[K] {
+	return &encodedCache[K]{bodies: make(map[K][]byte)}
+}
+
+// body returns the encoded form of the value key describes, encoding it
+// with encode on a miss.
+func (c *encodedCache[K]) body(key K, encode func() interface{}) ([]byte, error) {
+	c.mu.RLock()
+	body, ok := c.bodies[key]
+	c.mu.RUnlock()
+	if ok {
+		c.hits.Add(1)
+		return body, nil
+	}
+	c.misses.Add(1)
+
+	body, err := encodeJSON(encode())
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	if len(c.bodies) >= maxEncodedResponses {
+		for evicted := range c.bodies {
+			delete(c.bodies, evicted)
+			break
+		}
+	}
+	c.bodies[key] = body
+	c.mu.Unlock()
+	return body, nil
+}
+
+// stats returns the cache's size and hit counts.
+func (c *encodedCache[K]) stats(name string) CacheStats {
+	c.mu.RLock()
+	entries := len(c.bodies)
+	c.mu.RUnlock()
+	return newCacheStats(name, &entries, c.hits.Load(), c.misses.Load())
+}
+
+// invalidate drops the entries whose keys match, or every entry when match
+// is nil, and returns how many it dropped.
+func (c *encodedCache[K]) invalidate(match func(K) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := 0
+	for key := range c.bodies {
+		if match == nil || match(key) {
+			delete(c.bodies, key)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// encodeJSON encodes v exactly as writeJSON does without fields.
+func encodeJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeEncodedJSON writes the body cached under key, falling back to
+// writeJSON when the request filters fields.
+func writeEncodedJSON[K comparable](w http.ResponseWriter, r *http.Request, cache *encodedCache[K], key K, encode func() interface{}) {
+	if r.URL.Query().Get("fields") != "" {
+		writeJSON(w, r, encode())
+		return
+	}
+	body, err := cache.body(key, encode)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// pointsBodies caches points responses by value: receipts with the same
+// points under the same rules share one body.
+var pointsBodies = newEncodedCache[PointsResponse]()
+
+// finalizedReceiptKey identifies a finalized receipt's response. Finalized
+// receipts can still be favorited, have images attached and be released from
+// review, so those are part of the key.
+type finalizedReceiptKey struct {
+	id       string
+	favorite bool
+	images   int
+	status   string
+}
+
+// finalizedReceiptBodies caches the responses of finalized receipts.
+var finalizedReceiptBodies = newEncodedCache[finalizedReceiptKey]()
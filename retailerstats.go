@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RetailerSummary summarizes one retailer's receipts purchased in a date
+// range. The basket averages are per receipt.
+type RetailerSummary struct {
+	Retailer          string  `json:"retailer"`
+	Tenant            string  `json:"tenant,omitempty"`
+	From              string  `json:"from,omitempty"`
+	To                string  `json:"to,omitempty"`
+	Receipts          int     `json:"receipts"`
+	Items             int     `json:"items"`
+	SpendCents        int64   `json:"spendCents"`
+	Points            int     `json:"points"`
+	AverageItems      float64 `json:"averageItems"`
+	AverageSpendCents float64 `json:"averageSpendCents"`
+	AveragePoints     float64 `json:"averagePoints"`
+	// Suppressed is set when the figures are withheld under the privacy
+	// policy.
+	Suppressed bool `json:"suppressed,omitempty"`
+}
+
+// merge folds another group's receipts into g.
+func (g *aggregateGroup) merge(other *aggregateGroup) {
+	g.Receipts += other.Receipts
+	g.Items += other.Items
+	g.Points += other.Points
+	g.SpendCents += other.SpendCents
+	g.anonymous += other.anonymous
+	for userID, receipts := range other.users {
+		if g.users == nil {
+			g.users = make(map[string]int)
+		}
+		g.users[userID] += receipts
+	}
+}
+
+// RetailerRange sums a retailer's counters over the purchase days from
+// up to (but excluding) to, either of which may be empty for an open range,
+// under the tenant's privacy policy. Retailer names are matched ignoring
+// case.
+func (a *aggregateIndex) RetailerRange(tenant, retailer, from, to string) RetailerSummary {
+	a.mu.RLock()
+	view := a.all
+	if tenant != "" {
+		if view = a.tenants[tenant]; view == nil {
+			view = newAggregateView()
+		}
+	}
+	var sum aggregateGroup
+	for name, days := range view.retailerDays {
+		if !strings.EqualFold(name, retailer) {
+			continue
+		}
+		for day, g := range days {
+			if (from == "" || day >= from) && (to == "" || day < to) {
+				sum.merge(g)
+			}
+		}
+	}
+	a.mu.RUnlock()
+
+	summary := RetailerSummary{Retailer: retailer, Tenant: tenant, From: from, To: to}
+	counters, ok := privacyFor(tenant).protect(tenant+"\x00retailer\x00"+strings.ToLower(retailer)+"\x00"+from+"\x00"+to, sum)
+	if !ok {
+		summary.Suppressed = true
+		return summary
+	}
+	summary.Receipts, summary.Items, summary.SpendCents, summary.Points = counters.Receipts, counters.Items, counters.SpendCents, counters.Points
+	if counters.Receipts > 0 {
+		perReceipt := func(value float64) float64 {
+			return math.Round(value/float64(counters.Receipts)*100) / 100
+		}
+		summary.AverageItems = perReceipt(float64(counters.Items))
+		summary.AverageSpendCents = perReceipt(float64(counters.SpendCents))
+		summary.AveragePoints = perReceipt(float64(counters.Points))
+	}
+	return summary
+}
+
+// retailerRoutes serves GET /retailers/{name}/stats: a retailer's receipt
+// volume, basket size and points issued, for the purchase dates from up to
+// (but excluding) to, across all tenants or for the tenant named by the
+// tenant parameter.
+func retailerRoutes(w http.ResponseWriter, r *http.Request) {
+	escaped, action, _ := strings.Cut(strings.TrimPrefix(r.URL.EscapedPath(), "/retailers/"), "/")
+	name, err := url.PathUnescape(escaped)
+	if err != nil || name == "" || action != "stats" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	tenant := query.Get("tenant")
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+	from, to := query.Get("from"), query.Get("to")
+	for _, date := range []string{from, to} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			http.Error(w, "from and to must be dates such as 2024-01-31", http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, r, aggregates.RetailerRange(tenant, name, from, to))
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// PointsRounding records, for one receipt, the exact fractional points its
+// rules produced and the whole points awarded for them.
+type PointsRounding struct {
+	Policy  string
+	Exact   float64
+	Awarded int
+}
+
+// RoundingPolicyTotals sums rounding over the receipts awarded under one
+// policy. Drift is Awarded minus Exact.
+type RoundingPolicyTotals struct {
+	Policy   string  `json:"policy"`
+	Receipts int     `json:"receipts"`
+	Exact    float64 `json:"exactPoints"`
+	Awarded  int     `json:"awardedPoints"`
+	Drift    float64 `json:"drift"`
+}
+
+// RoundingReport is the rounding audit for receipts submitted in a period.
+type RoundingReport struct {
+	From     string                 `json:"from,omitempty"`
+	To       string                 `json:"to,omitempty"`
+	Policies []RoundingPolicyTotals `json:"policies"`
+	Exact    float64                `json:"exactPoints"`
+	Awarded  int                    `json:"awardedPoints"`
+	Drift    float64                `json:"drift"`
+	// Unrecorded receipts were scored before rounding was recorded.
+	Unrecorded int `json:"unrecorded"`
+}
+
+// descriptionRounding totals a receipt's exact and rounded description
+// points. It returns nil when the breakdown awarded none, so receipts that
+// were zeroed or had nothing to round are left out of the audit.
+func (c RulesConfig) descriptionRounding(receipt Receipt, breakdown []RuleResult) *PointsRounding {
+	awarded := false
+	for _, result := range breakdown {
+		awarded = awarded || result.Rule == "itemDescriptionLength"
+	}
+	if !awarded {
+		return nil
+	}
+	engine := c.engine()
+	rounding := &PointsRounding{Policy: engine.Rounding()}
+	for _, item := range receipt.PurchasedItems {
+		exact := engine.ExactDescriptionPoints(scoringItem(item))
+		rounding.Exact += exact
+		rounding.Awarded += engine.RoundDescriptionPoints(exact)
+	}
+	return rounding
+}
+
+// getRoundingReport sums rounding drift, by policy, over receipts submitted
+// from the from date up to, but not including, the to date (YYYY-MM-DD in
+// the rules zone). Either bound may be omitted.
+func getRoundingReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	report := RoundingReport{From: query.Get("from"), To: query.Get("to"), Policies: []RoundingPolicyTotals{}}
+	var from, to time.Time
+	var err error
+	if report.From != "" {
+		if from, err = time.ParseInLocation("2006-01-02", report.From, rulesLocation); err != nil {
+			http.Error(w, "Invalid from date", http.StatusBadRequest)
+			return
+		}
+	}
+	if report.To != "" {
+		if to, err = time.ParseInLocation("2006-01-02", report.To, rulesLocation); err != nil || !to.After(from) {
+			http.Error(w, "Invalid to date", http.StatusBadRequest)
+			return
+		}
+	}
+
+	policies := make(map[string]*RoundingPolicyTotals)
+	err = receiptStore.Range(r.Context(), func(id string, stored StoredReceipt) bool {
+		if stored.SubmittedAt.Before(from) || (!to.IsZero() && !stored.SubmittedAt.Before(to)) {
+			return true
+		}
+		if stored.Rounding == nil {
+			report.Unrecorded++
+			return true
+		}
+		totals, ok := policies[stored.Rounding.Policy]
+		if !ok {
+			totals = &RoundingPolicyTotals{Policy: stored.Rounding.Policy}
+			policies[stored.Rounding.Policy] = totals
+		}
+		totals.Receipts++
+		totals.Exact += stored.Rounding.Exact
+		totals.Awarded += stored.Rounding.Awarded
+		return true
+	})
+	if err != nil {
+		if !writeContextError(w, err) {
+			http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	for _, totals := range policies {
+		totals.Drift = roundPoints(float64(totals.Awarded) - totals.Exact)
+		report.Policies = append(report.Policies, *totals)
+		report.Exact += totals.Exact
+		report.Awarded += totals.Awarded
+	}
+	sort.Slice(report.Policies, func(i, j int) bool { return report.Policies[i].Policy < report.Policies[j].Policy })
+	report.Drift = roundPoints(float64(report.Awarded) - report.Exact)
+	report.Exact = roundPoints(report.Exact)
+	for i := range report.Policies {
+		report.Policies[i].Exact = roundPoints(report.Policies[i].Exact)
+	}
+	writeJSON(w, r, report)
+}
+
+// roundPoints rounds a fractional points figure to six decimal places,
+// hiding floating-point noise in reports.
+func roundPoints(points float64) float64 {
+	return math.Round(points*1e6) / 1e6
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+)
+
+// RuleResult records how many points a single scoring rule contributed.
+type RuleResult = scoring.Result
+
+// TotalBracket is one tier of the total bracket rule.
+type TotalBracket = scoring.TotalBracket
+
+// RulesConfig holds the tunable parameters of the scoring rules. It is the
+// scoring engine's configuration, with the service's own checks and
+// extension rules defined on it.
+type RulesConfig scoring.Config
+
+// defaultRules returns the standard scoring rules.
+func defaultRules() RulesConfig {
+	return RulesConfig(scoring.Default())
+}
+
+// activeRuleSet is a rule set together with its version.
+type activeRuleSet struct {
+	rules   RulesConfig
+	version string
+}
+
+// activeRules is the rule set applied to new receipts. It is only ever
+// replaced wholesale, so readers see either the old or the new configuration
+// and never a mix of both.
+var activeRules atomic.Pointer[activeRuleSet]
+
+func init() {
+	activate(defaultRules())
+}
+
+// currentRules returns the active rule set.
+func currentRules() RulesConfig {
+	return activeRules.Load().rules
+}
+
+// currentRuleSet returns the active rule set and its version.
+func currentRuleSet() (RulesConfig, string) {
+	active := activeRules.Load()
+	return active.rules, active.version
+}
+
+// activate makes rules the active rule set and registers its version.
+func activate(rules RulesConfig) {
+	version := rulesVersion(rules)
+	registerRuleSet(version, rules)
+	activeRules.Store(&activeRuleSet{rules: rules, version: version})
+}
+
+// setRules validates rules and, only if they are valid, atomically makes
+// them the active rule set. Invalid rules leave the running configuration
+// untouched.
+func setRules(rules RulesConfig) error {
+	if problems := rules.Validate(); len(problems) > 0 {
+		return &InvalidRulesError{Problems: problems}
+	}
+	activate(rules)
+	return nil
+}
+
+// InvalidRulesError lists why a rules configuration was refused.
+type InvalidRulesError struct {
+	Problems []string
+}
+
+func (e *InvalidRulesError) Error() string {
+	return "invalid rules configuration: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate reports every problem with the configuration, including its
+// expression rules and plugins.
+func (c RulesConfig) Validate() []string {
+	problems := c.engine().Validate()
+	problems = append(problems, c.validateExpressionRules()...)
+	return append(problems, c.validatePlugins()...)
+}
+
+// sortedKeys returns a map's keys in ascending order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// loadDeadlineConfig reads SUBMISSION_DEADLINE_DAYS from the environment.
+func loadDeadlineConfig() error {
+	value := os.Getenv("SUBMISSION_DEADLINE_DAYS")
+	if value == "" {
+		return nil
+	}
+	days, err := strconv.Atoi(value)
+	if err != nil || days < 0 {
+		return fmt.Errorf("SUBMISSION_DEADLINE_DAYS: invalid value %q", value)
+	}
+	rules := currentRules()
+	rules.SubmissionDeadlineDays = days
+	return setRules(rules)
+}
+
+// computePoints calculates the points earned based on the receipt details.
+func computePoints(receipt Receipt, submittedAt time.Time) int {
+	return sumBreakdown(computeBreakdown(receipt, submittedAt))
+}
+
+// sumBreakdown totals the points in a breakdown.
+func sumBreakdown(breakdown []RuleResult) int {
+	return scoring.Sum(breakdown)
+}
+
+// storedBreakdown scores a stored receipt under the rules it is pinned to.
+func storedBreakdown(stored StoredReceipt) []RuleResult {
+	rules, _ := storedRules(stored)
+	return rules.storedBreakdown(stored)
+}
+
+// storedBreakdown scores a stored receipt, first applying checks that depend
+// on how it was submitted rather than on its contents.
+func (c RulesConfig) storedBreakdown(stored StoredReceipt) []RuleResult {
+	if gate := holdGate(stored); gate != nil {
+		return gate
+	}
+	if gate := verificationGate(stored); gate != nil {
+		return gate
+	}
+	return c.breakdown(stored.Receipt, stored.SubmittedAt)
+}
+
+// computeBreakdown scores a receipt under the active rules.
+func computeBreakdown(receipt Receipt, submittedAt time.Time) []RuleResult {
+	return currentRules().breakdown(receipt, submittedAt)
+}
+
+// breakdown evaluates every scoring rule against the receipt, phase by
+// phase, and returns the rules that awarded points in evaluation order.
+// Campaigns active when the receipt was submitted add their rules.
+// Receipts submitted after the deadline score zero with a single
+// explanatory entry.
+func (c RulesConfig) breakdown(receipt Receipt, submittedAt time.Time) []RuleResult {
+	if late, reason := c.pastSubmissionDeadline(receipt, submittedAt); late {
+		return []RuleResult{{Rule: "submissionDeadline", Points: 0, Reason: reason}}
+	}
+
+	breakdown, err := c.engine().Breakdown(scoringReceipt(receipt), c.extensionRules(receipt, submittedAt)...)
+	if err != nil {
+		// Configurations are validated before they are activated.
+		panic(err)
+	}
+	return breakdown
+}
+
+// pastSubmissionDeadline reports whether the receipt was submitted too long
+// after its purchase to earn points.
+func (c RulesConfig) pastSubmissionDeadline(receipt Receipt, submittedAt time.Time) (bool, string) {
+	if c.SubmissionDeadlineDays == 0 {
+		return false, ""
+	}
+	purchasedAt, err := localPurchaseTime(receipt)
+	if err != nil {
+		return false, ""
+	}
+	if submittedAt.Sub(purchasedAt) <= time.Duration(c.SubmissionDeadlineDays)*24*time.Hour {
+		return false, ""
+	}
+	return true, fmt.Sprintf("submitted more than %d days after purchase", c.SubmissionDeadlineDays)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// maxValidationSample bounds how many stored receipts a validation run scores.
+const maxValidationSample = 1000
+
+// ValidateRulesRequest proposes a rule set. Receipts, when given, replace
+// the stored receipts as the sample the delta is computed on.
+type ValidateRulesRequest struct {
+	Rules    RulesConfig `json:"rules"`
+	Receipts []Receipt   `json:"receipts,omitempty"`
+}
+
+// ValidateRulesResponse reports configuration problems and how the proposed
+// rules would change scores on the sample.
+type ValidateRulesResponse struct {
+	Valid  bool     `json:"valid"`
+	Errors []string `json:"errors,omitempty"`
+	RulesImpact
+}
+
+// RulesImpact is how proposed rules would change scores on a sample of
+// receipts, compared with the rules they replace.
+type RulesImpact struct {
+	SampleSize      int `json:"sampleSize"`
+	CurrentPoints   int `json:"currentPoints"`
+	ProposedPoints  int `json:"proposedPoints"`
+	Delta           int `json:"delta"`
+	ChangedReceipts int `json:"changedReceipts"`
+}
+
+// simulateRules scores a sample under the current and the proposed rules.
+func simulateRules(ctx context.Context, current, proposed RulesConfig, sample []StoredReceipt) (RulesImpact, error) {
+	var impact RulesImpact
+	for _, stored := range sample {
+		if err := ctx.Err(); err != nil {
+			return impact, err
+		}
+		before := sumBreakdown(current.storedBreakdown(stored))
+		after := sumBreakdown(proposed.storedBreakdown(stored))
+		impact.CurrentPoints += before
+		impact.ProposedPoints += after
+		if before != after {
+			impact.ChangedReceipts++
+		}
+	}
+	impact.SampleSize = len(sample)
+	impact.Delta = impact.ProposedPoints - impact.CurrentPoints
+	return impact, nil
+}
+
+// validateRules checks a proposed rules configuration and reports its score
+// delta against the active rules without activating it.
+func validateRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	request := ValidateRulesRequest{Rules: defaultRules()}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid rules configuration", http.StatusBadRequest)
+		return
+	}
+
+	response := ValidateRulesResponse{Errors: request.Rules.Validate()}
+	response.Valid = len(response.Errors) == 0
+	if !response.Valid {
+		writeJSON(w, r, response)
+		return
+	}
+
+	var sample []StoredReceipt
+	if len(request.Receipts) > 0 {
+		// Sample receipts are treated as submitted at purchase time.
+		for _, receipt := range request.Receipts {
+			if validateReceipt(receipt) != nil {
+				continue
+			}
+			purchasedAt, _ := localPurchaseTime(receipt)
+			sample = append(sample, StoredReceipt{Receipt: receipt, SubmittedAt: purchasedAt})
+		}
+	} else {
+		err := receiptStore.Range(r.Context(), func(id string, stored StoredReceipt) bool {
+			sample = append(sample, stored)
+			return len(sample) < maxValidationSample
+		})
+		if err != nil {
+			if !writeContextError(w, err) {
+				http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+			}
+			return
+		}
+	}
+
+	impact, err := simulateRules(r.Context(), currentRules(), request.Rules, sample)
+	if err != nil {
+		writeContextError(w, err)
+		return
+	}
+	response.RulesImpact = impact
+	writeJSON(w, r, response)
+}
+
+// rulesHandler returns (GET) or replaces (PUT) the active rules. A PUT body
+// is a complete configuration; omitted fields take their default values. The
+// new rules are validated in full before being swapped in, so a rejected
+// configuration never affects requests in flight. Responses carry the rules'
+// version in Rules-Version, and GET ?version= returns an earlier version.
+func rulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if version := r.URL.Query().Get("version"); version != "" {
+			getRuleSet(w, r, version)
+			return
+		}
+	case http.MethodPut:
+		rules := defaultRules()
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, "Invalid rules configuration", http.StatusBadRequest)
+			return
+		}
+		if err := setRules(rules); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rules, version := currentRuleSet()
+	w.Header().Set("Rules-Version", version)
+	writeJSON(w, r, rules)
+}
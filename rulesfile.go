@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadRulesConfig activates the rules configuration in the file named by
+// RULES_FILE, so operators can tune scoring without recompiling. The file
+// holds the same fields as PUT /admin/rules, as JSON or, for .yaml and .yml
+// files, YAML. Omitted fields keep their default values; unknown fields are
+// refused so a misspelled parameter cannot be silently ignored.
+func loadRulesConfig() error {
+	path := os.Getenv("RULES_FILE")
+	if path == "" {
+		return nil
+	}
+	rules, err := readRulesFile(path)
+	if err != nil {
+		return fmt.Errorf("RULES_FILE: %w", err)
+	}
+	if err := setRules(rules); err != nil {
+		return fmt.Errorf("RULES_FILE: %s: %w", path, err)
+	}
+	go watchRulesReloadSignal()
+	return nil
+}
+
+// readRulesFile reads and decodes a rules file.
+func readRulesFile(path string) (RulesConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return RulesConfig{}, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// YAML is converted to JSON so both formats share the JSON field
+		// names and decoding.
+		var document interface{}
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return RulesConfig{}, err
+		}
+		if data, err = json.Marshal(document); err != nil {
+			return RulesConfig{}, err
+		}
+	}
+
+	rules := defaultRules()
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&rules); err != nil {
+		return RulesConfig{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// errNoRulesFile is returned when reloading without a RULES_FILE.
+var errNoRulesFile = errors.New("RULES_FILE is not set")
+
+// reloadRules reads RULES_FILE again and activates it, as at startup
+// including the SUBMISSION_DEADLINE_DAYS override. The new rules are
+// validated in full and swapped in atomically; if the file cannot be read
+// or is invalid, the running rules are kept.
+func reloadRules() (RulesConfig, error) {
+	path := os.Getenv("RULES_FILE")
+	if path == "" {
+		return RulesConfig{}, errNoRulesFile
+	}
+	rules, err := readRulesFile(path)
+	if err != nil {
+		return RulesConfig{}, err
+	}
+	if value := os.Getenv("SUBMISSION_DEADLINE_DAYS"); value != "" {
+		// Validated at startup.
+		rules.SubmissionDeadlineDays, _ = strconv.Atoi(value)
+	}
+	if err := setRules(rules); err != nil {
+		return RulesConfig{}, err
+	}
+	return rules, nil
+}
+
+// watchRulesReloadSignal reloads the rules file on every SIGHUP.
+func watchRulesReloadSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if _, err := reloadRules(); err != nil {
+			log.Printf("rules: reload failed, keeping the running rules: %v", err)
+			continue
+		}
+		_, version := currentRuleSet()
+		log.Printf("rules: reloaded %s, version %s", os.Getenv("RULES_FILE"), version)
+	}
+}
+
+// reloadRulesHandler reloads the rules file on request and returns the
+// rules now active.
+func reloadRulesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rules, err := reloadRules()
+	switch {
+	case err == errNoRulesFile:
+		http.Error(w, "No rules file is configured", http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, "Rules not reloaded: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Rules-Version", rulesVersion(rules))
+	writeJSON(w, r, rules)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+var (
+	ruleSetsMutex sync.Mutex
+	// ruleSets holds every rule set activated or loaded since startup, by
+	// version.
+	ruleSets = make(map[string]RulesConfig)
+	// savedRuleSets records the versions saved to the blob store.
+	savedRuleSets = make(map[string]bool)
+)
+
+// rulesVersion identifies a rule set by its contents and the scripts of the
+// plugins it lists, so the same rules keep the same version across restarts
+// and editing a listed plugin yields a new version.
+func rulesVersion(rules RulesConfig) string {
+	hash := sha256.New()
+	data, _ := json.Marshal(rules)
+	hash.Write(data)
+	for _, name := range rules.Plugins {
+		script := ""
+		if plugin, ok := scoringPlugins[name]; ok {
+			script = plugin.hash
+		}
+		fmt.Fprintf(hash, "\x00plugin %s %s", name, script)
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:16])
+}
+
+// legacyRulesVersion is the version rule sets were saved under before
+// versions covered plugin scripts.
+func legacyRulesVersion(rules RulesConfig) string {
+	data, _ := json.Marshal(rules)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// ruleSetKey is the blob key a rule set is saved under.
+func ruleSetKey(version string) string {
+	return "rules/" + version + ".json"
+}
+
+// registerRuleSet makes a rule set available by version.
+func registerRuleSet(version string, rules RulesConfig) {
+	ruleSetsMutex.Lock()
+	defer ruleSetsMutex.Unlock()
+	ruleSets[version] = rules
+}
+
+// ruleSetByVersion returns the rule set with the given version, loading it
+// from the blob store if it was saved before a restart.
+func ruleSetByVersion(version string) (RulesConfig, bool) {
+	ruleSetsMutex.Lock()
+	defer ruleSetsMutex.Unlock()
+	if rules, ok := ruleSets[version]; ok {
+		return rules, true
+	}
+	data, err := blobStore.Get(ruleSetKey(version))
+	if err != nil {
+		return RulesConfig{}, false
+	}
+	var rules RulesConfig
+	if err := json.Unmarshal(data, &rules); err != nil || (rulesVersion(rules) != version && legacyRulesVersion(rules) != version) {
+		log.Printf("rules: saved rule set %s is unreadable or its plugins have changed", version)
+		return RulesConfig{}, false
+	}
+	ruleSets[version] = rules
+	savedRuleSets[version] = true
+	return rules, true
+}
+
+// saveRuleSet saves a rule set receipts are pinned to, so they can be
+// rescored under it after a restart. Each version is saved once.
+func saveRuleSet(version string, rules RulesConfig) {
+	ruleSetsMutex.Lock()
+	defer ruleSetsMutex.Unlock()
+	if savedRuleSets[version] {
+		return
+	}
+	data, _ := json.Marshal(rules)
+	if err := blobStore.Put(ruleSetKey(version), data); err != nil {
+		log.Printf("rules: saving rule set %s: %v", version, err)
+		return
+	}
+	savedRuleSets[version] = true
+}
+
+// pinnedRules returns the rules a receipt is scored under: those of the
+// version it is pinned to, so that rule changes do not alter the points of
+// receipts already submitted. Receipts not yet pinned are pinned to their
+// tenant's current rules. Startup checks that every pinned rule set can be
+// loaded, so a missing one means the blob store lost it while running; it
+// is logged and the receipt repinned rather than left unscorable.
+func pinnedRules(stored *StoredReceipt) RulesConfig {
+	if stored.RulesVersion != "" {
+		if rules, ok := ruleSetByVersion(stored.RulesVersion); ok {
+			return rules
+		}
+		log.Printf("rules: rule set %s is missing, repinning a receipt to the current rules", stored.RulesVersion)
+	}
+	rules, version := tenantRuleSet(stored.Tenant)
+	stored.RulesVersion = version
+	saveRuleSet(version, rules)
+	return rules
+}
+
+// checkPinnedRuleSets verifies that every rule set stored receipts are
+// pinned to can be loaded, so that a restart never rescores receipts under
+// other rules. Rule sets are saved to the blob store, so a persistent
+// receipt store needs a persistent blob store (BLOB_DIR) as well.
+func checkPinnedRuleSets() error {
+	checked := make(map[string]bool)
+	missing := make(map[string]int)
+	err := receiptStore.Range(context.Background(), func(id string, stored StoredReceipt) bool {
+		version := stored.RulesVersion
+		if version == "" {
+			return true
+		}
+		if _, done := checked[version]; !done {
+			_, checked[version] = ruleSetByVersion(version)
+		}
+		if !checked[version] {
+			missing[version]++
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		versions := sortedKeys(missing)
+		return fmt.Errorf("rules: receipts are pinned to %d rule set(s) that cannot be loaded (%s); set BLOB_DIR to the directory they were saved in",
+			len(versions), strings.Join(versions, ", "))
+	}
+	return nil
+}
+
+// storedRules returns the rules a stored receipt was scored under, or its
+// tenant's current rules when those are unavailable, reporting which.
+func storedRules(stored StoredReceipt) (RulesConfig, bool) {
+	if stored.RulesVersion != "" {
+		if rules, ok := ruleSetByVersion(stored.RulesVersion); ok {
+			return rules, true
+		}
+	}
+	rules, _ := tenantRuleSet(stored.Tenant)
+	return rules, false
+}
+
+// getRuleSet returns a rule set receipts are pinned to, by version.
+func getRuleSet(w http.ResponseWriter, r *http.Request, version string) {
+	rules, ok := ruleSetByVersion(version)
+	if !ok {
+		http.Error(w, "Rules version not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Rules-Version", version)
+	writeJSON(w, r, rules)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSampleSize bounds the receipts returned by one sample.
+const maxSampleSize = 1000
+
+// SampledReceipt is one receipt of a sample, with the points it would earn
+// under the active rules, less refunds, next to its points.
+type SampledReceipt struct {
+	StoredReceiptResponse
+	CurrentPoints int `json:"currentPoints"`
+}
+
+// SampleResponse is a reproducible random sample of stored receipts.
+// Matched counts every receipt the filter selected.
+type SampleResponse struct {
+	Seed     int64            `json:"seed"`
+	Filter   string           `json:"filter,omitempty"`
+	Matched  int              `json:"matched"`
+	Receipts []SampledReceipt `json:"receipts"`
+}
+
+// receiptFilter selects receipts for a sample. Zero fields match anything.
+type receiptFilter struct {
+	tenant    string
+	retailer  string
+	userID    string
+	source    string
+	client    string
+	from, to  time.Time
+	minPoints *int
+	maxPoints *int
+	flagged   *bool
+}
+
+// parseReceiptFilter parses comma-separated field:value terms, all of which
+// a receipt must match.
+func parseReceiptFilter(value string) (receiptFilter, error) {
+	var filter receiptFilter
+	if value == "" {
+		return filter, nil
+	}
+	for _, term := range strings.Split(value, ",") {
+		field, operand, ok := strings.Cut(strings.TrimSpace(term), ":")
+		if !ok || operand == "" {
+			return filter, fmt.Errorf("filter term %q must be field:value", term)
+		}
+		var err error
+		switch field {
+		case "tenant":
+			filter.tenant = operand
+		case "retailer":
+			filter.retailer = operand
+		case "user":
+			filter.userID = operand
+		case "source":
+			filter.source = operand
+		case "client":
+			filter.client = operand
+		case "from":
+			filter.from, err = time.ParseInLocation("2006-01-02", operand, rulesLocation)
+		case "to":
+			filter.to, err = time.ParseInLocation("2006-01-02", operand, rulesLocation)
+		case "minPoints", "maxPoints":
+			var points int
+			if points, err = strconv.Atoi(operand); err == nil && field == "minPoints" {
+				filter.minPoints = &points
+			} else if err == nil {
+				filter.maxPoints = &points
+			}
+		case "flagged":
+			var flagged bool
+			if flagged, err = strconv.ParseBool(operand); err == nil {
+				filter.flagged = &flagged
+			}
+		default:
+			return filter, fmt.Errorf("unknown filter field %q", field)
+		}
+		if err != nil {
+			return filter, fmt.Errorf("invalid %s value %q", field, operand)
+		}
+	}
+	return filter, nil
+}
+
+// matches reports whether a stored receipt passes the filter. Dates select
+// by submission time, to being exclusive.
+func (f receiptFilter) matches(stored StoredReceipt) bool {
+	points := netPoints(stored)
+	switch {
+	case f.tenant != "" && stored.Tenant != f.tenant,
+		f.retailer != "" && !strings.EqualFold(stored.Receipt.StoreName, f.retailer),
+		f.userID != "" && stored.UserID != f.userID,
+		f.source != "" && stored.Source != f.source,
+		f.client != "" && stored.Client != f.client,
+		stored.SubmittedAt.Before(f.from),
+		!f.to.IsZero() && !stored.SubmittedAt.Before(f.to),
+		f.minPoints != nil && points < *f.minPoints,
+		f.maxPoints != nil && points > *f.maxPoints,
+		f.flagged != nil && (stored.DuplicateOf != "") != *f.flagged:
+		return false
+	}
+	return true
+}
+
+// sampleCandidate is a receipt ranked by its sampling key.
+type sampleCandidate struct {
+	key    uint64
+	id     string
+	stored StoredReceipt
+}
+
+// sampleHeap keeps the candidates with the lowest keys, the highest on top.
+type sampleHeap []sampleCandidate
+
+func (h sampleHeap) Len() int            { return len(h) }
+func (h sampleHeap) Less(i, j int) bool  { return h[i].key > h[j].key }
+func (h sampleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sampleHeap) Push(x interface{}) { *h = append(*h, x.(sampleCandidate)) }
+func (h *sampleHeap) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// sampleKey ranks a receipt pseudo-randomly for a seed. It depends only on
+// the seed and the receipt ID, so a sample does not depend on the order the
+// store returns receipts in.
+func sampleKey(seed int64, id string) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(seed))
+	h.Write(buf[:])
+	h.Write([]byte(id))
+	// FNV alone mixes the last bytes poorly; finish with a 64-bit mixer.
+	key := h.Sum64()
+	key ^= key >> 33
+	key *= 0xff51afd7ed558ccd
+	key ^= key >> 33
+	return key
+}
+
+// sampleReceipts returns a random sample of the stored receipts matching
+// filter, for spot-checking scoring. The same seed always selects the same
+// receipts while the store is unchanged; receipts added later only enter
+// the sample by displacing others. Only n receipts are held at a time.
+func sampleReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	n := 50
+	if value := query.Get("n"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n < 1 || n > maxSampleSize {
+			http.Error(w, fmt.Sprintf("n must be 1-%d", maxSampleSize), http.StatusBadRequest)
+			return
+		}
+	}
+	// Chosen seeds stay small enough to survive JSON clients that parse
+	// numbers as doubles.
+	seed := int64(rand.Int31())
+	if value := query.Get("seed"); value != "" {
+		var err error
+		if seed, err = strconv.ParseInt(value, 10, 64); err != nil {
+			http.Error(w, "Invalid seed", http.StatusBadRequest)
+			return
+		}
+	}
+	filter, err := parseReceiptFilter(query.Get("filter"))
+	if err != nil {
+		http.Error(w, "Invalid filter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := SampleResponse{Seed: seed, Filter: query.Get("filter"), Receipts: []SampledReceipt{}}
+	sample := make(sampleHeap, 0, n)
+	err = receiptStore.Range(r.Context(), func(id string, stored StoredReceipt) bool {
+		if !filter.matches(stored) {
+			return true
+		}
+		response.Matched++
+		candidate := sampleCandidate{key: sampleKey(seed, id), id: id, stored: stored}
+		if len(sample) < n {
+			heap.Push(&sample, candidate)
+		} else if candidate.key < sample[0].key {
+			sample[0] = candidate
+			heap.Fix(&sample, 0)
+		}
+		return true
+	})
+	if err != nil {
+		if !writeContextError(w, err) {
+			http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Popping yields the highest keys first; fill from the back so the
+	// sample is listed in key order.
+	rules := currentRules()
+	response.Receipts = make([]SampledReceipt, len(sample))
+	for i := len(sample) - 1; i >= 0; i-- {
+		candidate := heap.Pop(&sample).(sampleCandidate)
+		response.Receipts[i] = SampledReceipt{
+			StoredReceiptResponse: storedReceiptResponse(candidate.id, candidate.stored),
+			CurrentPoints:         sumBreakdown(rules.storedBreakdown(candidate.stored)) - candidate.stored.RefundedPoints,
+		}
+	}
+	writeJSON(w, r, response)
+}
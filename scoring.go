@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+)
+
+// Configuration types of the scoring engine, as they appear in rule sets.
+type (
+	GeoPoint         = scoring.GeoPoint
+	GeoFence         = scoring.GeoFence
+	PointsMultiplier = scoring.PointsMultiplier
+)
+
+// engine returns the rules as the scoring engine's configuration.
+func (c RulesConfig) engine() scoring.Config {
+	return scoring.Config(c)
+}
+
+// extensionRules returns the rules the service adds to the engine's for a
+// receipt: the configured expression rules and plugins, then the rules of
+// the campaigns active when it was submitted.
+func (c RulesConfig) extensionRules(receipt Receipt, submittedAt time.Time) []scoring.Rule {
+	var rules []scoring.Rule
+	for _, e := range c.ExpressionRules {
+		rules = append(rules, expressionRule(e, receipt))
+	}
+	for _, name := range c.Plugins {
+		rules = append(rules, pluginRule(name, receipt))
+	}
+	return append(rules, campaignRules(receipt, submittedAt)...)
+}
+
+// scoringItem converts an item for the engine, running its description
+// through the transliterator so that its length is counted as scored.
+func scoringItem(item Item) scoring.Item {
+	return scoring.Item{Description: normalizeDescription(item.Description), Price: item.Price}
+}
+
+// scoringReceipt converts a receipt for the engine. Its purchase time is the
+// wall-clock time in the zone it was recorded in; receipts whose time or
+// zone cannot be read earn no time-of-day points.
+func scoringReceipt(receipt Receipt) scoring.Receipt {
+	items := make([]scoring.Item, len(receipt.PurchasedItems))
+	for i, item := range receipt.PurchasedItems {
+		items[i] = scoringItem(item)
+	}
+	purchasedAt, _ := localPurchaseTime(receipt)
+	return scoring.Receipt{
+		Retailer:     receipt.StoreName,
+		PurchaseDate: receipt.DateOfPurchase,
+		PurchasedAt:  purchasedAt,
+		Total:        receipt.TotalAmount,
+		Items:        items,
+		Store:        receipt.Location,
+	}
+}
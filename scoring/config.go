@@ -0,0 +1,195 @@
+package scoring
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Config holds the tunable parameters of the scoring rules. Its JSON form is
+// the processor's rules configuration.
+type Config struct {
+	// RetailerCharPoints is awarded per alphanumeric character in the retailer
+	// name, or per unit counted by RetailerScoring.
+	RetailerCharPoints int `json:"retailerCharPoints"`
+	// RetailerScoring selects what the retailer name rule counts: characters
+	// (the default), words, uniqueLetters, or fixed, which awards the
+	// retailer's RetailerPoints and RetailerCharPoints to retailers not listed.
+	RetailerScoring string         `json:"retailerScoring,omitempty"`
+	RetailerPoints  map[string]int `json:"retailerPoints,omitempty"`
+	// RoundDollarPoints is awarded when the total has no cents.
+	RoundDollarPoints int `json:"roundDollarPoints"`
+	// QuarterMultiplePoints is awarded when the total is a multiple of 0.25.
+	QuarterMultiplePoints int `json:"quarterMultiplePoints"`
+	// ItemPairPoints is awarded for every two items.
+	ItemPairPoints int `json:"itemPairPoints"`
+	// DescriptionLengthMultiple selects items whose trimmed description
+	// length is a multiple of it; they earn DescriptionPriceMultiplier times
+	// their price, rounded up.
+	DescriptionLengthMultiple  int     `json:"descriptionLengthMultiple"`
+	DescriptionPriceMultiplier float64 `json:"descriptionPriceMultiplier"`
+	// DescriptionRounding turns each item's fractional description points
+	// into whole points: up (the default), nearest or down.
+	DescriptionRounding string `json:"descriptionRounding,omitempty"`
+	// OddDayPoints is awarded when the purchase day is odd.
+	OddDayPoints int `json:"oddDayPoints"`
+	// AfternoonPoints is awarded for purchases from AfternoonStartHour up to
+	// (but excluding) AfternoonEndHour.
+	AfternoonStartHour int `json:"afternoonStartHour"`
+	AfternoonEndHour   int `json:"afternoonEndHour"`
+	AfternoonPoints    int `json:"afternoonPoints"`
+	// SubmissionDeadlineDays zeroes receipts submitted more than this many
+	// days after purchase. Zero disables the deadline. The engine scores
+	// receipts as given; the processor applies the deadline.
+	SubmissionDeadlineDays int `json:"submissionDeadlineDays"`
+	// TotalBrackets awards bonus points by receipt total. Each receipt earns
+	// the points of the highest bracket whose Min it reaches.
+	TotalBrackets []TotalBracket `json:"totalBrackets,omitempty"`
+	// GeoFences award bonus points for purchases at stores inside them. A
+	// receipt inside several fences earns the points of the best one.
+	GeoFences []GeoFence `json:"geoFences,omitempty"`
+	// ExpressionRules are custom bonus rules declared as CEL expressions.
+	// The processor evaluates them and passes them to Breakdown as extra
+	// rules; the engine itself ignores them.
+	ExpressionRules []ExpressionRule `json:"expressionRules,omitempty"`
+	// Plugins names the scoring plugins, loaded from SCORING_PLUGINS_DIR,
+	// that add points after the expression rules, in the order given. Like
+	// expression rules, they are evaluated by the processor.
+	Plugins []string `json:"plugins,omitempty"`
+	// Multipliers scale the points of the base rules, and of any
+	// multipliers they are declared after, before the cap is applied.
+	Multipliers []PointsMultiplier `json:"multipliers,omitempty"`
+	// MaxPoints caps the points a single receipt can earn. Zero is uncapped.
+	MaxPoints int `json:"maxPoints"`
+}
+
+// TotalBracket is one tier of the total bracket rule.
+type TotalBracket struct {
+	// Min is the lowest total, in dollars, that falls in the bracket.
+	Min    float64 `json:"min"`
+	Points int     `json:"points"`
+}
+
+// ExpressionRule is a custom bonus rule: Points are awarded to receipts for
+// which the CEL expression When is true.
+type ExpressionRule struct {
+	Name   string `json:"name"`
+	When   string `json:"when"`
+	Points int    `json:"points"`
+	// Description explains the rule in points breakdowns.
+	Description string `json:"description,omitempty"`
+}
+
+// PointsMultiplier scales the points of the rules evaluated before it. It
+// adds (Factor - 1) times the running total, rounded to the nearest point.
+type PointsMultiplier struct {
+	Name   string  `json:"name"`
+	Factor float64 `json:"factor"`
+	// Retailer limits the multiplier to one retailer's receipts.
+	Retailer string `json:"retailer,omitempty"`
+	// After names other multipliers to apply first.
+	After []string `json:"after,omitempty"`
+}
+
+// Default returns the standard scoring rules.
+func Default() Config {
+	return Config{
+		RetailerCharPoints:         1,
+		RoundDollarPoints:          50,
+		QuarterMultiplePoints:      25,
+		ItemPairPoints:             5,
+		DescriptionLengthMultiple:  3,
+		DescriptionPriceMultiplier: 0.2,
+		OddDayPoints:               6,
+		AfternoonStartHour:         14,
+		AfternoonEndHour:           16,
+		AfternoonPoints:            10,
+	}
+}
+
+// Validate reports every problem with the configuration, except with its
+// expression rules and plugins, which are left to whoever evaluates them.
+func (c Config) Validate() []string {
+	var problems []string
+	nonNegative := map[string]int{
+		"retailerCharPoints":     c.RetailerCharPoints,
+		"roundDollarPoints":      c.RoundDollarPoints,
+		"quarterMultiplePoints":  c.QuarterMultiplePoints,
+		"itemPairPoints":         c.ItemPairPoints,
+		"oddDayPoints":           c.OddDayPoints,
+		"afternoonPoints":        c.AfternoonPoints,
+		"submissionDeadlineDays": c.SubmissionDeadlineDays,
+		"maxPoints":              c.MaxPoints,
+	}
+	for _, name := range sortedKeys(nonNegative) {
+		if nonNegative[name] < 0 {
+			problems = append(problems, fmt.Sprintf("%s must not be negative", name))
+		}
+	}
+	if c.DescriptionLengthMultiple <= 0 {
+		problems = append(problems, "descriptionLengthMultiple must be positive")
+	}
+	if c.DescriptionPriceMultiplier < 0 || math.IsNaN(c.DescriptionPriceMultiplier) || math.IsInf(c.DescriptionPriceMultiplier, 0) {
+		problems = append(problems, "descriptionPriceMultiplier must be a non-negative number")
+	}
+	switch c.DescriptionRounding {
+	case "", RoundingUp, RoundingNearest, RoundingDown:
+	default:
+		problems = append(problems, "descriptionRounding must be up, nearest or down")
+	}
+	problems = append(problems, c.validateRetailerScoring()...)
+	if c.AfternoonStartHour < 0 || c.AfternoonStartHour > 23 || c.AfternoonEndHour < 1 || c.AfternoonEndHour > 24 {
+		problems = append(problems, "afternoon window hours must be within 0-24")
+	} else if c.AfternoonStartHour >= c.AfternoonEndHour {
+		problems = append(problems, "afternoonStartHour must be before afternoonEndHour")
+	}
+	for i, bracket := range c.TotalBrackets {
+		switch {
+		case bracket.Min < 0 || math.IsNaN(bracket.Min) || math.IsInf(bracket.Min, 0):
+			problems = append(problems, fmt.Sprintf("totalBrackets[%d].min must be a non-negative number", i))
+		case i > 0 && bracket.Min <= c.TotalBrackets[i-1].Min:
+			problems = append(problems, fmt.Sprintf("totalBrackets[%d].min must be greater than the previous bracket's", i))
+		}
+		if bracket.Points < 0 {
+			problems = append(problems, fmt.Sprintf("totalBrackets[%d].points must not be negative", i))
+		}
+	}
+	problems = append(problems, validateGeoFences(c.GeoFences)...)
+	problems = append(problems, c.validateMultipliers()...)
+	return problems
+}
+
+// validateMultipliers reports every problem with the configured multipliers.
+func (c Config) validateMultipliers() []string {
+	var problems []string
+	names := make(map[string]bool)
+	for i, m := range c.Multipliers {
+		switch {
+		case m.Name == "":
+			problems = append(problems, fmt.Sprintf("multipliers[%d].name is required", i))
+		case names[m.Name]:
+			problems = append(problems, fmt.Sprintf("multipliers[%d].name %q is used twice", i, m.Name))
+		}
+		names[m.Name] = true
+		if m.Factor < 0 || math.IsNaN(m.Factor) || math.IsInf(m.Factor, 0) {
+			problems = append(problems, fmt.Sprintf("multipliers[%d].factor must be a non-negative number", i))
+		}
+	}
+	if len(problems) > 0 {
+		return problems
+	}
+	if _, err := c.Rules(Receipt{}); err != nil {
+		problems = append(problems, err.Error())
+	}
+	return problems
+}
+
+// sortedKeys returns a map's keys in ascending order.
+func sortedKeys(m map[string]int) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,45 @@
+package scoring
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Rounding policies for fractional description points.
+const (
+	RoundingUp      = "up"
+	RoundingNearest = "nearest"
+	RoundingDown    = "down"
+)
+
+// Rounding returns the description rounding policy in effect.
+func (c Config) Rounding() string {
+	if c.DescriptionRounding == "" {
+		return RoundingUp
+	}
+	return c.DescriptionRounding
+}
+
+// ExactDescriptionPoints returns the fractional points an item earns for its
+// description length, before rounding.
+func (c Config) ExactDescriptionPoints(item Item) float64 {
+	if len(strings.TrimSpace(item.Description))%c.DescriptionLengthMultiple != 0 {
+		return 0
+	}
+	price, _ := strconv.ParseFloat(item.Price, 64)
+	return price * c.DescriptionPriceMultiplier
+}
+
+// RoundDescriptionPoints rounds an item's description points under the
+// rounding policy.
+func (c Config) RoundDescriptionPoints(exact float64) int {
+	switch c.Rounding() {
+	case RoundingNearest:
+		return int(math.Round(exact))
+	case RoundingDown:
+		return int(math.Floor(exact))
+	default:
+		return int(math.Ceil(exact))
+	}
+}
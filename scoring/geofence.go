@@ -0,0 +1,114 @@
+package scoring
+
+import (
+	"fmt"
+	"math"
+)
+
+// earthRadiusMeters is the mean radius used for distances between points.
+const earthRadiusMeters = 6371000
+
+// GeoPoint is a position in decimal degrees.
+type GeoPoint struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// GeoFence is an area where purchases earn bonus points: either a circle of
+// RadiusMeters around Center or a polygon given by its vertices in order.
+type GeoFence struct {
+	Name         string     `json:"name"`
+	Points       int        `json:"points"`
+	Center       *GeoPoint  `json:"center,omitempty"`
+	RadiusMeters float64    `json:"radiusMeters,omitempty"`
+	Polygon      []GeoPoint `json:"polygon,omitempty"`
+}
+
+// Valid reports whether a point's coordinates are in range.
+func (p GeoPoint) Valid() bool {
+	return p.Latitude >= -90 && p.Latitude <= 90 && p.Longitude >= -180 && p.Longitude <= 180
+}
+
+// validateGeoFences reports every problem with a list of geo-fences.
+func validateGeoFences(fences []GeoFence) []string {
+	var problems []string
+	names := make(map[string]bool)
+	for i, fence := range fences {
+		prefix := fmt.Sprintf("geoFences[%d]", i)
+		if fence.Name == "" {
+			problems = append(problems, prefix+".name is required")
+		} else if names[fence.Name] {
+			problems = append(problems, fmt.Sprintf("%s.name %q is used twice", prefix, fence.Name))
+		}
+		names[fence.Name] = true
+		if fence.Points < 0 {
+			problems = append(problems, prefix+".points must not be negative")
+		}
+		switch {
+		case fence.Center != nil && len(fence.Polygon) > 0:
+			problems = append(problems, prefix+" must have either a center or a polygon, not both")
+		case fence.Center != nil:
+			if !fence.Center.Valid() {
+				problems = append(problems, prefix+".center is not a valid position")
+			}
+			if !(fence.RadiusMeters > 0) || math.IsInf(fence.RadiusMeters, 0) {
+				problems = append(problems, prefix+".radiusMeters must be positive")
+			}
+		case len(fence.Polygon) > 0:
+			if len(fence.Polygon) < 3 {
+				problems = append(problems, prefix+".polygon needs at least 3 points")
+			}
+			for j, vertex := range fence.Polygon {
+				if !vertex.Valid() {
+					problems = append(problems, fmt.Sprintf("%s.polygon[%d] is not a valid position", prefix, j))
+				}
+			}
+		default:
+			problems = append(problems, prefix+" needs a center and radiusMeters, or a polygon")
+		}
+	}
+	return problems
+}
+
+// contains reports whether the fence covers a point.
+func (f GeoFence) contains(p GeoPoint) bool {
+	if f.Center != nil {
+		return distanceMeters(*f.Center, p) <= f.RadiusMeters
+	}
+	// Cast a ray east from p and count the polygon edges it crosses. Fences
+	// are small enough to treat latitude and longitude as flat.
+	inside := false
+	for i, j := 0, len(f.Polygon)-1; i < len(f.Polygon); j, i = i, i+1 {
+		a, b := f.Polygon[i], f.Polygon[j]
+		if (a.Latitude > p.Latitude) != (b.Latitude > p.Latitude) &&
+			p.Longitude < a.Longitude+(p.Latitude-a.Latitude)*(b.Longitude-a.Longitude)/(b.Latitude-a.Latitude) {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// distanceMeters is the great-circle distance between two points.
+func distanceMeters(a, b GeoPoint) float64 {
+	toRadians := math.Pi / 180
+	dLat := (b.Latitude - a.Latitude) * toRadians
+	dLng := (b.Longitude - a.Longitude) * toRadians
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Latitude*toRadians)*math.Cos(b.Latitude*toRadians)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadiusMeters * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// geoFencePoints returns the points of the most generous fence containing
+// the receipt's store location. Receipts without a location earn nothing.
+func (c Config) geoFencePoints(receipt Receipt) int {
+	if receipt.Store == nil {
+		return 0
+	}
+	points := 0
+	for _, fence := range c.GeoFences {
+		if fence.Points > points && fence.contains(*receipt.Store) {
+			points = fence.Points
+		}
+	}
+	return points
+}
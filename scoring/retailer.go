@@ -0,0 +1,105 @@
+package scoring
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// Retailer name scoring modes. Each awards RetailerCharPoints per unit
+// counted, except fixed, which awards configured points per retailer.
+const (
+	retailerScoringCharacters    = "characters"
+	retailerScoringWords         = "words"
+	retailerScoringUniqueLetters = "uniqueLetters"
+	retailerScoringFixed         = "fixed"
+)
+
+// retailerScoring returns the retailer name scoring mode in effect.
+func (c Config) retailerScoring() string {
+	if c.RetailerScoring == "" {
+		return retailerScoringCharacters
+	}
+	return c.RetailerScoring
+}
+
+// retailerNamePoints returns the points a retailer name earns.
+func (c Config) retailerNamePoints(name string) int {
+	switch c.retailerScoring() {
+	case retailerScoringWords:
+		words := strings.FieldsFunc(name, func(char rune) bool { return !isAlphanumeric(char) })
+		return len(words) * c.RetailerCharPoints
+	case retailerScoringUniqueLetters:
+		letters := make(map[rune]bool)
+		for _, char := range name {
+			if isAlphanumeric(char) && unicode.IsLetter(char) {
+				letters[unicode.ToLower(char)] = true
+			}
+		}
+		return len(letters) * c.RetailerCharPoints
+	case retailerScoringFixed:
+		if points, ok := c.fixedRetailerPoints(name); ok {
+			return points
+		}
+		return c.RetailerCharPoints
+	}
+	nameChars := 0
+	for _, char := range name {
+		if isAlphanumeric(char) {
+			nameChars++
+		}
+	}
+	return nameChars * c.RetailerCharPoints
+}
+
+// fixedRetailerPoints looks a retailer up in RetailerPoints, ignoring case
+// and surrounding spaces.
+func (c Config) fixedRetailerPoints(name string) (int, bool) {
+	name = strings.TrimSpace(name)
+	for retailer, points := range c.RetailerPoints {
+		if strings.EqualFold(strings.TrimSpace(retailer), name) {
+			return points, true
+		}
+	}
+	return 0, false
+}
+
+// validateRetailerScoring reports problems with the retailer name scoring
+// mode and the fixed retailer points.
+func (c Config) validateRetailerScoring() []string {
+	var problems []string
+	switch c.RetailerScoring {
+	case "", retailerScoringCharacters, retailerScoringWords, retailerScoringUniqueLetters, retailerScoringFixed:
+	default:
+		problems = append(problems, "retailerScoring must be characters, words, uniqueLetters or fixed")
+	}
+	seen := make(map[string]string)
+	for _, retailer := range sortedKeys(c.RetailerPoints) {
+		key := strings.ToLower(strings.TrimSpace(retailer))
+		switch {
+		case key == "":
+			problems = append(problems, "retailerPoints names must not be empty")
+			continue
+		case seen[key] != "":
+			problems = append(problems, fmt.Sprintf("retailerPoints lists %q and %q, which differ only in case or spacing", seen[key], retailer))
+		}
+		seen[key] = retailer
+		if c.RetailerPoints[retailer] < 0 {
+			problems = append(problems, fmt.Sprintf("retailerPoints[%q] must not be negative", retailer))
+		}
+	}
+	return problems
+}
+
+// DescribeRetailerScoring explains what the retailer name rule awards.
+func (c Config) DescribeRetailerScoring() string {
+	switch c.retailerScoring() {
+	case retailerScoringWords:
+		return fmt.Sprintf("%d point(s) per word in the retailer name", c.RetailerCharPoints)
+	case retailerScoringUniqueLetters:
+		return fmt.Sprintf("%d point(s) per distinct letter in the retailer name", c.RetailerCharPoints)
+	case retailerScoringFixed:
+		return fmt.Sprintf("fixed points for the retailer, or %d point(s) for retailers not listed", c.RetailerCharPoints)
+	}
+	return fmt.Sprintf("%d point(s) per alphanumeric character in the retailer name", c.RetailerCharPoints)
+}
@@ -0,0 +1,302 @@
+// Package scoring is the receipt processor's points engine. It scores a
+// receipt under a rules configuration, rule by rule, so that other services
+// can compute the points the processor would award without calling it.
+//
+//	breakdown, err := scoring.Default().Breakdown(receipt)
+//	points := scoring.Sum(breakdown)
+//
+// Rules the engine does not know, such as the processor's expression rules,
+// plugins and campaigns, are passed to Breakdown as extra rules and are
+// evaluated in the same phases as the built-in ones.
+package scoring
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Phase orders the evaluation of rules. Base rules score the receipt
+// itself; multipliers scale the total of every rule before them; caps limit
+// the final total.
+type Phase int
+
+const (
+	Base Phase = iota
+	Multiplier
+	Cap
+)
+
+// phaseNames are the phases as written in rule configurations.
+var phaseNames = []string{"base", "multiplier", "cap"}
+
+func (p Phase) String() string {
+	if p < 0 || int(p) >= len(phaseNames) {
+		return fmt.Sprintf("Phase(%d)", int(p))
+	}
+	return phaseNames[p]
+}
+
+// Rule is one step of the engine. Score receives the total of the rules
+// evaluated before it and returns the points it adds, which may be
+// negative, and an optional reason.
+type Rule struct {
+	Name  string
+	Phase Phase
+	// After names rules, in this phase or an earlier one, that must be
+	// evaluated first.
+	After []string
+	Score func(total int) (int, string)
+}
+
+// Result records how many points a single rule contributed. Reason explains
+// rules that zeroed or adjusted the score.
+type Result struct {
+	Rule   string `json:"rule"`
+	Points int    `json:"points"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Item is a receipt line item.
+type Item struct {
+	Description string
+	// Price is a decimal amount such as "6.49".
+	Price string
+}
+
+// Receipt is the part of a receipt the rules read.
+type Receipt struct {
+	Retailer string
+	// PurchaseDate is the date printed on the receipt, as YYYY-MM-DD.
+	PurchaseDate string
+	// PurchasedAt is the wall-clock time of the purchase in the zone it was
+	// recorded in, or the zero time when it is not known.
+	PurchasedAt time.Time
+	// Total is a decimal amount such as "35.35".
+	Total string
+	Items []Item
+	// Store is where the store is, when known.
+	Store *GeoPoint
+}
+
+// MultiplierRulePrefix prefixes configured multipliers' rule names.
+const MultiplierRulePrefix = "multiplier:"
+
+// builtinRules returns the standard rules for a receipt, in declaration
+// order.
+func (c Config) builtinRules(receipt Receipt) []Rule {
+	return []Rule{
+		{Name: "retailerName", Phase: Base, Score: func(int) (int, string) {
+			return c.retailerNamePoints(receipt.Retailer), ""
+		}},
+		{Name: "roundDollarTotal", Phase: Base, Score: func(int) (int, string) {
+			if strings.HasSuffix(receipt.Total, ".00") {
+				return c.RoundDollarPoints, ""
+			}
+			return 0, ""
+		}},
+		{Name: "quarterMultipleTotal", Phase: Base, Score: func(int) (int, string) {
+			totalValue, _ := strconv.ParseFloat(receipt.Total, 64)
+			if math.Mod(totalValue, 0.25) == 0 {
+				return c.QuarterMultiplePoints, ""
+			}
+			return 0, ""
+		}},
+		{Name: "totalBracket", Phase: Base, Score: func(int) (int, string) {
+			if cents, err := ParseCents(receipt.Total); err == nil {
+				return c.totalBracketPoints(cents), ""
+			}
+			return 0, ""
+		}},
+		{Name: "geoFence", Phase: Base, Score: func(int) (int, string) {
+			return c.geoFencePoints(receipt), ""
+		}},
+		{Name: "itemPairs", Phase: Base, Score: func(int) (int, string) {
+			return (len(receipt.Items) / 2) * c.ItemPairPoints, ""
+		}},
+		{Name: "itemDescriptionLength", Phase: Base, Score: func(int) (int, string) {
+			descriptionPoints := 0
+			for _, item := range receipt.Items {
+				descriptionPoints += c.RoundDescriptionPoints(c.ExactDescriptionPoints(item))
+			}
+			return descriptionPoints, ""
+		}},
+		{Name: "oddPurchaseDay", Phase: Base, Score: func(int) (int, string) {
+			dateParts := strings.Split(receipt.PurchaseDate, "-")
+			day, _ := strconv.Atoi(dateParts[len(dateParts)-1])
+			if day%2 != 0 {
+				return c.OddDayPoints, ""
+			}
+			return 0, ""
+		}},
+		{Name: "afternoonPurchase", Phase: Base, Score: func(int) (int, string) {
+			purchasedAt := receipt.PurchasedAt
+			if !purchasedAt.IsZero() && purchasedAt.Hour() >= c.AfternoonStartHour && purchasedAt.Hour() < c.AfternoonEndHour {
+				return c.AfternoonPoints, ""
+			}
+			return 0, ""
+		}},
+		{Name: "pointsCap", Phase: Cap, Score: func(total int) (int, string) {
+			if c.MaxPoints > 0 && total > c.MaxPoints {
+				return c.MaxPoints - total, fmt.Sprintf("receipts earn at most %d points", c.MaxPoints)
+			}
+			return 0, ""
+		}},
+	}
+}
+
+// multiplierRule turns a configured multiplier into a rule for a receipt.
+func multiplierRule(m PointsMultiplier, receipt Receipt) Rule {
+	after := make([]string, len(m.After))
+	for i, name := range m.After {
+		after[i] = MultiplierRulePrefix + name
+	}
+	return Rule{
+		Name:  MultiplierRulePrefix + m.Name,
+		Phase: Multiplier,
+		After: after,
+		Score: func(total int) (int, string) {
+			if m.Retailer != "" && !strings.EqualFold(m.Retailer, receipt.Retailer) {
+				return 0, ""
+			}
+			return int(math.Round(float64(total) * (m.Factor - 1))), ""
+		},
+	}
+}
+
+// Rules returns the configuration's rules for a receipt in evaluation
+// order: by phase, then so that every rule follows the rules it names in
+// After, otherwise keeping declaration order. Extra rules follow the
+// configured rules of their phase.
+func (c Config) Rules(receipt Receipt, extra ...Rule) ([]Rule, error) {
+	rules := c.builtinRules(receipt)
+	for _, m := range c.Multipliers {
+		rules = append(rules, multiplierRule(m, receipt))
+	}
+	rules = append(rules, extra...)
+	return Order(rules)
+}
+
+// Breakdown evaluates every rule against the receipt, phase by phase, and
+// returns the rules that awarded points in evaluation order. It fails only
+// when the rules cannot be ordered, which Validate reports for configured
+// rules.
+func (c Config) Breakdown(receipt Receipt, extra ...Rule) ([]Result, error) {
+	rules, err := c.Rules(receipt, extra...)
+	if err != nil {
+		return nil, err
+	}
+	var breakdown []Result
+	total := 0
+	for _, rule := range rules {
+		points, reason := rule.Score(total)
+		if points != 0 {
+			breakdown = append(breakdown, Result{Rule: rule.Name, Points: points, Reason: reason})
+			total += points
+		}
+	}
+	return breakdown, nil
+}
+
+// Sum totals the points in a breakdown.
+func Sum(breakdown []Result) int {
+	points := 0
+	for _, result := range breakdown {
+		points += result.Points
+	}
+	return points
+}
+
+// Order sorts rules into a deterministic evaluation order, reporting
+// unknown or cyclic dependencies and dependencies on later phases.
+func Order(rules []Rule) ([]Rule, error) {
+	byName := make(map[string]Rule, len(rules))
+	for _, rule := range rules {
+		if _, ok := byName[rule.Name]; ok {
+			return nil, fmt.Errorf("rule %q is declared twice", rule.Name)
+		}
+		byName[rule.Name] = rule
+	}
+	for _, rule := range rules {
+		for _, dependency := range rule.After {
+			before, ok := byName[dependency]
+			switch {
+			case !ok:
+				return nil, fmt.Errorf("rule %q depends on unknown rule %q", rule.Name, dependency)
+			case before.Phase > rule.Phase:
+				return nil, fmt.Errorf("rule %q (%s phase) cannot follow %q (%s phase)", rule.Name, rule.Phase, dependency, before.Phase)
+			}
+		}
+	}
+
+	pending := append([]Rule(nil), rules...)
+	sort.SliceStable(pending, func(i, j int) bool { return pending[i].Phase < pending[j].Phase })
+	done := make(map[string]bool, len(rules))
+	ordered := make([]Rule, 0, len(rules))
+	for len(pending) > 0 {
+		// Take the first rule whose dependencies have all been evaluated.
+		next := -1
+		for i, rule := range pending {
+			ready := true
+			for _, dependency := range rule.After {
+				ready = ready && done[dependency]
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			names := make([]string, len(pending))
+			for i, rule := range pending {
+				names[i] = rule.Name
+			}
+			return nil, fmt.Errorf("rules %s depend on each other", strings.Join(names, ", "))
+		}
+		done[pending[next].Name] = true
+		ordered = append(ordered, pending[next])
+		pending = append(pending[:next], pending[next+1:]...)
+	}
+	return ordered, nil
+}
+
+// totalBracketPoints returns the points of the highest bracket reached by a
+// total given in cents.
+func (c Config) totalBracketPoints(cents int64) int {
+	points := 0
+	for _, bracket := range c.TotalBrackets {
+		if cents >= int64(math.Round(bracket.Min*100)) {
+			points = bracket.Points
+		}
+	}
+	return points
+}
+
+// ParseCents converts a decimal amount such as "35.35" to cents.
+func ParseCents(amount string) (int64, error) {
+	whole, frac, _ := strings.Cut(strings.TrimSpace(amount), ".")
+	if len(frac) > 2 {
+		return 0, strconv.ErrSyntax
+	}
+	frac += strings.Repeat("0", 2-len(frac))
+	dollars, err := strconv.ParseInt(whole, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	cents, err := strconv.ParseInt(frac, 10, 64)
+	if err != nil || cents < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	if strings.HasPrefix(whole, "-") {
+		return dollars*100 - cents, nil
+	}
+	return dollars*100 + cents, nil
+}
+
+// isAlphanumeric checks if a character is alphanumeric.
+func isAlphanumeric(char rune) bool {
+	return (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9')
+}
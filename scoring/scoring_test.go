@@ -0,0 +1,146 @@
+package scoring
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// randomReceipt is a receipt quick generates, with amounts and dates in the
+// forms the processor accepts.
+type randomReceipt struct {
+	Receipt
+}
+
+// randomItem is an item quick generates.
+type randomItem struct {
+	Item
+}
+
+const descriptionChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789 -&"
+
+func randomAmount(rand *rand.Rand) string {
+	cents := rand.Int63n(100000)
+	if rand.Intn(4) == 0 {
+		// Round totals and quarter multiples should come up often.
+		cents -= cents % 25
+	}
+	return fmt.Sprintf("%d.%02d", cents/100, cents%100)
+}
+
+func (randomItem) Generate(rand *rand.Rand, size int) reflect.Value {
+	var description strings.Builder
+	for i := rand.Intn(size + 1); i >= 0; i-- {
+		description.WriteByte(descriptionChars[rand.Intn(len(descriptionChars))])
+	}
+	return reflect.ValueOf(randomItem{Item{Description: description.String(), Price: randomAmount(rand)}})
+}
+
+func (randomReceipt) Generate(rand *rand.Rand, size int) reflect.Value {
+	var retailer strings.Builder
+	for i := rand.Intn(size + 1); i >= 0; i-- {
+		retailer.WriteByte(descriptionChars[rand.Intn(len(descriptionChars))])
+	}
+	purchasedAt := time.Date(2020+rand.Intn(6), time.Month(1+rand.Intn(12)), 1+rand.Intn(28), rand.Intn(24), rand.Intn(60), 0, 0, time.UTC)
+	receipt := Receipt{
+		Retailer:     retailer.String(),
+		PurchaseDate: purchasedAt.Format("2006-01-02"),
+		PurchasedAt:  purchasedAt,
+		Total:        randomAmount(rand),
+	}
+	for i := rand.Intn(size + 1); i >= 0; i-- {
+		receipt.Items = append(receipt.Items, randomItem{}.Generate(rand, size).Interface().(randomItem).Item)
+	}
+	return reflect.ValueOf(randomReceipt{receipt})
+}
+
+// points scores a receipt under the default rules.
+func points(t *testing.T, receipt Receipt) int {
+	breakdown, err := Default().Breakdown(receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Sum(breakdown)
+}
+
+// TestAddingItemNeverLowersPoints checks that, under the default rules, a
+// receipt with one more item never earns fewer points.
+func TestAddingItemNeverLowersPoints(t *testing.T) {
+	property := func(r randomReceipt, extra randomItem) bool {
+		more := r.Receipt
+		more.Items = append(append([]Item(nil), r.Items...), extra.Item)
+		return points(t, more) >= points(t, r.Receipt)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestEqualReceiptsScoreEqually checks that scoring is deterministic: equal
+// receipts, scored separately, get the same breakdown.
+func TestEqualReceiptsScoreEqually(t *testing.T) {
+	property := func(r randomReceipt) bool {
+		copied := r.Receipt
+		copied.Items = append([]Item(nil), r.Items...)
+		first, err := Default().Breakdown(r.Receipt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := Default().Breakdown(copied)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reflect.DeepEqual(first, second)
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestDefaultRules scores the two example receipts from the README.
+func TestDefaultRules(t *testing.T) {
+	tests := []struct {
+		receipt Receipt
+		points  int
+	}{
+		{Receipt{
+			Retailer:     "Target",
+			PurchaseDate: "2022-01-01",
+			PurchasedAt:  time.Date(2022, 1, 1, 13, 1, 0, 0, time.UTC),
+			Total:        "35.35",
+			Items: []Item{
+				{"Mountain Dew 12PK", "6.49"},
+				{"Emils Cheese Pizza", "12.25"},
+				{"Knorr Creamy Chicken", "1.26"},
+				{"Doritos Nacho Cheese", "3.35"},
+				{"   Klarbrunn 12-PK 12 FL OZ  ", "12.00"},
+			},
+		}, 28},
+		{Receipt{
+			Retailer:     "M&M Corner Market",
+			PurchaseDate: "2022-03-20",
+			PurchasedAt:  time.Date(2022, 3, 20, 14, 33, 0, 0, time.UTC),
+			Total:        "9.00",
+			Items:        []Item{{"Gatorade", "2.25"}, {"Gatorade", "2.25"}, {"Gatorade", "2.25"}, {"Gatorade", "2.25"}},
+		}, 109},
+	}
+	for _, test := range tests {
+		if got := points(t, test.receipt); got != test.points {
+			t.Errorf("%s: got %d points, want %d", test.receipt.Retailer, got, test.points)
+		}
+	}
+}
+
+// TestPhaseString names the known phases and numbers unknown ones.
+func TestPhaseString(t *testing.T) {
+	tests := map[Phase]string{Base: "base", Multiplier: "multiplier", Cap: "cap", Phase(3): "Phase(3)", Phase(-1): "Phase(-1)"}
+	for phase, want := range tests {
+		if got := phase.String(); got != want {
+			t.Errorf("Phase %d: got %q, want %q", int(phase), got, want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// BM25 parameters: searchK1 limits how much repeating a term raises a
+// receipt's score, and searchB how much long receipts are penalized.
+const (
+	searchK1 = 1.2
+	searchB  = 0.75
+)
+
+// searchDoc is what the search index knows about one receipt.
+type searchDoc struct {
+	tenant string
+	userID string
+	length int
+	// terms are the receipt's distinct terms, for removing it.
+	terms []string
+}
+
+// searchIndex is an inverted index over retailer names and item
+// descriptions, ranked by BM25.
+type searchIndex struct {
+	mu sync.RWMutex
+	// postings maps each term to the receipts containing it and how often.
+	postings    map[string]map[string]int
+	docs        map[string]searchDoc
+	totalLength int
+}
+
+var search = newSearchIndex()
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[string]int),
+		docs:     make(map[string]searchDoc),
+	}
+}
+
+// SearchResult is a receipt matching a search, with its relevance score.
+type SearchResult struct {
+	Score float64 `json:"score"`
+	StoredReceiptResponse
+}
+
+// SearchPage is one page of search results, best match first. Total counts
+// every matching receipt.
+type SearchPage struct {
+	Results []SearchResult `json:"results"`
+	Total   int            `json:"total"`
+	Limit   int            `json:"limit"`
+	Offset  int            `json:"offset"`
+}
+
+// searchTerms splits text into lowercase words and numbers.
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// receiptTerms returns the searchable terms of a receipt.
+func receiptTerms(receipt Receipt) []string {
+	terms := searchTerms(receipt.StoreName)
+	for _, item := range receipt.PurchasedItems {
+		terms = append(terms, searchTerms(item.Description)...)
+	}
+	return terms
+}
+
+// add indexes a receipt, replacing any earlier version of it.
+func (s *searchIndex) add(id string, stored StoredReceipt) {
+	terms := receiptTerms(stored.Receipt)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(id)
+	doc := searchDoc{tenant: stored.Tenant, userID: stored.UserID, length: len(terms)}
+	for _, term := range terms {
+		postings, ok := s.postings[term]
+		if !ok {
+			postings = make(map[string]int)
+			s.postings[term] = postings
+		}
+		if postings[id] == 0 {
+			doc.terms = append(doc.terms, term)
+		}
+		postings[id]++
+	}
+	s.docs[id] = doc
+	s.totalLength += len(terms)
+}
+
+// remove drops a receipt from the index. Callers hold s.mu.
+func (s *searchIndex) remove(id string) {
+	doc, ok := s.docs[id]
+	if !ok {
+		return
+	}
+	for _, term := range doc.terms {
+		delete(s.postings[term], id)
+		if len(s.postings[term]) == 0 {
+			delete(s.postings, term)
+		}
+	}
+	delete(s.docs, id)
+	s.totalLength -= doc.length
+}
+
+// searchHit is a receipt ID and its score.
+type searchHit struct {
+	id    string
+	score float64
+}
+
+// query ranks the receipts containing any of terms that are visible to the
+// tenant and user, best match first.
+func (s *searchIndex) query(terms []string, tenant, userID string) []searchHit {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.docs) == 0 {
+		return nil
+	}
+	n := float64(len(s.docs))
+	averageLength := float64(s.totalLength) / n
+	scores := make(map[string]float64)
+	seen := make(map[string]bool)
+	for _, term := range terms {
+		if seen[term] {
+			continue
+		}
+		seen[term] = true
+		postings := s.postings[term]
+		idf := math.Log(1 + (n-float64(len(postings))+0.5)/(float64(len(postings))+0.5))
+		for id, tf := range postings {
+			doc := s.docs[id]
+			if doc.tenant != tenant || (doc.userID != "" && doc.userID != userID) {
+				continue
+			}
+			f := float64(tf)
+			scores[id] += idf * f * (searchK1 + 1) / (f + searchK1*(1-searchB+searchB*float64(doc.length)/averageLength))
+		}
+	}
+
+	hits := make([]searchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, searchHit{id: id, score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].score != hits[j].score {
+			return hits[i].score > hits[j].score
+		}
+		return hits[i].id < hits[j].id
+	})
+	return hits
+}
+
+// rebuildSearchIndex indexes every stored receipt.
+func rebuildSearchIndex() error {
+	rebuilt := newSearchIndex()
+	err := receiptStore.Range(context.Background(), func(id string, stored StoredReceipt) bool {
+		rebuilt.add(id, stored)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	search = rebuilt
+	return nil
+}
+
+// searchReceipts finds receipts whose retailer or item descriptions contain
+// the words in q, with the same visibility as listReceipts.
+func searchReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub, ok := submissionFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid tenant or user ID", http.StatusBadRequest)
+		return
+	}
+	terms := searchTerms(r.URL.Query().Get("q"))
+	if len(terms) == 0 {
+		http.Error(w, "q must contain at least one word", http.StatusBadRequest)
+		return
+	}
+	limit, offset, ok := pageFromRequest(r)
+	if !ok {
+		http.Error(w, "limit must be 1-500 and offset non-negative", http.StatusBadRequest)
+		return
+	}
+
+	hits := search.query(terms, sub.Tenant, sub.UserID)
+	page := SearchPage{Results: []SearchResult{}, Total: len(hits), Limit: limit, Offset: offset}
+	for i := offset; i < len(hits) && i < offset+limit; i++ {
+		stored, err := receiptStore.Get(r.Context(), hits[i].id)
+		if err != nil {
+			writeReceiptError(w, err)
+			return
+		}
+		page.Results = append(page.Results, SearchResult{Score: hits[i].score, StoredReceiptResponse: storedReceiptResponse(hits[i].id, stored)})
+	}
+	writeJSON(w, r, page)
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"time"
+)
+
+// goldenReceipt is a scoring fixture: a receipt and the points it earns
+// under the default rules.
+type goldenReceipt struct {
+	name    string
+	receipt Receipt
+	points  int
+}
+
+// goldenReceipts are the reference receipts from the API specification.
+var goldenReceipts = []goldenReceipt{
+	{
+		name: "target",
+		receipt: Receipt{
+			StoreName:      "Target",
+			DateOfPurchase: "2022-01-01",
+			TimeOfPurchase: "13:01",
+			TotalAmount:    "35.35",
+			PurchasedItems: []Item{
+				{Description: "Mountain Dew 12PK", Price: "6.49"},
+				{Description: "Emils Cheese Pizza", Price: "12.25"},
+				{Description: "Knorr Creamy Chicken", Price: "1.26"},
+				{Description: "Doritos Nacho Cheese", Price: "3.35"},
+				{Description: "   Klarbrunn 12-PK 12 FL OZ  ", Price: "12.00"},
+			},
+		},
+		points: 28,
+	},
+	{
+		name: "cornerMarket",
+		receipt: Receipt{
+			StoreName:      "M&M Corner Market",
+			DateOfPurchase: "2022-03-20",
+			TimeOfPurchase: "14:33",
+			TotalAmount:    "9.00",
+			PurchasedItems: []Item{
+				{Description: "Gatorade", Price: "2.25"},
+				{Description: "Gatorade", Price: "2.25"},
+				{Description: "Gatorade", Price: "2.25"},
+				{Description: "Gatorade", Price: "2.25"},
+			},
+		},
+		points: 109,
+	},
+}
+
+// selfTestTimeout bounds the storage checks of a self-test.
+const selfTestTimeout = 30 * time.Second
+
+// selfTestReceiptID is the ID the self-test stores its receipt under. Each
+// run overwrites the receipt of the previous one.
+const selfTestReceiptID = "00000000-0000-0000-0000-000000000000"
+
+// selfTestTenant is the tenant of the self-test's receipt, keeping it out of
+// real tenants' listings and reports.
+const selfTestTenant = "selftest"
+
+// runSelfTest checks a configured server before it is deployed: the scoring
+// engine against the golden fixtures, then a write, read and update of the
+// configured receipt store and blob store. It logs each check and returns
+// the first failure.
+func runSelfTest() error {
+	checks := []struct {
+		name string
+		run  func(context.Context) error
+	}{
+		{"scoring", selfTestScoring},
+		{"receipt store", selfTestReceiptStore},
+		{"blob store", selfTestBlobStore},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	for _, check := range checks {
+		if err := check.run(ctx); err != nil {
+			return fmt.Errorf("selftest: %s: %w", check.name, err)
+		}
+		log.Printf("selftest: %s ok", check.name)
+	}
+	return nil
+}
+
+// selfTestScoring scores the golden receipts under the default rules,
+// whatever rules are configured, and as if recorded in the rules time zone,
+// so that retailer zones do not shift time-of-day rules.
+func selfTestScoring(context.Context) error {
+	rules := defaultRules()
+	for _, golden := range goldenReceipts {
+		receipt := golden.receipt
+		receipt.Timezone = rulesLocation.String()
+		if err := validateReceipt(receipt); err != nil {
+			return fmt.Errorf("receipt %s: %w", golden.name, err)
+		}
+		submittedAt, _ := time.ParseInLocation("2006-01-02", receipt.DateOfPurchase, rulesLocation)
+		if points := sumBreakdown(rules.breakdown(receipt, submittedAt)); points != golden.points {
+			return fmt.Errorf("receipt %s scored %d points, want %d", golden.name, points, golden.points)
+		}
+	}
+	return nil
+}
+
+// selfTestReceiptStore stores the first golden receipt, reads it back,
+// updates it and reads the update back.
+func selfTestReceiptStore(ctx context.Context) error {
+	stored := StoredReceipt{
+		Receipt:     goldenReceipts[0].receipt,
+		SubmittedAt: time.Now().UTC().Truncate(time.Second),
+		Tenant:      selfTestTenant,
+		Points:      goldenReceipts[0].points,
+	}
+	if err := receiptStore.Put(ctx, selfTestReceiptID, stored); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	read, err := receiptStore.Get(ctx, selfTestReceiptID)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if !read.SubmittedAt.Equal(stored.SubmittedAt) || !reflect.DeepEqual(read.Receipt, stored.Receipt) || read.Points != stored.Points {
+		return errors.New("get: receipt differs from the one put")
+	}
+	err = receiptStore.Update(ctx, selfTestReceiptID, func(stored *StoredReceipt) error {
+		stored.Favorite = !stored.Favorite
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("update: %w", err)
+	}
+	updated, err := receiptStore.Get(ctx, selfTestReceiptID)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if updated.Favorite == read.Favorite {
+		return errors.New("update: change was not stored")
+	}
+	return nil
+}
+
+// selfTestBlobStore writes a blob and reads it back.
+func selfTestBlobStore(context.Context) error {
+	key := "selftest/" + selfTestReceiptID
+	data := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+	if err := blobStore.Put(key, data); err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	read, err := blobStore.Get(key)
+	if err != nil {
+		return fmt.Errorf("get: %w", err)
+	}
+	if !bytes.Equal(read, data) {
+		return errors.New("get: blob differs from the one put")
+	}
+	return nil
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+	"github.com/google/uuid"
+)
+
+// checksumHeader carries the SHA-256 of a downloaded settlement file.
+const checksumHeader = "X-Checksum-SHA256"
+
+// settlementColumns is the header row of a settlement file.
+var settlementColumns = []string{"tenant", "retailer", "receipts", "spend", "pointsAwarded", "adjustments", "pendingPoints", "pointsLiability"}
+
+// Settlement describes a generated settlement file. Receipts and
+// PointsLiability are control totals over its rows.
+type Settlement struct {
+	ID              string    `json:"id"`
+	File            string    `json:"file"`
+	From            time.Time `json:"from"`
+	To              time.Time `json:"to"`
+	GeneratedAt     time.Time `json:"generatedAt"`
+	Rows            int       `json:"rows"`
+	Receipts        int       `json:"receipts"`
+	PointsLiability int       `json:"pointsLiability"`
+	SHA256          string    `json:"sha256"`
+	// Pushed lists the destinations the file was delivered to; PushErrors
+	// the ones that failed.
+	Pushed     []string `json:"pushed,omitempty"`
+	PushErrors []string `json:"pushErrors,omitempty"`
+}
+
+// SettlementRequest asks for a settlement covering purchase dates from From
+// up to, but not including, To, both YYYY-MM-DD in the rules zone.
+type SettlementRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// settlementRow accumulates one tenant and retailer's figures.
+type settlementRow struct {
+	tenant, retailer string
+	receipts         int
+	spendCents       int64
+	awarded          int
+	adjustments      int
+	pending          int
+}
+
+// S3Target is a bucket settlement files are uploaded to.
+type S3Target struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+var (
+	settlementMutex sync.Mutex
+	settlements     []Settlement
+	// settlementInterval, when set, generates a settlement for each
+	// interval as it ends.
+	settlementInterval time.Duration
+	// settlementSFTPDir, when set, receives settlement files over the
+	// SFTP connection configured by SFTP_ADDR.
+	settlementSFTPDir string
+	settlementS3      *S3Target
+)
+
+// loadSettlementConfig reads SETTLEMENT_INTERVAL_HOURS, SETTLEMENT_SFTP_DIR
+// and SETTLEMENT_S3_BUCKET with its AWS_REGION, AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and optional SETTLEMENT_S3_PREFIX and
+// SETTLEMENT_S3_ENDPOINT. Call after loadSFTPConfig.
+func loadSettlementConfig() error {
+	if value := os.Getenv("SETTLEMENT_INTERVAL_HOURS"); value != "" {
+		hours, err := strconv.Atoi(value)
+		if err != nil || hours <= 0 {
+			return fmt.Errorf("SETTLEMENT_INTERVAL_HOURS: invalid value %q", value)
+		}
+		settlementInterval = time.Duration(hours) * time.Hour
+	}
+	if dir := os.Getenv("SETTLEMENT_SFTP_DIR"); dir != "" {
+		if sftpConfig == nil {
+			return fmt.Errorf("SETTLEMENT_SFTP_DIR: requires SFTP_ADDR")
+		}
+		settlementSFTPDir = dir
+	}
+	if bucket := os.Getenv("SETTLEMENT_S3_BUCKET"); bucket != "" {
+		target := &S3Target{
+			Endpoint:  os.Getenv("SETTLEMENT_S3_ENDPOINT"),
+			Region:    os.Getenv("AWS_REGION"),
+			Bucket:    bucket,
+			Prefix:    strings.Trim(os.Getenv("SETTLEMENT_S3_PREFIX"), "/"),
+			AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}
+		if target.Region == "" || target.AccessKey == "" || target.SecretKey == "" {
+			return fmt.Errorf("SETTLEMENT_S3_BUCKET: requires AWS_REGION, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+		}
+		if target.Endpoint == "" {
+			target.Endpoint = "https://s3." + target.Region + ".amazonaws.com"
+		}
+		settlementS3 = target
+	}
+	return nil
+}
+
+// scheduleSettlements generates a settlement at the end of every interval,
+// covering that interval, until the process exits.
+func scheduleSettlements(interval time.Duration) {
+	for {
+		end := time.Now().Truncate(interval).Add(interval)
+		time.Sleep(time.Until(end))
+		settlement, err := generateSettlement(context.Background(), end.Add(-interval), end)
+		if err != nil {
+			log.Printf("settlement: %v", err)
+			continue
+		}
+		log.Printf("settlement: %s: %d rows, %d points liability", settlement.File, settlement.Rows, settlement.PointsLiability)
+	}
+}
+
+// generateSettlement builds the settlement file for purchases between from
+// and to, stores it in the blob store and pushes it to the configured
+// destinations.
+func generateSettlement(ctx context.Context, from, to time.Time) (Settlement, error) {
+	rows, err := settlementRows(ctx, from, to)
+	if err != nil {
+		return Settlement{}, err
+	}
+
+	settlement := Settlement{
+		ID:          uuid.New().String(),
+		File:        fmt.Sprintf("settlement_%s_%s.csv", from.UTC().Format("20060102T150405Z"), to.UTC().Format("20060102T150405Z")),
+		From:        from,
+		To:          to,
+		GeneratedAt: time.Now(),
+		Rows:        len(rows),
+	}
+	var buf bytes.Buffer
+	out := csv.NewWriter(&buf)
+	out.Write(settlementColumns)
+	for _, row := range rows {
+		liability := row.awarded + row.adjustments
+		settlement.Receipts += row.receipts
+		settlement.PointsLiability += liability
+		out.Write([]string{
+			row.tenant,
+			row.retailer,
+			strconv.Itoa(row.receipts),
+			formatCents(row.spendCents),
+			strconv.Itoa(row.awarded),
+			strconv.Itoa(row.adjustments),
+			strconv.Itoa(row.pending),
+			strconv.Itoa(liability),
+		})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		return Settlement{}, err
+	}
+	data := buf.Bytes()
+	sum := sha256.Sum256(data)
+	settlement.SHA256 = hex.EncodeToString(sum[:])
+	if err := blobStore.Put(settlementBlobKey(settlement.ID), data); err != nil {
+		return Settlement{}, err
+	}
+
+	pushSettlement(ctx, &settlement, data)
+	settlementMutex.Lock()
+	settlements = append(settlements, settlement)
+	settlementMutex.Unlock()
+	return settlement, nil
+}
+
+// settlementRows totals receipts purchased between from and to, and ledger
+// adjustments made in that period, by tenant and retailer. Receipts flagged
+// as duplicates count as pending rather than awarded.
+func settlementRows(ctx context.Context, from, to time.Time) ([]*settlementRow, error) {
+	rows := make(map[[2]string]*settlementRow)
+	row := func(tenant, retailer string) *settlementRow {
+		key := [2]string{tenant, retailer}
+		if rows[key] == nil {
+			rows[key] = &settlementRow{tenant: tenant, retailer: retailer}
+		}
+		return rows[key]
+	}
+
+	err := receiptStore.Range(ctx, func(id string, stored StoredReceipt) bool {
+		for _, entry := range stored.Ledger {
+			if !entry.CreatedAt.Before(from) && entry.CreatedAt.Before(to) {
+				row(stored.Tenant, stored.Receipt.StoreName).adjustments += entry.Points
+			}
+		}
+		purchased, err := localPurchaseTime(stored.Receipt)
+		if err != nil || purchased.Before(from) || !purchased.Before(to) {
+			return true
+		}
+		points := netPoints(stored) + stored.RefundedPoints
+		r := row(stored.Tenant, stored.Receipt.StoreName)
+		if onHold(stored) {
+			r.pending += points
+			return true
+		}
+		cents, _ := scoring.ParseCents(stored.Receipt.TotalAmount)
+		r.receipts++
+		r.spendCents += cents
+		r.awarded += points
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*settlementRow, 0, len(rows))
+	for _, r := range rows {
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].tenant != sorted[j].tenant {
+			return sorted[i].tenant < sorted[j].tenant
+		}
+		return sorted[i].retailer < sorted[j].retailer
+	})
+	return sorted, nil
+}
+
+// settlementBlobKey is where a settlement file is kept in the blob store.
+func settlementBlobKey(id string) string {
+	return "settlements/" + id + ".csv"
+}
+
+// pushSettlement delivers a settlement file, with a sha256sum-format
+// checksum file beside it, to SFTP and S3 when configured, recording the
+// outcome on the settlement.
+func pushSettlement(ctx context.Context, settlement *Settlement, data []byte) {
+	checksum := []byte(settlement.SHA256 + "  " + settlement.File + "\n")
+	record := func(destination string, err error) {
+		if err != nil {
+			log.Printf("settlement: push to %s: %v", destination, err)
+			settlement.PushErrors = append(settlement.PushErrors, destination+": "+err.Error())
+			return
+		}
+		settlement.Pushed = append(settlement.Pushed, destination)
+	}
+
+	if settlementSFTPDir != "" {
+		record("sftp", pushSettlementSFTP(settlement.File, data, checksum))
+	}
+	if settlementS3 != nil {
+		key := path.Join(settlementS3.Prefix, settlement.File)
+		err := settlementS3.put(ctx, key, data)
+		if err == nil {
+			err = settlementS3.put(ctx, key+".sha256", checksum)
+		}
+		record("s3", err)
+	}
+}
+
+// pushSettlementSFTP uploads a settlement file and its checksum to
+// settlementSFTPDir. The checksum is written last so its presence marks a
+// complete upload.
+func pushSettlementSFTP(name string, data, checksum []byte) error {
+	client, closeConn, err := dialSFTP(sftpConfig)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+	if err := client.MkdirAll(settlementSFTPDir); err != nil {
+		return err
+	}
+	if err := writeSFTPFile(client, path.Join(settlementSFTPDir, name), data); err != nil {
+		return err
+	}
+	return writeSFTPFile(client, path.Join(settlementSFTPDir, name+".sha256"), checksum)
+}
+
+// put uploads an object with a Signature Version 4 signed request.
+func (t *S3Target) put(ctx context.Context, key string, data []byte) error {
+	url := strings.TrimSuffix(t.Endpoint, "/") + "/" + t.Bucket + "/" + key
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	payloadHash := sha256.Sum256(data)
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+
+	signed := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	canonical := strings.Join([]string{
+		http.MethodPut,
+		req.URL.EscapedPath(),
+		"",
+		"content-type:" + req.Header.Get("Content-Type"),
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256"),
+		"x-amz-date:" + req.Header.Get("X-Amz-Date"),
+		"",
+		strings.Join(signed, ";"),
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := now.Format("20060102") + "/" + t.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + req.Header.Get("X-Amz-Date") + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key4 := []byte("AWS4" + t.SecretKey)
+	for _, part := range []string{now.Format("20060102"), t.Region, "s3", "aws4_request"} {
+		key4 = hmacSHA256(key4, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		t.AccessKey, scope, strings.Join(signed, ";"), hex.EncodeToString(hmacSHA256(key4, toSign))))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data under key.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// settlementsHandler lists settlements, newest first (GET), or generates one
+// for a date range (POST).
+func settlementsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		settlementMutex.Lock()
+		list := make([]Settlement, len(settlements))
+		for i, settlement := range settlements {
+			list[len(settlements)-1-i] = settlement
+		}
+		settlementMutex.Unlock()
+		writeJSON(w, r, list)
+	case http.MethodPost:
+		createSettlement(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createSettlement generates a settlement on demand.
+func createSettlement(w http.ResponseWriter, r *http.Request) {
+	var request SettlementRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid settlement request", http.StatusBadRequest)
+		return
+	}
+	from, err := time.ParseInLocation("2006-01-02", request.From, rulesLocation)
+	if err != nil {
+		http.Error(w, "Invalid from date", http.StatusBadRequest)
+		return
+	}
+	to, err := time.ParseInLocation("2006-01-02", request.To, rulesLocation)
+	if err != nil || !to.After(from) {
+		http.Error(w, "Invalid to date", http.StatusBadRequest)
+		return
+	}
+
+	settlement, err := generateSettlement(r.Context(), from, to)
+	if err != nil {
+		if !writeContextError(w, err) {
+			http.Error(w, "Failed to generate settlement", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSONStatus(w, r, http.StatusCreated, settlement)
+}
+
+// getSettlementFile downloads a settlement file, with its checksum in the
+// X-Checksum-SHA256 header.
+func getSettlementFile(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/settlements/"), "/")
+	var settlement Settlement
+	found := false
+	settlementMutex.Lock()
+	for _, s := range settlements {
+		if s.ID == id {
+			settlement, found = s, true
+		}
+	}
+	settlementMutex.Unlock()
+	if !found {
+		http.Error(w, "Settlement not found", http.StatusNotFound)
+		return
+	}
+	data, err := blobStore.Get(settlementBlobKey(id))
+	if err != nil {
+		http.Error(w, "Failed to read settlement", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", settlement.File))
+	w.Header().Set(checksumHeader, settlement.SHA256)
+	w.Write(data)
+}
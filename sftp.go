@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpDialTimeout bounds connecting to the SFTP server.
+const sftpDialTimeout = 30 * time.Second
+
+// SFTPConfig configures the SFTP batch pickup connector.
+type SFTPConfig struct {
+	Addr     string
+	SSH      *ssh.ClientConfig
+	Inbox    string
+	Outbox   string
+	Interval time.Duration
+	Tenant   string
+}
+
+// sftpConfig is nil unless SFTP_ADDR is set.
+var sftpConfig *SFTPConfig
+
+// loadSFTPConfig reads SFTP_ADDR (host:port), SFTP_USER, SFTP_PASSWORD or
+// SFTP_KEY_FILE, SFTP_HOST_KEY (the server's public key in authorized_keys
+// format), SFTP_INBOX (default "inbox"), SFTP_OUTBOX (default "results"),
+// SFTP_INTERVAL_SECONDS (default 300) and SFTP_TENANT.
+func loadSFTPConfig() error {
+	addr := os.Getenv("SFTP_ADDR")
+	if addr == "" {
+		return nil
+	}
+	user := os.Getenv("SFTP_USER")
+	if user == "" {
+		return errors.New("SFTP_USER: required with SFTP_ADDR")
+	}
+
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(os.Getenv("SFTP_HOST_KEY")))
+	if err != nil {
+		return fmt.Errorf("SFTP_HOST_KEY: %w", err)
+	}
+	var auth []ssh.AuthMethod
+	if keyFile := os.Getenv("SFTP_KEY_FILE"); keyFile != "" {
+		pem, err := os.ReadFile(keyFile)
+		if err != nil {
+			return fmt.Errorf("SFTP_KEY_FILE: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return fmt.Errorf("SFTP_KEY_FILE: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password := os.Getenv("SFTP_PASSWORD"); password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return errors.New("SFTP_PASSWORD or SFTP_KEY_FILE: required with SFTP_ADDR")
+	}
+
+	config := &SFTPConfig{
+		Addr: addr,
+		SSH: &ssh.ClientConfig{
+			User:            user,
+			Auth:            auth,
+			HostKeyCallback: ssh.FixedHostKey(hostKey),
+			Timeout:         sftpDialTimeout,
+		},
+		Inbox:    "inbox",
+		Outbox:   "results",
+		Interval: 5 * time.Minute,
+		Tenant:   defaultTenant,
+	}
+	if inbox := os.Getenv("SFTP_INBOX"); inbox != "" {
+		config.Inbox = inbox
+	}
+	if outbox := os.Getenv("SFTP_OUTBOX"); outbox != "" {
+		config.Outbox = outbox
+	}
+	if value := os.Getenv("SFTP_INTERVAL_SECONDS"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds <= 0 {
+			return fmt.Errorf("SFTP_INTERVAL_SECONDS: invalid value %q", value)
+		}
+		config.Interval = time.Duration(seconds) * time.Second
+	}
+	if tenant := os.Getenv("SFTP_TENANT"); tenant != "" {
+		if !tenantPattern.MatchString(tenant) {
+			return fmt.Errorf("SFTP_TENANT: invalid tenant %q", tenant)
+		}
+		config.Tenant = tenant
+	}
+	sftpConfig = config
+	return nil
+}
+
+// watchSFTP polls the SFTP inbox for new batches until the process exits.
+func watchSFTP(config *SFTPConfig) {
+	for {
+		if err := pollSFTP(config); err != nil {
+			log.Printf("sftp: %v", err)
+		}
+		time.Sleep(config.Interval)
+	}
+}
+
+// pollSFTP connects to the server and processes every settled batch file in
+// the inbox.
+func pollSFTP(config *SFTPConfig) error {
+	client, closeConn, err := dialSFTP(config)
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	for _, dir := range []string{path.Join(config.Inbox, "done"), path.Join(config.Inbox, "failed"), config.Outbox} {
+		if err := client.MkdirAll(dir); err != nil {
+			return fmt.Errorf("%s: %w", dir, err)
+		}
+	}
+	entries, err := client.ReadDir(config.Inbox)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() || !isBatchFile(entry.Name()) || time.Since(entry.ModTime()) < ingestSettle {
+			continue
+		}
+		if err := pickupSFTPFile(client, config, entry.Name()); err != nil {
+			log.Printf("sftp: %s: %v", entry.Name(), err)
+		}
+	}
+	return nil
+}
+
+// dialSFTP opens an SFTP session. The returned function closes it.
+func dialSFTP(config *SFTPConfig) (*sftp.Client, func(), error) {
+	conn, err := ssh.Dial("tcp", config.Addr, config.SSH)
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return client, func() {
+		client.Close()
+		conn.Close()
+	}, nil
+}
+
+// writeSFTPFile creates or replaces a remote file.
+func writeSFTPFile(client *sftp.Client, name string, data []byte) error {
+	f, err := client.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pickupSFTPFile downloads and submits one batch, writes its
+// <name>.result.json manifest to the outbox and moves the batch to done/
+// or failed/ in the inbox.
+func pickupSFTPFile(client *sftp.Client, config *SFTPConfig, name string) error {
+	source := path.Join(config.Inbox, name)
+	f, err := client.Open(source)
+	if err != nil {
+		return err
+	}
+	results := ingestBatch(config.Tenant, name, f)
+	f.Close()
+
+	manifest, _ := json.MarshalIndent(results, "", "  ")
+	if err := writeSFTPFile(client, path.Join(config.Outbox, name+".result.json"), manifest); err != nil {
+		return err
+	}
+
+	// The batch must leave the inbox or it would be submitted again on the
+	// next poll, so an existing file of the same name is replaced.
+	target := batchOutcome(results)
+	dest := path.Join(config.Inbox, target, name)
+	if err := client.PosixRename(source, dest); err != nil {
+		if err := client.Rename(source, dest); err != nil {
+			return err
+		}
+	}
+	log.Printf("sftp: %s: %d receipts, moved to %s", name, len(results), target)
+	return nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// shadowMismatchLimit is how many recent score mismatches the report keeps.
+const shadowMismatchLimit = 20
+
+// ShadowMismatch is a receipt the shadow rules scored differently.
+type ShadowMismatch struct {
+	ReceiptID     string `json:"receiptId"`
+	CurrentPoints int    `json:"currentPoints"`
+	ShadowPoints  int    `json:"shadowPoints"`
+}
+
+// ShadowReport compares the active and shadow rules over live traffic.
+type ShadowReport struct {
+	Active           bool             `json:"active"`
+	Since            *time.Time       `json:"since,omitempty"`
+	Rules            *RulesConfig     `json:"rules,omitempty"`
+	Compared         int              `json:"compared"`
+	Changed          int              `json:"changed"`
+	CurrentPoints    int              `json:"currentPoints"`
+	ShadowPoints     int              `json:"shadowPoints"`
+	Delta            int              `json:"delta"`
+	RuleDeltas       map[string]int   `json:"ruleDeltas"`
+	RecentMismatches []ShadowMismatch `json:"recentMismatches"`
+}
+
+var (
+	shadowMutex  sync.Mutex
+	shadowRules  *RulesConfig
+	shadowReport ShadowReport
+)
+
+// compareShadow scores a newly accepted receipt under the shadow rules, if
+// any, and records how the result differs from the active score.
+func compareShadow(receiptID string, stored StoredReceipt) {
+	shadowMutex.Lock()
+	defer shadowMutex.Unlock()
+	if shadowRules == nil {
+		return
+	}
+
+	current := storedBreakdown(stored)
+	shadow := shadowRules.storedBreakdown(stored)
+	currentPoints, shadowPoints := sumBreakdown(current), sumBreakdown(shadow)
+
+	shadowReport.Compared++
+	shadowReport.CurrentPoints += currentPoints
+	shadowReport.ShadowPoints += shadowPoints
+	shadowReport.Delta = shadowReport.ShadowPoints - shadowReport.CurrentPoints
+	for _, result := range current {
+		shadowReport.RuleDeltas[result.Rule] -= result.Points
+	}
+	for _, result := range shadow {
+		shadowReport.RuleDeltas[result.Rule] += result.Points
+	}
+	if currentPoints == shadowPoints {
+		return
+	}
+
+	shadowReport.Changed++
+	log.Printf("shadow rules: receipt %s scored %d, active rules scored %d", receiptID, shadowPoints, currentPoints)
+	shadowReport.RecentMismatches = append(shadowReport.RecentMismatches, ShadowMismatch{
+		ReceiptID:     receiptID,
+		CurrentPoints: currentPoints,
+		ShadowPoints:  shadowPoints,
+	})
+	if len(shadowReport.RecentMismatches) > shadowMismatchLimit {
+		shadowReport.RecentMismatches = shadowReport.RecentMismatches[1:]
+	}
+}
+
+// shadowRulesHandler deploys (PUT), inspects (GET) or withdraws (DELETE) the
+// shadow rule set. Deploying resets the comparison report.
+func shadowRulesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		rules := defaultRules()
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			http.Error(w, "Invalid rules configuration", http.StatusBadRequest)
+			return
+		}
+		if problems := rules.Validate(); len(problems) > 0 {
+			http.Error(w, (&InvalidRulesError{Problems: problems}).Error(), http.StatusBadRequest)
+			return
+		}
+		shadowMutex.Lock()
+		shadowRules = &rules
+		since := time.Now()
+		shadowReport = ShadowReport{Since: &since, RuleDeltas: make(map[string]int)}
+		shadowMutex.Unlock()
+	case http.MethodDelete:
+		shadowMutex.Lock()
+		shadowRules = nil
+		shadowMutex.Unlock()
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, currentShadowReport())
+}
+
+// currentShadowReport returns a copy of the shadow comparison report.
+func currentShadowReport() ShadowReport {
+	shadowMutex.Lock()
+	defer shadowMutex.Unlock()
+	report := shadowReport
+	report.Active = shadowRules != nil
+	if shadowRules != nil {
+		rules := *shadowRules
+		report.Rules = &rules
+	}
+	report.RuleDeltas = make(map[string]int, len(shadowReport.RuleDeltas))
+	for rule, delta := range shadowReport.RuleDeltas {
+		if delta != 0 {
+			report.RuleDeltas[rule] = delta
+		}
+	}
+	report.RecentMismatches = append([]ShadowMismatch{}, shadowReport.RecentMismatches...)
+	return report
+}
+
+// getShadowReport returns the shadow comparison report.
+func getShadowReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, currentShadowReport())
+}
+
+// promoteShadowRules makes the shadow rule set active and ends shadowing.
+func promoteShadowRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	shadowMutex.Lock()
+	rules := shadowRules
+	shadowRules = nil
+	shadowMutex.Unlock()
+	if rules == nil {
+		http.Error(w, "No shadow rules deployed", http.StatusConflict)
+		return
+	}
+
+	if err := setRules(*rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("shadow rules promoted to active")
+	writeJSON(w, r, rules)
+}
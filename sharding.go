@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// storeDrivers open storage backends from DSNs, keyed by URL scheme.
+var storeDrivers = map[string]func(dsn *url.URL) (ReceiptStore, error){
+	"memory": openMemoryStore,
+}
+
+// openMemoryStore opens an in-memory backend. The DSN is
+// "memory://" or "memory://?compression=deflate".
+func openMemoryStore(dsn *url.URL) (ReceiptStore, error) {
+	store := newMemoryStore()
+	switch compression := dsn.Query().Get("compression"); compression {
+	case "", "none":
+	case "deflate":
+		store.compress = true
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+	return store, nil
+}
+
+// openStore opens the backend a DSN names.
+func openStore(dsn string) (ReceiptStore, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	open, ok := storeDrivers[u.Scheme]
+	if !ok {
+		return nil, fmt.Errorf("unknown storage driver %q", u.Scheme)
+	}
+	return open(u)
+}
+
+// loadShardConfig reads STORE_SHARDS ("tenant=dsn,...") and, when set,
+// routes those tenants to their own backends.
+func loadShardConfig() error {
+	value := os.Getenv("STORE_SHARDS")
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	sharded := &shardedStore{fallback: receiptStore, tenants: make(map[string]ReceiptStore)}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		tenant, dsn, ok := strings.Cut(pair, "=")
+		tenant = strings.TrimSpace(tenant)
+		if !ok || !tenantPattern.MatchString(tenant) {
+			return fmt.Errorf("STORE_SHARDS: malformed entry %q", pair)
+		}
+		store, err := openStore(strings.TrimSpace(dsn))
+		if err != nil {
+			return fmt.Errorf("STORE_SHARDS: %s: %w", tenant, err)
+		}
+		sharded.tenants[tenant] = store
+	}
+	receiptStore = sharded
+	return nil
+}
+
+// shardedStore routes each tenant's receipts to its own backend, with the
+// remaining tenants sharing the fallback. Writes are routed by the
+// receipt's tenant; lookups by ID try each backend in turn.
+type shardedStore struct {
+	fallback ReceiptStore
+	tenants  map[string]ReceiptStore
+}
+
+// forTenant returns the backend holding a tenant's receipts.
+func (s *shardedStore) forTenant(tenant string) ReceiptStore {
+	if store, ok := s.tenants[tenant]; ok {
+		return store
+	}
+	return s.fallback
+}
+
+// all returns every backend, the fallback first and then the tenant shards
+// in tenant order.
+func (s *shardedStore) all() []ReceiptStore {
+	tenants := make([]string, 0, len(s.tenants))
+	for tenant := range s.tenants {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	stores := []ReceiptStore{s.fallback}
+	for _, tenant := range tenants {
+		stores = append(stores, s.tenants[tenant])
+	}
+	return stores
+}
+
+func (s *shardedStore) Put(ctx context.Context, id string, stored StoredReceipt) error {
+	return s.forTenant(stored.Tenant).Put(ctx, id, stored)
+}
+
+func (s *shardedStore) Get(ctx context.Context, id string) (StoredReceipt, error) {
+	for _, store := range s.all() {
+		stored, err := store.Get(ctx, id)
+		if err != errReceiptNotFound {
+			return stored, err
+		}
+	}
+	return StoredReceipt{}, errReceiptNotFound
+}
+
+func (s *shardedStore) Update(ctx context.Context, id string, fn func(*StoredReceipt) error) error {
+	for _, store := range s.all() {
+		if err := store.Update(ctx, id, fn); err != errReceiptNotFound {
+			return err
+		}
+	}
+	return errReceiptNotFound
+}
+
+func (s *shardedStore) Range(ctx context.Context, fn func(id string, stored StoredReceipt) bool) error {
+	done := false
+	for _, store := range s.all() {
+		err := store.Range(ctx, func(id string, stored StoredReceipt) bool {
+			done = !fn(id, stored)
+			return !done
+		})
+		if err != nil || done {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *shardedStore) Len(ctx context.Context) (int, error) {
+	total := 0
+	for _, store := range s.all() {
+		n, err := store.Len(ctx)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (s *shardedStore) FindByContentHash(ctx context.Context, tenant, hash string) (string, error) {
+	return s.forTenant(tenant).FindByContentHash(ctx, tenant, hash)
+}
+
+// Close closes every backend.
+func (s *shardedStore) Close() error {
+	var errs []error
+	for _, store := range s.all() {
+		if err := store.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// shutdownTimeout is how long a graceful shutdown waits for requests in
+	// flight before aborting them.
+	shutdownTimeout = 30 * time.Second
+	// shutdownReportPath, when set, is the file each shutdown report is
+	// appended to as a JSON line.
+	shutdownReportPath string
+)
+
+// loadShutdownConfig reads SHUTDOWN_TIMEOUT and SHUTDOWN_REPORT_FILE.
+func loadShutdownConfig() error {
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("SHUTDOWN_TIMEOUT: invalid value %q", value)
+		}
+		shutdownTimeout = timeout
+	}
+	shutdownReportPath = os.Getenv("SHUTDOWN_REPORT_FILE")
+	return nil
+}
+
+// AbortedRequest is a request still in flight when the shutdown timeout
+// expired. MessageID and IdempotencyKey, when the client sent them, let
+// operators match it to a retry or redelivery.
+type AbortedRequest struct {
+	Route          string    `json:"route"`
+	Tenant         string    `json:"tenant,omitempty"`
+	Client         string    `json:"client,omitempty"`
+	MessageID      string    `json:"messageId,omitempty"`
+	IdempotencyKey string    `json:"idempotencyKey,omitempty"`
+	StartedAt      time.Time `json:"startedAt"`
+}
+
+// ShutdownReport accounts for the requests in flight when a graceful
+// shutdown began: Drained finished within the timeout and Aborted did not.
+// Queued submissions still waiting for a worker at the timeout are canceled
+// rather than processed: Requeued counts those relayed from a message queue,
+// which are not recorded as processed so the broker redelivers them, and
+// Rejected the others, which their clients must retry.
+type ShutdownReport struct {
+	Signal        string           `json:"signal"`
+	StartedAt     time.Time        `json:"startedAt"`
+	FinishedAt    time.Time        `json:"finishedAt"`
+	Timeout       string           `json:"timeout"`
+	InFlight      int              `json:"inFlight"`
+	Drained       int              `json:"drained"`
+	DrainedRoutes map[string]int   `json:"drainedRoutes"`
+	Aborted       []AbortedRequest `json:"aborted"`
+	Requeued      int              `json:"requeued"`
+	Rejected      int              `json:"rejected"`
+}
+
+// requestTracker keeps the requests in flight so a shutdown can report
+// which of them drained.
+type requestTracker struct {
+	mu       sync.Mutex
+	nextID   int
+	inFlight map[int]AbortedRequest
+	// draining is set once shutdown begins; drained then counts requests
+	// finishing by route.
+	draining bool
+	drained  map[string]int
+}
+
+var inFlightRequests = &requestTracker{inFlight: make(map[int]AbortedRequest), drained: make(map[string]int)}
+
+// track wraps the server's handler to keep requests in flight.
+func (t *requestTracker) track(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, _ := tenantFromRequest(r)
+		messageID, _ := messageFromRequest(r)
+		request := AbortedRequest{
+			Route:          routeLabel(r),
+			Tenant:         tenant,
+			Client:         clientFromRequest(r),
+			MessageID:      messageID,
+			IdempotencyKey: r.Header.Get(idempotencyHeader),
+			StartedAt:      time.Now(),
+		}
+		t.mu.Lock()
+		t.nextID++
+		id := t.nextID
+		t.inFlight[id] = request
+		t.mu.Unlock()
+
+		defer func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if _, ok := t.inFlight[id]; !ok {
+				return
+			}
+			delete(t.inFlight, id)
+			if t.draining {
+				t.drained[request.Route]++
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// beginDrain starts counting drained requests and returns how many are in
+// flight.
+func (t *requestTracker) beginDrain() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.draining = true
+	return len(t.inFlight)
+}
+
+// abort ends the drain, returning the requests drained by route and those
+// still in flight, oldest first. Requests finishing later are not counted.
+func (t *requestTracker) abort() (map[string]int, []AbortedRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	aborted := make([]AbortedRequest, 0, len(t.inFlight))
+	for _, request := range t.inFlight {
+		aborted = append(aborted, request)
+	}
+	sort.Slice(aborted, func(i, j int) bool { return aborted[i].StartedAt.Before(aborted[j].StartedAt) })
+	t.inFlight = make(map[int]AbortedRequest)
+	return t.drained, aborted
+}
+
+// flush cancels every submission still waiting in the queue, counting those
+// relayed from a message queue (requeued) and the others (rejected).
+func (q *processingQueue) flush() (requeued, rejected int) {
+	for _, lane := range []chan submissionJob{q.interactive, q.bulk} {
+		for {
+			select {
+			case job := <-lane:
+				if job.sub.MessageID != "" {
+					requeued++
+				} else {
+					rejected++
+				}
+				job.done <- submissionResult{err: context.Canceled}
+				continue
+			default:
+			}
+			break
+		}
+	}
+	return requeued, rejected
+}
+
+// serve runs the server until SIGINT or SIGTERM, then shuts it down
+// gracefully: it stops accepting connections, waits up to shutdownTimeout
+// for requests in flight, and cancels those remaining. The report is logged
+// and, with SHUTDOWN_REPORT_FILE, appended to that file, once the stores
+// are closed.
+func serve(addr string, handler http.Handler) error {
+	base, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := &http.Server{
+		Addr:        addr,
+		Handler:     inFlightRequests.track(handler),
+		BaseContext: func(net.Listener) context.Context { return base },
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	failed := make(chan error, 1)
+	go func() { failed <- server.ListenAndServe() }()
+
+	var received os.Signal
+	select {
+	case err := <-failed:
+		return err
+	case received = <-signals:
+	}
+	signal.Stop(signals)
+
+	report := ShutdownReport{Signal: received.String(), StartedAt: time.Now(), Timeout: shutdownTimeout.String()}
+	report.InFlight = inFlightRequests.beginDrain()
+	log.Printf("shutdown: %s received, draining %d request(s) for up to %s", received, report.InFlight, shutdownTimeout)
+	ctx, stop := context.WithTimeout(context.Background(), shutdownTimeout)
+	err := server.Shutdown(ctx)
+	stop()
+	report.DrainedRoutes, report.Aborted = inFlightRequests.abort()
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Take queued submissions off the queue before their callers'
+		// contexts end, so they are counted here rather than skipped by
+		// the workers.
+		if submissions != nil {
+			report.Requeued, report.Rejected = submissions.flush()
+		}
+		cancel()
+		err = server.Close()
+	}
+	for _, drained := range report.DrainedRoutes {
+		report.Drained += drained
+	}
+	if closeErr := closeStores(); closeErr != nil {
+		log.Printf("shutdown: %v", closeErr)
+		if err == nil {
+			err = closeErr
+		}
+	}
+	report.FinishedAt = time.Now()
+	logShutdownReport(report)
+	return err
+}
+
+// closeStores saves the Bloom filter and closes the storage backend, syncing
+// the WAL and releasing database files and connections.
+func closeStores() error {
+	var errs []error
+	if bloomFilterPath != "" {
+		duplicates.mu.Lock()
+		bloom := duplicates.bloom
+		duplicates.mu.Unlock()
+		if err := bloom.Save(bloomFilterPath); err != nil {
+			errs = append(errs, fmt.Errorf("bloom filter: %w", err))
+		}
+	}
+	if err := receiptStore.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("storage: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// logShutdownReport logs the report, listing each aborted request, and
+// appends it to shutdownReportPath when set.
+func logShutdownReport(report ShutdownReport) {
+	log.Printf("shutdown: %d of %d request(s) drained, %d aborted; %d queued submission(s) requeued, %d rejected",
+		report.Drained, report.InFlight, len(report.Aborted), report.Requeued, report.Rejected)
+	for _, request := range report.Aborted {
+		log.Printf("shutdown: aborted %s (tenant %q, client %q, message %q, idempotency key %q) started %s",
+			request.Route, request.Tenant, request.Client, request.MessageID, request.IdempotencyKey, request.StartedAt.Format(time.RFC3339))
+	}
+	if shutdownReportPath == "" {
+		return
+	}
+	data, err := json.Marshal(report)
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(shutdownReportPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600); err == nil {
+			_, err = f.Write(append(data, '\n'))
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("shutdown: could not save the report to %s: %v", shutdownReportPath, err)
+	}
+}
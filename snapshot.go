@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// snapshotVersion is the snapshot format written by exportSnapshot.
+const snapshotVersion = 1
+
+// SnapshotReceipt is one receipt in a snapshot.
+type SnapshotReceipt struct {
+	ID      string        `json:"id"`
+	Receipt StoredReceipt `json:"receipt"`
+}
+
+// SnapshotImport summarizes a restored snapshot.
+type SnapshotImport struct {
+	// Imported receipts were added to the store; Skipped receipts already
+	// existed and were left as they are.
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+}
+
+// snapshotHandler serves GET (export) and POST (import) on /admin/snapshot.
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		exportSnapshot(w, r)
+	case http.MethodPost:
+		importSnapshot(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// exportFlushInterval is how many receipts an export writes between
+// flushes, so that clients receive the document as it is produced.
+const exportFlushInterval = 1000
+
+// exportSnapshot streams every stored receipt as a JSON document of the
+// form {"version": 1, "exportedAt": ..., "receipts": [...]}, gzipped when
+// format=gzip, and limited to one tenant's receipts by the tenant parameter.
+// Receipts written during the export may or may not be included.
+//
+// Receipts are exported in order of their IDs, so an interrupted export can
+// be resumed with after set to the ID of the last receipt received: the
+// response is then a snapshot of the receipts that follow it.
+//
+// With anonymize=true the receipts are anonymized for sharing and the
+// document is marked "anonymized", so that it cannot be imported. Anonymized
+// receipts are ordered and resumed by their hashed IDs, which only stay the
+// same across exports with ANONYMIZATION_KEY set.
+func exportSnapshot(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "gzip" {
+		http.Error(w, "format must be json or gzip", http.StatusBadRequest)
+		return
+	}
+	anonymize, _ := strconv.ParseBool(query.Get("anonymize"))
+	tenant := query.Get("tenant")
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+	after := query.Get("after")
+	if after != "" && anonymize && anonymizationKey == nil {
+		http.Error(w, "Resuming an anonymized export requires ANONYMIZATION_KEY", http.StatusBadRequest)
+		return
+	}
+	record := func(id string, stored StoredReceipt) interface{} {
+		return SnapshotReceipt{ID: id, Receipt: stored}
+	}
+	exportID := func(id string) string { return id }
+	if anonymize {
+		a, err := newAnonymizer()
+		if err != nil {
+			http.Error(w, "Failed to start export", http.StatusInternalServerError)
+			return
+		}
+		record = func(id string, stored StoredReceipt) interface{} {
+			return a.anonymize(id, stored)
+		}
+		exportID = func(id string) string { return a.pseudonym("receipt", id) }
+	}
+
+	// Only IDs are collected up front; receipts are read back one by one
+	// as they are written.
+	type exportEntry struct {
+		exportID, id string
+	}
+	var entries []exportEntry
+	err := receiptStore.Range(r.Context(), func(id string, stored StoredReceipt) bool {
+		if tenant != "" && stored.Tenant != tenant {
+			return true
+		}
+		if exported := exportID(id); exported > after {
+			entries = append(entries, exportEntry{exported, id})
+		}
+		return true
+	})
+	if writeContextError(w, err) {
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].exportID < entries[j].exportID })
+
+	exportedAt := time.Now().UTC()
+	file := "snapshot-" + exportedAt.Format("20060102T150405Z")
+	if anonymize {
+		file += "-anonymized"
+	}
+	file += ".json"
+	var out io.Writer = w
+	var zw *gzip.Writer
+	if format == "gzip" {
+		file += ".gz"
+		w.Header().Set("Content-Type", "application/gzip")
+		zw = gzip.NewWriter(w)
+		defer zw.Close()
+		out = zw
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file))
+
+	buffered := bufio.NewWriter(out)
+	defer buffered.Flush()
+	flush := func() {
+		buffered.Flush()
+		if zw != nil {
+			zw.Flush()
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	header, _ := json.Marshal(exportedAt)
+	fmt.Fprintf(buffered, `{"version":%d,"exportedAt":%s,`, snapshotVersion, header)
+	if anonymize {
+		buffered.WriteString(`"anonymized":true,`)
+	}
+	if after != "" {
+		cursor, _ := json.Marshal(after)
+		fmt.Fprintf(buffered, `"after":%s,`, cursor)
+	}
+	buffered.WriteString(`"receipts":[`)
+	written := 0
+	for _, entry := range entries {
+		stored, err := receiptStore.Get(r.Context(), entry.id)
+		if err == errReceiptNotFound {
+			continue
+		}
+		if err != nil {
+			// The response has started, so leave the document unterminated;
+			// importing it then reports an error instead of looking
+			// complete.
+			log.Printf("snapshot: export failed: receipt %s: %v", entry.id, err)
+			return
+		}
+		data, err := json.Marshal(record(entry.id, stored))
+		if err != nil {
+			log.Printf("snapshot: export failed: receipt %s: %v", entry.id, err)
+			return
+		}
+		if written > 0 {
+			buffered.WriteByte(',')
+		}
+		if _, err := buffered.Write(data); err != nil {
+			log.Printf("snapshot: export failed: %v", err)
+			return
+		}
+		if written++; written%exportFlushInterval == 0 {
+			flush()
+		}
+	}
+	buffered.WriteString("]}\n")
+}
+
+// importSnapshot restores a snapshot produced by exportSnapshot, gzipped or
+// not. Receipts whose IDs already exist are skipped, so an interrupted
+// import can simply be repeated.
+func importSnapshot(w http.ResponseWriter, r *http.Request) {
+	body := bufio.NewReader(r.Body)
+	var in io.Reader = body
+	if magic, err := body.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, "Invalid snapshot: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer zr.Close()
+		in = zr
+	}
+
+	result, err := restoreSnapshot(r.Context(), json.NewDecoder(in))
+	if err != nil {
+		if writeContextError(w, err) {
+			return
+		}
+		var malformed *snapshotError
+		if errors.As(err, &malformed) {
+			http.Error(w, fmt.Sprintf("Invalid snapshot after %d receipts: %v", result.Imported+result.Skipped, err), http.StatusBadRequest)
+			return
+		}
+		log.Printf("snapshot: import failed: %v", err)
+		http.Error(w, "Failed to import snapshot", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, r, result)
+}
+
+// snapshotError reports a malformed snapshot, as opposed to a storage
+// failure while restoring it.
+type snapshotError struct {
+	err error
+}
+
+func (e *snapshotError) Error() string {
+	return e.err.Error()
+}
+
+// restoreSnapshot reads a snapshot document, restoring receipts as they are
+// decoded so snapshots of any size can be imported.
+func restoreSnapshot(ctx context.Context, decoder *json.Decoder) (SnapshotImport, error) {
+	var result SnapshotImport
+	invalid := func(format string, args ...interface{}) (SnapshotImport, error) {
+		return result, &snapshotError{err: fmt.Errorf(format, args...)}
+	}
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return invalid("expected a JSON object")
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return invalid("%v", err)
+		}
+		switch token {
+		case "version":
+			var version int
+			if err := decoder.Decode(&version); err != nil {
+				return invalid("version: %v", err)
+			}
+			if version != snapshotVersion {
+				return invalid("unsupported version %d", version)
+			}
+		case "anonymized":
+			var anonymized bool
+			if err := decoder.Decode(&anonymized); err != nil {
+				return invalid("anonymized: %v", err)
+			}
+			if anonymized {
+				return invalid("anonymized snapshots cannot be imported")
+			}
+		case "receipts":
+			if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+				return invalid("receipts: expected an array")
+			}
+			for decoder.More() {
+				var entry SnapshotReceipt
+				if err := decoder.Decode(&entry); err != nil {
+					return invalid("%v", err)
+				}
+				if entry.ID == "" {
+					return invalid("receipt without an id")
+				}
+				imported, err := restoreReceipt(ctx, entry.ID, entry.Receipt)
+				if err != nil {
+					return result, err
+				}
+				if imported {
+					result.Imported++
+				} else {
+					result.Skipped++
+				}
+			}
+			if _, err := decoder.Token(); err != nil {
+				return invalid("%v", err)
+			}
+		default:
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return invalid("%v", err)
+			}
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return invalid("%v", err)
+	}
+	return result, nil
+}
+
+// restoreReceipt stores a receipt from a snapshot unless its ID is taken,
+// and adds it to the duplicate, message, aggregate and search indexes.
+func restoreReceipt(ctx context.Context, id string, stored StoredReceipt) (bool, error) {
+	_, err := receiptStore.Get(ctx, id)
+	if err == nil {
+		return false, nil
+	}
+	if err != errReceiptNotFound {
+		return false, err
+	}
+	if err := receiptStore.Put(ctx, id, stored); err != nil {
+		return false, err
+	}
+
+	duplicates.mu.Lock()
+	duplicates.add(duplicatePolicy, id, stored.Tenant, stored.ContentHash, stored.Receipt, stored.SubmittedAt)
+	duplicates.mu.Unlock()
+	if stored.MessageID != "" {
+		messages.mu.Lock()
+		messages.processed[messageKey(stored.Tenant, stored.MessageID)] = id
+		messages.mu.Unlock()
+	}
+	aggregates.record(stored, netPoints(stored), 1)
+	leaderboard.record(stored, 1)
+	search.add(id, stored)
+	return true, nil
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Submission sources: the channel a receipt arrived through.
+const (
+	sourceAPI     = "api"
+	sourceBatch   = "batch"
+	sourceImport  = "import"
+	sourceEmail   = "email"
+	sourceWallet  = "wallet"
+	sourceOCR     = "ocr"
+	sourcePartner = "partner"
+	sourceQueue   = "queue"
+)
+
+// sourceHeader lets clients of POST /receipts/process name the channel a
+// receipt reached them through, such as an OCR draft from /uploads or a
+// forwarded email.
+const sourceHeader = "X-Receipt-Source"
+
+// declarableSources are the sources clients may declare with sourceHeader.
+// The others are set by the endpoint or process receiving the receipt.
+var declarableSources = map[string]bool{sourceAPI: true, sourceOCR: true, sourceEmail: true}
+
+// sourceStatsRetention is how many days of per-source counts are kept.
+const sourceStatsRetention = 90
+
+// sourceFromRequest returns the source declared by a request to the
+// interactive submission endpoint: api unless it names another declarable
+// source. Relayed messages are reported as queue. ok is false for unknown
+// or undeclarable sources.
+func sourceFromRequest(r *http.Request, messageID string) (string, bool) {
+	source := r.Header.Get(sourceHeader)
+	switch {
+	case source == "" && messageID != "":
+		return sourceQueue, true
+	case source == "":
+		return sourceAPI, true
+	}
+	return source, declarableSources[source]
+}
+
+// SourceCounts tallies submissions through one channel: those stored, and
+// those refused because of the receipt (rejected) or a server error
+// (failed).
+type SourceCounts struct {
+	Submitted int `json:"submitted"`
+	Accepted  int `json:"accepted"`
+	Rejected  int `json:"rejected"`
+	Failed    int `json:"failed"`
+}
+
+func (c *SourceCounts) add(other SourceCounts) {
+	c.Submitted += other.Submitted
+	c.Accepted += other.Accepted
+	c.Rejected += other.Rejected
+	c.Failed += other.Failed
+}
+
+// rejectedSubmission counts a receipt that could not be decoded.
+var rejectedSubmission = SourceCounts{Submitted: 1, Rejected: 1}
+
+// submissionOutcome classifies the error submitReceipt returned.
+func submissionOutcome(err error) SourceCounts {
+	var duplicate *DuplicateError
+	var rejection *HookRejection
+	var invalid *validationError
+	switch {
+	case err == nil:
+		return SourceCounts{Submitted: 1, Accepted: 1}
+	case errors.As(err, &duplicate), errors.As(err, &rejection), errors.As(err, &invalid),
+		err == errInvalidReceipt, err == errInvalidPurchaseTime:
+		return rejectedSubmission
+	}
+	return SourceCounts{Submitted: 1, Failed: 1}
+}
+
+// sourceKey identifies the counts of one client through one source.
+type sourceKey struct {
+	source string
+	client string
+}
+
+// sourceCounter counts submissions per day, source and client.
+type sourceCounter struct {
+	mu   sync.Mutex
+	days map[string]map[sourceKey]*SourceCounts
+}
+
+var sourceStats = &sourceCounter{days: make(map[string]map[sourceKey]*SourceCounts)}
+
+// record counts one submission with the given outcome.
+func (c *sourceCounter) record(sub Submission, outcome SourceCounts, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	day := at.UTC().Format("2006-01-02")
+	keys, ok := c.days[day]
+	if !ok {
+		keys = make(map[sourceKey]*SourceCounts)
+		c.days[day] = keys
+		cutoff := at.UTC().AddDate(0, 0, -sourceStatsRetention).Format("2006-01-02")
+		for old := range c.days {
+			if old < cutoff {
+				delete(c.days, old)
+			}
+		}
+	}
+	key := sourceKey{source: sub.Source, client: sub.Client}
+	counts, ok := keys[key]
+	if !ok {
+		counts = &SourceCounts{}
+		keys[key] = counts
+	}
+	counts.add(outcome)
+}
+
+// ClientSourceCounts is one client's counts through one source on one day.
+type ClientSourceCounts struct {
+	Day    string `json:"day"`
+	Source string `json:"source"`
+	Client string `json:"client"`
+	SourceCounts
+}
+
+// SourceReport lists submissions per source, and per client and day, busiest
+// first.
+type SourceReport struct {
+	Since   string                  `json:"since"`
+	Total   SourceCounts            `json:"total"`
+	Sources map[string]SourceCounts `json:"sources"`
+	Clients []ClientSourceCounts    `json:"clients"`
+}
+
+// report returns counts for the last days days, optionally for one source
+// or client.
+func (c *sourceCounter) report(days int, source, client string, now time.Time) SourceReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	since := now.UTC().AddDate(0, 0, 1-days).Format("2006-01-02")
+	report := SourceReport{Since: since, Sources: make(map[string]SourceCounts), Clients: []ClientSourceCounts{}}
+	for day, keys := range c.days {
+		if day < since {
+			continue
+		}
+		for key, counts := range keys {
+			if (source != "" && key.source != source) || (client != "" && key.client != client) {
+				continue
+			}
+			report.Clients = append(report.Clients, ClientSourceCounts{Day: day, Source: key.source, Client: key.client, SourceCounts: *counts})
+			total := report.Sources[key.source]
+			total.add(*counts)
+			report.Sources[key.source] = total
+			report.Total.add(*counts)
+		}
+	}
+	sort.Slice(report.Clients, func(i, j int) bool {
+		a, b := report.Clients[i], report.Clients[j]
+		switch {
+		case a.Submitted != b.Submitted:
+			return a.Submitted > b.Submitted
+		case a.Day != b.Day:
+			return a.Day > b.Day
+		case a.Source != b.Source:
+			return a.Source < b.Source
+		}
+		return a.Client < b.Client
+	})
+	return report
+}
+
+// getSourceReport reports submissions and their outcomes per source, client
+// and day. The "days" query parameter (default 7) selects the period, and
+// "source" and "client" narrow the report.
+func getSourceReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	days := 7
+	query := r.URL.Query()
+	if value := query.Get("days"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > sourceStatsRetention {
+			http.Error(w, "Invalid days parameter", http.StatusBadRequest)
+			return
+		}
+		days = n
+	}
+	writeJSON(w, r, sourceStats.report(days, query.Get("source"), query.Get("client"), time.Now()))
+}
+
+// matchesSource reports whether a stored receipt passes the source and
+// client filters of a listing request.
+func matchesSource(r *http.Request, stored StoredReceipt) bool {
+	query := r.URL.Query()
+	source, client := query.Get("source"), query.Get("client")
+	return (source == "" || stored.Source == source) && (client == "" || stored.Client == client)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteMigrations upgrade the schema in order; a database records how many
+// it has applied in schema_migrations. Append new migrations, never edit
+// applied ones.
+var sqliteMigrations = []string{
+	`CREATE TABLE receipts (
+		seq          INTEGER PRIMARY KEY AUTOINCREMENT,
+		id           TEXT NOT NULL UNIQUE,
+		tenant       TEXT NOT NULL,
+		content_hash TEXT NOT NULL,
+		data         TEXT NOT NULL
+	)`,
+	`CREATE INDEX receipts_content_hash ON receipts (tenant, content_hash, seq)`,
+}
+
+func init() {
+	storeDrivers["sqlite"] = openSQLiteDSN
+}
+
+// sqliteStore keeps receipts in a SQLite database, as JSON alongside the
+// columns they are looked up by.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLiteDSN opens a SQLite backend from a DSN such as
+// "sqlite:///var/lib/receipts.db" or "sqlite://receipts.db".
+func openSQLiteDSN(dsn *url.URL) (ReceiptStore, error) {
+	path := dsn.Host + dsn.Path
+	if path == "" {
+		return nil, errors.New("sqlite: missing database path")
+	}
+	return openSQLiteStore(path)
+}
+
+// openSQLiteStore opens or creates the database at path and brings its
+// schema up to date.
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	// Write transactions take the lock up front so concurrent updates wait
+	// for each other instead of failing when they upgrade a read lock.
+	db, err := sql.Open("sqlite3", "file:"+path+"?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite: %s: %w", path, err)
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+// migrateSQLite applies the migrations the database has not yet seen, each
+// in its own transaction.
+func migrateSQLite(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+	var applied int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+	if applied > len(sqliteMigrations) {
+		return fmt.Errorf("schema version %d is newer than this build supports", applied)
+	}
+	for version := applied; version < len(sqliteMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqliteMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (?)`, version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqliteExecer is satisfied by both *sql.DB and *sql.Tx.
+type sqliteExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// put inserts or replaces a receipt, keeping its original position so the
+// earliest receipt with a content hash stays the earliest.
+func (s *sqliteStore) put(ctx context.Context, db sqliteExecer, id string, stored StoredReceipt) error {
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, `INSERT INTO receipts (id, tenant, content_hash, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET tenant = excluded.tenant, content_hash = excluded.content_hash, data = excluded.data`,
+		id, stored.Tenant, stored.ContentHash, string(data))
+	return err
+}
+
+func (s *sqliteStore) Put(ctx context.Context, id string, stored StoredReceipt) error {
+	return s.put(ctx, s.db, id, stored)
+}
+
+func (s *sqliteStore) Get(ctx context.Context, id string) (StoredReceipt, error) {
+	var stored StoredReceipt
+	var data string
+	err := s.db.QueryRowContext(ctx, `SELECT data FROM receipts WHERE id = ?`, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return stored, errReceiptNotFound
+	}
+	if err != nil {
+		return stored, err
+	}
+	err = json.Unmarshal([]byte(data), &stored)
+	return stored, err
+}
+
+func (s *sqliteStore) Update(ctx context.Context, id string, fn func(*StoredReceipt) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var data string
+	err = tx.QueryRowContext(ctx, `SELECT data FROM receipts WHERE id = ?`, id).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errReceiptNotFound
+	}
+	if err != nil {
+		return err
+	}
+	var stored StoredReceipt
+	if err := json.Unmarshal([]byte(data), &stored); err != nil {
+		return err
+	}
+	if err := fn(&stored); err != nil {
+		return err
+	}
+	if err := s.put(ctx, tx, id, stored); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Range(ctx context.Context, fn func(id string, stored StoredReceipt) bool) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, data FROM receipts ORDER BY seq`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return err
+		}
+		var stored StoredReceipt
+		if err := json.Unmarshal([]byte(data), &stored); err != nil {
+			return fmt.Errorf("receipt %s: %w", id, err)
+		}
+		if !fn(id, stored) {
+			break
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqliteStore) Len(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM receipts`).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteStore) FindByContentHash(ctx context.Context, tenant, hash string) (string, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM receipts WHERE tenant = ? AND content_hash = ? ORDER BY seq LIMIT 1`, tenant, hash).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return id, err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
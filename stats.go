@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// statsPercentiles are the points percentiles GET /stats reports.
+var statsPercentiles = []int{50, 75, 90, 95, 99}
+
+// maxStatsRetailers bounds the retailers GET /stats lists.
+const maxStatsRetailers = 1000
+
+// RetailerStats is one retailer's receipts and points.
+type RetailerStats struct {
+	Retailer      string  `json:"retailer"`
+	Receipts      int     `json:"receipts"`
+	Points        int     `json:"points"`
+	AveragePoints float64 `json:"averagePoints"`
+}
+
+// Stats summarizes the receipts processed and the points awarded for them.
+// Percentiles are taken over each receipt's points, by nearest rank.
+type Stats struct {
+	Tenant        string          `json:"tenant,omitempty"`
+	Receipts      int             `json:"receipts"`
+	TotalPoints   int             `json:"totalPoints"`
+	AveragePoints float64         `json:"averagePoints"`
+	MinPoints     int             `json:"minPoints"`
+	MaxPoints     int             `json:"maxPoints"`
+	Percentiles   map[string]int  `json:"percentiles"`
+	Retailers     []RetailerStats `json:"retailers"`
+	// Suppressed is set when the figures across all receipts are withheld
+	// under the privacy policy.
+	Suppressed bool `json:"suppressed,omitempty"`
+}
+
+// averagePoints divides points among receipts, to two decimals.
+func averagePoints(points, receipts int) float64 {
+	if receipts <= 0 {
+		return 0
+	}
+	return math.Round(float64(points)/float64(receipts)*100) / 100
+}
+
+// histogram returns a copy of how many of a tenant's receipts, or of every
+// receipt for the empty tenant, earned each number of points.
+func (a *aggregateIndex) histogram(tenant string) map[int]int {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	view := a.all
+	if tenant != "" {
+		if view = a.tenants[tenant]; view == nil {
+			return map[int]int{}
+		}
+	}
+	copied := make(map[int]int, len(view.histogram))
+	for points, receipts := range view.histogram {
+		copied[points] = receipts
+	}
+	return copied
+}
+
+// Stats returns the statistics of a tenant's receipts, or of every receipt
+// for the empty tenant, listing up to top retailers by receipt count. It
+// reads the aggregate counters under the tenant's privacy policy; the
+// distribution is only reported when the totals may be published.
+func (a *aggregateIndex) Stats(tenant string, top int) Stats {
+	published := a.Published(tenant)
+	stats := Stats{
+		Tenant:      tenant,
+		Percentiles: map[string]int{},
+		Retailers:   []RetailerStats{},
+		Suppressed:  published.TotalSuppressed,
+	}
+	for retailer, counters := range published.Retailers {
+		stats.Retailers = append(stats.Retailers, RetailerStats{
+			Retailer:      retailer,
+			Receipts:      counters.Receipts,
+			Points:        counters.Points,
+			AveragePoints: averagePoints(counters.Points, counters.Receipts),
+		})
+	}
+	sort.Slice(stats.Retailers, func(i, j int) bool {
+		x, y := stats.Retailers[i], stats.Retailers[j]
+		if x.Receipts != y.Receipts {
+			return x.Receipts > y.Receipts
+		}
+		return x.Retailer < y.Retailer
+	})
+	if len(stats.Retailers) > top {
+		stats.Retailers = stats.Retailers[:top]
+	}
+	if stats.Suppressed {
+		return stats
+	}
+
+	stats.Receipts = published.Total.Receipts
+	stats.TotalPoints = published.Total.Points
+	stats.AveragePoints = averagePoints(stats.TotalPoints, stats.Receipts)
+	histogram := a.histogram(tenant)
+	values := make([]int, 0, len(histogram))
+	count := 0
+	for points, receipts := range histogram {
+		values = append(values, points)
+		count += receipts
+	}
+	if count == 0 {
+		return stats
+	}
+	sort.Ints(values)
+	stats.MinPoints, stats.MaxPoints = values[0], values[len(values)-1]
+	for _, percentile := range statsPercentiles {
+		rank := int(math.Ceil(float64(percentile) / 100 * float64(count)))
+		seen := 0
+		for _, points := range values {
+			if seen += histogram[points]; seen >= rank {
+				stats.Percentiles[fmt.Sprintf("p%d", percentile)] = points
+				break
+			}
+		}
+	}
+	return stats
+}
+
+// getStats reports statistics on the receipts processed and the points
+// awarded, across all tenants or for the tenant named by the tenant
+// parameter, listing the top retailers (default 20) by receipt count.
+func getStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	tenant := query.Get("tenant")
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+	top := 20
+	if value := query.Get("top"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxStatsRetailers {
+			http.Error(w, fmt.Sprintf("top must be 1-%d", maxStatsRetailers), http.StatusBadRequest)
+			return
+		}
+		top = n
+	}
+	writeJSON(w, r, aggregates.Stats(tenant, top))
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// errReceiptNotFound is returned when no receipt is stored under an ID.
+var errReceiptNotFound = errors.New("receipt not found")
+
+// ReceiptStore persists submitted receipts by ID. Every method gives up with
+// the context's error once ctx is done.
+type ReceiptStore interface {
+	// Put stores a receipt, replacing any existing receipt with the same ID.
+	Put(ctx context.Context, id string, stored StoredReceipt) error
+	// Get returns the receipt stored under id or errReceiptNotFound.
+	Get(ctx context.Context, id string) (StoredReceipt, error)
+	// Update applies fn to the stored receipt atomically. If fn returns an
+	// error the receipt is left unchanged.
+	Update(ctx context.Context, id string, fn func(*StoredReceipt) error) error
+	// Range calls fn for each stored receipt until fn returns false.
+	Range(ctx context.Context, fn func(id string, stored StoredReceipt) bool) error
+	// Len returns the number of stored receipts.
+	Len(ctx context.Context) (int, error)
+	// FindByContentHash returns the ID of the earliest stored receipt with
+	// the tenant and content hash, or "" when there is none.
+	FindByContentHash(ctx context.Context, tenant, hash string) (string, error)
+	// Close flushes pending writes and releases the backend. The store is
+	// not used afterwards.
+	Close() error
+}
+
+// receiptStore is the active storage backend.
+var receiptStore ReceiptStore = newMemoryStore()
+
+// memoryStore keeps receipts in a map guarded by a mutex.
+type memoryStore struct {
+	mu       sync.Mutex
+	receipts map[string]storedValue
+	// hashes indexes receipt IDs by tenant and content hash, earliest
+	// stored first.
+	hashes map[string][]string
+	// compress keeps receipts as deflated JSON rather than as structs.
+	compress bool
+}
+
+// storedValue is a receipt as held by memoryStore: either as is or, with
+// compression enabled, packed into deflated JSON.
+type storedValue struct {
+	receipt *StoredReceipt
+	packed  []byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{receipts: make(map[string]storedValue), hashes: make(map[string][]string)}
+}
+
+// loadStoreConfig configures the default backend from STORAGE (memory,
+// optionally logged to WAL_PATH, sqlite with its database at SQLITE_PATH,
+// bolt with its file at BOLT_PATH, or postgres) and STORE_COMPRESSION,
+// per-tenant shards from STORE_SHARDS, the import throttle's observation
+// of them and the Redis cache in front of them from REDIS_URL.
+func loadStoreConfig() error {
+	storage := os.Getenv("STORAGE")
+	if os.Getenv("WAL_PATH") != "" && storage != "" && storage != "memory" {
+		return fmt.Errorf("WAL_PATH: only supported with in-memory storage")
+	}
+	switch storage {
+	case "", "memory":
+		store := newMemoryStore()
+		switch mode := os.Getenv("STORE_COMPRESSION"); mode {
+		case "", "none":
+		case "deflate":
+			store.compress = true
+		default:
+			return fmt.Errorf("STORE_COMPRESSION: unknown mode %q", mode)
+		}
+		receiptStore = store
+		if path := os.Getenv("WAL_PATH"); path != "" {
+			wal, err := openWAL(store, path, os.Getenv("WAL_FSYNC") != "false")
+			if err != nil {
+				return fmt.Errorf("WAL_PATH: %w", err)
+			}
+			receiptStore = wal
+		}
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "receipts.db"
+		}
+		store, err := openSQLiteStore(path)
+		if err != nil {
+			return fmt.Errorf("STORAGE: %w", err)
+		}
+		receiptStore = store
+	case "bolt":
+		path := os.Getenv("BOLT_PATH")
+		if path == "" {
+			path = "receipts.bolt"
+		}
+		store, err := openBoltStore(path)
+		if err != nil {
+			return fmt.Errorf("STORAGE: %w", err)
+		}
+		receiptStore = store
+	case "postgres":
+		store, err := loadPostgresStore()
+		if err != nil {
+			return err
+		}
+		receiptStore = store
+	default:
+		return fmt.Errorf("STORAGE: unknown backend %q", storage)
+	}
+	if err := loadShardConfig(); err != nil {
+		return err
+	}
+	if err := loadThrottleConfig(); err != nil {
+		return err
+	}
+	return loadCacheConfig()
+}
+
+// flateWriters recycles compressors, which are expensive to allocate.
+var flateWriters = sync.Pool{New: func() interface{} {
+	w, _ := flate.NewWriter(nil, flate.BestSpeed)
+	return w
+}}
+
+// pack converts a receipt to its stored form.
+func (s *memoryStore) pack(stored StoredReceipt) (storedValue, error) {
+	if !s.compress {
+		return storedValue{receipt: &stored}, nil
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return storedValue{}, err
+	}
+	var buf bytes.Buffer
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(&buf)
+	if _, err := w.Write(data); err != nil {
+		return storedValue{}, err
+	}
+	if err := w.Close(); err != nil {
+		return storedValue{}, err
+	}
+	return storedValue{packed: buf.Bytes()}, nil
+}
+
+// unpack restores a receipt from its stored form.
+func (s *memoryStore) unpack(value storedValue) (StoredReceipt, error) {
+	if value.receipt != nil {
+		return *value.receipt, nil
+	}
+	var stored StoredReceipt
+	r := flate.NewReader(bytes.NewReader(value.packed))
+	defer r.Close()
+	err := json.NewDecoder(r).Decode(&stored)
+	return stored, err
+}
+
+// contentKey is a receipt's key in the hash index.
+func contentKey(stored StoredReceipt) string {
+	return stored.Tenant + "\x00" + stored.ContentHash
+}
+
+// index adds id to the receipts with its tenant and content hash, after any
+// stored earlier. Callers hold s.mu.
+func (s *memoryStore) index(id string, stored StoredReceipt) {
+	key := contentKey(stored)
+	for _, indexed := range s.hashes[key] {
+		if indexed == id {
+			return
+		}
+	}
+	s.hashes[key] = append(s.hashes[key], id)
+}
+
+// unindex removes id from the hash index, so that the next receipt with the
+// same content hash, if any, is found in its place. Callers hold s.mu.
+func (s *memoryStore) unindex(id string, stored StoredReceipt) {
+	key := contentKey(stored)
+	ids := s.hashes[key]
+	for i, indexed := range ids {
+		if indexed == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(s.hashes, key)
+		return
+	}
+	s.hashes[key] = ids
+}
+
+// reindex moves id in the hash index from the previous content hash to the
+// new one. A receipt whose hash did not change keeps its place. Callers
+// hold s.mu.
+func (s *memoryStore) reindex(id string, previous, stored StoredReceipt) {
+	if contentKey(previous) == contentKey(stored) {
+		return
+	}
+	s.unindex(id, previous)
+	s.index(id, stored)
+}
+
+func (s *memoryStore) Put(ctx context.Context, id string, stored StoredReceipt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	value, err := s.pack(stored)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if previous, ok := s.receipts[id]; ok {
+		if previous, err := s.unpack(previous); err == nil {
+			s.reindex(id, previous, stored)
+		}
+	}
+	s.receipts[id] = value
+	s.index(id, stored)
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (StoredReceipt, error) {
+	if err := ctx.Err(); err != nil {
+		return StoredReceipt{}, err
+	}
+	s.mu.Lock()
+	value, ok := s.receipts[id]
+	s.mu.Unlock()
+	if !ok {
+		return StoredReceipt{}, errReceiptNotFound
+	}
+	return s.unpack(value)
+}
+
+func (s *memoryStore) Update(ctx context.Context, id string, fn func(*StoredReceipt) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.receipts[id]
+	if !ok {
+		return errReceiptNotFound
+	}
+	previous, err := s.unpack(value)
+	if err != nil {
+		return err
+	}
+	stored := previous
+	if err := fn(&stored); err != nil {
+		return err
+	}
+	if value, err = s.pack(stored); err != nil {
+		return err
+	}
+	s.receipts[id] = value
+	s.reindex(id, previous, stored)
+	return nil
+}
+
+func (s *memoryStore) Range(ctx context.Context, fn func(id string, stored StoredReceipt) bool) error {
+	s.mu.Lock()
+	snapshot := make(map[string]storedValue, len(s.receipts))
+	for id, value := range s.receipts {
+		snapshot[id] = value
+	}
+	s.mu.Unlock()
+
+	for id, value := range snapshot {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		stored, err := s.unpack(value)
+		if err != nil {
+			return err
+		}
+		if !fn(id, stored) {
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Len(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.receipts), nil
+}
+
+func (s *memoryStore) FindByContentHash(ctx context.Context, tenant, hash string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ids := s.hashes[tenant+"\x00"+hash]; len(ids) > 0 {
+		return ids[0], nil
+	}
+	return "", nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
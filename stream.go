@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+// maxStreamLineBytes bounds one receipt in a streaming import. Only one line
+// is held in memory at a time.
+const maxStreamLineBytes = 1 << 20
+
+// errStreamLineTooLong is reported for lines longer than maxStreamLineBytes.
+var errStreamLineTooLong = &httpError{status: http.StatusRequestEntityTooLarge, message: "receipt exceeds 1 MiB"}
+
+// StreamSummary is the last line of a streaming import's response.
+type StreamSummary struct {
+	Accepted int  `json:"accepted"`
+	Failed   int  `json:"failed"`
+	Complete bool `json:"complete"`
+}
+
+// processReceiptStream imports newline-delimited JSON receipts, for
+// backfills too large for a batch. Receipts are read, stored and answered
+// one line at a time, so memory stays bounded however long the body is.
+// Each line gets its own request timeout rather than the whole import.
+//
+// Results are written while the body is still being read, which HTTP/1.1
+// only allows with full duplex enabled.
+func processReceiptStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sub, ok := submissionFromRequest(r)
+	if !ok {
+		http.Error(w, "Invalid tenant or user ID", http.StatusBadRequest)
+		return
+	}
+	sub.Bulk, sub.Source = true, sourceBatch
+	mode := validationMode(sub.Tenant)
+
+	controller := http.NewResponseController(w)
+	if err := controller.EnableFullDuplex(); err != nil && r.ProtoMajor == 1 {
+		http.Error(w, "Streaming is not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	reader := bufio.NewReaderSize(r.Body, maxStreamLineBytes)
+	// Read before answering, so that clients waiting for 100 Continue send
+	// the body; any error is returned again by the first line's read.
+	reader.Peek(1)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	encoder := json.NewEncoder(w)
+
+	var summary StreamSummary
+	for index := 0; ; index++ {
+		line, err := readStreamLine(reader)
+		if err == io.EOF {
+			summary.Complete = true
+			break
+		}
+		if err != nil && err != errStreamLineTooLong {
+			// The body could not be read; what was stored is reported below.
+			break
+		}
+		if err == nil && len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		var result BatchResult
+		if err != nil {
+			result = BatchResult{Index: index, Error: err.Error()}
+		} else {
+			result = submitStreamLine(r.Context(), handlerTimeout(r), sub, mode, index, line)
+		}
+		if result.Error != "" {
+			summary.Failed++
+		} else {
+			summary.Accepted++
+		}
+		if encoder.Encode(result) != nil {
+			// The client has gone; stop importing.
+			return
+		}
+		controller.Flush()
+	}
+	encoder.Encode(summary)
+}
+
+// submitStreamLine submits one line of a streaming import under its own
+// timeout.
+func submitStreamLine(ctx context.Context, timeout time.Duration, sub Submission, mode string, index int, line []byte) BatchResult {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return submitBatchEntry(ctx, sub, mode, index, line)
+}
+
+// readStreamLine returns the next line of reader, without its newline. A line
+// longer than the reader's buffer is discarded up to its end and reported as
+// errStreamLineTooLong, so the import can carry on with the next line.
+func readStreamLine(reader *bufio.Reader) ([]byte, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		for err == bufio.ErrBufferFull {
+			_, err = reader.ReadSlice('\n')
+		}
+		if err == nil || err == io.EOF {
+			err = errStreamLineTooLong
+		}
+		return nil, err
+	}
+	if err == io.EOF && len(line) > 0 {
+		err = nil
+	}
+	return line, err
+}
@@ -0,0 +1,43 @@
+//go:build !windows && !plan9
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+)
+
+// syslogSink forwards log entries to syslog, at the severity of their level.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// openSyslog connects to the local syslog daemon, or to addr given as
+// "udp://host:port" or "tcp://host:port".
+func openSyslog(addr, tag string) (logSink, error) {
+	if tag == "" {
+		tag = "receipt-processor"
+	}
+	network, raddr := "", ""
+	if addr != "" {
+		u, err := url.Parse(addr)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("SYSLOG_ADDR must be udp://host:port or tcp://host:port, got %q", addr)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) writeEntry(entry LogEntry, line []byte) error {
+	message := string(line[:len(line)-1])
+	if entry.Level == "error" {
+		return s.w.Err(message)
+	}
+	return s.w.Info(message)
+}
@@ -0,0 +1,10 @@
+//go:build windows || plan9
+
+package main
+
+import "errors"
+
+// openSyslog reports that syslog is unavailable on this platform.
+func openSyslog(addr, tag string) (logSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
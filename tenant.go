@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+)
+
+// defaultTenant owns receipts submitted without a tenant header.
+const defaultTenant = "default"
+
+// tenantHeader names the request header identifying the submitting tenant.
+const tenantHeader = "X-Tenant-ID"
+
+// tenantPattern matches valid tenant and user IDs.
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// tenantFromRequest returns the tenant a request acts for. Malformed tenant
+// IDs are reported as ok=false.
+func tenantFromRequest(r *http.Request) (string, bool) {
+	tenant := r.Header.Get(tenantHeader)
+	if tenant == "" {
+		return defaultTenant, true
+	}
+	return tenant, tenantPattern.MatchString(tenant)
+}
+
+// clientHeader names the request header identifying the calling client.
+const clientHeader = "X-Client-ID"
+
+// clientFromRequest identifies the calling client by its X-Client-ID header,
+// falling back to the remote IP address.
+func clientFromRequest(r *http.Request) string {
+	if client := r.Header.Get(clientHeader); client != "" && len(client) <= 128 {
+		return client
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// userHeader names the request header identifying the end user a receipt
+// belongs to.
+const userHeader = "X-User-ID"
+
+// userFromRequest returns the user named by the X-User-ID header, which is
+// optional. Malformed user IDs are reported as ok=false.
+func userFromRequest(r *http.Request) (string, bool) {
+	userID := r.Header.Get(userHeader)
+	if userID == "" {
+		return "", true
+	}
+	return userID, tenantPattern.MatchString(userID)
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Rules proposal statuses.
+const (
+	proposalPending   = "pending"
+	proposalApproved  = "approved"
+	proposalRejected  = "rejected"
+	proposalWithdrawn = "withdrawn"
+)
+
+// maxPendingProposals bounds the proposals a tenant may have awaiting review.
+const maxPendingProposals = 20
+
+// tenantRulesKey is the blob key tenants' approved rules and their proposals
+// are saved under, so that tenants keep their rules after a restart.
+const tenantRulesKey = "tenant-rules.json"
+
+// RulesProposal is a tenant's proposed rule set awaiting, or having had, a
+// platform admin's decision. Diff and Impact compare it with the tenant's
+// rules when it was proposed, whose version is BaseVersion.
+type RulesProposal struct {
+	ID          string       `json:"id"`
+	Tenant      string       `json:"tenant"`
+	Status      string       `json:"status"`
+	Comment     string       `json:"comment,omitempty"`
+	Rules       RulesConfig  `json:"rules"`
+	BaseVersion string       `json:"baseVersion"`
+	Diff        []RuleChange `json:"diff"`
+	Impact      RulesImpact  `json:"impact"`
+	CreatedAt   time.Time    `json:"createdAt"`
+	DecidedAt   *time.Time   `json:"decidedAt,omitempty"`
+	// Reason explains a rejection.
+	Reason string `json:"reason,omitempty"`
+}
+
+// RuleChange is one rules field a proposal changes, with its current and
+// proposed values.
+type RuleChange struct {
+	Field string          `json:"field"`
+	From  json.RawMessage `json:"from"`
+	To    json.RawMessage `json:"to"`
+}
+
+// TenantRulesResponse is the rule set applied to a tenant's new receipts.
+// Custom is false when the tenant uses the platform's active rules.
+type TenantRulesResponse struct {
+	Tenant  string      `json:"tenant"`
+	Version string      `json:"version"`
+	Custom  bool        `json:"custom"`
+	Rules   RulesConfig `json:"rules"`
+}
+
+var (
+	tenantRulesMutex sync.RWMutex
+	// tenantRules are the rule sets approved for individual tenants, which
+	// replace the active rules for their new receipts.
+	tenantRules = make(map[string]*activeRuleSet)
+
+	// tenantAdminTokens maps tenants to their admins' bearer token.
+	tenantAdminTokens = make(map[string]string)
+
+	proposalsMutex sync.Mutex
+	proposals      = make(map[string]*RulesProposal)
+)
+
+// savedTenantRules is the tenants' approved rules and proposals as saved to
+// the blob store.
+type savedTenantRules struct {
+	Rules     map[string]RulesConfig `json:"rules"`
+	Proposals []RulesProposal        `json:"proposals"`
+}
+
+// loadTenantRules restores the tenant rules and proposals saved to the blob
+// store. It runs after the blob store and scoring plugins are configured.
+func loadTenantRules() error {
+	data, err := blobStore.Get(tenantRulesKey)
+	if errors.Is(err, errBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("tenant rules: %w", err)
+	}
+	var saved savedTenantRules
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("tenant rules: %w", err)
+	}
+	for tenant, rules := range saved.Rules {
+		if problems := rules.Validate(); len(problems) > 0 {
+			return fmt.Errorf("tenant rules: %s: %w", tenant, &InvalidRulesError{Problems: problems})
+		}
+		version := rulesVersion(rules)
+		registerRuleSet(version, rules)
+		tenantRules[tenant] = &activeRuleSet{rules: rules, version: version}
+	}
+	for i := range saved.Proposals {
+		proposals[saved.Proposals[i].ID] = &saved.Proposals[i]
+	}
+	return nil
+}
+
+// saveTenantRules writes every tenant's rules and every proposal to the blob
+// store. The caller holds proposalsMutex and tenantRulesMutex.
+func saveTenantRules() error {
+	saved := savedTenantRules{Rules: make(map[string]RulesConfig, len(tenantRules)), Proposals: make([]RulesProposal, 0, len(proposals))}
+	for tenant, active := range tenantRules {
+		saved.Rules[tenant] = active.rules
+	}
+	for _, proposal := range proposals {
+		saved.Proposals = append(saved.Proposals, *proposal)
+	}
+	sort.Slice(saved.Proposals, func(i, j int) bool { return saved.Proposals[i].ID < saved.Proposals[j].ID })
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return blobStore.Put(tenantRulesKey, data)
+}
+
+// saveProposals saves a change to the proposals. The caller holds
+// proposalsMutex.
+func saveProposals() error {
+	tenantRulesMutex.RLock()
+	defer tenantRulesMutex.RUnlock()
+	return saveTenantRules()
+}
+
+// loadTenantAdminConfig reads TENANT_ADMIN_TOKENS ("acme=<token>,...").
+// Tokens must be at least 16 characters and distinct.
+func loadTenantAdminConfig() error {
+	seen := make(map[string]bool)
+	for _, pair := range strings.Split(os.Getenv("TENANT_ADMIN_TOKENS"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		tenant, token, ok := strings.Cut(pair, "=")
+		tenant, token = strings.TrimSpace(tenant), strings.TrimSpace(token)
+		if !ok || !tenantPattern.MatchString(tenant) || len(token) < 16 || seen[token] {
+			return fmt.Errorf("TENANT_ADMIN_TOKENS: malformed entry for tenant %q", tenant)
+		}
+		seen[token] = true
+		tenantAdminTokens[tenant] = token
+	}
+	return nil
+}
+
+// tenantAdminFromRequest returns the tenant whose admin token the request
+// bears, if any.
+func tenantAdminFromRequest(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for tenant, expected := range tenantAdminTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(expected)) == 1 {
+			return tenant, true
+		}
+	}
+	return "", false
+}
+
+// requireTenantAdmin authenticates a tenant admin by bearer token and passes
+// the tenant the token belongs to.
+func requireTenantAdmin(next func(w http.ResponseWriter, r *http.Request, tenant string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(tenantAdminTokens) == 0 {
+			http.Error(w, "Tenant admin API disabled", http.StatusForbidden)
+			return
+		}
+		if tenant, ok := tenantAdminFromRequest(r); ok {
+			next(w, r, tenant)
+			return
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// tenantRuleSet returns the rules applied to a tenant's new receipts and
+// their version: the tenant's approved rules, or else the active rules.
+func tenantRuleSet(tenant string) (RulesConfig, string) {
+	tenantRulesMutex.RLock()
+	active, ok := tenantRules[tenant]
+	tenantRulesMutex.RUnlock()
+	if ok {
+		return active.rules, active.version
+	}
+	return currentRuleSet()
+}
+
+// setTenantRules validates rules and makes them the tenant's rule set, saving
+// it with the proposals. If saving fails the tenant keeps its previous rules.
+// The caller holds proposalsMutex.
+func setTenantRules(tenant string, rules RulesConfig) error {
+	if problems := rules.Validate(); len(problems) > 0 {
+		return &InvalidRulesError{Problems: problems}
+	}
+	version := rulesVersion(rules)
+	registerRuleSet(version, rules)
+	tenantRulesMutex.Lock()
+	defer tenantRulesMutex.Unlock()
+	previous, had := tenantRules[tenant]
+	tenantRules[tenant] = &activeRuleSet{rules: rules, version: version}
+	if err := saveTenantRules(); err != nil {
+		if had {
+			tenantRules[tenant] = previous
+		} else {
+			delete(tenantRules, tenant)
+		}
+		return err
+	}
+	return nil
+}
+
+// diffRules lists the fields in which two rule sets differ, by name.
+func diffRules(from, to RulesConfig) []RuleChange {
+	fields := func(rules RulesConfig) map[string]json.RawMessage {
+		data, _ := json.Marshal(rules)
+		var m map[string]json.RawMessage
+		json.Unmarshal(data, &m)
+		return m
+	}
+	before, after := fields(from), fields(to)
+	names := make(map[string]int)
+	for name := range before {
+		names[name] = 0
+	}
+	for name := range after {
+		names[name] = 0
+	}
+
+	changes := []RuleChange{}
+	for _, name := range sortedKeys(names) {
+		if !bytes.Equal(before[name], after[name]) {
+			changes = append(changes, RuleChange{Field: name, From: before[name], To: after[name]})
+		}
+	}
+	return changes
+}
+
+// tenantSample returns up to maxValidationSample of a tenant's receipts.
+func tenantSample(ctx context.Context, tenant string) ([]StoredReceipt, error) {
+	var sample []StoredReceipt
+	err := receiptStore.Range(ctx, func(id string, stored StoredReceipt) bool {
+		if stored.Tenant == tenant {
+			sample = append(sample, stored)
+		}
+		return len(sample) < maxValidationSample
+	})
+	return sample, err
+}
+
+// sortedProposals returns the proposals selected by keep, newest first.
+func sortedProposals(keep func(*RulesProposal) bool) []RulesProposal {
+	proposalsMutex.Lock()
+	defer proposalsMutex.Unlock()
+	list := []RulesProposal{}
+	for _, proposal := range proposals {
+		if keep(proposal) {
+			list = append(list, *proposal)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// getTenantRules returns the rules applied to the tenant's new receipts.
+func getTenantRules(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rules, version := tenantRuleSet(tenant)
+	tenantRulesMutex.RLock()
+	_, custom := tenantRules[tenant]
+	tenantRulesMutex.RUnlock()
+	writeJSON(w, r, TenantRulesResponse{Tenant: tenant, Version: version, Custom: custom, Rules: rules})
+}
+
+// tenantProposalsHandler lists (GET) the tenant's proposals or submits (POST)
+// a new one. A proposal's body is { "rules": {...}, "comment": "..." };
+// omitted rules fields keep the tenant's current values. The proposal is
+// validated, and its diff and impact on the tenant's stored receipts are
+// attached for the reviewer.
+func tenantProposalsHandler(w http.ResponseWriter, r *http.Request, tenant string) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, r, sortedProposals(func(p *RulesProposal) bool { return p.Tenant == tenant }))
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	current, version := tenantRuleSet(tenant)
+	request := struct {
+		Rules   RulesConfig `json:"rules"`
+		Comment string      `json:"comment"`
+	}{Rules: current}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "Invalid rules proposal", http.StatusBadRequest)
+		return
+	}
+	if problems := request.Rules.Validate(); len(problems) > 0 {
+		http.Error(w, (&InvalidRulesError{Problems: problems}).Error(), http.StatusBadRequest)
+		return
+	}
+	diff := diffRules(current, request.Rules)
+	if len(diff) == 0 {
+		http.Error(w, "Proposal does not change the rules", http.StatusBadRequest)
+		return
+	}
+
+	sample, err := tenantSample(r.Context(), tenant)
+	if err != nil {
+		if !writeContextError(w, err) {
+			http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		}
+		return
+	}
+	impact, err := simulateRules(r.Context(), current, request.Rules, sample)
+	if err != nil {
+		writeContextError(w, err)
+		return
+	}
+
+	proposal := &RulesProposal{
+		ID:          uuid.New().String(),
+		Tenant:      tenant,
+		Status:      proposalPending,
+		Comment:     request.Comment,
+		Rules:       request.Rules,
+		BaseVersion: version,
+		Diff:        diff,
+		Impact:      impact,
+		CreatedAt:   clockFrom(r.Context()).Now(),
+	}
+	proposalsMutex.Lock()
+	pending := 0
+	for _, other := range proposals {
+		if other.Tenant == tenant && other.Status == proposalPending {
+			pending++
+		}
+	}
+	if pending >= maxPendingProposals {
+		proposalsMutex.Unlock()
+		http.Error(w, "Too many pending proposals", http.StatusConflict)
+		return
+	}
+	proposals[proposal.ID] = proposal
+	if err := saveProposals(); err != nil {
+		delete(proposals, proposal.ID)
+		proposalsMutex.Unlock()
+		log.Printf("tenant rules: saving: %v", err)
+		http.Error(w, "Failed to save proposal", http.StatusInternalServerError)
+		return
+	}
+	response := *proposal
+	proposalsMutex.Unlock()
+	writeJSONStatus(w, r, http.StatusCreated, response)
+}
+
+// tenantProposalHandler returns (GET) or withdraws (DELETE) one of the
+// tenant's proposals at /tenant/rules/proposals/{id}. Only pending proposals
+// can be withdrawn.
+func tenantProposalHandler(w http.ResponseWriter, r *http.Request, tenant string) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/tenant/rules/proposals/"), "/")
+	proposalsMutex.Lock()
+	defer proposalsMutex.Unlock()
+	proposal, ok := proposals[id]
+	if !ok || proposal.Tenant != tenant {
+		http.Error(w, "Proposal not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		if proposal.Status != proposalPending {
+			http.Error(w, "Proposal is already "+proposal.Status, http.StatusConflict)
+			return
+		}
+		now := clockFrom(r.Context()).Now()
+		proposal.Status, proposal.DecidedAt = proposalWithdrawn, &now
+		if err := saveProposals(); err != nil {
+			proposal.Status, proposal.DecidedAt = proposalPending, nil
+			log.Printf("tenant rules: saving: %v", err)
+			http.Error(w, "Failed to save proposal", http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, r, *proposal)
+}
+
+// listRulesProposals lists every tenant's proposals for platform admins,
+// optionally filtered by ?status= and ?tenant=.
+func listRulesProposals(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	status, tenant := r.URL.Query().Get("status"), r.URL.Query().Get("tenant")
+	writeJSON(w, r, sortedProposals(func(p *RulesProposal) bool {
+		return (status == "" || p.Status == status) && (tenant == "" || p.Tenant == tenant)
+	}))
+}
+
+// rulesProposalRoutes handles /admin/rules/proposals/{id}: GET returns the
+// proposal, and POST .../approve and .../reject decide a pending one.
+// Approval activates the rules for the tenant's new receipts; it is refused
+// if the tenant's rules have changed since the proposal was made, since its
+// diff and impact would no longer hold. A rejection may give a reason as
+// { "reason": "..." }.
+func rulesProposalRoutes(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/rules/proposals/"), "/"), "/")
+	switch {
+	case action == "" && r.Method != http.MethodGet,
+		action != "" && r.Method != http.MethodPost:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	case action != "" && action != "approve" && action != "reject":
+		http.NotFound(w, r)
+		return
+	}
+
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if action == "reject" && r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid rejection", http.StatusBadRequest)
+			return
+		}
+	}
+
+	proposalsMutex.Lock()
+	defer proposalsMutex.Unlock()
+	proposal, ok := proposals[id]
+	if !ok {
+		http.Error(w, "Proposal not found", http.StatusNotFound)
+		return
+	}
+	if action != "" && proposal.Status != proposalPending {
+		http.Error(w, "Proposal is already "+proposal.Status, http.StatusConflict)
+		return
+	}
+
+	now := clockFrom(r.Context()).Now()
+	switch action {
+	case "approve":
+		if _, version := tenantRuleSet(proposal.Tenant); version != proposal.BaseVersion {
+			http.Error(w, "The tenant's rules have changed since the proposal was made", http.StatusConflict)
+			return
+		}
+		proposal.Status, proposal.DecidedAt = proposalApproved, &now
+		if err := setTenantRules(proposal.Tenant, proposal.Rules); err != nil {
+			proposal.Status, proposal.DecidedAt = proposalPending, nil
+			var invalid *InvalidRulesError
+			if errors.As(err, &invalid) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			log.Printf("tenant rules: saving: %v", err)
+			http.Error(w, "Failed to save tenant rules", http.StatusInternalServerError)
+			return
+		}
+	case "reject":
+		proposal.Status, proposal.DecidedAt, proposal.Reason = proposalRejected, &now, request.Reason
+		if err := saveProposals(); err != nil {
+			proposal.Status, proposal.DecidedAt, proposal.Reason = proposalPending, nil, ""
+			log.Printf("tenant rules: saving: %v", err)
+			http.Error(w, "Failed to save proposal", http.StatusInternalServerError)
+			return
+		}
+	}
+	writeJSON(w, r, *proposal)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// throttleSmoothing weights each new observation in the moving averages.
+	throttleSmoothing = 0.2
+	// throttleErrorRate is the storage error rate above which imports back off.
+	throttleErrorRate = 0.05
+	// throttleMinDelay is the first step when backing off from full speed.
+	throttleMinDelay = 10 * time.Millisecond
+)
+
+// importThrottle paces bulk imports by the health of the storage backend.
+// While storage latency stays under target and errors are rare, imports run
+// at full speed; otherwise the pause before each imported receipt doubles,
+// up to maxDelay, and halves again once storage recovers.
+type importThrottle struct {
+	mu        sync.Mutex
+	target    time.Duration
+	maxDelay  time.Duration
+	latencyMs float64
+	errorRate float64
+	delay     time.Duration
+}
+
+// ThrottleStatus reports the import throttle's view of storage.
+type ThrottleStatus struct {
+	Enabled          bool    `json:"enabled"`
+	TargetMs         float64 `json:"targetMs"`
+	StoreLatencyMs   float64 `json:"storeLatencyMs"`
+	StoreErrorRate   float64 `json:"storeErrorRate"`
+	ImportDelayMs    float64 `json:"importDelayMs"`
+	MaxImportDelayMs float64 `json:"maxImportDelayMs"`
+}
+
+// throttle is nil when BULK_THROTTLE_TARGET_MS is 0.
+var throttle *importThrottle
+
+// loadThrottleConfig reads BULK_THROTTLE_TARGET_MS (default 50; 0 disables
+// throttling) and BULK_THROTTLE_MAX_DELAY_MS (default 5000), and starts
+// observing the storage backend.
+func loadThrottleConfig() error {
+	t := &importThrottle{target: 50 * time.Millisecond, maxDelay: 5 * time.Second}
+	for _, setting := range []struct {
+		name   string
+		target *time.Duration
+	}{
+		{"BULK_THROTTLE_TARGET_MS", &t.target},
+		{"BULK_THROTTLE_MAX_DELAY_MS", &t.maxDelay},
+	} {
+		value := os.Getenv(setting.name)
+		if value == "" {
+			continue
+		}
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms < 0 {
+			return fmt.Errorf("%s: invalid value %q", setting.name, value)
+		}
+		*setting.target = time.Duration(ms) * time.Millisecond
+	}
+	if t.target == 0 {
+		return nil
+	}
+	throttle = t
+	receiptStore = &observedStore{ReceiptStore: receiptStore, throttle: t}
+	return nil
+}
+
+// observe folds one storage call into the moving averages.
+func (t *importThrottle) observe(d time.Duration, failed bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.latencyMs += throttleSmoothing * (float64(d.Microseconds())/1000 - t.latencyMs)
+	errorSample := 0.0
+	if failed {
+		errorSample = 1
+	}
+	t.errorRate += throttleSmoothing * (errorSample - t.errorRate)
+}
+
+// pace adjusts the import delay to the current storage health and waits
+// it out, returning early if ctx is done.
+func (t *importThrottle) pace(ctx context.Context) error {
+	t.mu.Lock()
+	previous := t.delay
+	if t.latencyMs > float64(t.target.Microseconds())/1000 || t.errorRate > throttleErrorRate {
+		t.delay *= 2
+		if t.delay < throttleMinDelay {
+			t.delay = throttleMinDelay
+		}
+		if t.delay > t.maxDelay {
+			t.delay = t.maxDelay
+		}
+	} else {
+		t.delay /= 2
+		if t.delay < throttleMinDelay/2 {
+			t.delay = 0
+		}
+	}
+	delay := t.delay
+	t.mu.Unlock()
+
+	if (previous == 0) != (delay == 0) {
+		if delay > 0 {
+			log.Printf("throttle: storage under strain, slowing bulk imports")
+		} else {
+			log.Printf("throttle: storage recovered, bulk imports at full speed")
+		}
+	}
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// status snapshots the throttle.
+func (t *importThrottle) status() ThrottleStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return ThrottleStatus{
+		Enabled:          true,
+		TargetMs:         float64(t.target.Microseconds()) / 1000,
+		StoreLatencyMs:   t.latencyMs,
+		StoreErrorRate:   t.errorRate,
+		ImportDelayMs:    float64(t.delay.Microseconds()) / 1000,
+		MaxImportDelayMs: float64(t.maxDelay.Microseconds()) / 1000,
+	}
+}
+
+// paceBulkImport waits as long as the throttle asks before the next
+// imported receipt.
+func paceBulkImport(ctx context.Context) error {
+	if throttle == nil {
+		return nil
+	}
+	return throttle.pace(ctx)
+}
+
+// observedStore times the storage calls every submission makes and reports
+// them to the import throttle. Missing receipts and canceled requests are
+// not counted as failures.
+type observedStore struct {
+	ReceiptStore
+	throttle *importThrottle
+}
+
+// record reports one call that started at started.
+func (s *observedStore) record(started time.Time, err error) {
+	failed := err != nil && err != errReceiptNotFound && !errors.Is(err, context.Canceled)
+	s.throttle.observe(time.Since(started), failed)
+}
+
+func (s *observedStore) Put(ctx context.Context, id string, stored StoredReceipt) error {
+	started := time.Now()
+	err := s.ReceiptStore.Put(ctx, id, stored)
+	s.record(started, err)
+	return err
+}
+
+func (s *observedStore) Get(ctx context.Context, id string) (StoredReceipt, error) {
+	started := time.Now()
+	stored, err := s.ReceiptStore.Get(ctx, id)
+	s.record(started, err)
+	return stored, err
+}
+
+func (s *observedStore) FindByContentHash(ctx context.Context, tenant, hash string) (string, error) {
+	started := time.Now()
+	id, err := s.ReceiptStore.FindByContentHash(ctx, tenant, hash)
+	s.record(started, err)
+	return id, err
+}
+
+// getThrottle reports storage health as seen by the import throttle and
+// the current pause between imported receipts.
+func getThrottle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if throttle == nil {
+		writeJSON(w, r, ThrottleStatus{})
+		return
+	}
+	writeJSON(w, r, throttle.status())
+}
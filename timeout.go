@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds how long a request may run. Handlers pass the
+// request context to storage and outbound calls, which give up once it
+// expires or the client disconnects. Zero disables the timeout.
+var requestTimeout = 30 * time.Second
+
+var (
+	// routeTimeouts override requestTimeout per route.
+	routeTimeouts = make(map[string]time.Duration)
+	// bodyTimeout bounds how long reading a request's body may take, so slow
+	// clients cannot hold handlers open. Zero leaves reads unbounded.
+	bodyTimeout time.Duration
+	// routeBodyTimeouts override bodyTimeout per route.
+	routeBodyTimeouts = make(map[string]time.Duration)
+)
+
+// loadTimeoutConfig reads REQUEST_TIMEOUT_SECONDS, BODY_TIMEOUT_SECONDS and
+// their per-route overrides ROUTE_TIMEOUTS and ROUTE_BODY_TIMEOUTS.
+func loadTimeoutConfig() error {
+	for name, timeout := range map[string]*time.Duration{"REQUEST_TIMEOUT_SECONDS": &requestTimeout, "BODY_TIMEOUT_SECONDS": &bodyTimeout} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("%s: invalid value %q", name, value)
+		}
+		*timeout = time.Duration(seconds) * time.Second
+	}
+	if err := parseRouteTimeouts("ROUTE_TIMEOUTS", routeTimeouts); err != nil {
+		return err
+	}
+	return parseRouteTimeouts("ROUTE_BODY_TIMEOUTS", routeBodyTimeouts)
+}
+
+// parseRouteTimeouts reads comma-separated route=seconds entries. Routes
+// are written as the metrics label them, with or without the method, e.g.
+// "POST /receipts/process/batch=120,GET /receipts/{id}/points=2".
+func parseRouteTimeouts(name string, timeouts map[string]time.Duration) error {
+	for _, pair := range strings.Split(os.Getenv(name), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		route, value, ok := strings.Cut(pair, "=")
+		seconds, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || seconds < 0 || strings.TrimSpace(route) == "" {
+			return fmt.Errorf("%s: malformed entry %q", name, pair)
+		}
+		timeouts[strings.TrimSpace(route)] = time.Duration(seconds) * time.Second
+	}
+	return nil
+}
+
+// timeoutFor returns the override for a request's route, trying the route
+// with its method before the path alone, or fallback.
+func timeoutFor(r *http.Request, timeouts map[string]time.Duration, fallback time.Duration) time.Duration {
+	if len(timeouts) == 0 {
+		return fallback
+	}
+	route := routeLabel(r)
+	if timeout, ok := timeouts[route]; ok {
+		return timeout
+	}
+	if timeout, ok := timeouts[strings.TrimPrefix(route, r.Method+" ")]; ok {
+		return timeout
+	}
+	return fallback
+}
+
+// handlerTimeout returns how long a request's handler may run. Zero means no
+// limit.
+func handlerTimeout(r *http.Request) time.Duration {
+	return timeoutFor(r, routeTimeouts, requestTimeout)
+}
+
+// streamingRoutes run for as long as the client keeps sending, so they are
+// bounded by neither their handler nor their body timeout; they apply the
+// handler timeout to each unit of work instead.
+var streamingRoutes = map[string]bool{"/receipts/process/stream": true}
+
+// withTimeout gives each request a context that is cancelled after its
+// route's handler timeout, and a deadline for reading its body.
+func withTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if streamingRoutes[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if timeout := timeoutFor(r, routeBodyTimeouts, bodyTimeout); timeout > 0 && r.Body != nil && r.Body != http.NoBody {
+			// Reads past the deadline fail, and handlers answer 400 as for
+			// any unreadable body. Writers that cannot set deadlines are
+			// left unbounded.
+			controller := http.NewResponseController(w)
+			if controller.SetReadDeadline(time.Now().Add(timeout)) == nil {
+				r.Body = &deadlineBody{ReadCloser: r.Body, controller: controller}
+			}
+		}
+		timeout := handlerTimeout(r)
+		if timeout <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// deadlineBody clears the connection's read deadline once the body has been
+// read. The server keeps reading the connection afterwards to notice clients
+// going away, and that read must not time out while the handler runs.
+type deadlineBody struct {
+	io.ReadCloser
+	controller *http.ResponseController
+}
+
+func (b *deadlineBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.controller.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
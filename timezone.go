@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// rulesLocation is the zone purchase times are recorded in when neither
+	// the receipt nor its retailer names one, and the zone of the service's
+	// own dates.
+	rulesLocation = time.Local
+	// retailerLocations maps a retailer name to its default time zone.
+	retailerLocations = make(map[string]*time.Location)
+	// receiptLocations caches zones by name, since every rule that reads the
+	// purchase time resolves the receipt's zone again.
+	receiptLocations sync.Map
+)
+
+// loadTimezoneConfig reads RULES_TIMEZONE and RETAILER_TIMEZONES from the
+// environment. RETAILER_TIMEZONES is a comma-separated list of
+// "Retailer=Zone" pairs, e.g. "Target=America/Chicago,Walgreens=America/New_York".
+func loadTimezoneConfig() error {
+	if name := os.Getenv("RULES_TIMEZONE"); name != "" {
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			return fmt.Errorf("RULES_TIMEZONE: %w", err)
+		}
+		rulesLocation = loc
+	}
+
+	for _, pair := range strings.Split(os.Getenv("RETAILER_TIMEZONES"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		retailer, zone, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("RETAILER_TIMEZONES: malformed entry %q", pair)
+		}
+		loc, err := time.LoadLocation(strings.TrimSpace(zone))
+		if err != nil {
+			return fmt.Errorf("RETAILER_TIMEZONES: %w", err)
+		}
+		retailerLocations[strings.TrimSpace(retailer)] = loc
+	}
+	return nil
+}
+
+// receiptLocation resolves the zone a receipt's purchase time was recorded in:
+// the receipt's own timezone, then the retailer default, then the rules zone.
+func receiptLocation(receipt Receipt) (*time.Location, error) {
+	if receipt.Timezone != "" {
+		if loc, ok := receiptLocations.Load(receipt.Timezone); ok {
+			return loc.(*time.Location), nil
+		}
+		loc, err := time.LoadLocation(receipt.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		receiptLocations.Store(receipt.Timezone, loc)
+		return loc, nil
+	}
+	if loc, ok := retailerLocations[receipt.StoreName]; ok {
+		return loc, nil
+	}
+	return rulesLocation, nil
+}
+
+// localPurchaseTime returns the purchase timestamp in the zone it was
+// recorded in, so that time-of-day and day rules see the wall-clock time
+// printed on the receipt.
+func localPurchaseTime(receipt Receipt) (time.Time, error) {
+	loc, err := receiptLocation(receipt)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := time.ParseInLocation("2006-01-02 15:04", receipt.DateOfPurchase+" "+receipt.TimeOfPurchase, loc)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t, nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Upload statuses reported by GET /uploads/{id}.
+const (
+	uploadPending    = "pending"
+	uploadProcessing = "processing"
+	uploadParsed     = "parsed"
+	uploadFailed     = "failed"
+)
+
+// uploadURLTTL is how long a signed upload URL may be used.
+const uploadURLTTL = 15 * time.Minute
+
+// ocrTimeout bounds how long OCR may run on one upload.
+const ocrTimeout = 2 * time.Minute
+
+// uploadRetention is how long a processed upload's result stays available.
+// Uploads never received are dropped when their URL expires.
+const uploadRetention = time.Hour
+
+// uploadSweepInterval is how often expired uploads are dropped.
+const uploadSweepInterval = time.Minute
+
+// Upload tracks an image uploaded through a signed URL and the receipt
+// extracted from it by OCR.
+type Upload struct {
+	ID        string    `json:"id"`
+	Retailer  string    `json:"retailer,omitempty"`
+	Status    string    `json:"status"`
+	UploadURL string    `json:"uploadUrl,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+	Receipt   *Receipt  `json:"receipt,omitempty"`
+	Warnings  []string  `json:"warnings,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	// Timing is set once the image has been received and queued for OCR.
+	Timing *JobTiming `json:"timing,omitempty"`
+	// finishedAt is when processing ended, for expiry.
+	finishedAt time.Time
+}
+
+// OCRProvider extracts raw text from a receipt image.
+type OCRProvider interface {
+	ExtractText(ctx context.Context, image []byte) (string, error)
+}
+
+// commandOCR runs an external OCR command that reads the image on stdin and
+// writes the recognized text to stdout, e.g. "tesseract stdin stdout".
+type commandOCR struct {
+	args []string
+}
+
+// ExtractText implements OCRProvider.
+func (c commandOCR) ExtractText(ctx context.Context, image []byte) (string, error) {
+	cmd := exec.CommandContext(ctx, c.args[0], c.args[1:]...)
+	cmd.Stdin = bytes.NewReader(image)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.New(strings.TrimSpace(err.Error() + ": " + stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+var (
+	// ocrProvider extracts text from uploaded images. Uploads cannot be
+	// processed while it is nil.
+	ocrProvider OCRProvider
+	// ocrSlots bounds the uploads processed at once; an upload holds a slot
+	// from when its image is accepted until it finishes.
+	ocrSlots    chan struct{}
+	uploadMutex sync.Mutex
+	uploads     = make(map[string]*Upload)
+)
+
+// loadOCRConfig configures the OCR provider from OCR_COMMAND and how many
+// uploads it may process at once from OCR_CONCURRENCY (default the number
+// of CPUs).
+func loadOCRConfig() error {
+	if command := strings.Fields(os.Getenv("OCR_COMMAND")); len(command) > 0 {
+		ocrProvider = commandOCR{args: command}
+	}
+	concurrency := runtime.NumCPU()
+	if value := os.Getenv("OCR_CONCURRENCY"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("OCR_CONCURRENCY: invalid value %q", value)
+		}
+		concurrency = n
+	}
+	ocrSlots = make(chan struct{}, concurrency)
+	return nil
+}
+
+// uploadKey is the blob key an upload's image is written to.
+func uploadKey(id string) string {
+	return "uploads/" + id
+}
+
+// createUpload issues a short-lived signed URL the client can PUT a receipt
+// image to directly.
+func createUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request struct {
+		Retailer string `json:"retailer"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+			http.Error(w, "Invalid upload request", http.StatusBadRequest)
+			return
+		}
+	}
+
+	id := uuid.New().String()
+	expires := time.Now().Add(uploadURLTTL)
+	upload := &Upload{
+		ID:        id,
+		Retailer:  request.Retailer,
+		Status:    uploadPending,
+		UploadURL: signBlobURL(http.MethodPut, uploadKey(id), expires),
+		ExpiresAt: expires,
+	}
+	uploadMutex.Lock()
+	uploads[id] = upload
+	response := *upload
+	uploadMutex.Unlock()
+
+	writeJSONStatus(w, r, http.StatusCreated, response)
+}
+
+// getUpload reports an upload's processing status and extracted receipt.
+func getUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	uploadMutex.Lock()
+	upload, exists := uploads[id]
+	var response Upload
+	if exists {
+		response = *upload
+		response.UploadURL = ""
+		if upload.Timing != nil {
+			timing := *upload.Timing
+			response.Timing = &timing
+		}
+	}
+	uploadMutex.Unlock()
+	if !exists {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, r, response)
+}
+
+// putBlob accepts an upload through a signed URL and starts OCR on it.
+func putBlob(w http.ResponseWriter, r *http.Request) {
+	key, ok := verifyBlobRequest(w, r)
+	if !ok {
+		return
+	}
+	id := strings.TrimPrefix(key, "uploads/")
+
+	uploadMutex.Lock()
+	upload, exists := uploads[id]
+	accept := exists && upload.Status == uploadPending
+	busy := false
+	if accept {
+		select {
+		case ocrSlots <- struct{}{}:
+			upload.Status = uploadProcessing
+		default:
+			accept, busy = false, true
+		}
+	}
+	uploadMutex.Unlock()
+	switch {
+	case !exists:
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	case busy:
+		// The upload stays pending, so the client may retry the same URL.
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "Too many uploads being processed, retry later", http.StatusServiceUnavailable)
+		return
+	case !accept:
+		http.Error(w, "Upload already received", http.StatusConflict)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImageBytes))
+	if err == nil {
+		err = blobStore.Put(key, data)
+	}
+	if err != nil {
+		finishUpload(id, nil, err)
+		http.Error(w, "Failed to store upload", http.StatusBadRequest)
+		return
+	}
+
+	uploadMutex.Lock()
+	upload.Timing = newJobTiming(time.Now())
+	uploadMutex.Unlock()
+	go processUpload(id, data)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// processUpload runs OCR on an uploaded image and parses the result into a
+// receipt for the client to confirm.
+func processUpload(id string, image []byte) {
+	if ocrProvider == nil {
+		finishUpload(id, nil, errors.New("OCR is not configured"))
+		return
+	}
+	uploadMutex.Lock()
+	uploads[id].Timing.start(time.Now())
+	uploadMutex.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), ocrTimeout)
+	defer cancel()
+	text, err := ocrProvider.ExtractText(ctx, image)
+	if err != nil {
+		finishUpload(id, nil, err)
+		return
+	}
+
+	uploadMutex.Lock()
+	retailer := uploads[id].Retailer
+	uploadMutex.Unlock()
+	parsed := parseReceiptText(retailer, text)
+	finishUpload(id, &parsed, nil)
+}
+
+// finishUpload records the outcome of processing an upload and frees its
+// OCR slot.
+func finishUpload(id string, parsed *ParseResponse, err error) {
+	<-ocrSlots
+	uploadMutex.Lock()
+	defer uploadMutex.Unlock()
+	upload := uploads[id]
+	upload.finishedAt = time.Now()
+	if upload.Timing != nil {
+		upload.Timing.finish(jobUpload, time.Now())
+	}
+	if err != nil {
+		upload.Status = uploadFailed
+		upload.Error = err.Error()
+		return
+	}
+	upload.Status = uploadParsed
+	upload.Receipt = &parsed.Receipt
+	upload.Warnings = parsed.Warnings
+}
+
+// expireUploads drops uploads whose URL expired before an image was received,
+// and processed uploads older than uploadRetention, with their images.
+func expireUploads(now time.Time) {
+	uploadMutex.Lock()
+	var expired []string
+	for id, upload := range uploads {
+		switch upload.Status {
+		case uploadPending:
+			if now.Before(upload.ExpiresAt) {
+				continue
+			}
+		case uploadParsed, uploadFailed:
+			if now.Before(upload.finishedAt.Add(uploadRetention)) {
+				continue
+			}
+		default:
+			continue
+		}
+		delete(uploads, id)
+		expired = append(expired, id)
+	}
+	uploadMutex.Unlock()
+
+	for _, id := range expired {
+		if err := blobStore.Delete(uploadKey(id)); err != nil {
+			log.Printf("uploads: deleting image of upload %s: %v", id, err)
+		}
+	}
+}
+
+// watchUploads expires uploads every uploadSweepInterval.
+func watchUploads() {
+	for {
+		time.Sleep(uploadSweepInterval)
+		expireUploads(time.Now())
+	}
+}
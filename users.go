@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// PointsProjection is a forward-looking view of a user's points balance.
+type PointsProjection struct {
+	UserID string `json:"userId"`
+	// PostedPoints have been credited.
+	PostedPoints int `json:"postedPoints"`
+	// PendingPoints will post once held receipts are released.
+	PendingPoints   int `json:"pendingPoints"`
+	PendingReceipts int `json:"pendingReceipts"`
+	// ExpiringPoints are scheduled to lapse.
+	ExpiringPoints int `json:"expiringPoints"`
+	// ProjectedBalance is posted plus pending minus expiring points.
+	ProjectedBalance int `json:"projectedBalance"`
+}
+
+// userPath splits a /users/{id}/... path into its segments.
+func userPath(r *http.Request) []string {
+	return strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/users/"), "/"), "/")
+}
+
+// userRoutes dispatches /users/{id}/... requests to their handlers, once the
+// request is authorized to read the user's data. User IDs are scoped to a
+// tenant, so the handlers only read the data of the authorized tenant's
+// user.
+func userRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := userPath(r)
+	tenant, ok := authorizeUser(w, r, parts[0])
+	if !ok {
+		return
+	}
+	switch {
+	case len(parts) == 2 && parts[1] == "receipts":
+		listUserReceipts(w, r, tenant)
+	case len(parts) == 3 && parts[1] == "points" && parts[2] == "projection":
+		getPointsProjection(w, r, tenant)
+	case len(parts) == 3 && parts[1] == "points" && parts[2] == "expiring":
+		getExpiringPoints(w, r, tenant)
+	case len(parts) == 2 && parts[1] == "favorites":
+		getFavorites(w, r, tenant)
+	case len(parts) == 2 && parts[1] == "ledger":
+		getLedger(w, r, tenant)
+	case len(parts) == 2 && parts[1] == "balance":
+		getUserBalance(w, r, tenant)
+	case len(parts) == 2 && parts[1] == "transactions":
+		getUserTransactions(w, r, tenant)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// projectPoints sums a tenant user's posted and pending points and the posted
+// points due to expire within the notice period. Expired points are left
+// out.
+func projectPoints(ctx context.Context, tenant, userID string) (PointsProjection, error) {
+	projection := PointsProjection{UserID: userID}
+	now := clockFrom(ctx).Now()
+	err := receiptStore.Range(ctx, func(id string, stored StoredReceipt) bool {
+		if stored.UserID != userID || stored.Tenant != tenant {
+			return true
+		}
+		expiresAt, expires := pointsExpireAt(stored)
+		if expires && !expiresAt.After(now) {
+			return true
+		}
+		points := netPoints(stored)
+		if onHold(stored) {
+			projection.PendingPoints += points
+			projection.PendingReceipts++
+		} else {
+			projection.PostedPoints += points
+			if expires && !expiresAt.After(now.Add(expiryNotice)) {
+				projection.ExpiringPoints += points
+			}
+		}
+		return true
+	})
+	projection.ProjectedBalance = projection.PostedPoints + projection.PendingPoints - projection.ExpiringPoints
+	return projection, err
+}
+
+// getPointsProjection estimates a user's balance once pending receipts clear,
+// now or as of the time given by asOf.
+func getPointsProjection(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r, ok := asOf(w, r)
+	if !ok {
+		return
+	}
+	userID := userPath(r)[0]
+	if !tenantPattern.MatchString(userID) {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+	projection, err := projectPoints(r.Context(), tenant, userID)
+	if err != nil {
+		if !writeContextError(w, err) {
+			http.Error(w, "Failed to read receipts", http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, r, projection)
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+)
+
+// Validation modes.
+const (
+	// validationStandard decodes receipts as the service always has.
+	validationStandard = "standard"
+	// validationStrict enforces the API spec's formats, requires the total
+	// to equal the sum of item prices and rejects unknown fields.
+	validationStrict = "strict"
+	// validationLenient coerces what it can into shape and reports each
+	// change as a warning.
+	validationLenient = "lenient"
+)
+
+// Field formats from the API spec, enforced in strict mode.
+var (
+	specRetailer    = regexp.MustCompile(`^[\w\s\-&]+$`)
+	specDescription = regexp.MustCompile(`^[\w\s\-]+$`)
+	specAmount      = regexp.MustCompile(`^\d+\.\d{2}$`)
+)
+
+// lenientDateLayouts and lenientTimeLayouts are the purchase date and time
+// formats lenient mode understands, the spec's own first.
+var (
+	lenientDateLayouts = []string{"2006-01-02", "2006/01/02", "01/02/2006", "2006-1-2", "Jan 2, 2006", "January 2, 2006"}
+	lenientTimeLayouts = []string{"15:04", "15:04:05", "3:04 PM", "3:04PM", "3:04 pm", "3:04pm", "15.04"}
+)
+
+// ValidationModeRequest sets a tenant's validation mode.
+type ValidationModeRequest struct {
+	Mode string `json:"mode"`
+}
+
+var (
+	validationMutex sync.Mutex
+	// defaultValidation applies to tenants without a mode of their own.
+	defaultValidation = validationStandard
+	tenantValidation  = make(map[string]string)
+)
+
+// validValidationMode reports whether mode is a known validation mode.
+func validValidationMode(mode string) bool {
+	return mode == validationStandard || mode == validationStrict || mode == validationLenient
+}
+
+// loadValidationConfig reads VALIDATION_MODE, the default mode, and
+// TENANT_VALIDATION ("acme=strict,globex=lenient").
+func loadValidationConfig() error {
+	if mode := os.Getenv("VALIDATION_MODE"); mode != "" {
+		if !validValidationMode(mode) {
+			return fmt.Errorf("VALIDATION_MODE: unknown mode %q", mode)
+		}
+		defaultValidation = mode
+	}
+	for _, pair := range strings.Split(os.Getenv("TENANT_VALIDATION"), ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		tenant, mode, ok := strings.Cut(pair, "=")
+		tenant, mode = strings.TrimSpace(tenant), strings.TrimSpace(mode)
+		if !ok || !tenantPattern.MatchString(tenant) || !validValidationMode(mode) {
+			return fmt.Errorf("TENANT_VALIDATION: malformed entry %q", pair)
+		}
+		tenantValidation[tenant] = mode
+	}
+	return nil
+}
+
+// validationMode returns the mode a tenant's receipts are validated in.
+func validationMode(tenant string) string {
+	validationMutex.Lock()
+	defer validationMutex.Unlock()
+	if mode, ok := tenantValidation[tenant]; ok {
+		return mode
+	}
+	return defaultValidation
+}
+
+// validationError lists every problem strict mode or the tenant's custom
+// field definitions found with a receipt.
+type validationError struct {
+	problems []string
+}
+
+func (e *validationError) Error() string {
+	return "Invalid receipt: " + strings.Join(e.problems, "; ")
+}
+
+// decodeReceipt decodes a submitted receipt in the given validation mode.
+// Lenient mode returns a warning for each value it changed.
+func decodeReceipt(body []byte, mode string) (Receipt, []string, error) {
+	var receipt Receipt
+	switch mode {
+	case validationStrict:
+		if err := checkStrictFields(body); err != nil {
+			return receipt, nil, err
+		}
+		if err := json.Unmarshal(body, &receipt); err != nil {
+			return receipt, nil, err
+		}
+		return receipt, nil, checkStrictReceipt(receipt)
+	case validationLenient:
+		normalized, warnings, err := coerceReceipt(body)
+		if err != nil {
+			return receipt, nil, err
+		}
+		err = json.Unmarshal(normalized, &receipt)
+		return receipt, warnings, err
+	default:
+		err := json.Unmarshal(body, &receipt)
+		return receipt, nil, err
+	}
+}
+
+// jsonFields returns the JSON field names of a struct type.
+func jsonFields(t reflect.Type) map[string]bool {
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+var (
+	receiptFields = jsonFields(reflect.TypeOf(Receipt{}))
+	itemFields    = jsonFields(reflect.TypeOf(Item{}))
+)
+
+// checkStrictFields rejects unknown fields and amounts not sent as strings.
+func checkStrictFields(body []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return err
+	}
+	var items []map[string]json.RawMessage
+	if value, ok := raw["items"]; ok {
+		if err := json.Unmarshal(value, &items); err != nil {
+			return err
+		}
+	}
+
+	var problems []string
+	check := func(prefix string, object map[string]json.RawMessage, known map[string]bool, amount string) {
+		for _, name := range rawKeys(object) {
+			if !known[name] {
+				problems = append(problems, fmt.Sprintf("%sunknown field %q", prefix, name))
+			}
+		}
+		if value, ok := object[amount]; ok && !bytes.HasPrefix(bytes.TrimSpace(value), []byte(`"`)) {
+			problems = append(problems, prefix+amount+" must be a string")
+		}
+	}
+	check("", raw, receiptFields, "total")
+	for i, item := range items {
+		check(fmt.Sprintf("items[%d]: ", i), item, itemFields, "price")
+	}
+	if len(problems) > 0 {
+		return &validationError{problems: problems}
+	}
+	return nil
+}
+
+// rawKeys returns a JSON object's keys in order, for stable error messages.
+func rawKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkStrictReceipt enforces the spec's formats and that the total equals
+// the sum of the item prices.
+func checkStrictReceipt(receipt Receipt) error {
+	var problems []string
+	if !specRetailer.MatchString(receipt.StoreName) {
+		problems = append(problems, "retailer must match "+specRetailer.String())
+	}
+	if _, err := time.Parse("2006-01-02", receipt.DateOfPurchase); err != nil {
+		problems = append(problems, "purchaseDate must be YYYY-MM-DD")
+	}
+	if _, err := time.Parse("15:04", receipt.TimeOfPurchase); err != nil {
+		problems = append(problems, "purchaseTime must be HH:MM (24-hour)")
+	}
+	if !specAmount.MatchString(receipt.TotalAmount) {
+		problems = append(problems, "total must match "+specAmount.String())
+	}
+	if len(receipt.PurchasedItems) == 0 {
+		problems = append(problems, "items must not be empty")
+	}
+	var sum int64
+	pricesValid := true
+	for i, item := range receipt.PurchasedItems {
+		if !specDescription.MatchString(item.Description) {
+			problems = append(problems, fmt.Sprintf("items[%d]: shortDescription must match %s", i, specDescription.String()))
+		}
+		if !specAmount.MatchString(item.Price) {
+			problems = append(problems, fmt.Sprintf("items[%d]: price must match %s", i, specAmount.String()))
+			pricesValid = false
+			continue
+		}
+		cents, _ := scoring.ParseCents(item.Price)
+		sum += cents
+	}
+	if total, err := scoring.ParseCents(receipt.TotalAmount); err == nil && pricesValid && total != sum {
+		problems = append(problems, fmt.Sprintf("total %s does not equal the sum of item prices %s", receipt.TotalAmount, formatCents(sum)))
+	}
+	if len(problems) > 0 {
+		return &validationError{problems: problems}
+	}
+	return nil
+}
+
+// coerceReceipt rewrites a receipt's JSON into the spec's shape as far as it
+// can: unknown fields are dropped, text is trimmed, amounts are rounded to
+// cents and dates and times are reformatted. A missing total is filled in
+// from the items.
+func coerceReceipt(body []byte) ([]byte, []string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var raw map[string]interface{}
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, nil, err
+	}
+
+	var warnings []string
+	warn := func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}
+	dropUnknown := func(prefix string, object map[string]interface{}, known map[string]bool) {
+		for _, name := range sortedFields(object) {
+			if !known[name] {
+				delete(object, name)
+				warn("%signored unknown field %q", prefix, name)
+			}
+		}
+	}
+	text := func(prefix string, object map[string]interface{}, name string) {
+		value, ok := object[name]
+		if !ok || value == nil {
+			return
+		}
+		s := strings.Join(strings.Fields(fmt.Sprint(value)), " ")
+		if _, isString := value.(string); !isString || s != value {
+			warn("%s%s normalized to %q", prefix, name, s)
+		}
+		object[name] = s
+	}
+	amount := func(prefix string, object map[string]interface{}, name string) (int64, bool) {
+		value, ok := object[name]
+		if !ok || value == nil {
+			return 0, false
+		}
+		original := fmt.Sprint(value)
+		cleaned := strings.NewReplacer("$", "", ",", "", " ", "").Replace(original)
+		f, err := strconv.ParseFloat(cleaned, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			warn("%s%s %q is not an amount", prefix, name, original)
+			return 0, false
+		}
+		cents := int64(math.Round(f * 100))
+		formatted := formatCents(cents)
+		if _, isString := value.(string); !isString || formatted != original {
+			warn("%s%s %q normalized to %q", prefix, name, original, formatted)
+		}
+		object[name] = formatted
+		return cents, true
+	}
+	layout := func(name string, layouts []string, canonical string) {
+		value, ok := raw[name].(string)
+		if !ok {
+			return
+		}
+		value = strings.TrimSpace(value)
+		for _, layout := range layouts {
+			if t, err := time.Parse(layout, value); err == nil {
+				if formatted := t.Format(canonical); formatted != raw[name] {
+					warn("%s %q normalized to %q", name, raw[name], formatted)
+					raw[name] = formatted
+				}
+				return
+			}
+		}
+	}
+
+	dropUnknown("", raw, receiptFields)
+	text("", raw, "retailer")
+	layout("purchaseDate", lenientDateLayouts, "2006-01-02")
+	layout("purchaseTime", lenientTimeLayouts, "15:04")
+
+	var sum int64
+	pricesValid := true
+	items, _ := raw["items"].([]interface{})
+	for i, value := range items {
+		item, ok := value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		prefix := fmt.Sprintf("items[%d]: ", i)
+		dropUnknown(prefix, item, itemFields)
+		text(prefix, item, "shortDescription")
+		cents, ok := amount(prefix, item, "price")
+		pricesValid = pricesValid && ok
+		sum += cents
+	}
+
+	if total, ok := amount("", raw, "total"); ok {
+		if pricesValid && len(items) > 0 && total != sum {
+			warn("total %s does not equal the sum of item prices %s", formatCents(total), formatCents(sum))
+		}
+	} else if _, present := raw["total"]; !present && pricesValid && len(items) > 0 {
+		raw["total"] = formatCents(sum)
+		warn("total missing, set to the sum of item prices %s", formatCents(sum))
+	}
+
+	normalized, err := json.Marshal(raw)
+	return normalized, warnings, err
+}
+
+// sortedFields returns a JSON object's keys in order.
+func sortedFields(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validationHandler lists the default and per-tenant validation modes.
+func validationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	validationMutex.Lock()
+	response := struct {
+		Default string            `json:"default"`
+		Tenants map[string]string `json:"tenants"`
+	}{Default: defaultValidation, Tenants: make(map[string]string, len(tenantValidation))}
+	for tenant, mode := range tenantValidation {
+		response.Tenants[tenant] = mode
+	}
+	validationMutex.Unlock()
+	writeJSON(w, r, response)
+}
+
+// tenantValidationHandler sets (PUT) or clears (DELETE) a tenant's
+// validation mode at /admin/validation/{tenant}.
+func tenantValidationHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/validation/"), "/")
+	if !tenantPattern.MatchString(tenant) {
+		http.Error(w, "Invalid tenant ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var request ValidationModeRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || !validValidationMode(request.Mode) {
+			http.Error(w, "Mode must be standard, strict or lenient", http.StatusBadRequest)
+			return
+		}
+		validationMutex.Lock()
+		tenantValidation[tenant] = request.Mode
+		validationMutex.Unlock()
+		writeJSON(w, r, request)
+	case http.MethodDelete:
+		validationMutex.Lock()
+		delete(tenantValidation, tenant)
+		validationMutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeDecodeError reports a receipt that could not be decoded, listing the
+// problems when strict validation found them.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	var invalid *validationError
+	if errors.As(err, &invalid) {
+		http.Error(w, invalid.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, "Invalid receipt format. Please verify input.", http.StatusBadRequest)
+}
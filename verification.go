@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/PoojaMulaguri593/receipt-processor/scoring"
+	"github.com/google/uuid"
+)
+
+// Verification statuses recorded on stored receipts.
+const (
+	// verificationUnverified means no check was possible: the retailer has
+	// no verifier or the receipt carries no order number.
+	verificationUnverified = "unverified"
+	verificationVerified   = "verified"
+	// verificationRejected means the retailer does not recognize the order
+	// or its total does not match.
+	verificationRejected = "rejected"
+	// verificationError means the retailer API could not be reached.
+	verificationError = "error"
+)
+
+// errOrderNotFound is returned by verifiers when the retailer has no such order.
+var errOrderNotFound = errors.New("order not found")
+
+// ReceiptVerifier checks a receipt against the retailer's own records.
+type ReceiptVerifier interface {
+	// Verify returns nil when the retailer confirms the order,
+	// errOrderNotFound or another error describing a mismatch, or an
+	// *unreachableError when the retailer could not be asked.
+	Verify(ctx context.Context, receipt Receipt) error
+}
+
+// unreachableError wraps failures to contact a retailer API.
+type unreachableError struct {
+	err error
+}
+
+func (e *unreachableError) Error() string { return "retailer API unreachable: " + e.err.Error() }
+
+// verifierConfig is the on-disk form of a retailer's order API.
+type verifierConfig struct {
+	// URL is the order lookup endpoint; "{orderNumber}" is replaced with the
+	// receipt's order number.
+	URL   string `json:"url"`
+	Token string `json:"token"`
+	// Required zeroes points for receipts that could not be verified.
+	Required bool `json:"required"`
+}
+
+// httpVerifier looks orders up via a retailer's HTTP API. The API must
+// answer 200 with a JSON body containing the order "total", or 404.
+type httpVerifier struct {
+	config verifierConfig
+	client *http.Client
+}
+
+// Verify implements ReceiptVerifier.
+func (v *httpVerifier) Verify(ctx context.Context, receipt Receipt) error {
+	endpoint := strings.ReplaceAll(v.config.URL, "{orderNumber}", url.PathEscape(receipt.OrderNumber))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return &unreachableError{err}
+	}
+	if v.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+v.config.Token)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return &unreachableError{err}
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errOrderNotFound
+	case resp.StatusCode != http.StatusOK:
+		return &unreachableError{fmt.Errorf("status %d", resp.StatusCode)}
+	}
+	var order struct {
+		Total string `json:"total"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
+		return &unreachableError{err}
+	}
+	orderCents, err1 := scoring.ParseCents(order.Total)
+	receiptCents, err2 := scoring.ParseCents(receipt.TotalAmount)
+	if err1 != nil || err2 != nil || orderCents != receiptCents {
+		return fmt.Errorf("order total %s does not match receipt total %s", order.Total, receipt.TotalAmount)
+	}
+	return nil
+}
+
+var (
+	// retailerVerifiers holds the verifier for each retailer that has one.
+	retailerVerifiers = make(map[string]ReceiptVerifier)
+	// verificationRequired lists retailers whose unverified receipts earn nothing.
+	verificationRequired = make(map[string]bool)
+)
+
+// loadVerifierConfig reads retailer order APIs from the JSON object, keyed by
+// retailer, in the file named by RETAILER_VERIFIERS_FILE.
+func loadVerifierConfig() error {
+	path := os.Getenv("RETAILER_VERIFIERS_FILE")
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("RETAILER_VERIFIERS_FILE: %w", err)
+	}
+	var configs map[string]verifierConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return fmt.Errorf("RETAILER_VERIFIERS_FILE: %w", err)
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	for retailer, config := range configs {
+		if !strings.Contains(config.URL, "{orderNumber}") {
+			return fmt.Errorf("RETAILER_VERIFIERS_FILE: %s: url must contain {orderNumber}", retailer)
+		}
+		retailerVerifiers[retailer] = &httpVerifier{config: config, client: client}
+		verificationRequired[retailer] = config.Required
+	}
+	return nil
+}
+
+// verifyReceipt runs the retailer's verifier, if any, and returns the
+// resulting status and a human-readable detail.
+func verifyReceipt(ctx context.Context, receipt Receipt) (string, string) {
+	verifier, ok := retailerVerifiers[receipt.StoreName]
+	if !ok || receipt.OrderNumber == "" {
+		return verificationUnverified, ""
+	}
+	err := verifier.Verify(ctx, receipt)
+	var unreachable *unreachableError
+	switch {
+	case err == nil:
+		return verificationVerified, ""
+	case errors.As(err, &unreachable):
+		return verificationError, err.Error()
+	default:
+		return verificationRejected, err.Error()
+	}
+}
+
+// verificationGate returns a zero-point breakdown for receipts that must not
+// earn points because of their verification status, or nil otherwise.
+func verificationGate(stored StoredReceipt) []RuleResult {
+	switch {
+	case stored.Verification == verificationRejected:
+		return []RuleResult{{Rule: "retailerVerification", Reason: "retailer rejected the order: " + stored.VerificationDetail}}
+	case stored.Verification != verificationVerified && verificationRequired[stored.Receipt.StoreName]:
+		return []RuleResult{{Rule: "retailerVerification", Reason: "retailer verification is required but has not succeeded"}}
+	}
+	return nil
+}
+
+// VerificationResponse reports a receipt's verification status.
+type VerificationResponse struct {
+	ReceiptID string `json:"id"`
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+}
+
+// reverifyReceipt re-runs verification on a stored receipt, e.g. after the
+// retailer API was unreachable at submission time.
+func reverifyReceipt(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	receiptID := receiptIDFromPath(r)
+	stored, err := receiptStore.Get(r.Context(), receiptID)
+	if err == nil && stored.FinalizedAt != nil {
+		err = errReceiptFinalized
+	}
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+
+	// The retailer API is called before taking the store's lock.
+	status, detail := verifyReceipt(r.Context(), stored.Receipt)
+	response := VerificationResponse{ReceiptID: receiptID, Status: status, Detail: detail}
+	var previous, reverified StoredReceipt
+	err = receiptStore.Update(r.Context(), receiptID, func(stored *StoredReceipt) error {
+		if stored.FinalizedAt != nil {
+			return errReceiptFinalized
+		}
+		previous = *stored
+		stored.Verification, stored.VerificationDetail = status, detail
+		awardPoints(stored)
+		if stored.Points != previous.Points {
+			stored.Ledger = append(stored.Ledger, LedgerEntry{
+				ID:        uuid.New().String(),
+				Tenant:    stored.Tenant,
+				UserID:    stored.UserID,
+				ReceiptID: receiptID,
+				Points:    stored.Points - previous.Points,
+				Reason:    "receipt re-verified",
+				CreatedAt: clockFrom(r.Context()).Now(),
+			})
+		}
+		reverified = *stored
+		return nil
+	})
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+	recordPointsChange(receiptID, previous, reverified, pointsReverified)
+	writeJSON(w, r, response)
+}
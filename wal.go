@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"sync"
+)
+
+// walRecord is one line of the write-ahead log: a receipt's full state after
+// it was stored or updated.
+type walRecord struct {
+	ID      string        `json:"id"`
+	Receipt StoredReceipt `json:"receipt"`
+}
+
+// walLockStripes is how many locks serialize writes to receipts by ID.
+const walLockStripes = 64
+
+// walStore makes the in-memory store crash-safe: every write is appended to
+// a log file, and synced to disk unless fsync is off, before it is applied
+// in memory. Reads never touch the file.
+type walStore struct {
+	*memoryStore
+	mu    sync.Mutex
+	file  *os.File
+	fsync bool
+	// receiptLocks serialize the writes to each receipt, so that its
+	// records are logged in the order they are applied without holding the
+	// memory store's lock during disk writes.
+	receiptLocks [walLockStripes]sync.Mutex
+}
+
+// openWAL replays the log at path into store, rewrites the log compacted to
+// one record per receipt and returns the store with logging enabled.
+func openWAL(store *memoryStore, path string, fsync bool) (*walStore, error) {
+	replayed, err := replayWAL(store, path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compact by writing the current state to a new file and renaming it
+	// over the old log, so a crash part way through leaves the old log.
+	// Records are written in submission order, keeping the earliest receipt
+	// with each content hash first on the next replay.
+	var records []walRecord
+	err = store.Range(context.Background(), func(id string, stored StoredReceipt) bool {
+		records = append(records, walRecord{ID: id, Receipt: stored})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, b := records[i].Receipt.SubmittedAt, records[j].Receipt.SubmittedAt
+		if !a.Equal(b) {
+			return a.Before(b)
+		}
+		return records[i].ID < records[j].ID
+	})
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	encoder := json.NewEncoder(w)
+	for _, record := range records {
+		if err = encoder.Encode(record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("compacting %s: %w", path, err)
+	}
+
+	f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if replayed > 0 {
+		log.Printf("wal: replayed %d records from %s", replayed, path)
+	}
+	return &walStore{memoryStore: store, file: f, fsync: fsync}, nil
+}
+
+// replayWAL applies every record in the log to store, returning how many
+// there were. A partial last line, left by a crash mid-write, is skipped.
+func replayWAL(store *memoryStore, path string) (int, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	replayed := 0
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(data) > 0 {
+				log.Printf("wal: %s: skipping incomplete record at line %d", path, line)
+			}
+			return replayed, nil
+		}
+		if err != nil {
+			return replayed, err
+		}
+		var record walRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return replayed, fmt.Errorf("%s: line %d: %w", path, line, err)
+		}
+		if err := store.Put(context.Background(), record.ID, record.Receipt); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+}
+
+// receiptLock returns the lock serializing writes to a receipt.
+func (s *walStore) receiptLock(id string) *sync.Mutex {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return &s.receiptLocks[hash.Sum32()%walLockStripes]
+}
+
+// append writes a record to the log.
+func (s *walStore) append(id string, stored StoredReceipt) error {
+	data, err := json.Marshal(walRecord{ID: id, Receipt: stored})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if s.fsync {
+		return s.file.Sync()
+	}
+	return nil
+}
+
+func (s *walStore) Put(ctx context.Context, id string, stored StoredReceipt) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	lock := s.receiptLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := s.append(id, stored); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	return s.memoryStore.Put(context.Background(), id, stored)
+}
+
+// Close syncs and closes the log.
+func (s *walStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.file.Sync()
+	if closeErr := s.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Update logs the updated receipt and applies it while holding the
+// receipt's lock, so records for one receipt are logged in the order they
+// are applied while writes to other receipts proceed.
+func (s *walStore) Update(ctx context.Context, id string, fn func(*StoredReceipt) error) error {
+	lock := s.receiptLock(id)
+	lock.Lock()
+	defer lock.Unlock()
+	stored, err := s.memoryStore.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := fn(&stored); err != nil {
+		return err
+	}
+	if err := s.append(id, stored); err != nil {
+		return fmt.Errorf("wal: %w", err)
+	}
+	return s.memoryStore.Put(context.Background(), id, stored)
+}
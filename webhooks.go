@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types delivered to webhooks.
+const (
+	eventReceiptProcessed = "receipt.processed"
+	eventPointsUpdated    = "points.updated"
+	eventWebhookTest      = "webhook.test"
+)
+
+// webhookEvents are the event types a webhook may subscribe to.
+var webhookEvents = map[string]bool{eventReceiptProcessed: true, eventPointsUpdated: true, eventPointsExpiring: true}
+
+const (
+	// webhookMaxAttempts bounds delivery attempts per event.
+	webhookMaxAttempts = 5
+	// webhookHistorySize is how many deliveries are kept per webhook.
+	webhookHistorySize = 50
+	// webhookSignatureHeader carries the hex HMAC-SHA256 of the body, keyed
+	// by the webhook's secret.
+	webhookSignatureHeader = "X-Webhook-Signature"
+	// webhooksKey is the blob key webhook registrations are saved under.
+	webhooksKey = "webhooks.json"
+)
+
+// webhookBackoff is the delay before the first retry; it doubles after
+// every further failure.
+var webhookBackoff = time.Second
+
+// Webhook is an endpoint registered by a tenant to receive events.
+type Webhook struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	// Secret signs deliveries. It is write-only and never returned.
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	// LastStatus is the HTTP status of the most recent attempt, or 0 when
+	// the endpoint could not be reached.
+	LastStatus     int        `json:"lastStatus"`
+	LastDeliveryAt *time.Time `json:"lastDeliveryAt,omitempty"`
+	// FailureCount counts consecutive failed attempts; a success resets it.
+	FailureCount int `json:"failureCount"`
+	tenant       string
+}
+
+// savedWebhook is a webhook as saved to the blob store, with its tenant.
+type savedWebhook struct {
+	Webhook
+	Tenant string `json:"tenant"`
+}
+
+// Event is the envelope POSTed to webhooks.
+type Event struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"createdAt"`
+	Data      interface{} `json:"data"`
+}
+
+// WebhookDelivery records the outcome of delivering one event.
+type WebhookDelivery struct {
+	ID        string    `json:"id"`
+	EventID   string    `json:"eventId"`
+	EventType string    `json:"eventType"`
+	Attempts  int       `json:"attempts"`
+	Status    int       `json:"status"`
+	Success   bool      `json:"success"`
+	Error     string    `json:"error,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// ReceiptEvent is the data of a receipt.processed event.
+type ReceiptEvent struct {
+	ReceiptID string `json:"id"`
+	Retailer  string `json:"retailer"`
+	Total     string `json:"total"`
+	Points    int    `json:"points"`
+	UserID    string `json:"userId,omitempty"`
+}
+
+// Reasons a receipt's points were updated.
+const (
+	pointsAmended    = "amended"
+	pointsRecomputed = "recomputed"
+	pointsRefunded   = "refunded"
+	pointsReverified = "reverified"
+	pointsReleased   = "released"
+	pointsDenied     = "denied"
+)
+
+// PointsUpdatedEvent is the data of a points.updated event: a stored
+// receipt's net points changed from OldPoints to NewPoints.
+type PointsUpdatedEvent struct {
+	ReceiptID string `json:"id"`
+	Retailer  string `json:"retailer"`
+	UserID    string `json:"userId,omitempty"`
+	Reason    string `json:"reason"`
+	OldPoints int    `json:"oldPoints"`
+	NewPoints int    `json:"newPoints"`
+	Delta     int    `json:"delta"`
+}
+
+// publishPointsUpdated publishes a points.updated event when a receipt's
+// net points differ between its previous and current versions.
+func publishPointsUpdated(receiptID string, previous, current StoredReceipt, reason string) {
+	oldPoints, newPoints := netPoints(previous), netPoints(current)
+	if oldPoints == newPoints {
+		return
+	}
+	publishEvent(current.Tenant, eventPointsUpdated, PointsUpdatedEvent{
+		ReceiptID: receiptID,
+		Retailer:  current.Receipt.StoreName,
+		UserID:    current.UserID,
+		Reason:    reason,
+		OldPoints: oldPoints,
+		NewPoints: newPoints,
+		Delta:     newPoints - oldPoints,
+	})
+}
+
+var (
+	webhookMutex      sync.Mutex
+	webhooks          = make(map[string]*Webhook)
+	webhookDeliveries = make(map[string][]*WebhookDelivery)
+	// webhooksInFlight counts deliveries still being attempted.
+	webhooksInFlight int
+	// webhookClient refuses to connect to private addresses. The check runs
+	// on the resolved address at dial time, so it also covers hostnames
+	// that resolve to them and redirects. Proxies are not used, since they
+	// would dial on the client's behalf.
+	webhookClient = &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: checkWebhookDial}).DialContext,
+			TLSHandshakeTimeout: 5 * time.Second,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+)
+
+// errPrivateWebhookTarget rejects webhook targets on loopback, link-local,
+// private or unspecified addresses.
+var errPrivateWebhookTarget = errors.New("url must not target a loopback, link-local or private address")
+
+func init() {
+	registerQueue("webhooks", func() int {
+		webhookMutex.Lock()
+		defer webhookMutex.Unlock()
+		return webhooksInFlight
+	})
+}
+
+// loadWebhooks restores the webhooks saved to the blob store.
+func loadWebhooks() error {
+	data, err := blobStore.Get(webhooksKey)
+	if errors.Is(err, errBlobNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("webhooks: %w", err)
+	}
+	var saved []savedWebhook
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("webhooks: %w", err)
+	}
+	for _, entry := range saved {
+		hook := entry.Webhook
+		hook.tenant = entry.Tenant
+		webhooks[hook.ID] = &hook
+	}
+	return nil
+}
+
+// saveWebhooks writes every webhook to the blob store. The caller holds
+// webhookMutex.
+func saveWebhooks() error {
+	saved := make([]savedWebhook, 0, len(webhooks))
+	for _, hook := range webhooks {
+		saved = append(saved, savedWebhook{Webhook: *hook, Tenant: hook.tenant})
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return blobStore.Put(webhooksKey, data)
+}
+
+// publicAddress reports whether ip may receive webhook deliveries.
+func publicAddress(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsUnspecified() &&
+		!ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// checkWebhookDial refuses connections to addresses that are not public.
+func checkWebhookDial(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || !publicAddress(ip) {
+		return errPrivateWebhookTarget
+	}
+	return nil
+}
+
+// validate checks a webhook registration. Hostnames are checked again when
+// each delivery connects, since they may resolve differently by then.
+func (h Webhook) validate() error {
+	u, err := url.Parse(h.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return errPrivateWebhookTarget
+	}
+	if ip := net.ParseIP(host); ip != nil && !publicAddress(ip) {
+		return errPrivateWebhookTarget
+	}
+	if len(h.Events) == 0 {
+		return fmt.Errorf("events must not be empty")
+	}
+	for _, event := range h.Events {
+		if !webhookEvents[event] {
+			return fmt.Errorf("unknown event %q", event)
+		}
+	}
+	return nil
+}
+
+// public returns a copy of the webhook that is safe to return to clients.
+func (h Webhook) public() Webhook {
+	h.Secret = ""
+	return h
+}
+
+// subscribed reports whether the webhook receives events of the given type.
+func (h *Webhook) subscribed(eventType string) bool {
+	for _, event := range h.Events {
+		if event == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// publishEvent delivers an event to every webhook of the tenant subscribed
+// to its type. Deliveries run in the background.
+func publishEvent(tenant, eventType string, data interface{}) {
+	event := Event{ID: uuid.New().String(), Type: eventType, CreatedAt: time.Now(), Data: data}
+	webhookMutex.Lock()
+	var targets []*Webhook
+	for _, hook := range webhooks {
+		if hook.tenant == tenant && hook.subscribed(eventType) {
+			targets = append(targets, hook)
+		}
+	}
+	webhookMutex.Unlock()
+
+	for _, hook := range targets {
+		deliverInBackground(hook, event)
+	}
+}
+
+// deliverInBackground delivers an event with retries on its own goroutine,
+// dead-lettering it if every attempt fails.
+func deliverInBackground(hook *Webhook, event Event) {
+	webhookMutex.Lock()
+	webhooksInFlight++
+	webhookMutex.Unlock()
+
+	go func() {
+		if delivery := deliverWithRetries(hook, event); !delivery.Success {
+			addDeadLetter(hook, event, delivery)
+		}
+		webhookMutex.Lock()
+		webhooksInFlight--
+		webhookMutex.Unlock()
+	}()
+}
+
+// deliverWithRetries attempts delivery until it succeeds or
+// webhookMaxAttempts is reached, backing off exponentially.
+func deliverWithRetries(hook *Webhook, event Event) *WebhookDelivery {
+	delivery := &WebhookDelivery{ID: uuid.New().String(), EventID: event.ID, EventType: event.Type}
+	backoff := webhookBackoff
+	for {
+		attemptDelivery(context.Background(), hook, event, delivery)
+		if delivery.Success || delivery.Attempts >= webhookMaxAttempts {
+			return delivery
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// attemptDelivery POSTs the event once and records the outcome on the
+// delivery and the webhook.
+func attemptDelivery(ctx context.Context, hook *Webhook, event Event, delivery *WebhookDelivery) {
+	webhookMutex.Lock()
+	target, secret := hook.URL, hook.Secret
+	webhookMutex.Unlock()
+
+	status, err := postEvent(ctx, target, secret, event)
+
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+	now := time.Now()
+	delivery.Attempts++
+	delivery.Status = status
+	delivery.Success = err == nil
+	delivery.Error = ""
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+	delivery.UpdatedAt = now
+	if delivery.Attempts == 1 {
+		history := append(webhookDeliveries[hook.ID], delivery)
+		if len(history) > webhookHistorySize {
+			history = history[len(history)-webhookHistorySize:]
+		}
+		webhookDeliveries[hook.ID] = history
+	}
+
+	hook.LastStatus = status
+	hook.LastDeliveryAt = &now
+	if err != nil {
+		hook.FailureCount++
+	} else {
+		hook.FailureCount = 0
+	}
+}
+
+// postEvent sends a signed event and returns the response status. Any
+// non-2xx status is an error.
+func postEvent(ctx context.Context, target, secret string, event Event) (int, error) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set(webhookSignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookPath splits a /webhooks/{id}/... path into its segments.
+func webhookPath(r *http.Request) []string {
+	return strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/"), "/")
+}
+
+// tenantWebhook returns the tenant's webhook with the given ID.
+func tenantWebhook(tenant, id string) (*Webhook, error) {
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+	hook, ok := webhooks[id]
+	if !ok || hook.tenant != tenant {
+		return nil, &httpError{status: http.StatusNotFound, message: "Webhook not found"}
+	}
+	return hook, nil
+}
+
+// webhooksHandler lists (GET) or registers (POST) the tenant's webhooks.
+func webhooksHandler(w http.ResponseWriter, r *http.Request, tenant string) {
+	switch r.Method {
+	case http.MethodGet:
+		webhookMutex.Lock()
+		list := []Webhook{}
+		for _, hook := range webhooks {
+			if hook.tenant == tenant {
+				list = append(list, hook.public())
+			}
+		}
+		webhookMutex.Unlock()
+		sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+		writeJSON(w, r, list)
+	case http.MethodPost:
+		var hook Webhook
+		if err := json.NewDecoder(r.Body).Decode(&hook); err != nil {
+			http.Error(w, "Invalid webhook", http.StatusBadRequest)
+			return
+		}
+		if err := hook.validate(); err != nil {
+			http.Error(w, "Invalid webhook: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		hook = Webhook{ID: uuid.New().String(), URL: hook.URL, Events: hook.Events, Secret: hook.Secret, CreatedAt: time.Now(), tenant: tenant}
+		webhookMutex.Lock()
+		webhooks[hook.ID] = &hook
+		if err := saveWebhooks(); err != nil {
+			delete(webhooks, hook.ID)
+			webhookMutex.Unlock()
+			log.Printf("webhooks: saving: %v", err)
+			http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+			return
+		}
+		webhookMutex.Unlock()
+		writeJSONStatus(w, r, http.StatusCreated, hook.public())
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookRoutes dispatches /webhooks/{id}/... requests to their handlers.
+func webhookRoutes(w http.ResponseWriter, r *http.Request, tenant string) {
+	parts := webhookPath(r)
+	switch {
+	case len(parts) == 1 && parts[0] != "":
+		webhookHandler(w, r, tenant)
+	case len(parts) == 2 && parts[1] == "test":
+		testWebhook(w, r, tenant)
+	case len(parts) == 2 && parts[1] == "deliveries":
+		getWebhookDeliveries(w, r, tenant)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// webhookHandler reads (GET), replaces (PUT) or removes (DELETE) a webhook.
+func webhookHandler(w http.ResponseWriter, r *http.Request, tenant string) {
+	hook, err := tenantWebhook(tenant, webhookPath(r)[0])
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		webhookMutex.Lock()
+		response := hook.public()
+		webhookMutex.Unlock()
+		writeJSON(w, r, response)
+	case http.MethodPut:
+		var update Webhook
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, "Invalid webhook", http.StatusBadRequest)
+			return
+		}
+		if err := update.validate(); err != nil {
+			http.Error(w, "Invalid webhook: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		webhookMutex.Lock()
+		previous := *hook
+		hook.URL, hook.Events = update.URL, update.Events
+		if update.Secret != "" {
+			hook.Secret = update.Secret
+		}
+		if err := saveWebhooks(); err != nil {
+			*hook = previous
+			webhookMutex.Unlock()
+			log.Printf("webhooks: saving: %v", err)
+			http.Error(w, "Failed to save webhook", http.StatusInternalServerError)
+			return
+		}
+		response := hook.public()
+		webhookMutex.Unlock()
+		writeJSON(w, r, response)
+	case http.MethodDelete:
+		webhookMutex.Lock()
+		delete(webhooks, hook.ID)
+		delete(webhookDeliveries, hook.ID)
+		err := saveWebhooks()
+		webhookMutex.Unlock()
+		if err != nil {
+			log.Printf("webhooks: saving: %v", err)
+			http.Error(w, "Failed to save webhooks", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// testWebhook sends a single webhook.test event synchronously and returns
+// the delivery outcome.
+func testWebhook(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hook, err := tenantWebhook(tenant, webhookPath(r)[0])
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+	event := Event{ID: uuid.New().String(), Type: eventWebhookTest, CreatedAt: time.Now(), Data: map[string]string{"webhookId": hook.ID}}
+	delivery := &WebhookDelivery{ID: uuid.New().String(), EventID: event.ID, EventType: event.Type}
+	attemptDelivery(r.Context(), hook, event, delivery)
+
+	webhookMutex.Lock()
+	response := *delivery
+	webhookMutex.Unlock()
+	writeJSON(w, r, response)
+}
+
+// getWebhookDeliveries lists a webhook's recent deliveries, newest first.
+func getWebhookDeliveries(w http.ResponseWriter, r *http.Request, tenant string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hook, err := tenantWebhook(tenant, webhookPath(r)[0])
+	if err != nil {
+		writeReceiptError(w, err)
+		return
+	}
+	webhookMutex.Lock()
+	history := webhookDeliveries[hook.ID]
+	response := make([]WebhookDelivery, len(history))
+	for i, delivery := range history {
+		response[len(history)-1-i] = *delivery
+	}
+	webhookMutex.Unlock()
+	writeJSON(w, r, response)
+}